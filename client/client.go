@@ -0,0 +1,766 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mowzhja/harpocrates/client/coeus"
+	"github.com/mowzhja/harpocrates/harpocrates/cerberus"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// How long to wait for a peer to connect to us (or for us to connect to it).
+const PEER_TIMEOUT = 30 * time.Second
+
+// How the chat with a peer is coded over the paths we have with them (see hermes.Peer.NegotiateErasure()):
+// any one of two shares is enough, so that a message sent over a direct path and the connection gets through if either does.
+const (
+	PEER_SHARES_NEEDED = 1
+	PEER_SHARES        = 2
+)
+
+const HELP = `Commands:
+  /connect <user>    start talking to user (or switch to them if you already are)
+  /contacts          list the people you talked to
+  /who               list the users that are online
+  /send-file <path>  send a file to the user you're talking to
+  /verify [user]     check that you're really talking to who you think you are
+  /msg <user> <text> leave a message for user, delivered even if they (or you) are offline
+  /quit              leave
+Anything else is sent to the user you're talking to.`
+
+// The state of the chat client: the session with the server and the connections with the peers.
+type client struct {
+	uname      string
+	passwd     []byte
+	serverAddr string
+	dataDir    string
+	identity   ed25519.PrivateKey
+	ui         *console
+	events     chan string   // what's happening, to be shown to the user
+	fatal      chan error    // something went wrong in the background and we can't go on
+	done       chan struct{} // closed when the user leaves
+	pending    func(string)  // what to do with the next line the user types, if it's an answer to a question
+
+	cmu sync.Mutex // the contacts are updated from several goroutines
+	pmu sync.Mutex // and so are the prekeys
+	mmu sync.Mutex // and the mailbox sessions
+
+	cover            hermes.CoverTraffic // what we offer the peers for the constant-rate mode (nothing by default)
+	handshakeTimeout time.Duration       // how long logging in can take
+	timeouts         hermes.Timeouts     // of the sessions with the server and the peers
+	auth             *cerberus.Config    // how we log in (the progress is shown to the user)
+	outbox           map[string][]string // messages waiting for the prekeys of their recipient
+	mailHeld         bool                // a message of this session couldn't be read because of our own files: the ones after it wait for the next session (c.mmu)
+	ticket           *cerberus.Ticket    // resumes the last session with the server, skipping the key derivation (only stayOnline() touches it)
+
+	mu        sync.Mutex
+	session   *hermes.Session // nil while we're offline
+	peers     map[string]*hermes.Peer
+	listeners map[string]net.Listener      // where we wait for the peers we asked the server for
+	relays    map[string]*hermes.RelayConn // the connections with peers that go through the server
+
+	udp       *hermes.PacketHub // the socket whose endpoint the server hands to our peers, shared by the UDP paths to them (nil while we're offline)
+	udpServer net.Addr
+	bindToken []byte
+	current   string // the peer messages are sent to
+}
+
+// Creates the client of uname, keeping its data in dataDir.
+func newClient(uname string, passwd []byte, serverAddr, dataDir string, identity ed25519.PrivateKey, ui *console) *client {
+	return &client{
+		uname:      uname,
+		passwd:     passwd,
+		serverAddr: serverAddr,
+		dataDir:    dataDir,
+		identity:   identity,
+		ui:         ui,
+		events:     make(chan string, 64),
+		fatal:      make(chan error, 1),
+		done:       make(chan struct{}),
+		peers:      make(map[string]*hermes.Peer),
+		listeners:  make(map[string]net.Listener),
+		relays:     make(map[string]*hermes.RelayConn),
+		outbox:     make(map[string][]string),
+
+		handshakeTimeout: hermes.HANDSHAKE_TIMEOUT,
+		timeouts:         hermes.DEFAULT_TIMEOUTS,
+		auth:             &cerberus.Config{Log: ui},
+	}
+}
+
+// Runs the client until the user leaves: one goroutine reads what the user types, another keeps us online and this one reacts to both.
+func (c *client) run() {
+	input := make(chan string)
+	go func() {
+		defer close(input)
+		for {
+			line, err := c.ui.ReadLine()
+			if err != nil {
+				return
+			}
+			input <- line
+		}
+	}()
+
+	go c.stayOnline()
+
+	c.ui.Println("[+] Type /help for the list of commands.")
+	for {
+		select {
+		case line, ok := <-input:
+			if !ok || !c.handle(line) {
+				c.shutdown()
+				return
+			}
+		case event := <-c.events:
+			c.ui.Println(event)
+		case err := <-c.fatal:
+			c.ui.Println("[-]", err)
+			c.shutdown()
+			return
+		}
+	}
+}
+
+// Reacts to a line typed by the user.
+// Returns false if the user wants to leave.
+func (c *client) handle(line string) bool {
+	line = strings.TrimSpace(line)
+	if c.pending != nil {
+		answer := c.pending
+		c.pending = nil
+		answer(line)
+		return true
+	}
+	if line == "" {
+		return true
+	}
+	if !strings.HasPrefix(line, "/") {
+		c.sendMessage(line)
+		return true
+	}
+
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "/connect":
+		if len(fields) != 2 {
+			c.show("[-] Usage: /connect <user>")
+			break
+		}
+		c.connect(fields[1])
+	case "/contacts":
+		c.listContacts()
+	case "/who":
+		c.who()
+	case "/send-file":
+		path := strings.TrimSpace(strings.TrimPrefix(line, "/send-file"))
+		if path == "" {
+			c.show("[-] Usage: /send-file <path>")
+			break
+		}
+		c.sendFile(path)
+	case "/verify":
+		if len(fields) > 2 {
+			c.show("[-] Usage: /verify [user]")
+			break
+		}
+		c.verify(fields[1:]...)
+	case "/msg":
+		if len(fields) < 3 {
+			c.show("[-] Usage: /msg <user> <text>")
+			break
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(line, "/msg"))
+		c.leaveMessage(fields[1], strings.TrimSpace(strings.TrimPrefix(rest, fields[1])))
+	case "/quit":
+		return false
+	case "/help":
+		c.show(HELP)
+	default:
+		c.show("[-] Unknown command %s, type /help for the list of commands.", fields[0])
+	}
+
+	return true
+}
+
+// Shows something to the user, from the main loop.
+func (c *client) show(format string, a ...interface{}) {
+	c.ui.Println(fmt.Sprintf(format, a...))
+}
+
+// Shows something to the user, from any other goroutine.
+func (c *client) notify(format string, a ...interface{}) {
+	select {
+	case c.events <- fmt.Sprintf(format, a...):
+	case <-c.done:
+	}
+}
+
+// Handles the messages of the server until the connection drops.
+// Returns the reason it dropped.
+func (c *client) serveSession(s *hermes.Session) error {
+	for {
+		fields, err := s.Receive()
+		if err != nil {
+			return err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "USERS":
+			c.notify("[+] Online: %s", strings.Join(fields[1:], ", "))
+		case "INVITE":
+			if len(fields) == 2 {
+				c.notify("[+] %s wants to talk to you, type /connect %s to accept.", fields[1], fields[1])
+			}
+		case "PEER":
+			if len(fields) != 5 && len(fields) != 6 {
+				break
+			}
+			key, err := hex.DecodeString(fields[4])
+			if err != nil {
+				break
+			}
+			// the UDP endpoint of the peer, - if the server has none for either of us
+			endpoint := "-"
+			if len(fields) == 6 {
+				endpoint = fields[5]
+			}
+			go c.openPeer(fields[1], fields[2], fields[3], endpoint, key)
+		case "BIND":
+			if len(fields) == 2 {
+				c.setBindToken(fields[1])
+			}
+		case "ENDPOINT":
+			if len(fields) == 2 {
+				c.notify("[+] Reachable over UDP at %s.", fields[1])
+			}
+		case "PREKEYS_LOW":
+			if len(fields) != 2 {
+				break
+			}
+			remaining, err := strconv.Atoi(fields[1])
+			if err != nil {
+				break
+			}
+			err = c.publishOneTimePrekeys(s, remaining)
+			if err != nil {
+				c.notify("[-] Couldn't publish the prekeys: %s", err)
+			}
+		case "BUNDLE":
+			err = c.startSession(s, fields[1:])
+			if err != nil {
+				c.notify("[-] Couldn't start a session: %s", err)
+			}
+		case "MSG":
+			err = c.receiveMessage(s, fields[1:])
+			if err != nil {
+				c.notify("[-] Couldn't receive a message: %s", err)
+			}
+		case "RELAYED", "RELAY_DATA", "RELAY_CLOSE":
+			c.handleRelay(fields)
+		case "QUEUED", "NOT_QUEUED":
+			err = c.messageQueued(fields[0] == "QUEUED", fields[1:])
+			if err != nil {
+				c.notify("[-] Couldn't update the messages waiting to be sent: %s", err)
+			}
+		case "ERROR":
+			c.notify("[-] %s", strings.Join(fields[1:], " "))
+			// the messages waiting for a bundle that won't come
+			if len(fields) > 4 && strings.Join(fields[1:4], " ") == "no bundle for" {
+				c.dropOutbox(strings.TrimSuffix(fields[4], ":"))
+			}
+		}
+	}
+}
+
+// Returns the session with the server, if we're online.
+func (c *client) getSession() (*hermes.Session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.session == nil {
+		return nil, errors.New("you're offline")
+	}
+
+	return c.session, nil
+}
+
+// Records the current session with the server (nil when we're offline).
+func (c *client) setSession(s *hermes.Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.session = s
+}
+
+// Asks the server who's online.
+func (c *client) who() {
+	s, err := c.getSession()
+	if err != nil {
+		c.show("[-] %s", err)
+		return
+	}
+
+	err = s.Send("WHO")
+	if err != nil {
+		c.show("[-] %s", err)
+	}
+}
+
+// Starts talking to peer: we listen for it and ask the server to put us in touch (unless we're talking already).
+func (c *client) connect(peer string) {
+	c.mu.Lock()
+	if _, ok := c.peers[peer]; ok {
+		c.current = peer
+		c.mu.Unlock()
+		c.ui.SetPrompt(fmt.Sprintf("[%s] > ", peer))
+		c.show("[+] Now talking to %s.", peer)
+		return
+	}
+	c.mu.Unlock()
+
+	s, err := c.getSession()
+	if err != nil {
+		c.show("[-] %s", err)
+		return
+	}
+
+	// the server decides who dials, so we have to be ready to be dialed
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		c.show("[-] %s", err)
+		return
+	}
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		l.Close()
+		c.show("[-] %s", err)
+		return
+	}
+
+	c.mu.Lock()
+	if old, ok := c.listeners[peer]; ok {
+		old.Close()
+	}
+	c.listeners[peer] = l
+	c.mu.Unlock()
+
+	err = s.Send("CONNECT", peer, port)
+	if err != nil {
+		c.show("[-] %s", err)
+		return
+	}
+	c.show("[+] Waiting for %s...", peer)
+}
+
+// Opens the connection with peer, as the server told us to.
+func (c *client) openPeer(peer, role, addr, endpoint string, pairingKey []byte) {
+	c.mu.Lock()
+	l, ok := c.listeners[peer]
+	delete(c.listeners, peer)
+	c.mu.Unlock()
+	if !ok {
+		c.notify("[-] The server paired us with %s, but we didn't ask for it.", peer)
+		return
+	}
+
+	// if we can't reach each other directly, the server relays the connection
+	ctx, cancel := context.WithTimeout(context.Background(), PEER_TIMEOUT)
+	defer cancel()
+	direct := func(ctx context.Context) (net.Conn, error) {
+		return hermes.DialPeer(ctx, l, role, addr)
+	}
+	p, relayed, err := hermes.OpenPeer(ctx, direct, func(ctx context.Context) (net.Conn, error) {
+		return c.openRelay(ctx, peer)
+	}, pairingKey, role == hermes.PEER_DIALER, c.identity)
+	l.Close()
+	if err != nil {
+		c.notify("[-] Couldn't connect with %s: %s", peer, err)
+		return
+	}
+	if relayed {
+		c.notify("[+] Couldn't reach %s directly, the connection goes through the server.", peer)
+	}
+
+	// messages and files are end-to-end encrypted with the Double Ratchet session we have with peer, which outlives the connection
+	saved, err := coeus.GetRatchet(c.dataDir, peer)
+	if err != nil {
+		p.Close()
+		c.notify("[-] Couldn't read the session with %s: %s", peer, err)
+		return
+	}
+	started, err := p.StartRatchet(saved, func(state []byte) error {
+		return coeus.SaveRatchet(c.dataDir, peer, state)
+	})
+	if err != nil {
+		p.Close()
+		c.notify("[-] Couldn't connect with %s: %s", peer, err)
+		return
+	}
+	if started && saved != nil {
+		c.notify("[!] Started a new encrypted session with %s, the previous one was lost on one side.", peer)
+	}
+	// the timeouts first, for the constant-rate mode to keep within them
+	p.SetTimeouts(c.timeouts)
+	// if either of us asks for it, when we talk (and how much) is hidden under a steady flow of records
+	cover, err := p.NegotiateCover(c.cover)
+	if err != nil {
+		p.Close()
+		c.notify("[-] Couldn't connect with %s: %s", peer, err)
+		return
+	}
+	if cover.Interval > 0 {
+		c.notify("[+] Constant-rate mode with %s: a record of %d bytes every %s.", peer, cover.Size, cover.Interval)
+	}
+	coder, err := p.NegotiateErasure(PEER_SHARES_NEEDED, PEER_SHARES)
+	if err != nil {
+		p.Close()
+		c.notify("[-] Couldn't connect with %s: %s", peer, err)
+		return
+	}
+	// next to the connection, the chat goes over a UDP path if we can punch one (but not in the constant-rate mode, which it would get around)
+	var paths []hermes.Path
+	if cover.Interval == 0 && endpoint != "-" {
+		if dc := c.punch(p, peer, role, endpoint, pairingKey); dc != nil {
+			paths = append(paths, dc)
+		}
+	}
+	// the chat and every file get a stream of their own, so that sending a file doesn't hold up the chat
+	err = p.StartStreams(coder, paths...)
+	if err != nil {
+		p.Close()
+		c.notify("[-] Couldn't connect with %s: %s", peer, err)
+		return
+	}
+	p.SetDeadline(time.Time{})
+
+	c.mu.Lock()
+	if old, ok := c.peers[peer]; ok {
+		old.Close()
+	}
+	c.peers[peer] = p
+	c.current = peer
+	c.mu.Unlock()
+
+	c.ui.SetPrompt(fmt.Sprintf("[%s] > ", peer))
+	c.notify("[+] Connected with %s.", peer)
+	c.checkIdentity(peer, p.Identity())
+
+	c.readPeer(peer, p)
+}
+
+// Compares the identity key of peer with the one it used last time, and remembers it.
+// The first key we see is trusted until the user verifies it, a key that changes is reported.
+func (c *client) checkIdentity(peer string, identity ed25519.PublicKey) {
+	c.cmu.Lock()
+	defer c.cmu.Unlock()
+
+	contact, ok, err := coeus.GetContact(c.dataDir, peer)
+	if err != nil {
+		c.notify("[-] Couldn't read the contacts: %s", err)
+		return
+	}
+	if !ok {
+		contact = coeus.Contact{Uname: peer}
+	}
+
+	if contact.Identity != nil && !bytes.Equal(contact.Identity, identity) {
+		if contact.Verified {
+			c.notify("[!] WARNING: the identity key of %s CHANGED since you verified it!\n"+
+				"[!] Either %s reinstalled the client, or someone (maybe the server) is in the middle of your conversation.\n"+
+				"[!] Don't send anything sensitive before checking the new safety number with /verify %s.", peer, peer, peer)
+		} else {
+			c.notify("[!] The identity key of %s changed since the last time you talked, type /verify %s to check it.", peer, peer)
+		}
+		contact.Verified = false
+	}
+	contact.Identity = identity
+
+	err = coeus.SaveContact(c.dataDir, contact)
+	if err != nil {
+		c.notify("[-] Couldn't save %s among the contacts: %s", peer, err)
+	}
+}
+
+// Shows the safety number of the conversation with peer (the current one if none is given) and asks the user whether it matches the one peer sees.
+func (c *client) verify(peer ...string) {
+	var uname string
+	if len(peer) > 0 {
+		uname = peer[0]
+	} else {
+		c.mu.Lock()
+		uname = c.current
+		c.mu.Unlock()
+	}
+	if uname == "" {
+		c.show("[-] Usage: /verify [user]")
+		return
+	}
+
+	contact, ok, err := coeus.GetContact(c.dataDir, uname)
+	if err != nil {
+		c.show("[-] %s", err)
+		return
+	}
+	if !ok || contact.Identity == nil {
+		c.show("[-] You never talked to %s, type /connect %s first.", uname, uname)
+		return
+	}
+
+	numeric, hexa, err := cerberus.SafetyNumber(c.uname, c.identity.Public().(ed25519.PublicKey), uname, contact.Identity)
+	if err != nil {
+		c.show("[-] %s", err)
+		return
+	}
+
+	formatted := cerberus.FormatSafetyNumber(numeric)
+	c.show("[+] Safety number with %s:\n  %s\n  %s\n  %s\n  (hex: %s)",
+		uname, formatted[:23], formatted[24:47], formatted[48:], hexa)
+	if contact.Verified {
+		c.show("[+] You already verified %s.", uname)
+		return
+	}
+	c.show("[+] Compare it with the one %s sees, in person or over a channel you trust.\n"+
+		"[+] Type yes if they are the same, anything else to leave %s unverified.", uname, uname)
+
+	shown := contact.Identity
+	c.pending = func(answer string) {
+		if !strings.EqualFold(answer, "yes") {
+			c.show("[-] %s was not verified.", uname)
+			return
+		}
+
+		c.cmu.Lock()
+		defer c.cmu.Unlock()
+
+		contact, _, err := coeus.GetContact(c.dataDir, uname)
+		if err != nil {
+			c.show("[-] %s", err)
+			return
+		}
+		if !bytes.Equal(contact.Identity, shown) {
+			c.show("[-] The identity key of %s changed in the meantime, type /verify %s again.", uname, uname)
+			return
+		}
+
+		contact.Verified = true
+		err = coeus.SaveContact(c.dataDir, contact)
+		if err != nil {
+			c.show("[-] %s", err)
+			return
+		}
+		c.show("[+] %s is now verified.", uname)
+	}
+}
+
+// Shows whatever peer sends us, until it hangs up.
+func (c *client) readPeer(peer string, p *hermes.Peer) {
+	for {
+		name, msg, err := p.Receive()
+		if err != nil {
+			c.removePeer(peer, p)
+			if err == io.EOF {
+				c.notify("[+] %s hung up.", peer)
+			} else {
+				c.notify("[-] Lost the connection with %s (%s).", peer, err)
+			}
+			return
+		}
+
+		if name == "" {
+			c.notify("%s: %s", peer, string(msg))
+			continue
+		}
+
+		path, err := c.saveFile(peer, name, msg)
+		if err != nil {
+			c.notify("[-] %s sent you %s, but it couldn't be saved: %s", peer, name, err)
+		} else {
+			c.notify("[+] %s sent you %s (saved to %s).", peer, name, path)
+		}
+	}
+}
+
+// Forgets about a peer we're not connected to anymore.
+func (c *client) removePeer(peer string, p *hermes.Peer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.peers[peer] != p {
+		// we reconnected in the meantime
+		return
+	}
+	delete(c.peers, peer)
+	p.Close()
+	if rc, ok := c.relays[peer]; ok && rc.Closed() {
+		delete(c.relays, peer)
+	}
+
+	if c.current == peer {
+		c.current = ""
+		c.ui.SetPrompt("> ")
+	}
+}
+
+// Returns the peer we're talking to (and its name).
+func (c *client) currentPeer() (string, *hermes.Peer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.peers[c.current]
+	if !ok {
+		return "", nil, errors.New("you're not talking to anyone, type /connect <user> first")
+	}
+
+	return c.current, p, nil
+}
+
+// Sends a message to the peer we're talking to.
+func (c *client) sendMessage(msg string) {
+	_, p, err := c.currentPeer()
+	if err != nil {
+		c.show("[-] %s", err)
+		return
+	}
+
+	err = p.Send([]byte(msg))
+	if err != nil {
+		c.show("[-] %s", err)
+	}
+}
+
+// Sends a file to the peer we're talking to.
+func (c *client) sendFile(path string) {
+	peer, p, err := c.currentPeer()
+	if err != nil {
+		c.show("[-] %s", err)
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		c.show("[-] %s", err)
+		return
+	}
+	if info.Size() > hermes.MAX_FILE_SIZE {
+		c.show("[-] The file is too large (at most %d bytes can be sent).", hermes.MAX_FILE_SIZE)
+		return
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		c.show("[-] %s", err)
+		return
+	}
+
+	// the transfer could take a while, so don't keep the user waiting
+	go func() {
+		err := p.SendFile(filepath.Base(path), content)
+		if err != nil {
+			c.notify("[-] Couldn't send %s to %s: %s", path, peer, err)
+			return
+		}
+		c.notify("[+] Sent %s to %s.", path, peer)
+	}()
+}
+
+// Saves a file received from peer among the downloads, without overwriting anything.
+// Returns where the file was saved and an error.
+func (c *client) saveFile(peer, name string, content []byte) (string, error) {
+	dir := filepath.Join(c.dataDir, "downloads", peer)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	// never trust the peer with paths
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == "/" || name == "." {
+		name = "file"
+	}
+
+	ext := filepath.Ext(name)
+	for i := 0; i < 100; i++ {
+		path := filepath.Join(dir, name)
+		if i > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext))
+		}
+
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		_, err = file.Write(content)
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		return path, err
+	}
+
+	return "", errors.New("too many files with the same name")
+}
+
+// Lists the people we talked to.
+func (c *client) listContacts() {
+	contacts, err := coeus.GetContacts(c.dataDir)
+	if err != nil {
+		c.show("[-] %s", err)
+		return
+	}
+	if len(contacts) == 0 {
+		c.show("[+] No contacts yet.")
+		return
+	}
+
+	var list strings.Builder
+	list.WriteString("[+] Contacts:")
+	c.mu.Lock()
+	for _, contact := range contacts {
+		list.WriteString("\n  " + contact.Uname)
+		if contact.Verified {
+			list.WriteString(" (verified)")
+		}
+		if _, ok := c.peers[contact.Uname]; ok {
+			list.WriteString(" (connected)")
+		}
+	}
+	c.mu.Unlock()
+	c.show("%s", list.String())
+}
+
+// Hangs up on everyone and leaves.
+func (c *client) shutdown() {
+	close(c.done)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, p := range c.peers {
+		p.Close()
+	}
+	for _, l := range c.listeners {
+		l.Close()
+	}
+	if c.session != nil {
+		c.session.Close()
+	}
+}
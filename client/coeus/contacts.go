@@ -0,0 +1,168 @@
+// Coeus is one of the Titans of Greek mythology, whose name means "query", "questioning".
+// As such, package coeus is responsible for the interaction with the filesystem (it queries it for information).
+package coeus
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const CONTACTS_FILE = "contacts.csv"
+
+// Someone we talked to.
+type Contact struct {
+	Uname    string
+	Added    time.Time
+	Identity []byte // the identity key it used last time (nil if we never saw one)
+	Verified bool   // whether the user compared the safety number with this contact
+}
+
+// Returns the contacts kept in dir, in the order they were added (no contacts if the file doesn't exist yet).
+func GetContacts(dir string) ([]Contact, error) {
+	file, err := os.Open(filepath.Join(dir, CONTACTS_FILE))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var contacts []Contact
+	for i, record := range records {
+		if i == 0 {
+			// header
+			continue
+		}
+		if len(record) < 2 {
+			return nil, errors.New("malformed contacts file")
+		}
+
+		added, err := time.Parse(time.RFC3339, record[1])
+		if err != nil {
+			return nil, err
+		}
+		contact := Contact{Uname: record[0], Added: added}
+
+		// files written before identity keys existed only have the first two columns
+		if len(record) >= 4 {
+			contact.Identity, err = hex.DecodeString(record[2])
+			if err != nil {
+				return nil, err
+			}
+			if len(contact.Identity) == 0 {
+				contact.Identity = nil
+			}
+			contact.Verified = record[3] == "true"
+		}
+		contacts = append(contacts, contact)
+	}
+
+	return contacts, nil
+}
+
+// Looks for uname among the contacts kept in dir.
+// Returns the contact, whether it was found and an error.
+func GetContact(dir, uname string) (Contact, bool, error) {
+	contacts, err := GetContacts(dir)
+	if err != nil {
+		return Contact{}, false, err
+	}
+
+	for _, c := range contacts {
+		if c.Uname == uname {
+			return c, true, nil
+		}
+	}
+
+	return Contact{}, false, nil
+}
+
+// Saves contact among the contacts kept in dir, replacing the one with the same username if there is one.
+func SaveContact(dir string, contact Contact) error {
+	contacts, err := GetContacts(dir)
+	if err != nil {
+		return err
+	}
+	if contact.Added.IsZero() {
+		contact.Added = time.Now()
+	}
+
+	for i, c := range contacts {
+		if c.Uname == contact.Uname {
+			contacts[i] = contact
+			return writeContacts(dir, contacts)
+		}
+	}
+
+	return writeContacts(dir, append(contacts, contact))
+}
+
+// Adds uname to the contacts kept in dir (nothing happens if it's there already).
+func AddContact(dir, uname string) error {
+	contacts, err := GetContacts(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range contacts {
+		if c.Uname == uname {
+			return nil
+		}
+	}
+	contacts = append(contacts, Contact{Uname: uname, Added: time.Now()})
+
+	return writeContacts(dir, contacts)
+}
+
+// (Re)writes the contacts file, atomically, so that a crash can't leave it half written.
+func writeContacts(dir string, contacts []Contact) error {
+	records := [][]string{
+		{"user", "added", "identity", "verified"},
+	}
+	for _, c := range contacts {
+		verified := "false"
+		if c.Verified {
+			verified = "true"
+		}
+		records = append(records, []string{c.Uname, c.Added.Format(time.RFC3339), hex.EncodeToString(c.Identity), verified})
+	}
+
+	return writeCSV(filepath.Join(dir, CONTACTS_FILE), records)
+}
+
+// Writes the records to a temporary file and moves it in place of filename.
+func writeCSV(filename string, records [][]string) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(file)
+	err = w.WriteAll(records)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,283 @@
+package coeus
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Tests adding and listing contacts.
+func Test_AddContact(t *testing.T) {
+	dir := t.TempDir()
+
+	contacts, err := GetContacts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 0 {
+		t.Fatal("there should be no contacts before adding any")
+	}
+
+	for _, uname := range []string{"bob", "carol", "bob", "dave"} {
+		err := AddContact(dir, uname)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	contacts, err = GetContacts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"bob", "carol", "dave"}
+	if len(contacts) != len(expected) {
+		t.Fatalf("expected %d contacts, got %d", len(expected), len(contacts))
+	}
+	for i, c := range contacts {
+		if c.Uname != expected[i] {
+			t.Fatalf("wrong contact: expected %s, got %s", expected[i], c.Uname)
+		}
+		if c.Added.IsZero() {
+			t.Fatal("the time a contact was added should be recorded")
+		}
+	}
+}
+
+// Tests that the contacts are kept in a subdirectory that doesn't exist yet.
+func Test_AddContact_newDir(t *testing.T) {
+	dir := t.TempDir() + "/alice/data"
+
+	err := AddContact(dir, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contacts, err := GetContacts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 1 || contacts[0].Uname != "bob" {
+		t.Fatal("bob should be the only contact")
+	}
+}
+
+// Tests saving the identity key of a contact and marking it verified.
+func Test_SaveContact(t *testing.T) {
+	dir := t.TempDir()
+
+	err := AddContact(dir, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok, err := GetContact(dir, "bob")
+	if err != nil || !ok {
+		t.Fatal("bob should be among the contacts", err)
+	}
+	if c.Identity != nil || c.Verified {
+		t.Fatal("a new contact has no identity key and isn't verified")
+	}
+
+	c.Identity = []byte{1, 2, 3}
+	c.Verified = true
+	err = SaveContact(dir, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SaveContact(dir, Contact{Uname: "carol", Identity: []byte{4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contacts, err := GetContacts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 2 {
+		t.Fatalf("expected 2 contacts, got %d", len(contacts))
+	}
+	if string(contacts[0].Identity) != "\x01\x02\x03" || !contacts[0].Verified || !contacts[0].Added.Equal(c.Added) {
+		t.Fatal("bob wasn't updated correctly")
+	}
+	if string(contacts[1].Identity) != "\x04" || contacts[1].Verified || contacts[1].Added.IsZero() {
+		t.Fatal("carol wasn't saved correctly")
+	}
+
+	if _, ok, _ := GetContact(dir, "dave"); ok {
+		t.Fatal("dave isn't a contact")
+	}
+}
+
+// Tests that contacts files written before identity keys existed can still be read.
+func Test_GetContacts_oldFormat(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, CONTACTS_FILE), []byte("user,added\nbob,2021-07-20T10:00:00Z\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contacts, err := GetContacts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 1 || contacts[0].Uname != "bob" || contacts[0].Identity != nil || contacts[0].Verified {
+		t.Fatal("bob wasn't read correctly")
+	}
+}
+
+// Tests keeping the identity key.
+func Test_SaveIdentity(t *testing.T) {
+	dir := t.TempDir() + "/alice"
+
+	identity, err := GetIdentity(dir)
+	if err != nil || identity != nil {
+		t.Fatal("there should be no identity key before saving one", err)
+	}
+
+	_, priv, _ := ed25519.GenerateKey(nil)
+	err = SaveIdentity(dir, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err = GetIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !identity.Equal(priv) {
+		t.Fatal("got a different identity key than the one saved")
+	}
+
+	info, err := os.Stat(filepath.Join(dir, IDENTITY_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("the identity key should be readable only by the user, got %v", info.Mode().Perm())
+	}
+}
+
+// Tests keeping the state of the ratchet sessions.
+func Test_SaveRatchet(t *testing.T) {
+	dir := t.TempDir()
+
+	state, err := GetRatchet(dir, "bob")
+	if err != nil || state != nil {
+		t.Fatal("there should be no session before saving one", err)
+	}
+
+	for _, uname := range []string{"bob", "../carol"} {
+		for _, s := range []string{"first state", "second state"} {
+			err = SaveRatchet(dir, uname, []byte(uname+s))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, uname := range []string{"bob", "../carol"} {
+		state, err = GetRatchet(dir, uname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(state) != uname+"second state" {
+			t.Fatalf("wrong state for %s: %s", uname, string(state))
+		}
+	}
+
+	// usernames can't escape the directory
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != RATCHETS_DIR {
+		t.Fatal("the sessions should all be kept in", RATCHETS_DIR)
+	}
+}
+
+// Tests keeping the prekeys.
+func Test_SavePrekeys(t *testing.T) {
+	dir := t.TempDir() + "/alice"
+
+	prekeys, err := GetPrekeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prekeys.NextID != 1 || len(prekeys.Signed) != 0 || len(prekeys.OneTime) != 0 {
+		t.Fatal("there should be no prekeys before saving any")
+	}
+
+	prekeys.Signed = append(prekeys.Signed, Prekey{ID: 1, Private: []byte{1}, Created: time.Unix(1626775200, 0)})
+	prekeys.OneTime = append(prekeys.OneTime, Prekey{ID: 2, Private: []byte{2}}, Prekey{ID: 3, Private: []byte{3}})
+	prekeys.NextID = 4
+	err = SavePrekeys(dir, prekeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetPrekeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.NextID != 4 || len(got.Signed) != 1 || !got.Signed[0].Created.Equal(prekeys.Signed[0].Created) ||
+		len(got.OneTime) != 2 || got.OneTime[1].ID != 3 || string(got.OneTime[1].Private) != "\x03" {
+		t.Fatalf("got different prekeys than the ones saved: %+v", got)
+	}
+}
+
+// Tests keeping the mailbox sessions and the id of the last message got from the server.
+func Test_SaveSessions(t *testing.T) {
+	dir := t.TempDir()
+
+	if state, err := GetSessions(dir, "bob"); err != nil || state != nil {
+		t.Fatal("there should be no sessions before saving any", err)
+	}
+	if name, id, err := GetMailboxCursor(dir); err != nil || name != "" || id != 0 {
+		t.Fatal("no message was got yet", err)
+	}
+
+	err := SaveSessions(dir, "bob", []byte("sessions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SaveMailboxCursor(dir, "a1", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state, _ := GetSessions(dir, "bob"); string(state) != "sessions" {
+		t.Fatalf("wrong state: %s", string(state))
+	}
+	if name, id, err := GetMailboxCursor(dir); err != nil || name != "a1" || id != 42 {
+		t.Fatal("expected 42 of mailbox a1, got", id, name, err)
+	}
+}
+
+// Tests keeping the messages the server didn't acknowledge yet.
+func Test_SaveOutbox(t *testing.T) {
+	dir := t.TempDir() + "/alice"
+
+	outbox, err := GetOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outbox.NextID != 1 || len(outbox.Pending) != 0 {
+		t.Fatal("the outbox should be empty before saving anything")
+	}
+
+	outbox.Pending = append(outbox.Pending, Outgoing{ID: 1, To: "bob", Envelope: []byte{2, 3}}, Outgoing{ID: 2, To: "carol", Envelope: []byte{2, 4}})
+	outbox.Name, outbox.NextID = "a1", 3
+	err = SaveOutbox(dir, outbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "a1" || got.NextID != 3 || len(got.Pending) != 2 || got.Pending[1].To != "carol" || string(got.Pending[1].Envelope) != "\x02\x04" {
+		t.Fatalf("got a different outbox than the one saved: %+v", got)
+	}
+}
@@ -0,0 +1,57 @@
+package coeus
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const IDENTITY_FILE = "identity.key"
+
+// Returns the identity key kept in dir (nil if there's none yet) and an error.
+func GetIdentity(dir string) (ed25519.PrivateKey, error) {
+	content, err := os.ReadFile(filepath.Join(dir, IDENTITY_FILE))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("malformed identity file")
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Keeps the identity key in dir, readable only by the user (only the seed is written, the rest can be derived from it).
+func SaveIdentity(dir string, identity ed25519.PrivateKey) error {
+	if len(identity) != ed25519.PrivateKeySize {
+		return errors.New("invalid identity key")
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(filepath.Join(dir, IDENTITY_FILE), []byte(hex.EncodeToString(identity.Seed())+"\n"))
+}
+
+// Writes content to a temporary file, readable only by the user, and moves it in place of filename.
+func writeFile(filename string, content []byte) error {
+	tmp := filename + ".tmp"
+	err := os.WriteFile(tmp, content, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
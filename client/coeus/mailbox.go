@@ -0,0 +1,76 @@
+package coeus
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Where the state of the sessions used for the messages left on the server is kept, one file per contact.
+const MAILBOX_DIR = "mailbox"
+
+// Where the name of the mailbox on the server and the id of the last message we got from it are kept.
+const MAILBOX_CURSOR_FILE = "mailbox.cursor"
+
+// Returns the saved state of the mailbox sessions with uname (nil if there's none) and an error.
+func GetSessions(dir, uname string) ([]byte, error) {
+	state, err := os.ReadFile(sessionsFile(dir, uname))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	return state, err
+}
+
+// Saves the state of the mailbox sessions with uname, replacing the previous one.
+func SaveSessions(dir, uname string, state []byte) error {
+	err := os.MkdirAll(filepath.Join(dir, MAILBOX_DIR), 0700)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(sessionsFile(dir, uname), state)
+}
+
+// Returns the name of the mailbox on the server and the id of the last message we got from it ("" and 0 if none), and an error.
+func GetMailboxCursor(dir string) (string, uint64, error) {
+	content, err := os.ReadFile(filepath.Join(dir, MAILBOX_CURSOR_FILE))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", 0, nil
+	} else if err != nil {
+		return "", 0, err
+	}
+
+	fields := strings.Fields(string(content))
+	if len(fields) == 1 {
+		// kept before the mailboxes had names
+		fields = []string{"", fields[0]}
+	}
+	if len(fields) != 2 {
+		return "", 0, errors.New("malformed mailbox cursor")
+	}
+	id, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return fields[0], id, nil
+}
+
+// Records the name of the mailbox on the server and the id of the last message we got from it, so that a message isn't handled twice if it's delivered again.
+func SaveMailboxCursor(dir, mailbox string, id uint64) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(filepath.Join(dir, MAILBOX_CURSOR_FILE), []byte(mailbox+" "+strconv.FormatUint(id, 10)+"\n"))
+}
+
+// Returns the file the mailbox sessions with uname are kept in (the name is hex encoded, usernames come from the network).
+func sessionsFile(dir, uname string) string {
+	return filepath.Join(dir, MAILBOX_DIR, hex.EncodeToString([]byte(uname)))
+}
@@ -0,0 +1,60 @@
+package coeus
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Where the messages left on the server are kept until it acknowledges them.
+const OUTBOX_FILE = "outbox.json"
+
+// The messages we left on the server that it didn't acknowledge yet.
+// They're kept encrypted, and sent again as they are once we're back online: the server keeps each of them only once, by its id.
+type Outbox struct {
+	Name    string // random, so that the server doesn't take the ids of a new outbox (if this one is lost) for ones it got already
+	NextID  uint64 // the id the next message gets (ids grow with every message, 0 is never used)
+	Pending []Outgoing
+}
+
+// A message waiting for the server to acknowledge it.
+type Outgoing struct {
+	ID       uint64
+	To       string
+	Envelope []byte
+}
+
+// Returns the outbox kept in dir (an empty one if there's none yet) and an error.
+func GetOutbox(dir string) (Outbox, error) {
+	outbox := Outbox{NextID: 1}
+
+	content, err := os.ReadFile(filepath.Join(dir, OUTBOX_FILE))
+	if errors.Is(err, os.ErrNotExist) {
+		return outbox, nil
+	} else if err != nil {
+		return Outbox{}, err
+	}
+
+	err = json.Unmarshal(content, &outbox)
+	if err != nil {
+		return Outbox{}, err
+	}
+
+	return outbox, nil
+}
+
+// Keeps the outbox in dir, readable only by the user.
+func SaveOutbox(dir string, outbox Outbox) error {
+	content, err := json.Marshal(outbox)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(filepath.Join(dir, OUTBOX_FILE), content)
+}
@@ -0,0 +1,59 @@
+package coeus
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const PREKEYS_FILE = "prekeys.json"
+
+// The private keys of the prekeys we published, to accept the sessions others start with them while we're offline.
+type Prekeys struct {
+	NextID  uint32   // the id the next prekey gets (0 is never used)
+	Signed  []Prekey // the last one is the current one, the ones before it are kept for messages still on their way
+	OneTime []Prekey
+}
+
+// A prekey we published.
+type Prekey struct {
+	ID      uint32
+	Private []byte
+	Created time.Time
+}
+
+// Returns the prekeys kept in dir (none if there are none yet) and an error.
+func GetPrekeys(dir string) (Prekeys, error) {
+	prekeys := Prekeys{NextID: 1}
+
+	content, err := os.ReadFile(filepath.Join(dir, PREKEYS_FILE))
+	if errors.Is(err, os.ErrNotExist) {
+		return prekeys, nil
+	} else if err != nil {
+		return Prekeys{}, err
+	}
+
+	err = json.Unmarshal(content, &prekeys)
+	if err != nil {
+		return Prekeys{}, err
+	}
+
+	return prekeys, nil
+}
+
+// Keeps the prekeys in dir, readable only by the user.
+func SavePrekeys(dir string, prekeys Prekeys) error {
+	content, err := json.Marshal(prekeys)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(filepath.Join(dir, PREKEYS_FILE), content)
+}
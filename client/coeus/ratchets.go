@@ -0,0 +1,36 @@
+package coeus
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Where the state of the Double Ratchet sessions is kept, one file per contact.
+const RATCHETS_DIR = "ratchets"
+
+// Returns the saved state of the Double Ratchet session with uname (nil if there's none) and an error.
+func GetRatchet(dir, uname string) ([]byte, error) {
+	state, err := os.ReadFile(ratchetFile(dir, uname))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	return state, err
+}
+
+// Saves the state of the Double Ratchet session with uname, replacing the previous one.
+func SaveRatchet(dir, uname string, state []byte) error {
+	err := os.MkdirAll(filepath.Join(dir, RATCHETS_DIR), 0700)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(ratchetFile(dir, uname), state)
+}
+
+// Returns the file the session with uname is kept in (the name is hex encoded, usernames come from the network).
+func ratchetFile(dir, uname string) string {
+	return filepath.Join(dir, RATCHETS_DIR, hex.EncodeToString([]byte(uname)))
+}
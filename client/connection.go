@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/harpocrates/cerberus"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// How long to wait before trying to reach the server again: the first time, and at most once the delay stopped doubling.
+const (
+	MIN_RECONNECT_DELAY = time.Second
+	MAX_RECONNECT_DELAY = 2 * time.Minute
+)
+
+// Where the connection with the server stands, as the console shows it.
+type connState int
+
+const (
+	STATE_OFFLINE connState = iota
+	STATE_CONNECTING
+	STATE_AUTHENTICATING
+	STATE_ONLINE
+)
+
+// Returns what the console shows for the state.
+func (s connState) String() string {
+	switch s {
+	case STATE_CONNECTING:
+		return "connecting"
+	case STATE_AUTHENTICATING:
+		return "authenticating"
+	case STATE_ONLINE:
+		return "online"
+	default:
+		return "offline"
+	}
+}
+
+// Keeps us connected to the server, logging in again whenever the connection drops.
+// The attempts that fail in a row are further and further apart (see reconnectDelay()).
+func (c *client) stayOnline() {
+	for attempt := 0; ; attempt++ {
+		s, err := c.login()
+		if errors.Is(err, cerberus.ErrAuthFailed) {
+			c.setState(STATE_OFFLINE)
+			c.fatal <- errors.New("wrong username or password")
+			return
+		}
+		if errors.Is(err, cerberus.ErrProtocolVersion) {
+			c.setState(STATE_OFFLINE)
+			c.fatal <- fmt.Errorf("%w, update the client", err)
+			return
+		}
+
+		lost := err == nil
+		if lost {
+			attempt = 0
+			err = c.online(s)
+
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+		}
+		c.setState(STATE_OFFLINE)
+
+		delay := reconnectDelay(attempt)
+		if lost {
+			c.notify("[-] Lost the connection with the server (%s), reconnecting in %s...", err, delay.Round(100*time.Millisecond))
+		} else {
+			c.notify("[-] Couldn't reach the server (%s), retrying in %s...", err, delay.Round(100*time.Millisecond))
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Uses the session with the server until the connection drops: what wasn't sent the last time goes first.
+// Returns the reason it dropped.
+func (c *client) online(s *hermes.Session) error {
+	// nothing new is sent before what's waiting in the outbox, so that the server gets the messages in order
+	c.mmu.Lock()
+	// the server delivers again whatever we didn't acknowledge
+	c.mailHeld = false
+	err := c.resendMessages(s)
+	if err == nil {
+		c.setSession(s)
+	}
+	c.mmu.Unlock()
+	if err != nil {
+		s.Close()
+		return err
+	}
+	c.setState(STATE_ONLINE)
+	c.notify("[+] Online as %s.", c.uname)
+
+	// so that others can start sessions with us while we're offline
+	err = c.publishSignedPrekey(s)
+	if err != nil {
+		c.notify("[-] Couldn't publish the prekeys: %s", err)
+	}
+
+	// so that peers can try to reach us over UDP
+	stop := make(chan struct{})
+	err = c.bindUDP(s, stop)
+	if err != nil {
+		c.notify("[-] Couldn't open the UDP socket: %s", err)
+	}
+
+	err = c.serveSession(s)
+	close(stop)
+	c.setSession(nil)
+	s.Close()
+	c.hangUpRelays()
+
+	return err
+}
+
+// Connects to the server and authenticates, resuming the last session if there's a ticket for it (and logging in with the password otherwise).
+// Returns the session with the server and an error.
+func (c *client) login() (*hermes.Session, error) {
+	if ticket := c.ticket; ticket != nil {
+		// a ticket is good for one try: if it fails, we log in with the password
+		c.ticket = nil
+		s, err := c.authenticate(func(conn net.Conn) (anubis.Cipher, *cerberus.Ticket, error) {
+			return cerberus.ResumeWithServer(conn, ticket, c.auth)
+		})
+		if err == nil {
+			return s, nil
+		}
+	}
+
+	return c.authenticate(func(conn net.Conn) (anubis.Cipher, *cerberus.Ticket, error) {
+		return cerberus.LoginWithServer(conn, []byte(c.uname), c.passwd, c.auth)
+	})
+}
+
+// Connects to the server and authenticates with auth, keeping the ticket the server issues for next time.
+// Returns the session with the server and an error.
+func (c *client) authenticate(auth func(conn net.Conn) (anubis.Cipher, *cerberus.Ticket, error)) (*hermes.Session, error) {
+	c.setState(STATE_CONNECTING)
+	conn, err := net.DialTimeout("tcp", c.serverAddr, PEER_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	conn = hermes.NewConn(conn)
+
+	c.setState(STATE_AUTHENTICATING)
+	// a server that stops answering in the middle of the handshake mustn't keep us waiting forever
+	if c.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.handshakeTimeout))
+	}
+	cipher, ticket, err := auth(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	c.ticket = ticket
+
+	s := hermes.NewSession(conn, cipher, hermes.CLIENT, c.uname)
+	s.SetTimeouts(c.timeouts)
+
+	return s, nil
+}
+
+// Shows the user where the connection with the server stands (the prompt says so, unless we're online).
+func (c *client) setState(state connState) {
+	if state == STATE_ONLINE {
+		c.ui.SetStatus("")
+		return
+	}
+
+	c.ui.SetStatus(state.String())
+}
+
+// Returns how long to wait before the attempt-th attempt in a row to reach the server (from 0): MIN_RECONNECT_DELAY, doubling with every attempt up to MAX_RECONNECT_DELAY.
+// Only a random part of it (from half of it to all of it) is waited, so that the clients the server lost at once don't all come back at once.
+func reconnectDelay(attempt int) time.Duration {
+	delay := MAX_RECONNECT_DELAY
+	if attempt < 32 && MIN_RECONNECT_DELAY<<uint(attempt) < MAX_RECONNECT_DELAY {
+		delay = MIN_RECONNECT_DELAY << uint(attempt)
+	}
+
+	jitter, err := rand.Int(rand.Reader, big.NewInt(int64(delay/2)+1))
+	if err != nil {
+		// crypto/rand doesn't fail on the systems we run on
+		panic(err)
+	}
+
+	return delay/2 + time.Duration(jitter.Int64())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/cerberus"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// Tests that the delay before reaching the server again doubles from MIN_RECONNECT_DELAY up to MAX_RECONNECT_DELAY, and that only half of it or more is waited.
+func Test_reconnectDelay(t *testing.T) {
+	for attempt := 0; attempt < 100; attempt++ {
+		delay := MAX_RECONNECT_DELAY
+		if attempt < 7 {
+			delay = MIN_RECONNECT_DELAY << uint(attempt)
+		}
+
+		for i := 0; i < 100; i++ {
+			if d := reconnectDelay(attempt); d < delay/2 || d > delay {
+				t.Fatalf("attempt %d: waited %s, expected between %s and %s", attempt, d, delay/2, delay)
+			}
+		}
+	}
+}
+
+// Tests that the client logs in again once the server drops the connection.
+func Test_stayOnline_reconnect(t *testing.T) {
+	users, err := cerberus.MemoryUsers(cerberus.VECTORS_KDF, map[string]string{"bob": "bobspass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the server hands over the sessions of the clients that authenticated
+	sessions := make(chan *hermes.Session)
+	cfg := &cerberus.Config{Tickets: cerberus.NewTickets(0, 0, nil)}
+	go func() {
+		for {
+			raw, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn := hermes.NewConn(raw)
+			cipher, uname, err := cerberus.DoMutualAuthWith(conn, users, cfg)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			sessions <- hermes.NewSession(conn, cipher, hermes.SERVER, uname)
+		}
+	}()
+
+	c := newTestClient(t)
+	c.serverAddr = l.Addr().String()
+	c.auth = &cerberus.Config{KDF: cerberus.VECTORS_KDF}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		c.stayOnline()
+	}()
+	defer func() {
+		close(c.done)
+		<-stopped
+	}()
+	// what the client shows the user would fill up the events otherwise
+	go func() {
+		for {
+			select {
+			case <-c.events:
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		var s *hermes.Session
+		select {
+		case s = <-sessions:
+		case <-time.After(30 * time.Second):
+			t.Fatalf("the client didn't log in (time %d)", i+1)
+		}
+
+		// the client publishes its prekeys as soon as it's online
+		fields, err := s.Receive()
+		if err != nil {
+			t.Fatalf("time %d: %v", i+1, err)
+		}
+		if len(fields) == 0 || fields[0] != "SIGNED_PREKEY" {
+			t.Fatalf("expected the prekeys of the client, got %v", fields)
+		}
+		s.Close()
+	}
+}
+
+// Tests that the client gives up when the server speaks another version of the protocol, instead of trying again and again.
+func Test_stayOnline_version(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the server of the next version refuses whatever the client sends first
+	go func() {
+		for {
+			raw, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn := hermes.NewConn(raw)
+			if _, _, err := hermes.Read(conn); err == nil {
+				hermes.Write(conn, append([]byte(cerberus.VERSION_FAIL), cerberus.PROTOCOL_VERSION+1))
+			}
+			conn.Close()
+		}
+	}()
+
+	c := newTestClient(t)
+	c.serverAddr = l.Addr().String()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		c.stayOnline()
+	}()
+
+	select {
+	case err := <-c.fatal:
+		if !errors.Is(err, cerberus.ErrProtocolVersion) {
+			t.Fatalf("expected the client to give up on the version, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the client kept trying")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the client kept trying")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// The console is where the user types commands and messages, and where everything that happens gets shown.
+// On a terminal, whatever is printed while the user is typing doesn't mess up the line being typed.
+type console struct {
+	term  *term.Terminal // nil if stdin isn't a terminal
+	state *term.State    // the state of the terminal before we took it over
+	lines *bufio.Scanner // used when stdin isn't a terminal
+	mu    sync.Mutex
+
+	pmu    sync.Mutex
+	prompt string
+	status string // where the connection with the server stands, shown in front of the prompt ("" to show nothing)
+}
+
+// Creates the console, taking over the terminal if there is one.
+// Returns the console and an error.
+func newConsole() (*console, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return &console{lines: bufio.NewScanner(os.Stdin)}, nil
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}
+
+	return &console{
+		term:   term.NewTerminal(rw, "> "),
+		state:  state,
+		prompt: "> ",
+	}, nil
+}
+
+// Waits for the user to type a line.
+// Returns the line and an error (io.EOF if the user is done typing).
+func (c *console) ReadLine() (string, error) {
+	if c.term != nil {
+		return c.term.ReadLine()
+	}
+
+	if !c.lines.Scan() {
+		if c.lines.Err() != nil {
+			return "", c.lines.Err()
+		}
+		return "", io.EOF
+	}
+
+	return c.lines.Text(), nil
+}
+
+// Asks the user for a password, without echoing it.
+// Returns the password and an error.
+func (c *console) ReadPassword(prompt string) (string, error) {
+	if c.term != nil {
+		return c.term.ReadPassword(prompt)
+	}
+
+	// nobody is watching, so there's nothing to hide
+	fmt.Fprint(c, prompt)
+	passwd, err := c.ReadLine()
+	if err == io.EOF {
+		return "", errors.New("no password given")
+	}
+
+	return passwd, err
+}
+
+// Changes the prompt shown in front of the line being typed.
+func (c *console) SetPrompt(prompt string) {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+
+	c.prompt = prompt
+	c.showPrompt()
+}
+
+// Changes the status shown in front of the prompt ("" to show nothing).
+func (c *console) SetStatus(status string) {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+
+	c.status = status
+	c.showPrompt()
+}
+
+// Shows the status and the prompt (c.pmu must be held).
+func (c *console) showPrompt() {
+	if c.term == nil {
+		return
+	}
+
+	if c.status == "" {
+		c.term.SetPrompt(c.prompt)
+	} else {
+		c.term.SetPrompt("(" + c.status + ") " + c.prompt)
+	}
+}
+
+// Prints a line.
+func (c *console) Println(a ...interface{}) {
+	fmt.Fprintln(c, a...)
+}
+
+// Prints whatever is written to the console, keeping the line being typed intact.
+func (c *console) Write(p []byte) (int, error) {
+	if c.term != nil {
+		return c.term.Write(p)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return os.Stdout.Write(p)
+}
+
+// Gives the terminal back in the state we found it in.
+func (c *console) Close() error {
+	if c.term == nil {
+		return nil
+	}
+
+	return term.Restore(int(os.Stdin.Fd()), c.state)
+}
@@ -3,8 +3,9 @@ module github.com/mowzhja/harpocrates/client
 go 1.16
 
 require (
-	github.com/libp2p/go-libp2p v0.14.4
-	github.com/libp2p/go-libp2p-core v0.8.5
-	github.com/multiformats/go-multiaddr v0.3.3
-	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
+	github.com/mowzhja/harpocrates/harpocrates v0.1.0
+	golang.org/x/term v0.0.0-20210615171337-6886f2dfbf5b
 )
+
+// builds against the copy of the protocol module in this tree (tagged harpocrates/v0.1.0), so that a change to both sides is tested as one
+replace github.com/mowzhja/harpocrates/harpocrates => ../harpocrates
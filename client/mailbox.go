@@ -0,0 +1,468 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mowzhja/harpocrates/client/coeus"
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// The kinds of messages left on the server: the first of a session (with the X3DH header in front) and the ones after it.
+const (
+	ENVELOPE_X3DH    = 1
+	ENVELOPE_RATCHET = 2
+)
+
+// Leaves a message for peer on the server, which delivers it even if peer is offline.
+// If there's no session with peer yet, the message waits for its prekeys; if we're offline, it waits for us to be back online.
+func (c *client) leaveMessage(peer, msg string) {
+	c.mmu.Lock()
+	defer c.mmu.Unlock()
+
+	// nil while we're offline
+	s, _ := c.getSession()
+	if s == nil {
+		c.show("[+] You're offline, the message for %s will be sent once you're back online.", peer)
+	}
+
+	sessions, err := c.getSessions(peer)
+	if err != nil {
+		c.show("[-] %s", err)
+		return
+	}
+
+	if sessions.Empty() {
+		c.outbox[peer] = append(c.outbox[peer], msg)
+		if len(c.outbox[peer]) > 1 || s == nil {
+			// the prekeys were already asked for, or will be once we're online
+			return
+		}
+
+		err = s.Send("BUNDLE", peer)
+		if err != nil {
+			c.show("[-] %s", err)
+		}
+		return
+	}
+
+	ct, err := sessions.Encrypt([]byte(msg))
+	if err != nil {
+		c.show("[-] %s", err)
+		return
+	}
+	err = c.saveSessions(peer, sessions)
+	if err != nil {
+		c.show("[-] %s", err)
+		return
+	}
+
+	err = c.queueMessage(s, peer, append([]byte{ENVELOPE_RATCHET}, ct...))
+	if err != nil {
+		c.show("[-] %s", err)
+	}
+}
+
+// Starts a session with the bundle the server sent us (BUNDLE <user> <identity> <id> <prekey> <created> <signature> <one-time id> <one-time prekey>),
+// and leaves the messages that were waiting for it.
+func (c *client) startSession(s *hermes.Session, args []string) error {
+	if len(args) != 8 {
+		return errors.New("malformed bundle")
+	}
+	peer := args[0]
+
+	b, err := parseBundle(args[1:])
+	if err != nil {
+		return err
+	}
+
+	c.mmu.Lock()
+	defer c.mmu.Unlock()
+
+	waiting := c.outbox[peer]
+	delete(c.outbox, peer)
+	if len(waiting) == 0 {
+		return nil
+	}
+
+	sessions, err := c.getSessions(peer)
+	if err != nil {
+		return err
+	}
+
+	var envelopes [][]byte
+	if sessions.Empty() {
+		r, first, err := anubis.X3DHInitiate(c.identity, b, []byte(waiting[0]))
+		if err != nil {
+			return err
+		}
+		c.checkIdentity(peer, b.Identity)
+
+		sessions.Add(r)
+		envelopes = append(envelopes, append([]byte{ENVELOPE_X3DH}, first...))
+		waiting = waiting[1:]
+	}
+	for _, msg := range waiting {
+		ct, err := sessions.Encrypt([]byte(msg))
+		if err != nil {
+			return err
+		}
+		envelopes = append(envelopes, append([]byte{ENVELOPE_RATCHET}, ct...))
+	}
+
+	// the session must be safe before anything encrypted with it leaves
+	err = c.saveSessions(peer, sessions)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range envelopes {
+		err = c.queueMessage(s, peer, e)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Keeps an envelope for peer in the outbox until the server acknowledges it, and sends it if we're online (s isn't nil) (c.mmu must be held).
+// Returns an error if it couldn't be kept, or sent.
+func (c *client) queueMessage(s *hermes.Session, peer string, envelope []byte) error {
+	outbox, err := c.getOutbox()
+	if err != nil {
+		return err
+	}
+	out := coeus.Outgoing{ID: outbox.NextID, To: peer, Envelope: envelope}
+	outbox.NextID++
+	outbox.Pending = append(outbox.Pending, out)
+
+	// what's sent must be in the outbox first, so that it's sent again if the connection drops before the server acknowledges it
+	err = coeus.SaveOutbox(c.dataDir, outbox)
+	if err != nil || s == nil {
+		return err
+	}
+
+	return sendQueued(s, outbox.Name, out)
+}
+
+// Returns the outbox, named if it wasn't yet (c.mmu must be held), and an error.
+func (c *client) getOutbox() (coeus.Outbox, error) {
+	outbox, err := coeus.GetOutbox(c.dataDir)
+	if err != nil || outbox.Name != "" {
+		return outbox, err
+	}
+
+	name := make([]byte, 16)
+	_, err = rand.Read(name)
+	if err != nil {
+		return coeus.Outbox{}, err
+	}
+	outbox.Name = hex.EncodeToString(name)
+
+	// the server must never see two names for the same outbox
+	return outbox, coeus.SaveOutbox(c.dataDir, outbox)
+}
+
+// Sends again what the server didn't acknowledge before we went offline (the server keeps each message once, whatever it got already),
+// and asks again for the prekeys the messages still waiting for them need (c.mmu must be held).
+// Returns an error if the connection broke.
+func (c *client) resendMessages(s *hermes.Session) error {
+	outbox, err := c.getOutbox()
+	if err != nil {
+		c.notify("[-] Couldn't read the messages waiting to be sent: %s", err)
+	}
+	for _, out := range outbox.Pending {
+		err = sendQueued(s, outbox.Name, out)
+		if err != nil {
+			return err
+		}
+	}
+
+	for peer := range c.outbox {
+		err = s.Send("BUNDLE", peer)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Handles the answer of the server to a message we left (QUEUED <user> <id>, or NOT_QUEUED <user> <id> <REFUSED|RETRY> <reason>), which can leave the outbox.
+// A message the server couldn't leave for now (RETRY) stays in the outbox, and is sent again at the next login: only a REFUSED one is given up on.
+func (c *client) messageQueued(queued bool, args []string) error {
+	if len(args) < 2 {
+		return errors.New("malformed acknowledgement")
+	}
+	id, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return errors.New("malformed acknowledgement")
+	}
+
+	c.mmu.Lock()
+	defer c.mmu.Unlock()
+
+	outbox, err := coeus.GetOutbox(c.dataDir)
+	if err != nil {
+		return err
+	}
+	for i, out := range outbox.Pending {
+		if out.ID != id {
+			continue
+		}
+		if !queued && (len(args) < 3 || args[2] != "REFUSED") {
+			c.notify("[-] The message for %s couldn't be left on the server for now (%s): it's sent again at the next login.", args[0], reason(args[2:]))
+			return nil
+		}
+
+		outbox.Pending = append(outbox.Pending[:i], outbox.Pending[i+1:]...)
+		if queued {
+			c.notify("[+] Message for %s left on the server.", args[0])
+		} else {
+			c.notify("[-] The message for %s couldn't be left on the server: %s", args[0], reason(args[2:]))
+		}
+
+		return coeus.SaveOutbox(c.dataDir, outbox)
+	}
+
+	// acknowledged already
+	return nil
+}
+
+// Returns the reason of a NOT_QUEUED (after <user> and <id>), without the word that says whether to try again.
+func reason(args []string) string {
+	if len(args) > 0 && (args[0] == "REFUSED" || args[0] == "RETRY") {
+		args = args[1:]
+	}
+
+	return strings.Join(args, " ")
+}
+
+// Sends a message of the outbox (named outbox) to the server.
+func sendQueued(s *hermes.Session, outbox string, out coeus.Outgoing) error {
+	return s.Send("SEND", out.To, outbox, strconv.FormatUint(out.ID, 10), hex.EncodeToString(out.Envelope))
+}
+
+// Forgets the messages waiting for the prekeys of peer, which the server doesn't have.
+func (c *client) dropOutbox(peer string) {
+	c.mmu.Lock()
+	defer c.mmu.Unlock()
+
+	if n := len(c.outbox[peer]); n > 0 {
+		c.notify("[-] %d message(s) for %s were not sent.", n, peer)
+	}
+	delete(c.outbox, peer)
+}
+
+// Shows a message the server kept for us (MSG <mailbox> <id> <from> <sent> <message>) and acknowledges it, so that the server deletes it.
+// A message delivered twice is acknowledged again but shown only once. One we couldn't read because of our own files isn't acknowledged, to be read once they're fixed:
+// neither are the ones after it, until the server delivers them all again in the next session (the cursor mustn't get past a message we didn't read).
+func (c *client) receiveMessage(s *hermes.Session, args []string) error {
+	if len(args) != 5 {
+		return errors.New("malformed message")
+	}
+	mailbox := args[0]
+	id, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return errors.New("malformed message")
+	}
+	from := args[2]
+	sent, err1 := strconv.ParseInt(args[3], 10, 64)
+	envelope, err2 := hex.DecodeString(args[4])
+	if err1 != nil || err2 != nil || len(envelope) == 0 {
+		return errors.New("malformed message")
+	}
+
+	c.mmu.Lock()
+	defer c.mmu.Unlock()
+
+	if c.mailHeld {
+		return nil
+	}
+	name, last, err := coeus.GetMailboxCursor(c.dataDir)
+	if err != nil {
+		return c.holdMail(err)
+	}
+	if name != mailbox {
+		// the server lost the mailbox we got the last message from: the ids of the new one start over
+		last = 0
+	}
+	if id > last {
+		msg, err := c.openEnvelope(from, envelope)
+		if errors.Is(err, ErrUnreadable) {
+			// it can't ever be read, so there's no point in keeping it
+			c.notify("[-] Couldn't read a message from %s: %s", from, err)
+		} else if err != nil {
+			return c.holdMail(err)
+		} else {
+			c.notify("%s (%s): %s", from, time.Unix(sent, 0).Format("Jan 2 15:04"), string(msg))
+		}
+
+		err = coeus.SaveMailboxCursor(c.dataDir, mailbox, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.Send("ACK", args[1])
+}
+
+// Leaves the messages of this session unread from the one that couldn't be read because of err (one of our own files) on (c.mmu must be held).
+// Returns err, saying so.
+func (c *client) holdMail(err error) error {
+	c.mailHeld = true
+
+	return fmt.Errorf("%s (the messages after it wait for the next session)", err)
+}
+
+// Returned (wrapped) by openEnvelope() for a message that can never be read, unlike one that couldn't be because of our own files.
+var ErrUnreadable = errors.New("unreadable message")
+
+// Decrypts a message left by from, starting a new session if it's the first one (c.mmu must be held).
+// Returns the message and an error (wrapping ErrUnreadable if the message itself is to blame).
+func (c *client) openEnvelope(from string, envelope []byte) ([]byte, error) {
+	sessions, err := c.getSessions(from)
+	if err != nil {
+		return nil, err
+	}
+
+	switch envelope[0] {
+	case ENVELOPE_X3DH:
+		return c.acceptSession(envelope[1:], func(r *anubis.Ratchet, identity ed25519.PublicKey) error {
+			c.checkIdentity(from, identity)
+			sessions.Add(r)
+			return c.saveSessions(from, sessions)
+		})
+	case ENVELOPE_RATCHET:
+		msg, err := sessions.Decrypt(envelope[1:])
+		if err != nil {
+			return nil, unreadable(err)
+		}
+		return msg, c.saveSessions(from, sessions)
+	}
+
+	return nil, unreadable(errors.New("unknown kind of message"))
+}
+
+// Returns err, wrapping ErrUnreadable.
+func unreadable(err error) error {
+	return fmt.Errorf("%w: %s", ErrUnreadable, err)
+}
+
+// Accepts a session started with one of our bundles, deleting the one-time prekey it used so that it can't be accepted twice.
+// keep is given the Ratchet of the session and the identity key of who started it, to save them before the prekey is gone (the message can be read again if it fails).
+// Returns the first message of the session and an error (wrapping ErrUnreadable if the message itself is to blame).
+func (c *client) acceptSession(msg []byte, keep func(*anubis.Ratchet, ed25519.PublicKey) error) ([]byte, error) {
+	h, err := anubis.ParseX3DHHeader(msg)
+	if err != nil {
+		return nil, unreadable(err)
+	}
+
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+
+	prekeys, err := coeus.GetPrekeys(c.dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var signed, oneTime []byte
+	for _, p := range prekeys.Signed {
+		if p.ID == h.SignedPrekeyID {
+			signed = p.Private
+		}
+	}
+	used := -1
+	for i, p := range prekeys.OneTime {
+		if p.ID == h.OneTimePrekeyID {
+			oneTime, used = p.Private, i
+		}
+	}
+	if signed == nil {
+		return nil, unreadable(errors.New("the signed prekey it was sent to is gone"))
+	}
+	if h.OneTimePrekeyID != 0 && oneTime == nil {
+		return nil, unreadable(errors.New("the one-time prekey it was sent to was already used"))
+	}
+
+	r, first, err := anubis.X3DHRespond(c.identity, signed, oneTime, msg)
+	if err != nil {
+		return nil, unreadable(err)
+	}
+	err = keep(r, h.Identity)
+	if err != nil {
+		return nil, err
+	}
+
+	if used >= 0 {
+		prekeys.OneTime = append(prekeys.OneTime[:used], prekeys.OneTime[used+1:]...)
+		err = coeus.SavePrekeys(c.dataDir, prekeys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return first, nil
+}
+
+// Returns the mailbox sessions with peer and an error (c.mmu must be held).
+func (c *client) getSessions(peer string) (*anubis.Sessions, error) {
+	state, err := coeus.GetSessions(c.dataDir, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return anubis.UnmarshalSessions(state)
+}
+
+// Saves the mailbox sessions with peer (c.mmu must be held).
+func (c *client) saveSessions(peer string, sessions *anubis.Sessions) error {
+	state, err := sessions.Marshal()
+	if err != nil {
+		return err
+	}
+
+	return coeus.SaveSessions(c.dataDir, peer, state)
+}
+
+// Reads the fields of a BUNDLE message, after the username.
+// Returns the bundle and an error.
+func parseBundle(args []string) (anubis.Bundle, error) {
+	identity, err1 := hex.DecodeString(args[0])
+	spkID, err2 := strconv.ParseUint(args[1], 10, 32)
+	spk, err3 := hex.DecodeString(args[2])
+	created, err4 := strconv.ParseInt(args[3], 10, 64)
+	sig, err5 := hex.DecodeString(args[4])
+	otpkID, err6 := strconv.ParseUint(args[5], 10, 32)
+	for _, err := range []error{err1, err2, err3, err4, err5, err6} {
+		if err != nil {
+			return anubis.Bundle{}, errors.New("malformed bundle")
+		}
+	}
+
+	b := anubis.Bundle{
+		Identity:        ed25519.PublicKey(identity),
+		SignedPrekeyID:  uint32(spkID),
+		SignedPrekey:    spk,
+		Created:         time.Unix(created, 0),
+		Signature:       sig,
+		OneTimePrekeyID: uint32(otpkID),
+	}
+	if otpkID != 0 {
+		otpk, err := hex.DecodeString(args[6])
+		if err != nil {
+			return anubis.Bundle{}, errors.New("malformed bundle")
+		}
+		b.OneTimePrekey = otpk
+	}
+
+	return b, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mowzhja/harpocrates/client/coeus"
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// Utility function, creates the client of bob, keeping its data in a temporary directory and printing nothing.
+func newTestClient(t *testing.T) *client {
+	_, identity, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ui := &console{lines: bufio.NewScanner(strings.NewReader(""))}
+
+	return newClient("bob", []byte("bobspass"), "", t.TempDir(), identity, ui)
+}
+
+// Utility function, connects a session of the client with the end of the server, whose messages are handed to the returned channel.
+func newTestSession(t *testing.T) (*hermes.Session, chan []string) {
+	key := make([]byte, anubis.BYTE_SEC)
+	rand.Read(key)
+	cipher, err := anubis.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote := net.Pipe()
+	s := hermes.NewSession(local, cipher, hermes.CLIENT, "bob")
+	server := hermes.NewSession(remote, cipher, hermes.SERVER, "bob")
+	t.Cleanup(func() {
+		s.Close()
+		server.Close()
+	})
+
+	received := make(chan []string, 16)
+	go func() {
+		for {
+			fields, err := server.Receive()
+			if err != nil {
+				return
+			}
+			received <- fields
+		}
+	}()
+
+	return s, received
+}
+
+// Utility function, starts a mailbox session between from and the client, saving the end of the client.
+// Returns the end of from.
+func newMailboxSession(t *testing.T, c *client, from string) *anubis.Ratchet {
+	sk := make([]byte, anubis.BYTE_SEC)
+	rand.Read(sk)
+	ad := []byte(from + " and bob")
+
+	bobKey, err := anubis.NewRatchetKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobPub, err := anubis.RatchetPublicKey(bobKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := anubis.NewRatchetInitiator(sk, ad, bobPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := anubis.NewRatchetResponder(sk, ad, bobKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := anubis.UnmarshalSessions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions.Add(receiver)
+	if err := c.saveSessions(from, sessions); err != nil {
+		t.Fatal(err)
+	}
+
+	return sender
+}
+
+// Utility function, encrypts msg in an envelope, the way it's left on the server.
+func envelope(t *testing.T, r *anubis.Ratchet, msg string) string {
+	ct, err := r.Encrypt([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hex.EncodeToString(append([]byte{ENVELOPE_RATCHET}, ct...))
+}
+
+// Utility function, returns what the client showed the user so far.
+func shown(c *client) []string {
+	var events []string
+	for {
+		select {
+		case event := <-c.events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// Tests that a message we couldn't read because of our own files isn't lost when the one after it can be read:
+// neither is acknowledged, and both are shown once the server delivers them again.
+func Test_receiveMessage_localFailure(t *testing.T) {
+	c := newTestClient(t)
+	carol := newMailboxSession(t, c, "carol")
+	alice := newMailboxSession(t, c, "alice")
+	fromCarol, fromAlice := envelope(t, carol, "hello from carol"), envelope(t, alice, "hello from alice")
+
+	// the sessions with carol can't be read for now
+	saved, err := coeus.GetSessions(c.dataDir, "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := coeus.SaveSessions(c.dataDir, "carol", []byte("not a session")); err != nil {
+		t.Fatal(err)
+	}
+
+	s, acks := newTestSession(t)
+	if err := c.receiveMessage(s, []string{"box", "1", "carol", "0", fromCarol}); err == nil {
+		t.Fatal("the message of carol shouldn't have been read")
+	}
+	if err := c.receiveMessage(s, []string{"box", "2", "alice", "0", fromAlice}); err != nil {
+		t.Fatal(err)
+	}
+	if events := shown(c); len(events) != 0 {
+		t.Fatalf("nothing should have been shown, got %q", events)
+	}
+	select {
+	case ack := <-acks:
+		t.Fatalf("nothing should have been acknowledged, got %q", ack)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the file is fixed, and the next session gets both messages again
+	if err := coeus.SaveSessions(c.dataDir, "carol", saved); err != nil {
+		t.Fatal(err)
+	}
+	c.mailHeld = false
+	s, acks = newTestSession(t)
+	for i, msg := range [][]string{{"box", "1", "carol", "0", fromCarol}, {"box", "2", "alice", "0", fromAlice}} {
+		if err := c.receiveMessage(s, msg); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case ack := <-acks:
+			if strings.Join(ack, " ") != "ACK "+msg[1] {
+				t.Fatalf("message %d: expected ACK %s, got %q", i, msg[1], ack)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d wasn't acknowledged", i)
+		}
+	}
+
+	events := shown(c)
+	if len(events) != 2 || !strings.HasSuffix(events[0], "hello from carol") || !strings.HasSuffix(events[1], "hello from alice") {
+		t.Fatalf("expected both messages, in order, got %q", events)
+	}
+}
+
+// Tests that a message the server couldn't leave for now stays in the outbox, to be sent again, and that only a refused or queued one leaves it.
+func Test_messageQueued(t *testing.T) {
+	c := newTestClient(t)
+	outbox := coeus.Outbox{Name: "outbox", NextID: 3, Pending: []coeus.Outgoing{{ID: 1, To: "carol", Envelope: []byte{1}}, {ID: 2, To: "dave", Envelope: []byte{2}}}}
+	if err := coeus.SaveOutbox(c.dataDir, outbox); err != nil {
+		t.Fatal(err)
+	}
+
+	answers := []struct {
+		queued  bool
+		args    []string
+		pending int
+	}{
+		{false, []string{"carol", "1", "RETRY", "the", "mailbox", "of", "carol", "is", "full"}, 2},
+		{false, []string{"dave", "2", "REFUSED", "can't", "leave", "messages", "for", "dave"}, 1},
+		{true, []string{"carol", "1"}, 0},
+	}
+	for _, answer := range answers {
+		if err := c.messageQueued(answer.queued, answer.args); err != nil {
+			t.Fatal(err)
+		}
+		outbox, err := coeus.GetOutbox(c.dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(outbox.Pending) != answer.pending {
+			t.Fatalf("%v: expected %d message(s) in the outbox, got %+v", answer.args, answer.pending, outbox.Pending)
+		}
+	}
+}
@@ -1,32 +1,68 @@
 package main
 
 import (
-	"fmt"
-	"net"
+	"flag"
 	"os"
-	"time"
+	"path/filepath"
+	"strings"
 
-	"github.com/mowzhja/harpocrates/client/cerberus"
-	"github.com/mowzhja/harpocrates/client/hermes"
-	"github.com/mowzhja/harpocrates/client/seshat"
+	"github.com/mowzhja/harpocrates/client/coeus"
+	"github.com/mowzhja/harpocrates/harpocrates/cerberus"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+	"github.com/mowzhja/harpocrates/harpocrates/seshat"
 )
 
 func main() {
-	conn, err := net.Dial("tcp", "127.0.0.1:9001")
-	seshat.HandleErr(err)
+	server := flag.String("server", "127.0.0.1:9001", "address of the server")
+	user := flag.String("user", "", "username (asked for if not given)")
+	data := flag.String("data", "", "where contacts and received files are kept (default ~/.harpocrates/<user>)")
+	coverInterval := flag.Duration("cover-interval", 0, "send a record to every peer this often, whether there's something to say or not (constant-rate mode, off if 0)")
+	coverSize := flag.Int("cover-size", hermes.DEFAULT_COVER_TRAFFIC.Size, "how long every record of the constant-rate mode is")
+	coverBudget := flag.Int("cover-budget", hermes.DEFAULT_COVER_TRAFFIC.Budget, "the most bytes per second the constant-rate mode can cost (no limit if 0)")
+	handshakeTimeout := flag.Duration("handshake-timeout", hermes.HANDSHAKE_TIMEOUT, "how long logging in can take (0 for no limit)")
+	keepalive := flag.Duration("keepalive", hermes.DEFAULT_TIMEOUTS.Keepalive, "how long we stay silent before sending the server (or a peer) a keepalive (0 for none)")
+	idleTimeout := flag.Duration("idle-timeout", hermes.DEFAULT_TIMEOUTS.Idle, "how long the server (or a peer) can stay silent before it's taken for dead (0 for no limit)")
+	flag.Parse()
 
-	sharedSecret, err := hermes.DoECDHE(conn)
+	ui, err := newConsole()
 	seshat.HandleErr(err)
+	defer ui.Close()
 
-	user := os.Args[1]
-	pass := os.Args[2]
-	// peerAddr is a multiaddress (check out firefox)
-	_, _, peerAddr, err := cerberus.AuthWithServer(conn, sharedSecret, []byte(user), []byte(pass))
+	// never take the password from the command line, it would end up in the shell history and in ps
+	uname := *user
+	if uname == "" {
+		ui.SetPrompt("username: ")
+		uname, err = ui.ReadLine()
+		seshat.HandleErr(err)
+		uname = strings.TrimSpace(uname)
+		ui.SetPrompt("> ")
+	}
+	passwd, err := ui.ReadPassword("password: ")
 	seshat.HandleErr(err)
 
-	// close connection to server
-	conn.Close()
+	dataDir := *data
+	if dataDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			home = "."
+		}
+		dataDir = filepath.Join(home, ".harpocrates", uname)
+	}
+
+	// the identity key is created the first time the user runs the client, and kept from then on
+	identity, err := coeus.GetIdentity(dataDir)
+	seshat.HandleErr(err)
+	if identity == nil {
+		identity, err = cerberus.NewIdentity()
+		seshat.HandleErr(err)
+		seshat.HandleErr(coeus.SaveIdentity(dataDir, identity))
+	}
 
-	fmt.Printf("\n[+] Initiating peer to peer connection with %s...\n", peerAddr)
-	time.Sleep(10 * time.Second)
+	c := newClient(uname, []byte(passwd), *server, dataDir, identity, ui)
+	if *coverInterval > 0 {
+		c.cover = hermes.CoverTraffic{Interval: *coverInterval, Size: *coverSize, Budget: *coverBudget}
+	}
+	c.handshakeTimeout = *handshakeTimeout
+	c.timeouts.Keepalive, c.timeouts.Idle = *keepalive, *idleTimeout
+	c.run()
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/mowzhja/harpocrates/client/coeus"
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// How long a signed prekey is used before a new one replaces it (well before the server considers it stale).
+const SIGNED_PREKEY_ROTATION = 7 * 24 * time.Hour
+
+// How many signed prekeys are kept: the current one and the previous one, for the sessions started just before it was replaced.
+const KEPT_SIGNED_PREKEYS = 2
+
+// How many one-time prekeys the server should have for us.
+const ONETIME_PREKEYS_BATCH = 100
+
+// The most one-time prekeys whose private key is kept (the server handed out the oldest, but the sessions started with them may not have reached us yet).
+const MAX_ONETIME_PREKEYS = 4 * ONETIME_PREKEYS_BATCH
+
+// Publishes our signed prekey, replacing it first if it's too old (the server answers with PREKEYS_LOW if it needs one-time prekeys as well).
+func (c *client) publishSignedPrekey(s *hermes.Session) error {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+
+	prekeys, err := coeus.GetPrekeys(c.dataDir)
+	if err != nil {
+		return err
+	}
+
+	if len(prekeys.Signed) == 0 || time.Since(prekeys.Signed[len(prekeys.Signed)-1].Created) > SIGNED_PREKEY_ROTATION {
+		priv, err := anubis.NewRatchetKey()
+		if err != nil {
+			return err
+		}
+
+		// the signature covers the creation time in seconds
+		prekeys.Signed = append(prekeys.Signed, coeus.Prekey{ID: prekeys.NextID, Private: priv, Created: time.Now().Truncate(time.Second)})
+		prekeys.NextID++
+		if len(prekeys.Signed) > KEPT_SIGNED_PREKEYS {
+			prekeys.Signed = prekeys.Signed[len(prekeys.Signed)-KEPT_SIGNED_PREKEYS:]
+		}
+
+		err = coeus.SavePrekeys(c.dataDir, prekeys)
+		if err != nil {
+			return err
+		}
+	}
+
+	current := prekeys.Signed[len(prekeys.Signed)-1]
+	pub, err := anubis.RatchetPublicKey(current.Private)
+	if err != nil {
+		return err
+	}
+	sig := anubis.SignPrekey(c.identity, current.ID, pub, current.Created)
+
+	return s.Send("SIGNED_PREKEY", hex.EncodeToString(c.identity.Public().(ed25519.PublicKey)), strconv.FormatUint(uint64(current.ID), 10),
+		hex.EncodeToString(pub), strconv.FormatInt(current.Created.Unix(), 10), hex.EncodeToString(sig))
+}
+
+// Publishes new one-time prekeys, so that the server has ONETIME_PREKEYS_BATCH of them again.
+func (c *client) publishOneTimePrekeys(s *hermes.Session, remaining int) error {
+	n := ONETIME_PREKEYS_BATCH - remaining
+	if n <= 0 {
+		return nil
+	}
+
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+
+	prekeys, err := coeus.GetPrekeys(c.dataDir)
+	if err != nil {
+		return err
+	}
+
+	request := []string{"ONETIME_PREKEYS"}
+	for i := 0; i < n; i++ {
+		priv, err := anubis.NewRatchetKey()
+		if err != nil {
+			return err
+		}
+		pub, err := anubis.RatchetPublicKey(priv)
+		if err != nil {
+			return err
+		}
+
+		prekeys.OneTime = append(prekeys.OneTime, coeus.Prekey{ID: prekeys.NextID, Private: priv, Created: time.Now()})
+		request = append(request, strconv.FormatUint(uint64(prekeys.NextID), 10)+":"+hex.EncodeToString(pub))
+		prekeys.NextID++
+	}
+	if len(prekeys.OneTime) > MAX_ONETIME_PREKEYS {
+		prekeys.OneTime = prekeys.OneTime[len(prekeys.OneTime)-MAX_ONETIME_PREKEYS:]
+	}
+
+	// the private keys must be safe before the public ones are handed out
+	err = coeus.SavePrekeys(c.dataDir, prekeys)
+	if err != nil {
+		return err
+	}
+
+	return s.Send(request...)
+}
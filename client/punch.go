@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// How often the bind request is repeated, to keep the mapping of the NAT we're behind (if any) alive.
+const UDP_KEEPALIVE = 20 * time.Second
+
+// How long punching a hole to a peer can take.
+const PUNCH_TIMEOUT = 5 * time.Second
+
+// Opens the UDP socket whose endpoint, as seen by the server, is handed to our peers, and asks the server for the token to bind it with.
+// The bind request is repeated until stop is closed; the socket is closed along with it (and with it the UDP paths to the peers).
+func (c *client) bindUDP(s *hermes.Session, stop chan struct{}) error {
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return err
+	}
+	server, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	hub := hermes.NewPacketHub(pc)
+
+	c.mu.Lock()
+	c.udp, c.udpServer, c.bindToken = hub, server, nil
+	c.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(UDP_KEEPALIVE)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.sendBind()
+			case <-stop:
+				c.mu.Lock()
+				c.udp, c.bindToken = nil, nil
+				c.mu.Unlock()
+				hub.Close()
+				return
+			}
+		}
+	}()
+
+	return s.Send("BIND")
+}
+
+// Records the token the server handed out with BIND, and sends the first bind request.
+func (c *client) setBindToken(token string) {
+	t, err := hex.DecodeString(token)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.bindToken = t
+	c.mu.Unlock()
+
+	c.sendBind()
+}
+
+// Sends the bind request to the UDP port of the server (nothing comes back on it, the server answers ENDPOINT over the session).
+func (c *client) sendBind() {
+	c.mu.Lock()
+	hub, server, token := c.udp, c.udpServer, c.bindToken
+	c.mu.Unlock()
+
+	if hub != nil && token != nil {
+		hub.WriteTo(hermes.BindRequest(token), server)
+	}
+}
+
+// Tries to open a UDP path with peer, reachable at endpoint as seen by the server, for the chat of the connection p.
+// Returns the path, nil if the peer couldn't be reached (the chat only goes over the connection then).
+func (c *client) punch(p *hermes.Peer, peer, role, endpoint string, pairingKey []byte) *hermes.DatagramConn {
+	addr, err := net.ResolveUDPAddr("udp", endpoint)
+	if err != nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	hub := c.udp
+	c.mu.Unlock()
+	if hub == nil {
+		return nil
+	}
+
+	pc := hub.Conn()
+	ctx, cancel := context.WithTimeout(context.Background(), PUNCH_TIMEOUT)
+	defer cancel()
+	from, err := hermes.Punch(ctx, pc, addr, pairingKey, role == hermes.PEER_DIALER)
+	if err == nil {
+		var dc *hermes.DatagramConn
+		dc, err = p.Datagrams(pc, from)
+		if err == nil {
+			c.notify("[+] Opened a UDP path with %s (%s).", peer, from)
+			return dc
+		}
+	}
+	pc.Close()
+	c.notify("[-] Couldn't open a UDP path with %s, we talk over the connection only: %s", peer, err)
+
+	return nil
+}
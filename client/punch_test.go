@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// Utility function, gives the client a UDP socket on the loopback, the way bindUDP() does once it's online.
+func bindTestUDP(t *testing.T, c *client) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.udp = hermes.NewPacketHub(pc)
+	t.Cleanup(func() {
+		c.udp.Close()
+	})
+}
+
+// Tests punching a UDP path between two clients, and records going over it, and that there's no path without a socket.
+func Test_punch(t *testing.T) {
+	alice, bob := newTestClient(t), newTestClient(t)
+	bindTestUDP(t, alice)
+	bindTestUDP(t, bob)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	ctx, cancel := context.WithTimeout(context.Background(), PEER_TIMEOUT)
+	defer cancel()
+	a, b := net.Pipe()
+	peers := make(chan *hermes.Peer)
+	for _, end := range []struct {
+		c      *client
+		conn   net.Conn
+		dialer bool
+	}{{alice, a, true}, {bob, b, false}} {
+		go func(c *client, conn net.Conn, dialer bool) {
+			p, _, err := hermes.OpenPeer(ctx, func(context.Context) (net.Conn, error) {
+				return conn, nil
+			}, nil, key, dialer, c.identity)
+			if err != nil {
+				t.Error(err)
+			}
+			peers <- p
+		}(end.c, end.conn, end.dialer)
+	}
+	p1, p2 := <-peers, <-peers
+	if p1 == nil || p2 == nil {
+		t.FailNow()
+	}
+	// nothing reads the connections, closing the peers would wait for the deadline
+	defer a.Close()
+	defer b.Close()
+	// the peers come in any order, the paths don't care which is which
+	paths := make(chan *hermes.DatagramConn)
+	go func() {
+		paths <- alice.punch(p1, "bob", hermes.PEER_DIALER, bob.udp.LocalAddr().String(), key)
+	}()
+	go func() {
+		paths <- bob.punch(p2, "alice", hermes.PEER_LISTENER, alice.udp.LocalAddr().String(), key)
+	}()
+	d1, d2 := <-paths, <-paths
+	if d1 == nil || d2 == nil {
+		t.Fatal("the path wasn't opened")
+	}
+	defer d1.Close()
+	defer d2.Close()
+
+	if err := d1.Send([]byte("over UDP")); err != nil {
+		t.Fatal(err)
+	}
+	d2.SetReadDeadline(time.Now().Add(time.Second))
+	if record, err := d2.Receive(); err != nil || string(record) != "over UDP" {
+		t.Fatalf("expected the record over UDP, got %q (%v)", record, err)
+	}
+
+	// offline, there's no socket to punch with
+	carol := newTestClient(t)
+	if carol.punch(p1, "bob", hermes.PEER_DIALER, bob.udp.LocalAddr().String(), key) != nil {
+		t.Fatal("a path was opened without a socket")
+	}
+}
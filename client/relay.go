@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// Asks the server to relay the connection with peer, and waits for peer to ask for the same.
+// Returns the relayed connection and an error.
+func (c *client) openRelay(ctx context.Context, peer string) (net.Conn, error) {
+	s, err := c.getSession()
+	if err != nil {
+		return nil, err
+	}
+
+	rc := hermes.NewRelayConn(s, peer)
+	c.mu.Lock()
+	old, ok := c.relays[peer]
+	c.relays[peer] = rc
+	c.mu.Unlock()
+	if ok {
+		old.Close()
+	}
+
+	err = s.Send("RELAY", peer)
+	if err == nil {
+		err = rc.WaitOpen(ctx)
+	}
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+// Hands a RELAYED, RELAY_DATA or RELAY_CLOSE message of the server to the relayed connection it's about.
+func (c *client) handleRelay(fields []string) {
+	if len(fields) < 2 {
+		return
+	}
+	peer := fields[1]
+
+	c.mu.Lock()
+	rc, ok := c.relays[peer]
+	if ok && fields[0] == "RELAY_CLOSE" {
+		delete(c.relays, peer)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	switch fields[0] {
+	case "RELAYED":
+		rc.Opened()
+	case "RELAY_DATA":
+		if len(fields) != 3 {
+			return
+		}
+		data, err := hex.DecodeString(fields[2])
+		if err == nil {
+			err = rc.Deliver(data)
+		}
+		if err != nil {
+			rc.Close()
+		}
+	case "RELAY_CLOSE":
+		rc.HangUp()
+	}
+}
+
+// Hangs up all the relayed connections, once the session with the server they went through is lost.
+func (c *client) hangUpRelays() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for peer, rc := range c.relays {
+		rc.HangUp()
+		delete(c.relays, peer)
+	}
+}
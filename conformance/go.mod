@@ -0,0 +1,8 @@
+module github.com/mowzhja/harpocrates/conformance
+
+go 1.16
+
+require github.com/mowzhja/harpocrates/harpocrates v0.1.0
+
+// builds against the copy of the protocol module in this tree (tagged harpocrates/v0.1.0), so that a change to both sides is tested as one
+replace github.com/mowzhja/harpocrates/harpocrates => ../harpocrates
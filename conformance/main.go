@@ -0,0 +1,60 @@
+// The conformance command checks another implementation of the server against the protocol, running it through scripted handshakes
+// (including the malformed messages it has to refuse), and prints the test vectors of the protocol for those writing clients.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/cerberus"
+	"github.com/mowzhja/harpocrates/harpocrates/seshat"
+)
+
+func main() {
+	server := flag.String("server", "127.0.0.1:9001", "address of the server under test")
+	uname := flag.String("user", "alice", "a user of the server under test")
+	passwd := flag.String("password", "alicespass", "the password of that user")
+	kdfTime := flag.Uint("kdf-time", uint(cerberus.DEFAULT_KDF.Time), "Argon2 passes the server registered its users with")
+	kdfMemory := flag.Uint("kdf-memory", uint(cerberus.DEFAULT_KDF.Memory), "Argon2 memory (KiB) the server registered its users with")
+	kdfThreads := flag.Uint("kdf-threads", uint(cerberus.DEFAULT_KDF.Threads), "Argon2 threads the server registered its users with")
+	timeout := flag.Duration("timeout", 30*time.Second, "how long each scenario can take")
+	vectors := flag.Bool("vectors", false, "print the test vectors (JSON) instead")
+	flag.Parse()
+
+	if *vectors {
+		v, err := cerberus.GenerateVectors()
+		seshat.HandleErr(err)
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		seshat.HandleErr(enc.Encode(v))
+		return
+	}
+
+	t := &tester{
+		addr:    *server,
+		uname:   *uname,
+		passwd:  *passwd,
+		cfg:     &cerberus.Config{KDF: cerberus.KDFParams{Time: uint32(*kdfTime), Memory: uint32(*kdfMemory), Threads: uint8(*kdfThreads)}},
+		timeout: *timeout,
+	}
+
+	failed := 0
+	for _, s := range scenarios {
+		err := s.run(t)
+		if err != nil {
+			failed++
+			fmt.Printf("[-] FAIL %s: %s\n", s.name, err)
+		} else {
+			fmt.Printf("[+] PASS %s\n", s.name)
+		}
+	}
+
+	fmt.Printf("[+] %d of %d scenarios passed\n", len(scenarios)-failed, len(scenarios))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates"
+	"github.com/mowzhja/harpocrates/harpocrates/cerberus"
+)
+
+// Utility function, returns a tester for the server listening on l (whose only user is alice, with alicespass as password).
+func newTester(l net.Listener, timeout time.Duration) *tester {
+	return &tester{
+		addr:    l.Addr().String(),
+		uname:   "alice",
+		passwd:  "alicespass",
+		cfg:     &cerberus.Config{KDF: cerberus.VECTORS_KDF},
+		timeout: timeout,
+	}
+}
+
+// Tests that the server of this project passes every scenario.
+func Test_scenarios(t *testing.T) {
+	users, err := cerberus.MemoryUsers(cerberus.VECTORS_KDF, map[string]string{"alice": "alicespass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := harpocrates.Listen("127.0.0.1:0", &harpocrates.Config{Credentials: users, Tickets: cerberus.NewTickets(0, 0, nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, c)
+		}
+	}()
+
+	tr := newTester(l, 5*time.Second)
+	for _, s := range scenarios {
+		if err := s.run(tr); err != nil {
+			t.Errorf("%s: %s", s.name, err)
+		}
+	}
+}
+
+// Tests that a server that never answers fails every scenario.
+func Test_scenarios_silentServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, c)
+		}
+	}()
+
+	tr := newTester(l, 100*time.Millisecond)
+	for _, s := range scenarios {
+		if err := s.run(tr); err == nil {
+			t.Errorf("%s: the silent server passed", s.name)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/cerberus"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+	"github.com/mowzhja/harpocrates/harpocrates/seshat"
+)
+
+// The messages a client sends during the handshake, in order.
+const (
+	MSG_KEY = iota
+	MSG_NAME
+	MSG_PROOF
+	MSG_CLIENT_OK
+)
+
+// Plays the client against the server under test.
+type tester struct {
+	addr    string
+	uname   string
+	passwd  string
+	cfg     *cerberus.Config
+	timeout time.Duration
+}
+
+// A scripted exchange with the server under test.
+// run returns why the server failed it (nil if it passed).
+type scenario struct {
+	name string
+	run  func(t *tester) error
+}
+
+// Takes the i-th message the client sends (in handshake h) and returns what to send in its place.
+type tamper func(h *cerberus.ClientHandshake, i int, msg []byte) [][]byte
+
+// Everything the server under test goes through, one connection each.
+var scenarios = []scenario{
+	{"login", func(t *tester) error {
+		h, conn, err := t.play(t.uname, t.passwd, nil)
+		if conn != nil {
+			conn.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if h.State() != cerberus.DONE {
+			return errors.New("the handshake isn't done")
+		}
+		return nil
+	}},
+	{"wrong password", func(t *tester) error {
+		return t.refused(t.uname, t.passwd+"-but-wrong")
+	}},
+	{"unknown user", func(t *tester) error {
+		return t.refused("no-such-user-"+t.uname, t.passwd)
+	}},
+	{"unknown protocol version", func(t *tester) error {
+		_, conn, err := t.play(t.uname, t.passwd, on(MSG_KEY, func(msg []byte) []byte {
+			// the version comes first in the first message
+			return append([]byte{cerberus.PROTOCOL_VERSION + 1}, msg[1:]...)
+		}))
+		if conn != nil {
+			conn.Close()
+		}
+		if !errors.Is(err, cerberus.ErrProtocolVersion) {
+			return errors.New("expected the server to tell the version it speaks, got: " + describe(err))
+		}
+		return nil
+	}},
+	{"public key not on the curve", func(t *tester) error {
+		return t.rejects(on(MSG_KEY, flipLast))
+	}},
+	{"truncated public key", func(t *tester) error {
+		return t.rejects(on(MSG_KEY, func(msg []byte) []byte { return msg[:len(msg)/2] }))
+	}},
+	{"public key sent twice", func(t *tester) error {
+		return t.rejects(func(h *cerberus.ClientHandshake, i int, msg []byte) [][]byte {
+			if i == MSG_KEY {
+				return [][]byte{msg, msg}
+			}
+			return [][]byte{msg}
+		})
+	}},
+	{"tampered username", func(t *tester) error {
+		return t.rejects(on(MSG_NAME, flipLast))
+	}},
+	{"tampered proof", func(t *tester) error {
+		return t.rejects(on(MSG_PROOF, flipLast))
+	}},
+	{"proof for another nonce", func(t *tester) error {
+		return t.rejects(func(h *cerberus.ClientHandshake, i int, msg []byte) [][]byte {
+			if i != MSG_PROOF {
+				return [][]byte{msg}
+			}
+			cipher := h.Cipher()
+			authMessage, err := cipher.Decrypt(msg)
+			if err != nil {
+				return [][]byte{msg}
+			}
+			proof, nonce, err := seshat.ExtractDataNonce(authMessage, 64)
+			if err != nil {
+				return [][]byte{msg}
+			}
+			// the server nonce changes, the proof stays the same
+			tampered, err := cipher.Encrypt(seshat.MergeChunks(nonce[:32], flipLast(nonce[32:]), proof))
+			if err != nil {
+				return [][]byte{msg}
+			}
+			return [][]byte{tampered}
+		})
+	}},
+	{"tampered CLIENT_OK", func(t *tester) error {
+		h, conn, err := t.play(t.uname, t.passwd, on(MSG_CLIENT_OK, flipLast))
+		if conn != nil {
+			defer conn.Close()
+		}
+		if err != nil || h.State() != cerberus.DONE {
+			return errors.New("the handshake should get to CLIENT_OK")
+		}
+		// the client thinks it's in, the server has to hang up on it
+		return t.hangsUp(conn)
+	}},
+	{"resumption", func(t *tester) error {
+		ticket, err := t.ticket()
+		if err != nil {
+			return err
+		}
+		h, conn, err := t.run(cerberus.NewResumingHandshake(ticket, t.cfg), nil)
+		if conn != nil {
+			conn.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if h.State() != cerberus.DONE {
+			return errors.New("the handshake isn't done")
+		}
+		return nil
+	}},
+	{"tampered ticket", func(t *tester) error {
+		ticket, err := t.ticket()
+		if err != nil {
+			return err
+		}
+		// the ticket comes last in the first message
+		_, conn, err := t.run(cerberus.NewResumingHandshake(ticket, t.cfg), on(MSG_KEY, flipLast))
+		if conn != nil {
+			conn.Close()
+		}
+		if !errors.Is(err, cerberus.ErrTicketRejected) {
+			return errors.New("expected the server to reject the ticket, got: " + describe(err))
+		}
+		return nil
+	}},
+	{"message that isn't hex", func(t *tester) error {
+		return t.rejectsRaw([]byte("not hex at all\n"))
+	}},
+	{"empty message", func(t *tester) error {
+		return t.rejectsRaw([]byte("\n"))
+	}},
+}
+
+// Flips the last bit of msg (the tag of a record, or a coordinate of a key).
+// Returns a copy of msg, flipped.
+func flipLast(msg []byte) []byte {
+	flipped := append([]byte{}, msg...)
+	if len(flipped) > 0 {
+		flipped[len(flipped)-1] ^= 1
+	}
+
+	return flipped
+}
+
+// Returns a tamper that changes the i-th message of the client with change, and leaves the others alone.
+func on(i int, change func(msg []byte) []byte) tamper {
+	return func(h *cerberus.ClientHandshake, j int, msg []byte) [][]byte {
+		if j == i {
+			return [][]byte{change(msg)}
+		}
+		return [][]byte{msg}
+	}
+}
+
+// Connects to the server under test, with the deadline of a scenario.
+// Returns the connection and an error.
+func (t *tester) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", t.addr, t.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(t.timeout))
+
+	return hermes.NewConn(conn), nil
+}
+
+// Runs the handshake of a client logging in as uname, passing every message it sends through tamper (nil to leave them alone).
+// Returns the handshake (to see how far it got), the connection (nil if it couldn't be opened) and the error the handshake ended with.
+func (t *tester) play(uname, passwd string, tamper tamper) (*cerberus.ClientHandshake, net.Conn, error) {
+	return t.run(cerberus.NewClientHandshake([]byte(uname), []byte(passwd), t.cfg), tamper)
+}
+
+// Runs the handshake h (of a client) against the server under test, passing every message it sends through tamper (nil to leave them alone).
+// Returns the handshake, the connection (nil if it couldn't be opened) and the error the handshake ended with.
+func (t *tester) run(h *cerberus.ClientHandshake, tamper tamper) (*cerberus.ClientHandshake, net.Conn, error) {
+	conn, err := t.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var msg []byte
+	for sent := 0; ; {
+		out, err := h.Step(msg)
+		for _, m := range out {
+			send := [][]byte{m}
+			if tamper != nil {
+				send = tamper(h, sent, m)
+			}
+			sent++
+			for _, s := range send {
+				if _, werr := hermes.Write(conn, s); werr != nil && err == nil {
+					err = werr
+				}
+			}
+		}
+		if err != nil || h.State() == cerberus.DONE {
+			return h, conn, err
+		}
+
+		msg, _, err = hermes.Read(conn)
+		if err != nil {
+			return h, conn, err
+		}
+	}
+}
+
+// Logs in, to get a ticket from the server under test.
+// Returns the ticket and an error if the server issued none.
+func (t *tester) ticket() (*cerberus.Ticket, error) {
+	h, conn, err := t.play(t.uname, t.passwd, nil)
+	if conn != nil {
+		conn.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if h.Ticket() == nil {
+		return nil, errors.New("the server issued no ticket")
+	}
+
+	return h.Ticket(), nil
+}
+
+// Checks that the server refuses to log uname in with passwd (with SERVER_FAIL, or an empty salt for unknown users).
+// Returns an error if it doesn't.
+func (t *tester) refused(uname, passwd string) error {
+	_, conn, err := t.play(uname, passwd, nil)
+	if conn != nil {
+		conn.Close()
+	}
+	if !errors.Is(err, cerberus.ErrAuthFailed) {
+		return errors.New("expected the server to refuse the client, got: " + describe(err))
+	}
+
+	return nil
+}
+
+// Checks that the server ends the handshake when tamper gets in the way, never letting the client in.
+// Returns an error if it doesn't.
+func (t *tester) rejects(tamper tamper) error {
+	h, conn, err := t.play(t.uname, t.passwd, tamper)
+	if conn != nil {
+		defer conn.Close()
+	}
+	if h == nil {
+		return err
+	}
+	if h.State() == cerberus.CLIENT_ACCEPTED || h.State() == cerberus.DONE {
+		return errors.New("the server accepted the client")
+	}
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		return errors.New("the server neither refused the client nor hung up")
+	}
+
+	return nil
+}
+
+// Checks that the server hangs up on a client that sends line (in place of its public key).
+// Returns an error if it doesn't.
+func (t *tester) rejectsRaw(line []byte) error {
+	conn, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(line)
+	if err != nil {
+		return err
+	}
+
+	return t.hangsUp(conn)
+}
+
+// Checks that the server closes conn, sending nothing more.
+// Returns an error if it doesn't.
+func (t *tester) hangsUp(conn net.Conn) error {
+	msg, _, err := hermes.Read(conn)
+	if err == nil {
+		return fmt.Errorf("the server answered with %x", msg)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return errors.New("the server didn't hang up")
+	}
+
+	return nil
+}
+
+// Returns what err says, or that there's no error.
+func describe(err error) string {
+	if err == nil {
+		return "no error"
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,78 @@
+// Anubis is the Egyptian god of the underworld, but i used his name because of this: https://en.wikipedia.org/wiki/Anubis_(cipher)
+// Package anubis implements all the cryptography needed for the project.
+package anubis
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// Creates a new Cipher given the key, drawing its nonces from crypto/rand.
+// Returns the Cipher and nil in case of a success, an empty Cipher and an error otherwise.
+func NewCipher(k []byte) (Cipher, error) {
+	return NewCipherWith(k, rand.Reader)
+}
+
+// Creates a new Cipher given the key, drawing its nonces (the one of the session and the one of every message) from random.
+// Returns the Cipher and nil in case of a success, an empty Cipher and an error otherwise.
+func NewCipherWith(k []byte, random io.Reader) (Cipher, error) {
+	if len(k) != BYTE_SEC {
+		return Cipher{}, errors.New("the key must be 32 bytes long")
+	}
+
+	n := make([]byte, BYTE_SEC)
+	_, err := io.ReadFull(random, n)
+	if err != nil {
+		return Cipher{}, err
+	}
+
+	gcm, err := newGCM(k)
+	if err != nil {
+		return Cipher{}, err
+	}
+
+	return Cipher{
+		key:    k,
+		nonce:  n,
+		aead:   gcm,
+		random: random,
+	}, nil
+}
+
+// Creates a new RecordCipher, given the traffic secret the keys of outgoing records come from and the one of incoming ones.
+// Returns the RecordCipher and nil in case of a success, nil and an error otherwise.
+func NewRecordCipher(sendSecret, recvSecret []byte) (*RecordCipher, error) {
+	if len(sendSecret) != BYTE_SEC || len(recvSecret) != BYTE_SEC {
+		return nil, errors.New("the keys must be 32 bytes long")
+	}
+
+	send, sendNext, err := nextTrafficKey(sendSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	recv, recvNext, err := nextTrafficKey(recvSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RecordCipher{
+		send:       send,
+		recv:       recv,
+		sendSecret: sendNext,
+		recvSecret: recvNext,
+	}, nil
+}
+
+// Creates an AES-GCM AEAD from the given key.
+func newGCM(k []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
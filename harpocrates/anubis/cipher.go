@@ -0,0 +1,78 @@
+package anubis
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+type Cipher struct {
+	key    []byte
+	nonce  []byte
+	aead   cipher.AEAD
+	random io.Reader // where the nonces come from
+}
+
+const BYTE_SEC = 32 // 32 * 8 == 256
+
+// Returns the nonce of a Cipher.
+func (c *Cipher) Nonce() []byte {
+	return c.nonce
+}
+
+// Updates the nonce of a given cipher.
+func (c *Cipher) UpdateNonce(newNonce []byte) error {
+	c.nonce = newNonce
+	if string(c.nonce) != string(newNonce) {
+		return errors.New("failed to update the nonce")
+	}
+
+	return nil
+}
+
+// Wrapper around conn.Write() to make sure we send encrypted data over the channel.
+
+// Wrapper around encryption.
+// A fresh random AEAD nonce is drawn for every message and prepended to the ciphertext, so that the receiver doesn't need to know it in advance.
+// Returns the ciphertext and an error (without a fresh nonce there's no way to encrypt safely).
+func (c *Cipher) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err := io.ReadFull(c.random, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Wrapper around decryption.
+func (c *Cipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < c.aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce := ciphertext[:c.aead.NonceSize()]
+
+	return c.aead.Open(nil, nonce, ciphertext[c.aead.NonceSize():], nil)
+}
+
+// Derives the RecordCipher of the session this cipher was agreed on for, on the side of the client (or of the server):
+// each direction gets its own traffic secret, from the key and the nonce of the session.
+// Returns the RecordCipher and an error.
+func (c *Cipher) RecordCipher(client bool) (*RecordCipher, error) {
+	secrets := make([]byte, 2*BYTE_SEC)
+	_, err := io.ReadFull(hkdf.New(sha256.New, c.key, c.nonce, []byte("harpocrates session traffic")), secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(secrets)
+
+	clientSecret, serverSecret := secrets[:BYTE_SEC], secrets[BYTE_SEC:]
+	if client {
+		return NewRecordCipher(clientSecret, serverSecret)
+	}
+
+	return NewRecordCipher(serverSecret, clientSecret)
+}
@@ -1,6 +1,7 @@
 package anubis
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -100,7 +101,11 @@ func Test_encryptDecrypt(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if p, err := c.Decrypt(c.Encrypt(plaintext)); err == nil {
+		ct, err := c.Encrypt(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, err := c.Decrypt(ct); err == nil {
 			if string(p) != string(plaintext) {
 				t.Fatalf("the encryption and decryption are incorrect: expected %s, got %s", string(plaintext), string(p))
 			}
@@ -109,3 +114,20 @@ func Test_encryptDecrypt(t *testing.T) {
 		}
 	}
 }
+
+// Tests that Encrypt fails, rather than panicking, once the randomness runs out.
+func Test_Encrypt_noRandomness(t *testing.T) {
+	key := make([]byte, BYTE_SEC)
+	rand.Read(key)
+
+	// just enough for the nonce of the cipher, none for the one of the message
+	c, err := NewCipherWith(key, bytes.NewReader(make([]byte, BYTE_SEC)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ct, err := c.Encrypt([]byte("testingthetestingtest"))
+	if err == nil {
+		t.Fatalf("encrypted to %x without a nonce", ct)
+	}
+}
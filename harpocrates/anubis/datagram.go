@@ -0,0 +1,242 @@
+package anubis
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// The largest datagram sealed or opened, header and tag included (small enough not to be fragmented on any sane path).
+const MAX_DATAGRAM_SIZE = 1200
+
+// Length of the header of a datagram: the epoch (2 bytes) and the sequence number within it (6 bytes).
+const DATAGRAM_HEADER_SIZE = 8
+
+// The largest plaintext a datagram can carry.
+const MAX_DATAGRAM_PAYLOAD = MAX_DATAGRAM_SIZE - DATAGRAM_HEADER_SIZE - 16
+
+// How many datagrams are sealed with the keys of an epoch before moving to the next one.
+const DATAGRAM_EPOCH_RECORDS = 1 << 24
+
+// How far behind the newest datagram received an older one can be and still be accepted (they can arrive out of order).
+const DATAGRAM_REPLAY_WINDOW = 64
+
+// The largest epoch: it's 2 bytes on the wire.
+const MAX_DATAGRAM_EPOCH = 1<<16 - 1
+
+// A DatagramCipher protects records sent over an unreliable transport, where they can be lost, duplicated or reordered.
+// Unlike a RecordCipher, every datagram carries its epoch and sequence number in the clear (authenticated along with the payload),
+// and the receiver keeps a sliding window of the sequence numbers it saw to reject replays.
+// The keys of each epoch are derived from those of the previous one, which are then wiped: moving to a new epoch rekeys the session.
+type DatagramCipher struct {
+	send      *datagramEpoch
+	sendChain []byte // where the keys of the next send epoch come from
+
+	recv      *datagramEpoch
+	prev      *datagramEpoch // the previous receive epoch, for datagrams sealed before the peer moved on (nil if there's none)
+	next      *datagramEpoch // the next receive epoch, derived in advance (nil until it's needed)
+	recvChain []byte
+}
+
+// The keys and the state of an epoch, in one direction.
+type datagramEpoch struct {
+	epoch  uint16
+	aead   cipher.AEAD
+	seq    uint64 // next sequence number to seal with (send only)
+	window replayWindow
+}
+
+// Creates a new DatagramCipher, given the secrets the keys of each direction are derived from.
+// Returns the DatagramCipher and an error.
+func NewDatagramCipher(sendSecret, recvSecret []byte) (*DatagramCipher, error) {
+	if len(sendSecret) != BYTE_SEC || len(recvSecret) != BYTE_SEC {
+		return nil, errors.New("the secrets must be 32 bytes long")
+	}
+
+	dc := &DatagramCipher{
+		sendChain: append([]byte{}, sendSecret...),
+		recvChain: append([]byte{}, recvSecret...),
+	}
+
+	var err error
+	dc.send, dc.sendChain, err = nextEpoch(dc.sendChain, 0)
+	if err != nil {
+		return nil, err
+	}
+	dc.recv, dc.recvChain, err = nextEpoch(dc.recvChain, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return dc, nil
+}
+
+// Returns the epoch datagrams are sealed in.
+func (dc *DatagramCipher) Epoch() uint16 {
+	return dc.send.epoch
+}
+
+// Moves the sending side to the next epoch, with fresh keys: the peer follows once it gets the first datagram sealed in it.
+// Returns an error if the epochs have been exhausted.
+func (dc *DatagramCipher) Rekey() error {
+	if dc.send.epoch == MAX_DATAGRAM_EPOCH {
+		return errors.New("the epochs are exhausted")
+	}
+
+	next, chain, err := nextEpoch(dc.sendChain, dc.send.epoch+1)
+	if err != nil {
+		return err
+	}
+	wipe(dc.sendChain)
+	dc.send, dc.sendChain = next, chain
+
+	return nil
+}
+
+// Encrypts a datagram with the keys of the current epoch, moving to the next one every DATAGRAM_EPOCH_RECORDS datagrams.
+// Returns the datagram (header included) and an error if the plaintext is too large.
+func (dc *DatagramCipher) Seal(plaintext []byte) ([]byte, error) {
+	if len(plaintext) > MAX_DATAGRAM_PAYLOAD {
+		return nil, errors.New("the datagram is too large")
+	}
+	if dc.send.seq == DATAGRAM_EPOCH_RECORDS {
+		if err := dc.Rekey(); err != nil {
+			return nil, err
+		}
+	}
+
+	header := datagramHeader(dc.send.epoch, dc.send.seq)
+	dc.send.seq++
+
+	return dc.send.aead.Seal(header, seqNonce(binary.BigEndian.Uint64(header), dc.send.aead.NonceSize()), plaintext, header), nil
+}
+
+// Decrypts a datagram, sealed in the current receive epoch, the one before (if it arrived late) or the one after (if the peer rekeyed).
+// Returns the plaintext and an error if the datagram is too large, was tampered with or was already received.
+func (dc *DatagramCipher) Open(datagram []byte) ([]byte, error) {
+	if len(datagram) > MAX_DATAGRAM_SIZE {
+		return nil, errors.New("the datagram is too large")
+	}
+	if len(datagram) < DATAGRAM_HEADER_SIZE {
+		return nil, errors.New("the datagram is too short")
+	}
+	header := datagram[:DATAGRAM_HEADER_SIZE]
+	epoch, seq := parseDatagramHeader(header)
+
+	var e *datagramEpoch
+	switch {
+	case epoch == dc.recv.epoch:
+		e = dc.recv
+	case dc.prev != nil && epoch == dc.prev.epoch:
+		e = dc.prev
+	case epoch == dc.recv.epoch+1 && dc.recv.epoch != MAX_DATAGRAM_EPOCH:
+		if dc.next == nil {
+			next, chain, err := nextEpoch(dc.recvChain, epoch)
+			if err != nil {
+				return nil, err
+			}
+			dc.next = next
+			wipe(dc.recvChain)
+			dc.recvChain = chain
+		}
+		e = dc.next
+	default:
+		return nil, errors.New("the datagram is from an unknown epoch")
+	}
+
+	if !e.window.check(seq) {
+		return nil, errors.New("the datagram was replayed")
+	}
+	plaintext, err := e.aead.Open(nil, seqNonce(binary.BigEndian.Uint64(header), e.aead.NonceSize()), datagram[DATAGRAM_HEADER_SIZE:], header)
+	if err != nil {
+		return nil, err
+	}
+	e.window.update(seq)
+
+	if e == dc.next {
+		// the peer rekeyed: the epoch before the previous one is forgotten, along with its keys
+		dc.prev, dc.recv, dc.next = dc.recv, dc.next, nil
+	}
+
+	return plaintext, nil
+}
+
+// Derives the keys of the given epoch from chain.
+// Returns the epoch, the chain the keys of the one after it come from and an error.
+func nextEpoch(chain []byte, epoch uint16) (*datagramEpoch, []byte, error) {
+	keys := make([]byte, 2*BYTE_SEC)
+	_, err := io.ReadFull(hkdf.New(sha256.New, chain, nil, []byte("harpocrates datagram epoch")), keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(keys[:BYTE_SEC])
+
+	aead, err := newGCM(keys[:BYTE_SEC])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &datagramEpoch{epoch: epoch, aead: aead}, keys[BYTE_SEC:], nil
+}
+
+// Returns the header of the datagram with the given epoch and sequence number.
+func datagramHeader(epoch uint16, seq uint64) []byte {
+	header := make([]byte, DATAGRAM_HEADER_SIZE)
+	binary.BigEndian.PutUint64(header, uint64(epoch)<<48|seq)
+
+	return header
+}
+
+// Returns the epoch and the sequence number in the header of a datagram.
+func parseDatagramHeader(header []byte) (uint16, uint64) {
+	n := binary.BigEndian.Uint64(header)
+
+	return uint16(n >> 48), n & (1<<48 - 1)
+}
+
+// A sliding window over the sequence numbers received, as in IPsec and DTLS:
+// anything newer than the newest one is accepted, anything older only if it's within the window and wasn't seen yet.
+type replayWindow struct {
+	top    uint64 // the newest sequence number received
+	seen   uint64 // bit i is set if top-i was received
+	active bool   // whether anything was received
+}
+
+// Returns whether the datagram with sequence number seq can be accepted.
+func (w *replayWindow) check(seq uint64) bool {
+	if !w.active || seq > w.top {
+		return true
+	}
+	diff := w.top - seq
+	if diff >= DATAGRAM_REPLAY_WINDOW {
+		return false
+	}
+
+	return w.seen&(1<<diff) == 0
+}
+
+// Records that the datagram with sequence number seq was received (it must have passed check()).
+func (w *replayWindow) update(seq uint64) {
+	if !w.active {
+		w.top, w.seen, w.active = seq, 1, true
+		return
+	}
+
+	if seq > w.top {
+		shift := seq - w.top
+		if shift >= DATAGRAM_REPLAY_WINDOW {
+			w.seen = 0
+		} else {
+			w.seen <<= shift
+		}
+		w.seen |= 1
+		w.top = seq
+		return
+	}
+
+	w.seen |= 1 << (w.top - seq)
+}
@@ -0,0 +1,146 @@
+package anubis
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+// Utility function, creates the two ends of a datagram-protected session.
+func newDatagramPair(t *testing.T) (*DatagramCipher, *DatagramCipher) {
+	s1 := make([]byte, BYTE_SEC)
+	rand.Read(s1)
+	s2 := make([]byte, BYTE_SEC)
+	rand.Read(s2)
+
+	a, err := NewDatagramCipher(s1, s2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewDatagramCipher(s2, s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a, b
+}
+
+// Tests the replay window: newer sequence numbers and older ones within the window are accepted once, the ones too old never.
+func Test_replayWindow(t *testing.T) {
+	var w replayWindow
+
+	accept := func(seq uint64, expected bool) {
+		t.Helper()
+		if w.check(seq) != expected {
+			t.Fatalf("check(%d) should be %v", seq, expected)
+		}
+		if expected {
+			w.update(seq)
+		}
+	}
+
+	accept(5, true)
+	accept(5, false)
+	accept(3, true)
+	accept(3, false)
+	accept(100, true)
+	accept(100-DATAGRAM_REPLAY_WINDOW+1, true)
+	accept(100-DATAGRAM_REPLAY_WINDOW, false)
+	accept(5, false)
+	accept(99, true)
+	accept(99, false)
+	accept(1000, true)
+	accept(100, false)
+}
+
+// Tests datagrams opened out of order and across a rekey, including late ones from the previous epoch.
+func Test_DatagramCipher_rekey(t *testing.T) {
+	a, b := newDatagramPair(t)
+
+	var old [][]byte
+	for i := 0; i < 3; i++ {
+		d, err := a.Seal([]byte("before"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		old = append(old, d)
+	}
+	if _, err := b.Open(old[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Rekey(); err != nil {
+		t.Fatal(err)
+	}
+	if a.Epoch() != 1 {
+		t.Fatalf("the epoch should be 1, got %d", a.Epoch())
+	}
+	fresh, err := a.Seal([]byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt, err := b.Open(fresh); err != nil || string(pt) != "after" {
+		t.Fatal("the datagram of the new epoch should be opened", err)
+	}
+	if _, err := b.Open(fresh); err == nil {
+		t.Fatal("the datagram was replayed")
+	}
+
+	// late datagrams of the previous epoch are still fine
+	if pt, err := b.Open(old[0]); err != nil || string(pt) != "before" {
+		t.Fatal("the late datagram should be opened", err)
+	}
+
+	// two epochs ahead is too far, and an epoch the peer left twice is gone
+	a.Rekey()
+	a.Rekey()
+	skipped, _ := a.Seal([]byte("too far"))
+	if _, err := b.Open(skipped); err == nil {
+		t.Fatal("a datagram two epochs ahead shouldn't be opened")
+	}
+	a2, b2 := newDatagramPair(t)
+	first, _ := a2.Seal([]byte("epoch 0"))
+	for i := 0; i < 2; i++ {
+		a2.Rekey()
+		d, _ := a2.Seal([]byte("next"))
+		if _, err := b2.Open(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b2.Open(first); err == nil {
+		t.Fatal("a datagram from two epochs ago shouldn't be opened")
+	}
+}
+
+// Tests that the header is authenticated and that the size limits hold.
+func Test_DatagramCipher_tampering(t *testing.T) {
+	a, b := newDatagramPair(t)
+
+	if _, err := a.Seal(make([]byte, MAX_DATAGRAM_PAYLOAD+1)); err == nil {
+		t.Fatal("a plaintext too large should be rejected")
+	}
+	d, err := a.Seal(make([]byte, MAX_DATAGRAM_PAYLOAD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d) != MAX_DATAGRAM_SIZE {
+		t.Fatalf("the datagram should be %d bytes long, got %d", MAX_DATAGRAM_SIZE, len(d))
+	}
+	if _, err := b.Open(append(d, 0)); err == nil {
+		t.Fatal("a datagram too large should be rejected")
+	}
+
+	// moving the datagram to another sequence number
+	moved := append([]byte{}, d...)
+	moved[DATAGRAM_HEADER_SIZE-1] ^= 1
+	if _, err := b.Open(moved); err == nil {
+		t.Fatal("the header should be authenticated")
+	}
+	if _, err := b.Open(d[:DATAGRAM_HEADER_SIZE-1]); err == nil {
+		t.Fatal("a truncated datagram should be rejected")
+	}
+
+	// the failed attempt didn't mark the sequence number as seen
+	if _, err := b.Open(d); err != nil {
+		t.Fatal(err)
+	}
+}
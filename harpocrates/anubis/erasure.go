@@ -0,0 +1,254 @@
+package anubis
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The most shares a message can be coded into (they're evaluations of a polynomial at distinct non-zero points of GF(256)).
+const MAX_SHARES = 255
+
+// Length of the header of a share, authenticated but not encrypted: the ID of the message (8 bytes), the index of the share, k and n.
+const SHARE_HEADER_SIZE = 8 + 1 + 1 + 1
+
+// Length of a share on top of its data: header, nonce and tag.
+const SHARE_OVERHEAD = SHARE_HEADER_SIZE + 12 + 16
+
+// An ErasureCoder codes messages into n shares, any k of which are enough to get the message back (Reed–Solomon over GF(256)).
+// Every share is encrypted and authenticated on its own, so a share that was tampered with is just one more missing share.
+type ErasureCoder struct {
+	k    int
+	n    int
+	aead cipher.AEAD
+}
+
+// Creates a new ErasureCoder, coding messages into n shares any k of which are enough, with the given key.
+// Returns the ErasureCoder and an error.
+func NewErasureCoder(key []byte, k, n int) (*ErasureCoder, error) {
+	if len(key) != BYTE_SEC {
+		return nil, errors.New("the key must be 32 bytes long")
+	}
+	if k < 1 || k > n || n > MAX_SHARES {
+		return nil, errors.New("invalid number of shares")
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ErasureCoder{k: k, n: n, aead: aead}, nil
+}
+
+// Returns how many shares are enough to get a message back.
+func (ec *ErasureCoder) K() int {
+	return ec.k
+}
+
+// Returns how many shares a message is coded into.
+func (ec *ErasureCoder) N() int {
+	return ec.n
+}
+
+// Codes msg into n shares, each encrypted with the ID of the message, its index, k and n as additional data.
+// Returns the shares and an error.
+func (ec *ErasureCoder) Seal(msg []byte) ([][]byte, error) {
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, err
+	}
+
+	// the length goes first, so that the padding can be told apart from the message
+	size := (4 + len(msg) + ec.k - 1) / ec.k
+	data := make([]byte, ec.k*size)
+	binary.BigEndian.PutUint32(data, uint32(len(msg)))
+	copy(data[4:], msg)
+
+	shares := make([][]byte, ec.n)
+	for i := range shares {
+		header := append(append([]byte{}, id...), byte(i), byte(ec.k), byte(ec.n))
+		nonce := make([]byte, ec.aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+
+		share := rsEncode(data, ec.k, size, byte(i+1))
+		shares[i] = ec.aead.Seal(append(header, nonce...), nonce, share, header)
+		wipe(share)
+	}
+	wipe(data)
+
+	return shares, nil
+}
+
+// Checks and decrypts a share.
+// Returns the ID of its message, its index, its data and an error if it was tampered with or was coded with other parameters.
+func (ec *ErasureCoder) OpenShare(share []byte) (string, int, []byte, error) {
+	if len(share) < SHARE_OVERHEAD {
+		return "", 0, nil, errors.New("the share is too short")
+	}
+	header := share[:SHARE_HEADER_SIZE]
+	index, k, n := int(header[8]), int(header[9]), int(header[10])
+	if k != ec.k || n != ec.n || index >= n {
+		return "", 0, nil, errors.New("the share was coded with other parameters")
+	}
+
+	nonce := share[SHARE_HEADER_SIZE : SHARE_HEADER_SIZE+ec.aead.NonceSize()]
+	data, err := ec.aead.Open(nil, nonce, share[SHARE_HEADER_SIZE+ec.aead.NonceSize():], header)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	return string(header[:8]), index, data, nil
+}
+
+// Gets a message back from (at least) k of its shares, as returned by OpenShare() and indexed by their index.
+// Returns the message and an error if there aren't enough shares or they don't fit together.
+func (ec *ErasureCoder) Join(shares map[int][]byte) ([]byte, error) {
+	if len(shares) < ec.k {
+		return nil, errors.New("not enough shares")
+	}
+
+	var points []byte
+	var rows [][]byte
+	size := -1
+	for index, share := range shares {
+		if index < 0 || index >= ec.n {
+			return nil, errors.New("invalid share index")
+		}
+		if size == -1 {
+			size = len(share)
+		}
+		if len(share) != size {
+			return nil, errors.New("the shares have different sizes")
+		}
+		points = append(points, byte(index+1))
+		rows = append(rows, share)
+		if len(points) == ec.k {
+			break
+		}
+	}
+
+	inv, err := gfInvertVandermonde(points)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, ec.k*size)
+	for t := 0; t < ec.k; t++ {
+		for r := 0; r < ec.k; r++ {
+			c := inv[t][r]
+			for j := 0; j < size; j++ {
+				data[t*size+j] ^= gfMul(c, rows[r][j])
+			}
+		}
+	}
+
+	if len(data) < 4 || int(binary.BigEndian.Uint32(data)) > len(data)-4 {
+		return nil, errors.New("the shares don't fit together")
+	}
+
+	return data[4 : 4+binary.BigEndian.Uint32(data)], nil
+}
+
+// Computes the share at point x: for each column j, the polynomial whose coefficients are data[t*size+j] (t < k) evaluated at x.
+func rsEncode(data []byte, k, size int, x byte) []byte {
+	share := make([]byte, size)
+	// Horner, from the highest coefficient down
+	for t := k - 1; t >= 0; t-- {
+		for j := 0; j < size; j++ {
+			share[j] = gfMul(share[j], x) ^ data[t*size+j]
+		}
+	}
+
+	return share
+}
+
+// Inverts the Vandermonde matrix whose row r is (1, x_r, x_r^2, ...), with Gauss-Jordan elimination.
+// Returns the inverse and an error if two points are the same.
+func gfInvertVandermonde(points []byte) ([][]byte, error) {
+	k := len(points)
+	m := make([][]byte, k)
+	inv := make([][]byte, k)
+	for r, x := range points {
+		m[r] = make([]byte, k)
+		inv[r] = make([]byte, k)
+		inv[r][r] = 1
+		v := byte(1)
+		for t := 0; t < k; t++ {
+			m[r][t] = v
+			v = gfMul(v, x)
+		}
+	}
+
+	for col := 0; col < k; col++ {
+		pivot := -1
+		for r := col; r < k; r++ {
+			if m[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot == -1 {
+			return nil, errors.New("the shares don't fit together")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		c := gfInv(m[col][col])
+		for t := 0; t < k; t++ {
+			m[col][t] = gfMul(m[col][t], c)
+			inv[col][t] = gfMul(inv[col][t], c)
+		}
+		for r := 0; r < k; r++ {
+			if r == col || m[r][col] == 0 {
+				continue
+			}
+			f := m[r][col]
+			for t := 0; t < k; t++ {
+				m[r][t] ^= gfMul(f, m[col][t])
+				inv[r][t] ^= gfMul(f, inv[col][t])
+			}
+		}
+	}
+
+	// so that data[t] = sum_r inv[t][r] * share[r]
+	return inv, nil
+}
+
+// Logarithms and exponentials in GF(256), with the polynomial x^8 + x^4 + x^3 + x^2 + 1.
+var gfLog, gfExp = gfTables()
+
+// Builds the tables of gfLog and gfExp (the exponentials are repeated, so that the sum of two logarithms needs no reduction).
+func gfTables() ([256]byte, [510]byte) {
+	var log [256]byte
+	var exp [510]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		exp[i+255] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+
+	return log, exp
+}
+
+// Multiplies a and b in GF(256).
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// Returns the inverse of a (which mustn't be 0) in GF(256).
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
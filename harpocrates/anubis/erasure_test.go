@@ -0,0 +1,105 @@
+package anubis
+
+import (
+	"bytes"
+	"crypto/rand"
+	mrand "math/rand"
+	"testing"
+)
+
+// Utility function, creates an ErasureCoder with a random key.
+func newErasureCoder(t *testing.T, k, n int) *ErasureCoder {
+	key := make([]byte, BYTE_SEC)
+	rand.Read(key)
+	ec, err := NewErasureCoder(key, k, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ec
+}
+
+// Tests that messages are got back from any k of their shares, dropping random subsets of them.
+func Test_ErasureCoder_drop(t *testing.T) {
+	rng := mrand.New(mrand.NewSource(36))
+
+	for _, kn := range [][2]int{{1, 1}, {1, 3}, {2, 3}, {3, 5}, {4, 10}, {10, 20}} {
+		k, n := kn[0], kn[1]
+		ec := newErasureCoder(t, k, n)
+
+		for _, size := range []int{0, 1, 31, 1000, 4096} {
+			msg := make([]byte, size)
+			rand.Read(msg)
+			sealed, err := ec.Seal(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sealed) != n {
+				t.Fatalf("expected %d shares, got %d", n, len(sealed))
+			}
+
+			for trial := 0; trial < 10; trial++ {
+				// keep a random subset of k shares (or more), drop the others
+				keep := k + rng.Intn(n-k+1)
+				shares := make(map[int][]byte)
+				for _, i := range rng.Perm(n)[:keep] {
+					_, index, data, err := ec.OpenShare(sealed[i])
+					if err != nil {
+						t.Fatal(err)
+					}
+					shares[index] = data
+				}
+
+				got, err := ec.Join(shares)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, msg) {
+					t.Fatalf("k=%d n=%d: the message of %d bytes wasn't got back from %d shares", k, n, size, keep)
+				}
+			}
+
+			if k > 1 {
+				shares := make(map[int][]byte)
+				for _, i := range rng.Perm(n)[:k-1] {
+					_, index, data, _ := ec.OpenShare(sealed[i])
+					shares[index] = data
+				}
+				if _, err := ec.Join(shares); err == nil {
+					t.Fatal("k-1 shares shouldn't be enough")
+				}
+			}
+		}
+	}
+}
+
+// Tests that shares are authenticated, header included, and that only shares coded with the same parameters are accepted.
+func Test_ErasureCoder_tampering(t *testing.T) {
+	ec := newErasureCoder(t, 2, 4)
+	sealed, err := ec.Seal([]byte("a message to be coded"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pos := range []int{0, 8, SHARE_HEADER_SIZE, len(sealed[0]) - 1} {
+		tampered := append([]byte{}, sealed[0]...)
+		tampered[pos] ^= 1
+		if _, _, _, err := ec.OpenShare(tampered); err == nil {
+			t.Fatalf("a share tampered with at byte %d should be rejected", pos)
+		}
+	}
+	if _, _, _, err := ec.OpenShare(sealed[0][:SHARE_OVERHEAD-1]); err == nil {
+		t.Fatal("a truncated share should be rejected")
+	}
+
+	other := newErasureCoder(t, 2, 4)
+	if _, _, _, err := other.OpenShare(sealed[0]); err == nil {
+		t.Fatal("a share sealed with another key should be rejected")
+	}
+	if _, err := NewErasureCoder(make([]byte, BYTE_SEC), 3, 2); err == nil {
+		t.Fatal("k can't be larger than n")
+	}
+	if _, err := NewErasureCoder(make([]byte, BYTE_SEC), 1, MAX_SHARES+1); err == nil {
+		t.Fatal("n can't be larger than MAX_SHARES")
+	}
+}
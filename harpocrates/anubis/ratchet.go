@@ -0,0 +1,483 @@
+package anubis
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The most message keys that can be skipped in a single receiving chain (messages lost or still on their way).
+const MAX_SKIP = 1000
+
+// The most skipped message keys kept at once: when there are more, the oldest are thrown away.
+const MAX_SKIPPED_KEYS = 2000
+
+// Length of the header in front of every ratchet message: the ratchet public key of the sender, the length of its previous sending chain and the number of the message in the current one.
+const RATCHET_HEADER_SIZE = curve25519.PointSize + 4 + 4
+
+// A Ratchet is one end of a Double Ratchet session (https://signal.org/docs/specifications/doubleratchet/).
+// Every message is encrypted with its own key, which is deleted once used: a key stolen today can't decrypt past messages (forward secrecy),
+// and since every round trip mixes in a fresh X25519 exchange, it stops decrypting future messages soon too (post-compromise security).
+// A Ratchet isn't safe for concurrent use.
+type Ratchet struct {
+	id        []byte // identifies the session, the same on both ends
+	ad        []byte // associated data authenticated with every message
+	dhSelf    []byte // our current ratchet private key
+	dhRemote  []byte // the current ratchet public key of the peer (nil until we know it)
+	rootKey   []byte
+	sendChain []byte // nil until we can send
+	recvChain []byte // nil until we received something
+	sendN     uint32
+	recvN     uint32
+	prevN     uint32 // length of the previous sending chain
+	skipped   []skippedKey
+	random    io.Reader // where the new ratchet keys come from (crypto/rand if nil)
+}
+
+// A message key kept for a message that didn't arrive yet.
+type skippedKey struct {
+	Pub []byte
+	N   uint32
+	Key []byte
+}
+
+// What a Ratchet looks like when saved.
+type ratchetState struct {
+	ID        []byte
+	AD        []byte
+	DHSelf    []byte
+	DHRemote  []byte
+	RootKey   []byte
+	SendChain []byte
+	RecvChain []byte
+	SendN     uint32
+	RecvN     uint32
+	PrevN     uint32
+	Skipped   []skippedKey
+}
+
+// Creates the Ratchet of the one who speaks first, given the secret shared with the peer, the associated data and the ratchet public key of the peer.
+// Returns the Ratchet and an error.
+func NewRatchetInitiator(sharedKey, ad, remotePub []byte) (*Ratchet, error) {
+	return NewRatchetInitiatorWith(sharedKey, ad, remotePub, rand.Reader)
+}
+
+// Creates the Ratchet of the one who speaks first, like NewRatchetInitiator(), with its ratchet keys drawn from random (which tests can make deterministic).
+// Returns the Ratchet and an error.
+func NewRatchetInitiatorWith(sharedKey, ad, remotePub []byte, random io.Reader) (*Ratchet, error) {
+	if len(sharedKey) != BYTE_SEC || len(remotePub) != curve25519.PointSize {
+		return nil, errors.New("invalid ratchet keys")
+	}
+
+	dhSelf, err := NewRatchetKeyWith(random)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Ratchet{
+		id:       ratchetID(sharedKey),
+		ad:       append([]byte{}, ad...),
+		dhSelf:   dhSelf,
+		dhRemote: append([]byte{}, remotePub...),
+		random:   random,
+	}
+
+	dh, err := curve25519.X25519(dhSelf, remotePub)
+	if err != nil {
+		return nil, err
+	}
+	r.rootKey, r.sendChain, err = kdfRoot(sharedKey, dh)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Creates the Ratchet of the one who receives the first message, given the secret shared with the peer, the associated data and the ratchet private key whose public key the peer used.
+// The responder can't send anything before receiving the first message.
+// Returns the Ratchet and an error.
+func NewRatchetResponder(sharedKey, ad, dhSelf []byte) (*Ratchet, error) {
+	if len(sharedKey) != BYTE_SEC || len(dhSelf) != curve25519.ScalarSize {
+		return nil, errors.New("invalid ratchet keys")
+	}
+
+	return &Ratchet{
+		id:      ratchetID(sharedKey),
+		ad:      append([]byte{}, ad...),
+		dhSelf:  append([]byte{}, dhSelf...),
+		rootKey: append([]byte{}, sharedKey...),
+	}, nil
+}
+
+// Creates a new X25519 ratchet private key.
+// Returns the key and an error.
+func NewRatchetKey() ([]byte, error) {
+	return NewRatchetKeyWith(rand.Reader)
+}
+
+// Creates a new X25519 ratchet private key, read from random.
+// Returns the key and an error.
+func NewRatchetKeyWith(random io.Reader) ([]byte, error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	_, err := io.ReadFull(random, priv)
+	if err != nil {
+		return nil, err
+	}
+
+	return priv, nil
+}
+
+// Sets where the ratchet keys of the next steps come from (crypto/rand by default, and for a Ratchet loaded with UnmarshalRatchet).
+func (r *Ratchet) SetRand(random io.Reader) {
+	r.random = random
+}
+
+// Returns the public key of a ratchet private key and an error.
+func RatchetPublicKey(priv []byte) ([]byte, error) {
+	return curve25519.X25519(priv, curve25519.Basepoint)
+}
+
+// Loads a Ratchet saved with Marshal.
+// Returns the Ratchet and an error.
+func UnmarshalRatchet(data []byte) (*Ratchet, error) {
+	var s ratchetState
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.DHSelf) != curve25519.ScalarSize || len(s.RootKey) != BYTE_SEC {
+		return nil, errors.New("malformed ratchet state")
+	}
+
+	return &Ratchet{
+		id:        s.ID,
+		ad:        s.AD,
+		dhSelf:    s.DHSelf,
+		dhRemote:  s.DHRemote,
+		rootKey:   s.RootKey,
+		sendChain: s.SendChain,
+		recvChain: s.RecvChain,
+		sendN:     s.SendN,
+		recvN:     s.RecvN,
+		prevN:     s.PrevN,
+		skipped:   s.Skipped,
+	}, nil
+}
+
+// Saves the state of the Ratchet, so that the session survives a restart.
+// The state contains secret keys, so it must be kept as safely as the identity key.
+func (r *Ratchet) Marshal() ([]byte, error) {
+	return json.Marshal(ratchetState{
+		ID:        r.id,
+		AD:        r.ad,
+		DHSelf:    r.dhSelf,
+		DHRemote:  r.dhRemote,
+		RootKey:   r.rootKey,
+		SendChain: r.sendChain,
+		RecvChain: r.recvChain,
+		SendN:     r.sendN,
+		RecvN:     r.recvN,
+		PrevN:     r.prevN,
+		Skipped:   r.skipped,
+	})
+}
+
+// Returns the identifier of the session (the same on both ends).
+func (r *Ratchet) ID() []byte {
+	return r.id
+}
+
+// Returns the associated data the session was created with.
+func (r *Ratchet) AD() []byte {
+	return r.ad
+}
+
+// Encrypts a message with the next key of the sending chain.
+// Returns the header followed by the ciphertext, and an error.
+func (r *Ratchet) Encrypt(plaintext []byte) ([]byte, error) {
+	if r.sendChain == nil {
+		return nil, errors.New("can't send before receiving the first message of the peer")
+	}
+
+	pub, err := RatchetPublicKey(r.dhSelf)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, RATCHET_HEADER_SIZE)
+	copy(header, pub)
+	binary.BigEndian.PutUint32(header[curve25519.PointSize:], r.prevN)
+	binary.BigEndian.PutUint32(header[curve25519.PointSize+4:], r.sendN)
+
+	chain, mk := kdfChain(r.sendChain)
+	defer wipe(mk)
+	wipe(r.sendChain)
+	r.sendChain = chain
+	r.sendN++
+
+	aead, nonce, err := messageAEAD(mk)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(header, nonce, plaintext, append(append([]byte{}, r.ad...), header...)), nil
+}
+
+// Decrypts a message, ratcheting forward if the peer did.
+// If the message can't be decrypted the Ratchet is left as it was, so a forged message can't break the session.
+// Returns the plaintext and an error.
+func (r *Ratchet) Decrypt(msg []byte) ([]byte, error) {
+	if len(msg) < RATCHET_HEADER_SIZE {
+		return nil, errors.New("the ratchet message is too short")
+	}
+	header := msg[:RATCHET_HEADER_SIZE]
+	pub := header[:curve25519.PointSize]
+	pn := binary.BigEndian.Uint32(header[curve25519.PointSize:])
+	n := binary.BigEndian.Uint32(header[curve25519.PointSize+4:])
+	ad := append(append([]byte{}, r.ad...), header...)
+
+	// a message that arrived late
+	for i, sk := range r.skipped {
+		if sk.N == n && bytes.Equal(sk.Pub, pub) {
+			plaintext, err := openMessage(sk.Key, msg[RATCHET_HEADER_SIZE:], ad)
+			if err != nil {
+				return nil, err
+			}
+			wipe(sk.Key)
+			r.skipped = append(r.skipped[:i], r.skipped[i+1:]...)
+			return plaintext, nil
+		}
+	}
+
+	// work on a copy, which replaces the Ratchet only if the message is authentic
+	next := r.clone()
+	if !bytes.Equal(pub, next.dhRemote) {
+		err := next.skipKeys(pn)
+		if err != nil {
+			next.wipe()
+			return nil, err
+		}
+		err = next.dhRatchet(pub)
+		if err != nil {
+			next.wipe()
+			return nil, err
+		}
+	}
+	if next.recvChain == nil {
+		next.wipe()
+		return nil, errors.New("unexpected ratchet message")
+	}
+	err := next.skipKeys(n)
+	if err != nil {
+		next.wipe()
+		return nil, err
+	}
+
+	chain, mk := kdfChain(next.recvChain)
+	defer wipe(mk)
+	wipe(next.recvChain)
+	next.recvChain = chain
+	next.recvN++
+
+	plaintext, err := openMessage(mk, msg[RATCHET_HEADER_SIZE:], ad)
+	if err != nil {
+		next.wipe()
+		return nil, err
+	}
+
+	r.wipe()
+	*r = *next
+
+	return plaintext, nil
+}
+
+// Keeps the keys of the messages of the receiving chain up to (excluding) until, which haven't arrived yet.
+// Returns an error if too many messages would be skipped.
+func (r *Ratchet) skipKeys(until uint32) error {
+	if r.recvChain == nil {
+		return nil
+	}
+	if until > r.recvN+MAX_SKIP {
+		return errors.New("too many skipped messages")
+	}
+
+	for r.recvN < until {
+		chain, mk := kdfChain(r.recvChain)
+		wipe(r.recvChain)
+		r.recvChain = chain
+		r.skipped = append(r.skipped, skippedKey{Pub: r.dhRemote, N: r.recvN, Key: mk})
+		r.recvN++
+	}
+
+	// the oldest messages are the least likely to ever arrive
+	for len(r.skipped) > MAX_SKIPPED_KEYS {
+		wipe(r.skipped[0].Key)
+		r.skipped = r.skipped[1:]
+	}
+
+	return nil
+}
+
+// Takes a step of the DH ratchet, after the peer sent its new ratchet public key.
+func (r *Ratchet) dhRatchet(remotePub []byte) error {
+	r.prevN = r.sendN
+	r.sendN = 0
+	r.recvN = 0
+	r.dhRemote = append([]byte{}, remotePub...)
+
+	dh, err := curve25519.X25519(r.dhSelf, r.dhRemote)
+	if err != nil {
+		return err
+	}
+	rootKey, recvChain, err := kdfRoot(r.rootKey, dh)
+	wipe(dh)
+	if err != nil {
+		return err
+	}
+	wipe(r.rootKey)
+	wipe(r.recvChain)
+	r.rootKey, r.recvChain = rootKey, recvChain
+
+	random := r.random
+	if random == nil {
+		random = rand.Reader
+	}
+	dhSelf, err := NewRatchetKeyWith(random)
+	if err != nil {
+		return err
+	}
+	wipe(r.dhSelf)
+	r.dhSelf = dhSelf
+
+	dh, err = curve25519.X25519(r.dhSelf, r.dhRemote)
+	if err != nil {
+		return err
+	}
+	rootKey, sendChain, err := kdfRoot(r.rootKey, dh)
+	wipe(dh)
+	if err != nil {
+		return err
+	}
+	wipe(r.rootKey)
+	wipe(r.sendChain)
+	r.rootKey, r.sendChain = rootKey, sendChain
+
+	return nil
+}
+
+// Returns a deep copy of the Ratchet.
+func (r *Ratchet) clone() *Ratchet {
+	c := *r
+	c.dhSelf = copyKey(r.dhSelf)
+	c.dhRemote = copyKey(r.dhRemote)
+	c.rootKey = copyKey(r.rootKey)
+	c.sendChain = copyKey(r.sendChain)
+	c.recvChain = copyKey(r.recvChain)
+	c.skipped = make([]skippedKey, len(r.skipped))
+	for i, sk := range r.skipped {
+		c.skipped[i] = skippedKey{Pub: sk.Pub, N: sk.N, Key: copyKey(sk.Key)}
+	}
+
+	return &c
+}
+
+// Overwrites the secret keys of the Ratchet, once it's not needed anymore.
+func (r *Ratchet) wipe() {
+	wipe(r.dhSelf)
+	wipe(r.rootKey)
+	wipe(r.sendChain)
+	wipe(r.recvChain)
+	for _, sk := range r.skipped {
+		wipe(sk.Key)
+	}
+}
+
+// Derives the next root key and a chain key from the current root key and the result of a DH exchange.
+// Returns the root key, the chain key and an error.
+func kdfRoot(rootKey, dh []byte) ([]byte, []byte, error) {
+	kdf := hkdf.New(sha256.New, dh, rootKey, []byte("harpocrates ratchet root"))
+
+	keys := make([]byte, 2*BYTE_SEC)
+	if _, err := io.ReadFull(kdf, keys); err != nil {
+		return nil, nil, err
+	}
+
+	return keys[:BYTE_SEC], keys[BYTE_SEC:], nil
+}
+
+// Derives the next chain key and a message key from the current chain key.
+// Returns the chain key and the message key.
+func kdfChain(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x02})
+	next := mac.Sum(nil)
+
+	mac.Reset()
+	mac.Write([]byte{0x01})
+	mk := mac.Sum(nil)
+
+	return next, mk
+}
+
+// Derives the AEAD and the nonce used with a message key (each message key is used only once, so the nonce can be derived too).
+// Returns the AEAD, the nonce and an error.
+func messageAEAD(mk []byte) (cipher.AEAD, []byte, error) {
+	kdf := hkdf.New(sha256.New, mk, nil, []byte("harpocrates ratchet message"))
+
+	keys := make([]byte, BYTE_SEC+12)
+	if _, err := io.ReadFull(kdf, keys); err != nil {
+		return nil, nil, err
+	}
+	defer wipe(keys[:BYTE_SEC])
+
+	aead, err := newGCM(keys[:BYTE_SEC])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return aead, keys[BYTE_SEC:], nil
+}
+
+// Decrypts the ciphertext of a message with its message key.
+// Returns the plaintext and an error.
+func openMessage(mk, ciphertext, ad []byte) ([]byte, error) {
+	aead, nonce, err := messageAEAD(mk)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
+
+// Derives the identifier of a session from the secret it starts from.
+func ratchetID(sharedKey []byte) []byte {
+	mac := hmac.New(sha256.New, sharedKey)
+	mac.Write([]byte("harpocrates ratchet id"))
+
+	return mac.Sum(nil)
+}
+
+// Returns a copy of a key (nil stays nil).
+func copyKey(k []byte) []byte {
+	if k == nil {
+		return nil
+	}
+
+	return append([]byte{}, k...)
+}
+
+// Overwrites a key with zeros.
+func wipe(k []byte) {
+	for i := range k {
+		k[i] = 0
+	}
+}
@@ -0,0 +1,347 @@
+package anubis
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	mrand "math/rand"
+	"testing"
+)
+
+// Utility function, creates the two ends of a Double Ratchet session (alice speaks first).
+func newRatchetPair(t *testing.T) (*Ratchet, *Ratchet) {
+	sk := make([]byte, BYTE_SEC)
+	rand.Read(sk)
+	ad := []byte("alice and bob")
+
+	bobKey, err := NewRatchetKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobPub, err := RatchetPublicKey(bobKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, err := NewRatchetInitiator(sk, ad, bobPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := NewRatchetResponder(sk, ad, bobKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(alice.ID(), bob.ID()) {
+		t.Fatal("both ends should have the same session id")
+	}
+
+	return alice, bob
+}
+
+// Utility function, encrypts msg with from and checks that to decrypts it.
+func exchange(t *testing.T, from, to *Ratchet, msg string) {
+	t.Helper()
+
+	ct, err := from.Encrypt([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := to.Decrypt(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pt) != msg {
+		t.Fatalf("wrong message: expected %s, got %s", msg, string(pt))
+	}
+}
+
+// Tests a conversation, with both ends taking turns and sending several messages in a row.
+func Test_Ratchet_conversation(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+
+	if _, err := bob.Encrypt([]byte("hi")); err == nil {
+		t.Fatal("bob shouldn't be able to send before receiving the first message")
+	}
+
+	for round := 0; round < 20; round++ {
+		from, to := alice, bob
+		if round%2 == 1 {
+			from, to = bob, alice
+		}
+		for i := 0; i <= round%4; i++ {
+			exchange(t, from, to, fmt.Sprintf("round %d, message %d", round, i))
+		}
+	}
+}
+
+// Tests that messages delivered out of order are decrypted, across several DH ratchet steps.
+func Test_Ratchet_outOfOrder(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+
+	var cts [][]byte
+	var msgs []string
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 10; i++ {
+			msg := fmt.Sprintf("alice %d %d", round, i)
+			ct, err := alice.Encrypt([]byte(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cts = append(cts, ct)
+			msgs = append(msgs, msg)
+		}
+
+		// bob gets the first message of the round, and answers, so that alice ratchets forward
+		pt, err := bob.Decrypt(cts[len(cts)-10])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(pt) != msgs[len(msgs)-10] {
+			t.Fatal("wrong message")
+		}
+		cts = append(cts[:len(cts)-10], cts[len(cts)-9:]...)
+		msgs = append(msgs[:len(msgs)-10], msgs[len(msgs)-9:]...)
+		exchange(t, bob, alice, "ok")
+	}
+
+	// all the other messages arrive shuffled
+	perm := mrand.Perm(len(cts))
+	for _, i := range perm {
+		pt, err := bob.Decrypt(cts[i])
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if string(pt) != msgs[i] {
+			t.Fatalf("wrong message: expected %s, got %s", msgs[i], string(pt))
+		}
+	}
+	if len(bob.skipped) != 0 {
+		t.Fatalf("all skipped keys should have been used, %d are left", len(bob.skipped))
+	}
+}
+
+// Tests that the conversation goes on when messages are lost.
+func Test_Ratchet_lostMessages(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+
+	for round := 0; round < 10; round++ {
+		from, to := alice, bob
+		if round%2 == 1 {
+			from, to = bob, alice
+		}
+		if round == 0 {
+			exchange(t, alice, bob, "hello")
+			continue
+		}
+
+		// a few messages never arrive, before and after one that does
+		for i := 0; i < round; i++ {
+			from.Encrypt([]byte("lost"))
+		}
+		exchange(t, from, to, fmt.Sprintf("round %d", round))
+		from.Encrypt([]byte("lost as well"))
+	}
+
+	// the keys of the lost messages are kept, within the limits
+	if len(alice.skipped) == 0 || len(bob.skipped) == 0 {
+		t.Fatal("the keys of the lost messages should be kept")
+	}
+}
+
+// Tests that too large a gap is refused, without breaking the session.
+func Test_Ratchet_tooManySkipped(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+	exchange(t, alice, bob, "hello")
+
+	for i := 0; i < MAX_SKIP+1; i++ {
+		alice.Encrypt([]byte("lost"))
+	}
+	ct, _ := alice.Encrypt([]byte("too far"))
+	if _, err := bob.Decrypt(ct); err == nil {
+		t.Fatal("skipping more than MAX_SKIP messages should be refused")
+	}
+	if len(bob.skipped) != 0 {
+		t.Fatal("a refused message shouldn't change the state")
+	}
+
+	exchange(t, bob, alice, "still there?")
+}
+
+// Tests that the store of skipped keys doesn't grow past its limit.
+func Test_Ratchet_skippedBound(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+	exchange(t, alice, bob, "hello")
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < MAX_SKIP; i++ {
+			alice.Encrypt([]byte("lost"))
+		}
+		exchange(t, alice, bob, "arrived")
+		exchange(t, bob, alice, "answer")
+	}
+
+	if len(bob.skipped) != MAX_SKIPPED_KEYS {
+		t.Fatalf("expected %d skipped keys, got %d", MAX_SKIPPED_KEYS, len(bob.skipped))
+	}
+}
+
+// Tests that forged or tampered messages are rejected and leave the session working.
+func Test_Ratchet_tampering(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+	exchange(t, alice, bob, "hello")
+
+	ct, _ := bob.Encrypt([]byte("the real message"))
+	for _, i := range []int{0, RATCHET_HEADER_SIZE - 1, RATCHET_HEADER_SIZE, len(ct) - 1} {
+		forged := append([]byte{}, ct...)
+		forged[i] ^= 1
+		if _, err := alice.Decrypt(forged); err == nil {
+			t.Fatalf("a message with byte %d flipped should be rejected", i)
+		}
+	}
+	if _, err := alice.Decrypt(ct[:RATCHET_HEADER_SIZE-1]); err == nil {
+		t.Fatal("a truncated message should be rejected")
+	}
+
+	pt, err := alice.Decrypt(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pt) != "the real message" {
+		t.Fatal("wrong message")
+	}
+}
+
+// Tests that the keys are deleted once used: messages can't be decrypted twice and old chain keys are wiped.
+func Test_Ratchet_keyDeletion(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+
+	first, _ := alice.Encrypt([]byte("first"))
+	second, _ := alice.Encrypt([]byte("second"))
+	if _, err := bob.Decrypt(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Decrypt(first); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ct := range [][]byte{first, second} {
+		if _, err := bob.Decrypt(ct); err == nil {
+			t.Fatal("a message shouldn't be decrypted twice")
+		}
+	}
+
+	// the chain keys of alice are wiped when she ratchets forward
+	sendChain, rootKey, dhSelf := alice.sendChain, alice.rootKey, alice.dhSelf
+	exchange(t, bob, alice, "answer")
+	for _, k := range [][]byte{sendChain, rootKey, dhSelf} {
+		if !bytes.Equal(k, make([]byte, len(k))) {
+			t.Fatal("the old keys should have been wiped")
+		}
+	}
+
+	// and the message keys don't end up in the saved state
+	saved, err := alice.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := UnmarshalRatchet(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restored.Decrypt(first); err == nil {
+		t.Fatal("a restored session shouldn't decrypt old messages")
+	}
+}
+
+// Tests that a session saved in the middle of a conversation (with messages still on their way) goes on after being restored.
+func Test_Ratchet_marshal(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+	exchange(t, alice, bob, "hello")
+	exchange(t, bob, alice, "hi")
+
+	late, _ := alice.Encrypt([]byte("late"))
+	exchange(t, alice, bob, "on time")
+
+	for _, r := range []**Ratchet{&alice, &bob} {
+		saved, err := (*r).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		*r, err = UnmarshalRatchet(saved)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pt, err := bob.Decrypt(late)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pt) != "late" {
+		t.Fatal("wrong message")
+	}
+	for i := 0; i < 5; i++ {
+		exchange(t, bob, alice, "after the restart")
+		exchange(t, alice, bob, "after the restart")
+	}
+
+	if _, err := UnmarshalRatchet([]byte("{}")); err == nil {
+		t.Fatal("an empty state should be refused")
+	}
+}
+
+// Tests that the ratchet keys come from the randomness the Ratchet is given: the same randomness gives the same messages.
+func Test_Ratchet_rand(t *testing.T) {
+	sk := make([]byte, BYTE_SEC)
+	ad := []byte("alice and bob")
+
+	conversation := func(seed int64) [][]byte {
+		random := mrand.New(mrand.NewSource(seed))
+		bobKey, err := NewRatchetKeyWith(random)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bobPub, err := RatchetPublicKey(bobKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice, err := NewRatchetInitiatorWith(sk, ad, bobPub, random)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob, err := NewRatchetResponder(sk, ad, bobKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob.SetRand(random)
+
+		var msgs [][]byte
+		for i, r := range []*Ratchet{alice, bob, alice} {
+			to := bob
+			if r == bob {
+				to = alice
+			}
+			ct, err := r.Encrypt([]byte(fmt.Sprint("message ", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = to.Decrypt(ct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, ct)
+		}
+
+		return msgs
+	}
+
+	first, second := conversation(1), conversation(1)
+	for i := range first {
+		if !bytes.Equal(first[i], second[i]) {
+			t.Fatalf("message %d differs with the same randomness", i)
+		}
+	}
+	if bytes.Equal(first[1], conversation(2)[1]) {
+		t.Fatal("the same message with different randomness")
+	}
+}
@@ -0,0 +1,108 @@
+package anubis
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// A RecordCipher protects the records of a session: each direction has its own key and each record its own nonce, derived from a sequence number.
+// Since the sequence numbers are implicit, records must be opened in the same order they were sealed.
+// The key of each direction comes from a traffic secret, which UpdateSend() and UpdateRecv() ratchet forward (wiping the old one):
+// once both ends updated a direction, the records already sent in it can't be opened anymore, even by someone who gets hold of the new keys.
+type RecordCipher struct {
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	sendSeq uint64
+	recvSeq uint64
+
+	sendSecret []byte // where the next send key comes from
+	recvSecret []byte
+}
+
+// Encrypts a record with the send key.
+// Returns the ciphertext and an error if the sequence numbers have been exhausted.
+func (rc *RecordCipher) Seal(plaintext []byte) ([]byte, error) {
+	if rc.sendSeq == math.MaxUint64 {
+		return nil, errors.New("the send sequence number is exhausted")
+	}
+
+	ciphertext := rc.send.Seal(nil, seqNonce(rc.sendSeq, rc.send.NonceSize()), plaintext, nil)
+	rc.sendSeq++
+
+	return ciphertext, nil
+}
+
+// Decrypts a record with the receive key.
+// Returns the plaintext and an error if the record was tampered with, replayed or reordered.
+func (rc *RecordCipher) Open(ciphertext []byte) ([]byte, error) {
+	if rc.recvSeq == math.MaxUint64 {
+		return nil, errors.New("the receive sequence number is exhausted")
+	}
+
+	plaintext, err := rc.recv.Open(nil, seqNonce(rc.recvSeq, rc.recv.NonceSize()), ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	rc.recvSeq++
+
+	return plaintext, nil
+}
+
+// Moves the sending side to the next key, wiping the secret of the current one: the records sealed from now on need the next key to be opened.
+// The other end has to know when to do the same with UpdateRecv() (hermes sends it a KeyUpdate record, the last one sealed with the old key).
+// Returns an error if the next key couldn't be derived.
+func (rc *RecordCipher) UpdateSend() error {
+	send, secret, err := nextTrafficKey(rc.sendSecret)
+	if err != nil {
+		return err
+	}
+	wipe(rc.sendSecret)
+	rc.send, rc.sendSecret, rc.sendSeq = send, secret, 0
+
+	return nil
+}
+
+// Moves the receiving side to the next key, wiping the secret of the current one: the records of the other end are opened with it from now on.
+// Returns an error if the next key couldn't be derived.
+func (rc *RecordCipher) UpdateRecv() error {
+	recv, secret, err := nextTrafficKey(rc.recvSecret)
+	if err != nil {
+		return err
+	}
+	wipe(rc.recvSecret)
+	rc.recv, rc.recvSecret, rc.recvSeq = recv, secret, 0
+
+	return nil
+}
+
+// Derives a key from a traffic secret, and the secret the next key comes from.
+// Returns the AEAD of the key (the key itself is wiped), the next secret and an error.
+func nextTrafficKey(secret []byte) (cipher.AEAD, []byte, error) {
+	keys := make([]byte, 2*BYTE_SEC)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("harpocrates record traffic")), keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(keys[:BYTE_SEC])
+
+	aead, err := newGCM(keys[:BYTE_SEC])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return aead, keys[BYTE_SEC:], nil
+}
+
+// Builds the nonce of a record from its sequence number (big endian, left padded with zeros).
+func seqNonce(seq uint64, size int) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-8:], seq)
+
+	return nonce
+}
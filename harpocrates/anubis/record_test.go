@@ -0,0 +1,198 @@
+package anubis
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+// Utility function, creates the two ends of a record-protected session.
+func newRecordPair(t *testing.T) (*RecordCipher, *RecordCipher) {
+	k1 := make([]byte, BYTE_SEC)
+	rand.Read(k1)
+	k2 := make([]byte, BYTE_SEC)
+	rand.Read(k2)
+
+	a, err := NewRecordCipher(k1, k2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewRecordCipher(k2, k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a, b
+}
+
+// Tests that records sealed by one end are opened by the other, in both directions.
+func Test_RecordCipher_sealOpen(t *testing.T) {
+	a, b := newRecordPair(t)
+
+	for i := 0; i < 50; i++ {
+		msg := []byte("a message from a to b")
+		ct, err := a.Seal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt, err := b.Open(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(pt) != string(msg) {
+			t.Fatalf("wrong plaintext: expected %s, got %s", string(msg), string(pt))
+		}
+
+		msg = []byte("and one from b to a")
+		ct, err = b.Seal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt, err = a.Open(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(pt) != string(msg) {
+			t.Fatalf("wrong plaintext: expected %s, got %s", string(msg), string(pt))
+		}
+	}
+}
+
+// Tests that two records with the same plaintext never have the same ciphertext.
+func Test_RecordCipher_freshNonces(t *testing.T) {
+	a, _ := newRecordPair(t)
+
+	seen := make(map[string]struct{})
+	for i := 0; i < 100; i++ {
+		ct, err := a.Seal([]byte("same old message"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[string(ct)] = struct{}{}
+	}
+
+	if len(seen) != 100 {
+		t.Fatal("sealing the same plaintext twice produced the same ciphertext")
+	}
+}
+
+// Tests that tampered, replayed and reordered records are rejected.
+func Test_RecordCipher_reject(t *testing.T) {
+	a, b := newRecordPair(t)
+
+	ct, _ := a.Seal([]byte("first"))
+	tampered := append([]byte{}, ct...)
+	tampered[0] ^= 0xff
+	if _, err := b.Open(tampered); err == nil {
+		t.Fatal("a tampered record should be rejected")
+	}
+	if _, err := b.Open(ct); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Open(ct); err == nil {
+		t.Fatal("a replayed record should be rejected")
+	}
+
+	second, _ := a.Seal([]byte("second"))
+	third, _ := a.Seal([]byte("third"))
+	if _, err := b.Open(third); err == nil {
+		t.Fatal("a reordered record should be rejected")
+	}
+	if _, err := b.Open(second); err != nil {
+		t.Fatal(err)
+	}
+
+	// a record can't be reflected back at its sender
+	ct, _ = a.Seal([]byte("reflected"))
+	if _, err := a.Open(ct); err == nil {
+		t.Fatal("a reflected record should be rejected")
+	}
+}
+
+// Tests that keys of the wrong length are refused.
+func Test_NewRecordCipher_invalidKeys(t *testing.T) {
+	for i := 0; i < 40; i++ {
+		k := make([]byte, i)
+		_, err := NewRecordCipher(k, make([]byte, BYTE_SEC))
+		if i == BYTE_SEC {
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else if err == nil {
+			t.Fatalf("keys that are not 32 bytes long must raise an error (got %d)", i)
+		}
+	}
+}
+
+// Tests that records keep flowing across many key updates, in either direction, and that the secrets of the old keys are wiped.
+func Test_RecordCipher_update(t *testing.T) {
+	a, b := newRecordPair(t)
+
+	for i := 0; i < 100; i++ {
+		// a updates every record, b every third
+		old := a.sendSecret
+		if err := a.UpdateSend(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(old, make([]byte, BYTE_SEC)) {
+			t.Fatal("the old secret wasn't wiped")
+		}
+		ct, _ := a.Seal([]byte("from a"))
+		if _, err := b.Open(ct); err == nil {
+			t.Fatal("a record sealed with the next key was opened with the old one")
+		}
+		if err := b.UpdateRecv(); err != nil {
+			t.Fatal(err)
+		}
+		if pt, err := b.Open(ct); err != nil || string(pt) != "from a" {
+			t.Fatalf("update %d: got %q and %v", i, pt, err)
+		}
+
+		if i%3 == 0 {
+			b.UpdateSend()
+			a.UpdateRecv()
+		}
+		ct, _ = b.Seal([]byte("from b"))
+		if pt, err := a.Open(ct); err != nil || string(pt) != "from b" {
+			t.Fatalf("update %d: got %q and %v", i, pt, err)
+		}
+	}
+
+	// a record of before an update can't be opened after it
+	ct, _ := a.Seal([]byte("late"))
+	b.UpdateRecv()
+	if _, err := b.Open(ct); err == nil {
+		t.Fatal("a record sealed with the old key was opened with the next one")
+	}
+}
+
+// Tests that the two ends of a session derive matching record ciphers, which are different for every session.
+func Test_Cipher_RecordCipher(t *testing.T) {
+	key := make([]byte, BYTE_SEC)
+	rand.Read(key)
+	c, err := NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := c.RecordCipher(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := c.RecordCipher(false)
+	for _, ends := range [][2]*RecordCipher{{client, server}, {server, client}} {
+		ct, _ := ends[0].Seal([]byte("hello"))
+		if pt, err := ends[1].Open(ct); err != nil || string(pt) != "hello" {
+			t.Fatalf("got %q and %v", pt, err)
+		}
+	}
+
+	// same key, another nonce
+	client, _ = c.RecordCipher(true)
+	c.UpdateNonce(make([]byte, 64))
+	other, _ := c.RecordCipher(false)
+	ct, _ := client.Seal([]byte("hello"))
+	if _, err := other.Open(ct); err == nil {
+		t.Fatal("two sessions share their keys")
+	}
+}
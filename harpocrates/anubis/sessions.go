@@ -0,0 +1,95 @@
+package anubis
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// How many sessions with the same user are kept: when both start one at the same time, each ends up with two of them until one wins.
+const MAX_SESSIONS = 2
+
+// Sessions are the Double Ratchet sessions with a user, the most recently used first.
+// Messages are sent with the first one, and received with whichever can decrypt them.
+type Sessions struct {
+	ratchets []*Ratchet
+}
+
+// Loads Sessions saved with Marshal (nil or empty data means there are none yet).
+// Returns the Sessions and an error.
+func UnmarshalSessions(data []byte) (*Sessions, error) {
+	s := &Sessions{}
+	if len(data) == 0 {
+		return s, nil
+	}
+
+	var states []json.RawMessage
+	err := json.Unmarshal(data, &states)
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range states {
+		r, err := UnmarshalRatchet(state)
+		if err != nil {
+			return nil, err
+		}
+		s.ratchets = append(s.ratchets, r)
+	}
+
+	return s, nil
+}
+
+// Saves the state of the Sessions, which contains secret keys just like the one of a Ratchet.
+// Returns the state and an error.
+func (s *Sessions) Marshal() ([]byte, error) {
+	states := []json.RawMessage{}
+	for _, r := range s.ratchets {
+		state, err := r.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+
+	return json.Marshal(states)
+}
+
+// Returns whether there's a session to send messages with.
+func (s *Sessions) Empty() bool {
+	return len(s.ratchets) == 0
+}
+
+// Makes r the session messages are sent with, forgetting the oldest session if there are too many.
+func (s *Sessions) Add(r *Ratchet) {
+	s.ratchets = append([]*Ratchet{r}, s.ratchets...)
+	for len(s.ratchets) > MAX_SESSIONS {
+		s.ratchets[len(s.ratchets)-1].wipe()
+		s.ratchets = s.ratchets[:len(s.ratchets)-1]
+	}
+}
+
+// Encrypts a message with the most recently used session.
+// Returns the message and an error.
+func (s *Sessions) Encrypt(plaintext []byte) ([]byte, error) {
+	if len(s.ratchets) == 0 {
+		return nil, errors.New("no session to encrypt with")
+	}
+
+	return s.ratchets[0].Encrypt(plaintext)
+}
+
+// Decrypts a message with whichever session it was sent with, which becomes the one used to answer (so that both ends settle on the same one).
+// Returns the plaintext and an error.
+func (s *Sessions) Decrypt(msg []byte) ([]byte, error) {
+	for i, r := range s.ratchets {
+		plaintext, err := r.Decrypt(msg)
+		if err != nil {
+			continue
+		}
+
+		copy(s.ratchets[1:i+1], s.ratchets[:i])
+		s.ratchets[0] = r
+		return plaintext, nil
+	}
+
+	return nil, errors.New("the message doesn't belong to any session")
+}
@@ -0,0 +1,99 @@
+package anubis
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Tests that two users starting a session with each other at the same time settle on one of them.
+func Test_Sessions_simultaneous(t *testing.T) {
+	alice := newPrekeyOwner(t, time.Now())
+	bob := newPrekeyOwner(t, time.Now())
+	aliceSessions, _ := UnmarshalSessions(nil)
+	bobSessions, _ := UnmarshalSessions(nil)
+
+	// both send their first message before getting the other's
+	ar, toBob, err := X3DHInitiate(alice.identity, bob.bundle, []byte("hi bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceSessions.Add(ar)
+	br, toAlice, err := X3DHInitiate(bob.identity, alice.bundle, []byte("hi alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobSessions.Add(br)
+
+	for _, c := range []struct {
+		owner    *prekeyOwner
+		sessions *Sessions
+		msg      []byte
+	}{{alice, aliceSessions, toAlice}, {bob, bobSessions, toBob}} {
+		r, _, err := X3DHRespond(c.owner.identity, c.owner.signedPrekey, c.owner.oneTime, c.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.sessions.Add(r)
+	}
+
+	// alice answers with bob's session, and bob switches to it
+	for i, from := range []*Sessions{aliceSessions, bobSessions, aliceSessions, bobSessions} {
+		to := bobSessions
+		if from == bobSessions {
+			to = aliceSessions
+		}
+		ct, err := from.Encrypt([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt, err := to.Decrypt(ct)
+		if err != nil || string(pt) != "hello" {
+			t.Fatalf("message %d wasn't decrypted: %v", i, err)
+		}
+	}
+	if !bytes.Equal(aliceSessions.ratchets[0].ID(), bobSessions.ratchets[0].ID()) {
+		t.Fatal("alice and bob should be using the same session")
+	}
+	if !bytes.Equal(aliceSessions.ratchets[0].ID(), br.ID()) {
+		t.Fatal("the session started by bob should have won")
+	}
+}
+
+// Tests that the sessions survive being saved, and that the oldest ones are forgotten.
+func Test_Sessions_marshal(t *testing.T) {
+	s, _ := UnmarshalSessions(nil)
+	if !s.Empty() {
+		t.Fatal("there should be no sessions yet")
+	}
+	if _, err := s.Encrypt([]byte("hi")); err == nil {
+		t.Fatal("there's no session to encrypt with")
+	}
+
+	var peers []*Ratchet
+	for i := 0; i < MAX_SESSIONS+1; i++ {
+		a, b := newRatchetPair(t)
+		s.Add(a)
+		peers = append(peers, b)
+	}
+	if len(s.ratchets) != MAX_SESSIONS {
+		t.Fatalf("expected %d sessions, got %d", MAX_SESSIONS, len(s.ratchets))
+	}
+
+	saved, err := s.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = UnmarshalSessions(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ct, _ := s.Encrypt([]byte("to the last one"))
+	if pt, err := peers[MAX_SESSIONS].Decrypt(ct); err != nil || string(pt) != "to the last one" {
+		t.Fatal("messages should be sent with the last session added", err)
+	}
+	if _, err := UnmarshalSessions([]byte("[{}]")); err == nil {
+		t.Fatal("a malformed state should be refused")
+	}
+}
@@ -0,0 +1,310 @@
+package anubis
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// How old a signed prekey can be before it's considered stale (and refused).
+const MAX_SIGNED_PREKEY_AGE = 30 * 24 * time.Hour
+
+// How far in the future the creation time of a signed prekey can be (the clocks of the users may not agree).
+const MAX_CLOCK_SKEW = 10 * time.Minute
+
+// Length of the header in front of the first message of an X3DH session: the identity key of the sender, its ephemeral key and the ids of the prekeys it used.
+const X3DH_HEADER_SIZE = ed25519.PublicKeySize + curve25519.PointSize + 4 + 4
+
+// A Bundle is what the server hands out about a user, so that others can start a session with it while it's offline (https://signal.org/docs/specifications/x3dh/).
+type Bundle struct {
+	Identity        ed25519.PublicKey
+	SignedPrekeyID  uint32
+	SignedPrekey    []byte // X25519 public key, signed with the identity key
+	Created         time.Time
+	Signature       []byte
+	OneTimePrekeyID uint32 // 0 if the user ran out of one-time prekeys
+	OneTimePrekey   []byte // X25519 public key, handed out only once (nil if the user ran out of them)
+}
+
+// The header of the first message of an X3DH session.
+type X3DHHeader struct {
+	Identity        ed25519.PublicKey
+	Ephemeral       []byte
+	SignedPrekeyID  uint32
+	OneTimePrekeyID uint32 // 0 if no one-time prekey was used
+}
+
+// Signs a prekey with the identity key, binding it to its id and creation time.
+// Returns the signature.
+func SignPrekey(identity ed25519.PrivateKey, id uint32, prekey []byte, created time.Time) []byte {
+	return ed25519.Sign(identity, prekeyMessage(id, prekey, created))
+}
+
+// Checks the signature of a signed prekey (made with the identity key of its owner, over its id, the key and its creation time).
+// Returns true if the signature is valid.
+func VerifyPrekey(identity ed25519.PublicKey, id uint32, prekey []byte, created time.Time, sig []byte) bool {
+	if len(identity) != ed25519.PublicKeySize {
+		return false
+	}
+
+	return ed25519.Verify(identity, prekeyMessage(id, prekey, created), sig)
+}
+
+// Returns whether a signed prekey created at the given time is stale (older than MAX_SIGNED_PREKEY_AGE, or from further in the future than MAX_CLOCK_SKEW).
+func StalePrekey(created time.Time) bool {
+	age := time.Since(created)
+
+	return age > MAX_SIGNED_PREKEY_AGE || age < -MAX_CLOCK_SKEW
+}
+
+// Checks the signature of the signed prekey of a bundle, and that the prekey isn't stale.
+// Returns an error if the bundle can't be used.
+func VerifyBundle(b Bundle) error {
+	if len(b.Identity) != ed25519.PublicKeySize || len(b.SignedPrekey) != curve25519.PointSize {
+		return errors.New("malformed prekey bundle")
+	}
+	if b.OneTimePrekey != nil && (len(b.OneTimePrekey) != curve25519.PointSize || b.OneTimePrekeyID == 0) {
+		return errors.New("malformed prekey bundle")
+	}
+	if !ed25519.Verify(b.Identity, prekeyMessage(b.SignedPrekeyID, b.SignedPrekey, b.Created), b.Signature) {
+		return errors.New("invalid signature of the signed prekey")
+	}
+
+	if StalePrekey(b.Created) {
+		return errors.New("the signed prekey is stale")
+	}
+
+	return nil
+}
+
+// Starts a session with the owner of the bundle and encrypts the first message, which can be delivered while the owner is offline.
+// Returns the Ratchet of the session, the first message (header and ratchet message) and an error.
+func X3DHInitiate(identity ed25519.PrivateKey, b Bundle, plaintext []byte) (*Ratchet, []byte, error) {
+	err := VerifyBundle(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	peerIdentity, err := x25519Public(b.Identity)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeral, err := NewRatchetKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(ephemeral)
+	ephemeralPub, err := RatchetPublicKey(ephemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	own := x25519Private(identity)
+	defer wipe(own)
+
+	// DH1 = DH(IK_A, SPK_B), DH2 = DH(EK_A, IK_B), DH3 = DH(EK_A, SPK_B), DH4 = DH(EK_A, OPK_B)
+	pairs := [][2][]byte{
+		{own, b.SignedPrekey},
+		{ephemeral, peerIdentity},
+		{ephemeral, b.SignedPrekey},
+	}
+	if b.OneTimePrekey != nil {
+		pairs = append(pairs, [2][]byte{ephemeral, b.OneTimePrekey})
+	}
+	sk, err := x3dhSecret(pairs)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(sk)
+
+	ownPub := identity.Public().(ed25519.PublicKey)
+	r, err := NewRatchetInitiator(sk, x3dhAD(ownPub, b.Identity), b.SignedPrekey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := make([]byte, X3DH_HEADER_SIZE)
+	copy(header, ownPub)
+	copy(header[ed25519.PublicKeySize:], ephemeralPub)
+	binary.BigEndian.PutUint32(header[ed25519.PublicKeySize+curve25519.PointSize:], b.SignedPrekeyID)
+	binary.BigEndian.PutUint32(header[ed25519.PublicKeySize+curve25519.PointSize+4:], b.OneTimePrekeyID)
+
+	ct, err := r.Encrypt(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return r, append(header, ct...), nil
+}
+
+// Reads the header of the first message of an X3DH session, to find out which prekeys it was sent to.
+// Returns the header and an error.
+func ParseX3DHHeader(msg []byte) (X3DHHeader, error) {
+	if len(msg) < X3DH_HEADER_SIZE {
+		return X3DHHeader{}, errors.New("the X3DH message is too short")
+	}
+
+	return X3DHHeader{
+		Identity:        ed25519.PublicKey(msg[:ed25519.PublicKeySize]),
+		Ephemeral:       msg[ed25519.PublicKeySize : ed25519.PublicKeySize+curve25519.PointSize],
+		SignedPrekeyID:  binary.BigEndian.Uint32(msg[ed25519.PublicKeySize+curve25519.PointSize:]),
+		OneTimePrekeyID: binary.BigEndian.Uint32(msg[ed25519.PublicKeySize+curve25519.PointSize+4:]),
+	}, nil
+}
+
+// Accepts a session started with one of our bundles, given the private keys of the prekeys named in the header (oneTimePrekey is nil if none was used).
+// The caller must delete the one-time prekey afterwards, so that the first message can't be replayed.
+// Returns the Ratchet of the session, the first message and an error.
+func X3DHRespond(identity ed25519.PrivateKey, signedPrekey, oneTimePrekey []byte, msg []byte) (*Ratchet, []byte, error) {
+	h, err := ParseX3DHHeader(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if (h.OneTimePrekeyID == 0) != (oneTimePrekey == nil) {
+		return nil, nil, errors.New("wrong one-time prekey")
+	}
+
+	peerIdentity, err := x25519Public(h.Identity)
+	if err != nil {
+		return nil, nil, err
+	}
+	own := x25519Private(identity)
+	defer wipe(own)
+
+	pairs := [][2][]byte{
+		{signedPrekey, peerIdentity},
+		{own, h.Ephemeral},
+		{signedPrekey, h.Ephemeral},
+	}
+	if oneTimePrekey != nil {
+		pairs = append(pairs, [2][]byte{oneTimePrekey, h.Ephemeral})
+	}
+	sk, err := x3dhSecret(pairs)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(sk)
+
+	r, err := NewRatchetResponder(sk, x3dhAD(h.Identity, identity.Public().(ed25519.PublicKey)), signedPrekey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the first message is what authenticates the sender
+	plaintext, err := r.Decrypt(msg[X3DH_HEADER_SIZE:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return r, plaintext, nil
+}
+
+// Computes the secret of an X3DH session from the results of the DH exchanges between the given private and public keys.
+// Returns the secret and an error.
+func x3dhSecret(pairs [][2][]byte) ([]byte, error) {
+	// 32 0xFF bytes in front, as in the specification
+	ikm := bytes.Repeat([]byte{0xFF}, 32)
+	defer func() { wipe(ikm) }()
+	for _, pair := range pairs {
+		dh, err := curve25519.X25519(pair[0], pair[1])
+		if err != nil {
+			return nil, err
+		}
+		ikm = append(ikm, dh...)
+		wipe(dh)
+	}
+
+	kdf := hkdf.New(sha256.New, ikm, make([]byte, 32), []byte("harpocrates x3dh"))
+	sk := make([]byte, BYTE_SEC)
+	if _, err := io.ReadFull(kdf, sk); err != nil {
+		return nil, err
+	}
+
+	return sk, nil
+}
+
+// Returns the associated data of a session between two identities: the keys are sorted, so that it's the same as in peer to peer sessions whoever started it.
+func x3dhAD(a, b ed25519.PublicKey) []byte {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+
+	return append(append([]byte{}, a...), b...)
+}
+
+// Returns what the signature of a prekey covers.
+func prekeyMessage(id uint32, prekey []byte, created time.Time) []byte {
+	idBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(idBytes, id)
+	createdBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(createdBytes, uint64(created.Unix()))
+
+	msg := append([]byte("harpocrates prekey"), idBytes...)
+	msg = append(msg, prekey...)
+
+	return append(msg, createdBytes...)
+}
+
+// The prime 2^255 - 19 the curves are defined over.
+var curveP, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// Converts an Ed25519 private key to the X25519 private key with the matching public key (the scalar Ed25519 derives from the seed).
+func x25519Private(priv ed25519.PrivateKey) []byte {
+	h := sha512.Sum512(priv.Seed())
+	s := append([]byte{}, h[:curve25519.ScalarSize]...)
+	wipe(h[:])
+
+	s[0] &= 248
+	s[31] &= 127
+	s[31] |= 64
+
+	return s
+}
+
+// Converts an Ed25519 public key to the matching X25519 public key: u = (1 + y) / (1 - y).
+// Returns the X25519 public key and an error.
+func x25519Public(pub ed25519.PublicKey) ([]byte, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid identity key")
+	}
+
+	// y is encoded in little endian, with the sign of x in the top bit
+	le := append([]byte{}, pub...)
+	le[31] &= 0x7f
+	y := new(big.Int).SetBytes(reverse(le))
+	if y.Cmp(curveP) >= 0 {
+		return nil, errors.New("invalid identity key")
+	}
+
+	one := big.NewInt(1)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, curveP)
+	if den.Sign() == 0 {
+		return nil, errors.New("invalid identity key")
+	}
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, den.ModInverse(den, curveP))
+	u.Mod(u, curveP)
+
+	out := make([]byte, curve25519.PointSize)
+	return reverse(u.FillBytes(out)), nil
+}
+
+// Reverses b in place (big endian to little endian and back).
+// Returns b.
+func reverse(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+
+	return b
+}
@@ -0,0 +1,176 @@
+package anubis
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// Utility function, a user with its identity, signed prekey and one-time prekey.
+type prekeyOwner struct {
+	identity     ed25519.PrivateKey
+	signedPrekey []byte
+	oneTime      []byte
+	bundle       Bundle
+}
+
+// Utility function, creates a user and its bundle (signed at created).
+func newPrekeyOwner(t *testing.T, created time.Time) *prekeyOwner {
+	_, identity, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spk, _ := NewRatchetKey()
+	spkPub, _ := RatchetPublicKey(spk)
+	opk, _ := NewRatchetKey()
+	opkPub, _ := RatchetPublicKey(opk)
+
+	return &prekeyOwner{
+		identity:     identity,
+		signedPrekey: spk,
+		oneTime:      opk,
+		bundle: Bundle{
+			Identity:        identity.Public().(ed25519.PublicKey),
+			SignedPrekeyID:  7,
+			SignedPrekey:    spkPub,
+			Created:         created,
+			Signature:       SignPrekey(identity, 7, spkPub, created),
+			OneTimePrekeyID: 42,
+			OneTimePrekey:   opkPub,
+		},
+	}
+}
+
+// Tests the conversion of identity keys to X25519 keys, against a vector computed independently and against each other.
+func Test_x25519Conversion(t *testing.T) {
+	zero := ed25519.NewKeyFromSeed(make([]byte, 32))
+	pub, err := x25519Public(zero.Public().(ed25519.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(pub) != "5bf55c73b82ebe22be80f3430667af570fae2556a6415e6b30d4065300aa947d" {
+		t.Fatalf("wrong X25519 public key: %x", pub)
+	}
+
+	for i := 0; i < 20; i++ {
+		edPub, edPriv, _ := ed25519.GenerateKey(nil)
+		fromPub, err := x25519Public(edPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromPriv, err := RatchetPublicKey(x25519Private(edPriv))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(fromPub) != hex.EncodeToString(fromPriv) {
+			t.Fatal("the converted public key doesn't match the converted private key")
+		}
+	}
+
+	if _, err := x25519Public(make([]byte, 31)); err == nil {
+		t.Fatal("a 31 bytes identity key should be refused")
+	}
+}
+
+// Tests a session started from a bundle, with and without a one-time prekey.
+func Test_X3DH(t *testing.T) {
+	_, alice, _ := ed25519.GenerateKey(nil)
+
+	for _, withOneTime := range []bool{true, false} {
+		bob := newPrekeyOwner(t, time.Now())
+		opk := bob.oneTime
+		if !withOneTime {
+			bob.bundle.OneTimePrekeyID, bob.bundle.OneTimePrekey, opk = 0, nil, nil
+		}
+
+		ar, msg, err := X3DHInitiate(alice, bob.bundle, []byte("hi bob, are you there?"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h, err := ParseX3DHHeader(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.SignedPrekeyID != 7 || h.OneTimePrekeyID != bob.bundle.OneTimePrekeyID || !h.Identity.Equal(alice.Public()) {
+			t.Fatalf("wrong header: %+v", h)
+		}
+
+		br, pt, err := X3DHRespond(bob.identity, bob.signedPrekey, opk, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(pt) != "hi bob, are you there?" {
+			t.Fatal("wrong first message")
+		}
+
+		// the session goes on as any other
+		exchange(t, br, ar, "yes, I'm back")
+		exchange(t, ar, br, "great")
+		if hex.EncodeToString(ar.ID()) != hex.EncodeToString(br.ID()) {
+			t.Fatal("both ends should have the same session id")
+		}
+	}
+}
+
+// Tests that sessions can't be started with forged or stale bundles.
+func Test_X3DH_badBundle(t *testing.T) {
+	_, alice, _ := ed25519.GenerateKey(nil)
+
+	stale := newPrekeyOwner(t, time.Now().Add(-MAX_SIGNED_PREKEY_AGE-time.Hour))
+	if _, _, err := X3DHInitiate(alice, stale.bundle, nil); err == nil {
+		t.Fatal("a stale signed prekey should be refused")
+	}
+
+	future := newPrekeyOwner(t, time.Now().Add(time.Hour))
+	if _, _, err := X3DHInitiate(alice, future.bundle, nil); err == nil {
+		t.Fatal("a signed prekey from the future should be refused")
+	}
+
+	// the server swapping the signed prekey (or its creation time) is noticed
+	bob := newPrekeyOwner(t, time.Now())
+	mallory := newPrekeyOwner(t, time.Now())
+	forged := bob.bundle
+	forged.SignedPrekey = mallory.bundle.SignedPrekey
+	if _, _, err := X3DHInitiate(alice, forged, nil); err == nil {
+		t.Fatal("a signed prekey that wasn't signed by bob should be refused")
+	}
+	forged = bob.bundle
+	forged.Created = forged.Created.Add(-time.Hour)
+	if _, _, err := X3DHInitiate(alice, forged, nil); err == nil {
+		t.Fatal("a changed creation time should be refused")
+	}
+}
+
+// Tests that the responder rejects first messages it can't authenticate.
+func Test_X3DH_badMessage(t *testing.T) {
+	_, alice, _ := ed25519.GenerateKey(nil)
+	bob := newPrekeyOwner(t, time.Now())
+
+	_, msg, err := X3DHInitiate(alice, bob.bundle, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mallory claims to be alice, but can't compute DH(IK_A, SPK_B)
+	_, mallory, _ := ed25519.GenerateKey(nil)
+	forged := append([]byte{}, msg...)
+	copy(forged, mallory.Public().(ed25519.PublicKey))
+	if _, _, err := X3DHRespond(bob.identity, bob.signedPrekey, bob.oneTime, forged); err == nil {
+		t.Fatal("a message with a swapped identity key should be rejected")
+	}
+
+	// the one-time prekey was used, so it's needed
+	if _, _, err := X3DHRespond(bob.identity, bob.signedPrekey, nil, msg); err == nil {
+		t.Fatal("a message to a one-time prekey can't be read without it")
+	}
+	wrong, _ := NewRatchetKey()
+	if _, _, err := X3DHRespond(bob.identity, bob.signedPrekey, wrong, msg); err == nil {
+		t.Fatal("a message to a one-time prekey can't be read with another one")
+	}
+
+	if _, _, err := X3DHRespond(bob.identity, bob.signedPrekey, bob.oneTime, msg[:X3DH_HEADER_SIZE-1]); err == nil {
+		t.Fatal("a truncated message should be rejected")
+	}
+}
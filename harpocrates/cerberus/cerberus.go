@@ -0,0 +1,99 @@
+// The cerberus package (just as the three-headed dog whose name it has) is responsible for authentication.
+// The handshake of each side is a state machine (ClientHandshake, ServerHandshake): AuthWithServer() and DoMutualAuth() run them over a connection.
+// After logging in, a client can get a Ticket that resumes its session on a new connection (ResumeWithServer()) without deriving its keys again.
+package cerberus
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+)
+
+// Returned when the server refuses our credentials.
+var ErrAuthFailed = errors.New("client authentication failed")
+
+// Looks up the SCRAM credentials of a user.
+// Returns its salt, stored key and server key (all nil if there's no such user) and an error.
+type Credentials func(uname string) ([]byte, []byte, []byte, error)
+
+// Implements the mutual challenge-response auth between server and clients (ECDHE, then SCRAM), on the side of the client (cfg can be nil, for the defaults).
+// Returns the cipher to use for the rest of the session with the server and an error.
+func AuthWithServer(conn net.Conn, uname, passwd []byte, cfg *Config) (anubis.Cipher, error) {
+	cipher, _, err := LoginWithServer(conn, uname, passwd, cfg)
+	return cipher, err
+}
+
+// Same as AuthWithServer(), but keeps the ticket the server issues to resume the session later, with ResumeWithServer().
+// Returns the cipher to use for the rest of the session with the server, the ticket (nil if the server issued none) and an error.
+func LoginWithServer(conn net.Conn, uname, passwd []byte, cfg *Config) (anubis.Cipher, *Ticket, error) {
+	h := NewClientHandshake(uname, passwd, cfg)
+	log := cfg.log()
+	err := drive(conn, h, func(state State) {
+		switch state {
+		case CLIENT_SENT_PROOF:
+			fmt.Fprintln(log, "[+] Challenge successful...")
+		case CLIENT_ACCEPTED:
+			fmt.Fprintln(log, "[+] Client authentication successful...")
+		case DONE:
+			fmt.Fprintln(log, "[+] Server authentication successful...")
+		}
+	})
+	if err != nil {
+		return anubis.Cipher{}, nil, err
+	}
+
+	return h.Cipher(), h.Ticket(), nil
+}
+
+// Resumes the session of ticket with the server instead of logging in again: there's no key derivation, but a fresh ECDHE all the same.
+// cfg can be nil, for the defaults.
+// Returns the cipher to use for the rest of the session, the ticket to resume with next time (nil if the server issued none)
+// and an error (ErrTicketRejected if the server refused the ticket: the client has to log in with its password then, on a new connection).
+func ResumeWithServer(conn net.Conn, ticket *Ticket, cfg *Config) (anubis.Cipher, *Ticket, error) {
+	h := NewResumingHandshake(ticket, cfg)
+	log := cfg.log()
+	err := drive(conn, h, func(state State) {
+		if state == DONE {
+			fmt.Fprintln(log, "[+] Session resumed...")
+		}
+	})
+	if err != nil {
+		return anubis.Cipher{}, nil, err
+	}
+
+	return h.Cipher(), h.Ticket(), nil
+}
+
+// Implements the mutual challenge-response auth between server and clients (ECDHE, then SCRAM), on the side of the server, against the users in DB_FILE.
+// Returns the cipher to use for the rest of the session, the name of the authenticated user and an error.
+func DoMutualAuth(conn net.Conn) (anubis.Cipher, string, error) {
+	return DoMutualAuthWith(conn, UsersFile(DB_FILE), nil)
+}
+
+// Implements the mutual challenge-response auth between server and clients (ECDHE, then SCRAM), on the side of the server, against the users known to creds
+// (cfg can be nil, for the defaults). The clients resume their sessions with the tickets of cfg.Tickets, if there are any.
+// Returns the cipher to use for the rest of the session, the name of the authenticated user and an error.
+func DoMutualAuthWith(conn net.Conn, creds Credentials, cfg *Config) (anubis.Cipher, string, error) {
+	h := NewServerHandshake(creds, cfg)
+	log := cfg.log()
+	err := drive(conn, h, func(state State) {
+		switch state {
+		case SERVER_SENT_CHALLENGE:
+			fmt.Fprintf(log, "\n[+] Initiating auth sequence with %s...\n", h.Username())
+		case SERVER_RESUMED:
+			fmt.Fprintf(log, "\n[+] (%s) Resuming the session with a ticket...\n", h.Username())
+		case SERVER_SENT_SIGNATURE:
+			fmt.Fprintf(log, "[+] (%s) Challenge successful...\n", h.Username())
+			fmt.Fprintf(log, "[+] (%s) Client authentication successful...\n", h.Username())
+		case DONE:
+			fmt.Fprintf(log, "[+] (%s) Server authentication successful...\n", h.Username())
+		}
+	})
+	if err != nil {
+		return anubis.Cipher{}, "", err
+	}
+
+	return h.Cipher(), h.Username(), nil
+}
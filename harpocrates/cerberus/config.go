@@ -0,0 +1,85 @@
+package cerberus
+
+import (
+	"crypto/rand"
+	"io"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// The knobs of a handshake (a nil *Config means the defaults).
+type Config struct {
+	KDF  KDFParams // the one the users were registered with (DEFAULT_KDF if left empty)
+	Rand io.Reader // where the keys and nonces come from (crypto/rand if nil): tests can make a handshake reproducible with it
+
+	// The clock tickets are issued and checked by (time.Now if nil).
+	Now func() time.Time
+	// Issues resumption tickets after a successful login, and lets the clients resume with them (the server issues none if nil).
+	Tickets *Tickets
+	// How the records of the handshake are padded, so that their length gives nothing away (hermes.DEFAULT_PADDING if left empty).
+	Padding hermes.PaddingPolicy
+	// Where the progress of the handshake is reported, a "[+] ..." line at every step (nowhere if nil).
+	Log io.Writer
+}
+
+// Returns the KDF parameters of the config.
+func (c *Config) kdf() KDFParams {
+	if c == nil || c.KDF == (KDFParams{}) {
+		return DEFAULT_KDF
+	}
+
+	return c.KDF
+}
+
+// Returns the source of randomness of the config.
+func (c *Config) random() io.Reader {
+	if c == nil || c.Rand == nil {
+		return rand.Reader
+	}
+
+	return c.Rand
+}
+
+// Returns the clock of the config.
+func (c *Config) clock() func() time.Time {
+	if c == nil || c.Now == nil {
+		return time.Now
+	}
+
+	return c.Now
+}
+
+// Returns where the progress of the handshake is reported.
+func (c *Config) log() io.Writer {
+	if c == nil || c.Log == nil {
+		return io.Discard
+	}
+
+	return c.Log
+}
+
+// Returns the tickets of the config (nil if there are none).
+func (c *Config) tickets() *Tickets {
+	if c == nil {
+		return nil
+	}
+
+	return c.Tickets
+}
+
+// Returns the padding of the config, whose random padding (if any) comes from the randomness of the config.
+func (c *Config) padding() hermes.PaddingPolicy {
+	var padding hermes.PaddingPolicy
+	if c != nil {
+		padding = c.Padding
+	}
+	if padding.Scheme == 0 {
+		padding = hermes.DEFAULT_PADDING
+	}
+	if padding.Rand == nil {
+		padding.Rand = c.random()
+	}
+
+	return padding
+}
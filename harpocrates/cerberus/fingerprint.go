@@ -0,0 +1,87 @@
+package cerberus
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Version of the fingerprint format, hashed together with the key.
+const FINGERPRINT_VERSION = 0
+
+// Number of hash iterations needed to compute a fingerprint (makes looking for a key with a colliding fingerprint expensive).
+const FINGERPRINT_ITERATIONS = 5200
+
+// Creates a new long-term identity key.
+// Returns the private key (the public one is part of it) and an error.
+func NewIdentity() (ed25519.PrivateKey, error) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	return priv, err
+}
+
+// Computes the safety number of two users, Signal style: each user gets a 30 digits fingerprint of its identity key and username, the safety number is the two fingerprints one after the other.
+// The fingerprints are sorted, so both users get the same safety number (and can compare it out of band).
+// Returns the safety number in numeric form (60 digits), in hex form (120 digits) and an error.
+func SafetyNumber(uname string, identity ed25519.PublicKey, peerUname string, peerIdentity ed25519.PublicKey) (string, string, error) {
+	own, err := fingerprint(uname, identity)
+	if err != nil {
+		return "", "", err
+	}
+	peer, err := fingerprint(peerUname, peerIdentity)
+	if err != nil {
+		return "", "", err
+	}
+
+	if bytes.Compare(own, peer) > 0 {
+		own, peer = peer, own
+	}
+
+	numeric := displayable(own) + displayable(peer)
+	hexa := hex.EncodeToString(own) + hex.EncodeToString(peer)
+
+	return numeric, hexa, nil
+}
+
+// Splits a safety number in groups of five digits, for display.
+func FormatSafetyNumber(number string) string {
+	var groups []string
+	for len(number) > 5 {
+		groups = append(groups, number[:5])
+		number = number[5:]
+	}
+
+	return strings.Join(append(groups, number), " ")
+}
+
+// Computes the fingerprint of a user: the first 30 bytes of an iterated SHA-512 over the identity key and the username.
+func fingerprint(uname string, identity ed25519.PublicKey) ([]byte, error) {
+	if len(identity) != ed25519.PublicKeySize {
+		return nil, errors.New("the identity key must be 32 bytes long")
+	}
+
+	version := make([]byte, 2)
+	binary.BigEndian.PutUint16(version, FINGERPRINT_VERSION)
+
+	hash := sha512.Sum512(append(append(version, identity...), []byte(uname)...))
+	for i := 0; i < FINGERPRINT_ITERATIONS; i++ {
+		hash = sha512.Sum512(append(hash[:], identity...))
+	}
+
+	return hash[:30], nil
+}
+
+// Turns a fingerprint into 30 digits: each 5 bytes chunk becomes 5 digits.
+func displayable(fp []byte) string {
+	var digits strings.Builder
+	for i := 0; i+5 <= len(fp); i += 5 {
+		chunk := uint64(fp[i])<<32 | uint64(fp[i+1])<<24 | uint64(fp[i+2])<<16 | uint64(fp[i+3])<<8 | uint64(fp[i+4])
+		fmt.Fprintf(&digits, "%05d", chunk%100000)
+	}
+
+	return digits.String()
+}
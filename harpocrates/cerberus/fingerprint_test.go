@@ -0,0 +1,124 @@
+package cerberus
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+)
+
+// Utility function, the identity key derived from a seed made of the given byte repeated.
+func testIdentity(b byte) ed25519.PublicKey {
+	seed := make([]byte, ed25519.SeedSize)
+	for i := range seed {
+		seed[i] = b
+	}
+
+	return ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+}
+
+// Tests the safety number against fixed vectors (computed independently of this implementation).
+func Test_SafetyNumber_vectors(t *testing.T) {
+	// the seed of alice is all zeros, the one of bob is 00 01 02 ... 1f
+	alice := ed25519.NewKeyFromSeed(make([]byte, 32)).Public().(ed25519.PublicKey)
+	seed := make([]byte, 32)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	bob := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+
+	if hex.EncodeToString(alice) != "3b6a27bcceb6a42d62a3a8d02a6f0d73653215771de243a63ac048a18b59da29" ||
+		hex.EncodeToString(bob) != "03a107bff3ce10be1d70dd18e74bc09967e4d6309ba50d5f1ddc8664125531b8" {
+		t.Fatal("the test identity keys are wrong")
+	}
+
+	vectors := []struct {
+		alice, bob      string
+		numeric, hexnum string
+	}{
+		{
+			"alice", "bob",
+			"997803269216198171084079993307986312955938419234820862496453",
+			"8a0a3a9b04774939cbb46a94ebd286c46978d73462d3df971f365f1ee17baeabd258670a9aabe5379101219e93ba5001f87aa2fe5b755011ee9834e5",
+		},
+	}
+
+	for _, v := range vectors {
+		numeric, hexnum, err := SafetyNumber(v.alice, alice, v.bob, bob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if numeric != v.numeric {
+			t.Fatalf("wrong numeric safety number: expected %s, got %s", v.numeric, numeric)
+		}
+		if hexnum != v.hexnum {
+			t.Fatalf("wrong hex safety number: expected %s, got %s", v.hexnum, hexnum)
+		}
+	}
+
+	fp, err := fingerprint("alice", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(fp) != "8a0a3a9b04774939cbb46a94ebd286c46978d73462d3df971f365f1ee17b" {
+		t.Fatalf("wrong fingerprint for alice: got %s", hex.EncodeToString(fp))
+	}
+	if displayable(fp) != "997803269216198171084079993307" {
+		t.Fatalf("wrong displayable fingerprint for alice: got %s", displayable(fp))
+	}
+}
+
+// Tests that both users compute the same safety number.
+func Test_SafetyNumber_symmetric(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		alice, bob := testIdentity(byte(i)), testIdentity(byte(100+i))
+
+		n1, h1, err := SafetyNumber("alice", alice, "bob", bob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n2, h2, err := SafetyNumber("bob", bob, "alice", alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n1 != n2 || h1 != h2 {
+			t.Fatalf("alice and bob got different safety numbers: %s != %s", n1, n2)
+		}
+		if len(n1) != 60 || len(h1) != 120 {
+			t.Fatalf("the safety number should be 60 digits (120 in hex), got %d (%d)", len(n1), len(h1))
+		}
+	}
+}
+
+// Tests that changing a key (or a username) changes the safety number.
+func Test_SafetyNumber_changes(t *testing.T) {
+	alice, bob, mallory := testIdentity(1), testIdentity(2), testIdentity(3)
+
+	n, _, _ := SafetyNumber("alice", alice, "bob", bob)
+	substituted, _, _ := SafetyNumber("alice", alice, "bob", mallory)
+	renamed, _, _ := SafetyNumber("alice", alice, "bobby", bob)
+
+	if n == substituted {
+		t.Fatal("substituting the key of bob should change the safety number")
+	}
+	if n == renamed {
+		t.Fatal("changing the username of bob should change the safety number")
+	}
+}
+
+// Tests that keys of the wrong length are refused.
+func Test_SafetyNumber_invalidKey(t *testing.T) {
+	_, _, err := SafetyNumber("alice", make([]byte, 31), "bob", testIdentity(2))
+	if err == nil {
+		t.Fatal("a 31 bytes identity key should be refused")
+	}
+}
+
+// Tests the grouping of the digits.
+func Test_FormatSafetyNumber(t *testing.T) {
+	got := FormatSafetyNumber("997803269216198171084079993307")
+	expected := "99780 32692 16198 17108 40799 93307"
+	if got != expected {
+		t.Fatalf("wrong format: expected %s, got %s", expected, got)
+	}
+}
@@ -0,0 +1,131 @@
+package cerberus
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// The seeds in testdata/fuzz were recorded during a real handshake (alice logging in).
+
+// Tests that the server makes sense of whatever name and proof the client sends, without ever taking a made up proof.
+// The nonce at the start of the proof is replaced with the one of the session, so that the fuzzer gets to the proof itself.
+func Fuzz_ServerHandshake(f *testing.F) {
+	privKey, pubKey, err := hermes.NewECDHEKeys(rand.Reader)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add([]byte{}, []byte{})
+	f.Add(make([]byte, 32), make([]byte, 64))
+
+	f.Fuzz(func(t *testing.T, name, proof []byte) {
+		server := NewServerHandshake(testUsers, nil)
+		out, err := server.Step(versioned(pubKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sharedKey, err := hermes.ECDHESharedKey(privKey, out[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		cipher, err := anubis.NewCipher(sharedKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sealed, err := cipher.Encrypt(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := server.Step(sealed); err != nil {
+			return
+		}
+		if server.State() != SERVER_SENT_CHALLENGE {
+			t.Fatalf("the server is in state %s", server.State())
+		}
+
+		authMessage := append([]byte{}, proof...)
+		if len(authMessage) >= 64 {
+			copy(authMessage, server.cipher.Nonce())
+		}
+		sealed, err = cipher.Encrypt(authMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := server.Step(sealed); err == nil {
+			t.Fatalf("the server took %x as the proof of %q", proof, server.Username())
+		}
+	})
+}
+
+// Tests that the client makes sense of whatever challenge the server sends.
+// The client nonce at the start of the challenge is replaced with the real one, so that the fuzzer gets past it.
+func Fuzz_ClientHandshake_challenge(f *testing.F) {
+	_, pubKey, err := hermes.NewECDHEKeys(rand.Reader)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add([]byte{})
+	f.Add(make([]byte, 64))
+
+	f.Fuzz(func(t *testing.T, challenge []byte) {
+		client := NewClientHandshake([]byte("alice"), []byte("alicespass"), testConfig)
+		if _, err := client.Step(nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Step(pubKey); err != nil {
+			t.Fatal(err)
+		}
+
+		sdata := append([]byte{}, challenge...)
+		if len(sdata) >= 32 {
+			copy(sdata, client.cipher.Nonce())
+		}
+		sealed, err := client.cipher.Encrypt(sdata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		salt, snonce, err := client.openChallenge(sealed)
+		if err != nil {
+			return
+		}
+		if len(salt) == 0 || len(snonce) != 64 {
+			t.Fatalf("%x opened to salt %x and nonce %x", sdata, salt, snonce)
+		}
+	})
+}
+
+// Tests the whole handshake of the server against a client that sends whatever it likes: it has to fail, and never hang.
+func Fuzz_DoMutualAuthWith(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte("\n\n\n\n"))
+	f.Add([]byte(hex.EncodeToString(versioned([]byte(RESUME+"not a ticket"))) + "\n"))
+
+	cfg := &Config{Tickets: NewTickets(0, 0, nil)}
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		local, remote := net.Pipe()
+		defer local.Close()
+		go io.Copy(io.Discard, remote)
+		go func() {
+			remote.Write(stream)
+			remote.Close()
+		}()
+
+		local.SetDeadline(time.Now().Add(10 * time.Second))
+		_, uname, err := DoMutualAuthWith(local, testUsers, cfg)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal("the handshake hung")
+		}
+		if err == nil {
+			t.Fatalf("%q logged in with a made up handshake", uname)
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package cerberus
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// Returned by Step() once the handshake is over (done or failed).
+var ErrHandshakeOver = errors.New("the handshake is over")
+
+// The version of the protocol (the handshake and the session after it): the first message of the client starts with it.
+const PROTOCOL_VERSION byte = 1
+
+// What the server answers a client speaking another version of the protocol with, followed by the version it speaks.
+const VERSION_FAIL = "VERSION_FAIL"
+
+// Returned when the other side speaks another version of the protocol.
+var ErrProtocolVersion = errors.New("the other side speaks another version of the protocol")
+
+// A State of the handshake: the client and the server go through their own, in order, to DONE (or to FAILED, from any of them).
+type State int
+
+const (
+	CLIENT_START       State = iota + 1 // nothing sent yet: the client speaks first
+	CLIENT_SENT_KEY                     // sent its ECDHE key, waits for the one of the server
+	CLIENT_SENT_NAME                    // sent the username, waits for the challenge
+	CLIENT_SENT_PROOF                   // answered the challenge, waits for the verdict of the server
+	CLIENT_ACCEPTED                     // the server accepted the proof, waits for its signature
+	CLIENT_SENT_TICKET                  // sent its ticket (and ECDHE key) to resume a session, waits for the server to resume it
+
+	SERVER_START          // waits for the ECDHE key of the client (or its ticket)
+	SERVER_SENT_KEY       // sent its ECDHE key, waits for the username
+	SERVER_SENT_CHALLENGE // waits for the proof
+	SERVER_SENT_SIGNATURE // accepted the proof and signed it, waits for the verdict of the client
+	SERVER_RESUMED        // accepted the ticket and proved it holds its key, waits for the client to confirm
+
+	DONE
+	FAILED
+)
+
+// The states each state can move to (on top of FAILED).
+var transitions = map[State][]State{
+	CLIENT_START:       {CLIENT_SENT_KEY, CLIENT_SENT_TICKET},
+	CLIENT_SENT_KEY:    {CLIENT_SENT_NAME},
+	CLIENT_SENT_NAME:   {CLIENT_SENT_PROOF},
+	CLIENT_SENT_PROOF:  {CLIENT_ACCEPTED},
+	CLIENT_ACCEPTED:    {DONE},
+	CLIENT_SENT_TICKET: {DONE},
+
+	SERVER_START:          {SERVER_SENT_KEY, SERVER_RESUMED},
+	SERVER_SENT_KEY:       {SERVER_SENT_CHALLENGE},
+	SERVER_SENT_CHALLENGE: {SERVER_SENT_SIGNATURE},
+	SERVER_SENT_SIGNATURE: {DONE},
+	SERVER_RESUMED:        {DONE},
+}
+
+var stateNames = map[State]string{
+	CLIENT_START:          "CLIENT_START",
+	CLIENT_SENT_KEY:       "CLIENT_SENT_KEY",
+	CLIENT_SENT_NAME:      "CLIENT_SENT_NAME",
+	CLIENT_SENT_PROOF:     "CLIENT_SENT_PROOF",
+	CLIENT_ACCEPTED:       "CLIENT_ACCEPTED",
+	CLIENT_SENT_TICKET:    "CLIENT_SENT_TICKET",
+	SERVER_START:          "SERVER_START",
+	SERVER_SENT_KEY:       "SERVER_SENT_KEY",
+	SERVER_SENT_CHALLENGE: "SERVER_SENT_CHALLENGE",
+	SERVER_SENT_SIGNATURE: "SERVER_SENT_SIGNATURE",
+	SERVER_RESUMED:        "SERVER_RESUMED",
+	DONE:                  "DONE",
+	FAILED:                "FAILED",
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// A Handshake is one side of the handshake between client and server (ECDHE, then SCRAM, or ECDHE with the key of a ticket), as a state machine that does no I/O:
+// it's fed the messages of the other side, one at a time, and answers with the messages to send back.
+type Handshake interface {
+	// Moves the handshake on with the next message of the other side (nil to start the client).
+	// Returns the messages to send (even along with an error, to tell the other side it failed) and an error, after which the handshake is FAILED.
+	Step(msg []byte) ([][]byte, error)
+	State() State
+	// Returns the cipher of the session, once the handshake is DONE.
+	Cipher() anubis.Cipher
+}
+
+// Moves *state to next, if the transition is allowed.
+// Returns an error otherwise.
+func advance(state *State, next State) error {
+	if next == FAILED {
+		*state = next
+		return nil
+	}
+
+	for _, allowed := range transitions[*state] {
+		if next == allowed {
+			*state = next
+			return nil
+		}
+	}
+
+	return fmt.Errorf("illegal transition from %s to %s", *state, next)
+}
+
+// Runs the handshake h over conn: sends what it says and feeds it what comes back, until it's done.
+// progress is told every state the handshake goes through.
+// Returns an error if the handshake failed (or the connection broke).
+func drive(conn net.Conn, h Handshake, progress func(State)) error {
+	var msg []byte
+	if h.State() != CLIENT_START {
+		var err error
+		msg, _, err = hermes.Read(conn)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		out, err := h.Step(msg)
+		for _, m := range out {
+			if _, werr := hermes.Write(conn, m); werr != nil && err == nil {
+				err = werr
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		progress(h.State())
+		if h.State() == DONE {
+			return nil
+		}
+
+		msg, _, err = hermes.Read(conn)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package cerberus
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+	"github.com/mowzhja/harpocrates/harpocrates/seshat"
+)
+
+// The side of the client of the handshake.
+// Implements SCRAM authentication, as specified in RFC5802, on top of ECDHE (or resumes a session with a ticket, skipping SCRAM).
+type ClientHandshake struct {
+	state   State
+	uname   []byte
+	passwd  []byte
+	kdf     KDFParams
+	random  io.Reader
+	now     func() time.Time
+	padding hermes.PaddingPolicy
+
+	privKey     []byte // the ECDHE private key, until the shared key is computed
+	sessionKey  []byte // the key of the cipher, which the key of the next ticket is derived from
+	cipher      anubis.Cipher
+	authMessage []byte
+	servKey     []byte
+
+	resume *Ticket // the ticket we resume with (nil to log in)
+	hello  []byte  // the first message we sent, when resuming
+	ticket *Ticket // the ticket the server issued
+}
+
+// Creates the handshake of a client logging in as uname (cfg can be nil, for the defaults).
+func NewClientHandshake(uname, passwd []byte, cfg *Config) *ClientHandshake {
+	return &ClientHandshake{
+		state:   CLIENT_START,
+		uname:   uname,
+		passwd:  passwd,
+		kdf:     cfg.kdf(),
+		random:  cfg.random(),
+		now:     cfg.clock(),
+		padding: cfg.padding(),
+	}
+}
+
+// Creates the handshake of a client resuming its session with ticket, instead of logging in (cfg can be nil, for the defaults).
+func NewResumingHandshake(ticket *Ticket, cfg *Config) *ClientHandshake {
+	h := NewClientHandshake([]byte(ticket.Username), nil, cfg)
+	h.resume = ticket
+
+	return h
+}
+
+// Returns the state the handshake is in.
+func (h *ClientHandshake) State() State {
+	return h.state
+}
+
+// Returns the cipher of the session (left with the shared client-server nonce), once the handshake is DONE.
+func (h *ClientHandshake) Cipher() anubis.Cipher {
+	return h.cipher
+}
+
+// Returns the ticket the server issued for resuming the session later, once the handshake is DONE (nil if it issued none).
+func (h *ClientHandshake) Ticket() *Ticket {
+	return h.ticket
+}
+
+// Moves the handshake on with the next message of the server (nil to start it).
+// Returns the messages to send to the server and an error.
+func (h *ClientHandshake) Step(msg []byte) ([][]byte, error) {
+	if h.state == DONE || h.state == FAILED {
+		return nil, ErrHandshakeOver
+	}
+
+	out, next, err := h.step(msg)
+	if err != nil {
+		h.state = FAILED
+		return out, err
+	}
+
+	return out, advance(&h.state, next)
+}
+
+// Handles msg in the current state.
+// Returns the messages to send, the next state and an error.
+func (h *ClientHandshake) step(msg []byte) ([][]byte, State, error) {
+	if (h.state == CLIENT_START) != (msg == nil) {
+		return nil, FAILED, errors.New("the client speaks first, and only then")
+	}
+
+	switch h.state {
+	case CLIENT_START:
+		if h.resume != nil {
+			return h.startResuming()
+		}
+
+		privKey, pubKey, err := hermes.NewECDHEKeys(h.random)
+		if err != nil {
+			return nil, FAILED, err
+		}
+		h.privKey = privKey
+
+		return [][]byte{versioned(pubKey)}, CLIENT_SENT_KEY, nil
+
+	case CLIENT_SENT_KEY:
+		if err := checkVersion(msg); err != nil {
+			return nil, FAILED, err
+		}
+		sharedKey, err := hermes.ECDHESharedKey(h.privKey, msg)
+		if err != nil {
+			return nil, FAILED, err
+		}
+		h.privKey = nil
+		h.sessionKey = sharedKey
+
+		h.cipher, err = anubis.NewCipherWith(sharedKey, h.random)
+		if err != nil {
+			return nil, FAILED, err
+		}
+
+		// the username goes along with our nonce
+		record, err := hermes.SealRecord(h.cipher, h.uname, h.padding)
+		if err != nil {
+			return nil, FAILED, err
+		}
+
+		return [][]byte{record}, CLIENT_SENT_NAME, nil
+
+	case CLIENT_SENT_NAME:
+		salt, snonce, err := h.openChallenge(msg)
+		if err != nil {
+			return nil, FAILED, err
+		}
+
+		// from this point forth the nonce is 64 bytes long (client + server)
+		err = h.cipher.UpdateNonce(snonce)
+		if err != nil {
+			return nil, FAILED, err
+		}
+
+		h.authMessage, h.servKey, _, err = computeParams(h.kdf, h.passwd, salt, h.cipher.Nonce())
+		if err != nil {
+			return nil, FAILED, err
+		}
+
+		proof, err := h.cipher.Encrypt(h.authMessage)
+		if err != nil {
+			return nil, FAILED, err
+		}
+
+		return [][]byte{proof}, CLIENT_SENT_PROOF, nil
+
+	case CLIENT_SENT_PROOF:
+		resp, err := hermes.OpenRecord(h.cipher, msg)
+		if err != nil {
+			return nil, FAILED, err
+		}
+		if string(resp) != "SERVER_OK" {
+			return nil, FAILED, ErrAuthFailed
+		}
+
+		return nil, CLIENT_ACCEPTED, nil
+
+	case CLIENT_ACCEPTED:
+		resp, err := hermes.OpenRecord(h.cipher, msg)
+		if err != nil {
+			return nil, FAILED, err
+		}
+		// the ticket (if any) comes along with the signature
+		serverSignature, ticket, lifetime, err := splitTicket(resp)
+		if err != nil {
+			return nil, FAILED, err
+		}
+		expectedSignature, err := seshat.GetServerSignature(h.authMessage, h.servKey)
+		if err != nil {
+			return nil, FAILED, err
+		}
+
+		if subtle.ConstantTimeCompare(expectedSignature, serverSignature) != 1 {
+			err = errors.New("error authenticating the server (signatures don't match)")
+			fail, serr := hermes.SealRecord(h.cipher, []byte("CLIENT_FAIL"), h.padding)
+			if serr != nil {
+				// the server isn't told, but it was refused all the same
+				return nil, FAILED, err
+			}
+			return [][]byte{fail}, FAILED, err
+		}
+		h.keepTicket(ticket, lifetime, h.authMessage)
+
+		ok, err := hermes.SealRecord(h.cipher, []byte("CLIENT_OK"), h.padding)
+		if err != nil {
+			return nil, FAILED, err
+		}
+
+		return [][]byte{ok}, DONE, nil
+
+	case CLIENT_SENT_TICKET:
+		return h.finishResuming(msg)
+	}
+
+	return nil, FAILED, errors.New("unknown state " + h.state.String())
+}
+
+// Opens the challenge of the server.
+// Returns the salt, the client-server nonce and an error if anything went wrong.
+func (h *ClientHandshake) openChallenge(msg []byte) ([]byte, []byte, error) {
+	sdata, err := h.cipher.Decrypt(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	salt, snonce, err := seshat.ExtractDataNonce(sdata, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	if subtle.ConstantTimeCompare(snonce[:32], h.cipher.Nonce()) != 1 {
+		return nil, nil, errors.New("the server used the incorrect client nonce")
+	}
+	if len(salt) == 0 {
+		// the server doesn't know us
+		return nil, nil, ErrAuthFailed
+	}
+
+	return salt, snonce, nil
+}
+
+// Starts resuming the session of the ticket: sends it along with our nonce, our ECDHE key and the binder that proves we hold its key.
+// Returns the messages to send, the next state and an error.
+func (h *ClientHandshake) startResuming() ([][]byte, State, error) {
+	if !h.now().Before(h.resume.Expires) {
+		return nil, FAILED, ErrTicketExpired
+	}
+
+	privKey, pubKey, err := hermes.NewECDHEKeys(h.random)
+	if err != nil {
+		return nil, FAILED, err
+	}
+	h.privKey = privKey
+
+	cnonce := make([]byte, 32)
+	_, err = io.ReadFull(h.random, cnonce)
+	if err != nil {
+		return nil, FAILED, err
+	}
+
+	binder := resumeBinder(h.resume.psk, cnonce, pubKey, h.resume.blob)
+	h.hello = seshat.MergeChunks([]byte(RESUME), cnonce, pubKey, binder, h.resume.blob)
+
+	return [][]byte{versioned(h.hello)}, CLIENT_SENT_TICKET, nil
+}
+
+// Finishes resuming the session with the answer of the server: its ECDHE key, its nonce, and the proof that it holds the key of the ticket
+// (along with a new ticket).
+// Returns the messages to send, the next state and an error (ErrTicketRejected if the server refused the ticket).
+func (h *ClientHandshake) finishResuming(msg []byte) ([][]byte, State, error) {
+	if string(msg) == RESUME_FAIL {
+		return nil, FAILED, ErrTicketRejected
+	}
+	if err := checkVersion(msg); err != nil {
+		return nil, FAILED, err
+	}
+	if len(msg) < hermes.ECDHE_KEY_SIZE+32 {
+		return nil, FAILED, errors.New("the answer of the server is too short")
+	}
+	pubKey, snonce, record := msg[:hermes.ECDHE_KEY_SIZE], msg[hermes.ECDHE_KEY_SIZE:hermes.ECDHE_KEY_SIZE+32], msg[hermes.ECDHE_KEY_SIZE+32:]
+
+	sharedKey, err := hermes.ECDHESharedKey(h.privKey, pubKey)
+	if err != nil {
+		return nil, FAILED, err
+	}
+	h.privKey = nil
+
+	nonce := seshat.MergeChunks(h.hello[len(RESUME):len(RESUME)+32], snonce)
+	h.sessionKey = resumedKey(h.resume.psk, sharedKey, nonce)
+	h.cipher, err = anubis.NewCipherWith(h.sessionKey, h.random)
+	if err != nil {
+		return nil, FAILED, err
+	}
+	err = h.cipher.UpdateNonce(nonce)
+	if err != nil {
+		return nil, FAILED, err
+	}
+
+	resp, err := hermes.OpenRecord(h.cipher, record)
+	if err != nil {
+		return nil, FAILED, err
+	}
+	finished, ticket, lifetime, err := splitTicket(resp)
+	if err != nil {
+		return nil, FAILED, err
+	}
+	if !hmac.Equal(finished, resumeFinished(h.resume.psk, h.hello, pubKey, snonce)) {
+		return nil, FAILED, errors.New("error authenticating the server (it doesn't hold the key of the ticket)")
+	}
+	h.keepTicket(ticket, lifetime, nonce)
+
+	ok, err := hermes.SealRecord(h.cipher, []byte("CLIENT_OK"), h.padding)
+	if err != nil {
+		return nil, FAILED, err
+	}
+
+	return [][]byte{ok}, DONE, nil
+}
+
+// Keeps the ticket the server issued (if it did), whose key is bound to the session by binding.
+func (h *ClientHandshake) keepTicket(ticket []byte, lifetime time.Duration, binding []byte) {
+	if ticket == nil {
+		return
+	}
+
+	h.ticket = &Ticket{
+		Username: string(h.uname),
+		Expires:  h.now().Add(lifetime),
+		blob:     ticket,
+		psk:      resumptionKey(h.sessionKey, binding),
+	}
+}
+
+// Returns the first message of the handshake, msg after the version of the protocol.
+func versioned(msg []byte) []byte {
+	return append([]byte{PROTOCOL_VERSION}, msg...)
+}
+
+// Checks whether the first answer of the server says that it speaks another version of the protocol.
+// Returns ErrProtocolVersion (along with the version of the server) if it does.
+func checkVersion(msg []byte) error {
+	if len(msg) == len(VERSION_FAIL)+1 && string(msg[:len(VERSION_FAIL)]) == VERSION_FAIL {
+		return fmt.Errorf("%w (we speak version %d, the server %d)", ErrProtocolVersion, PROTOCOL_VERSION, msg[len(VERSION_FAIL)])
+	}
+
+	return nil
+}
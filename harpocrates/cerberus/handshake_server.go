@@ -0,0 +1,320 @@
+package cerberus
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"io"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+	"github.com/mowzhja/harpocrates/harpocrates/seshat"
+)
+
+// The side of the server of the handshake.
+// Implements SCRAM authentication, as specified in RFC5802, on top of ECDHE (or resumes the session of a ticket it issued, skipping SCRAM).
+type ServerHandshake struct {
+	state   State
+	creds   Credentials
+	random  io.Reader
+	tickets *Tickets
+	padding hermes.PaddingPolicy
+
+	sessionKey []byte // the key of the cipher, which the key of the ticket is derived from
+	cipher     anubis.Cipher
+	uname      string
+	storedKey  []byte
+	servKey    []byte
+}
+
+// Creates the handshake of the server, checking the client against the users known to creds (the only thing it calls out to).
+// cfg can be nil, for the defaults.
+func NewServerHandshake(creds Credentials, cfg *Config) *ServerHandshake {
+	return &ServerHandshake{
+		state:   SERVER_START,
+		creds:   creds,
+		random:  cfg.random(),
+		tickets: cfg.tickets(),
+		padding: cfg.padding(),
+	}
+}
+
+// Returns the state the handshake is in.
+func (h *ServerHandshake) State() State {
+	return h.state
+}
+
+// Returns the cipher of the session (left with the shared client-server nonce), once the handshake is DONE.
+func (h *ServerHandshake) Cipher() anubis.Cipher {
+	return h.cipher
+}
+
+// Returns the name the client claims to have (it's authenticated only once the handshake is DONE).
+func (h *ServerHandshake) Username() string {
+	return h.uname
+}
+
+// Moves the handshake on with the next message of the client.
+// Returns the messages to send to the client and an error.
+func (h *ServerHandshake) Step(msg []byte) ([][]byte, error) {
+	if h.state == DONE || h.state == FAILED {
+		return nil, ErrHandshakeOver
+	}
+
+	out, next, err := h.step(msg)
+	if err != nil {
+		h.state = FAILED
+		return out, err
+	}
+
+	return out, advance(&h.state, next)
+}
+
+// Handles msg in the current state.
+// Returns the messages to send, the next state and an error.
+func (h *ServerHandshake) step(msg []byte) ([][]byte, State, error) {
+	if msg == nil {
+		return nil, FAILED, errors.New("the client speaks first")
+	}
+
+	switch h.state {
+	case SERVER_START:
+		if len(msg) == 0 {
+			return nil, FAILED, errors.New("empty message")
+		}
+		if msg[0] != PROTOCOL_VERSION {
+			return [][]byte{append([]byte(VERSION_FAIL), PROTOCOL_VERSION)}, FAILED, ErrProtocolVersion
+		}
+		msg = msg[1:]
+
+		if bytes.HasPrefix(msg, []byte(RESUME)) {
+			return h.resume(msg)
+		}
+
+		privKey, pubKey, err := hermes.NewECDHEKeys(h.random)
+		if err != nil {
+			return nil, FAILED, err
+		}
+		sharedKey, err := hermes.ECDHESharedKey(privKey, msg)
+		if err != nil {
+			return nil, FAILED, err
+		}
+		h.sessionKey = sharedKey
+
+		h.cipher, err = anubis.NewCipherWith(sharedKey, h.random)
+		if err != nil {
+			return nil, FAILED, err
+		}
+
+		return [][]byte{pubKey}, SERVER_SENT_KEY, nil
+
+	case SERVER_SENT_KEY:
+		cdata, err := h.cipher.Decrypt(msg) // client nonce and username
+		if err != nil {
+			return nil, FAILED, err
+		}
+		padded, cnonce, err := seshat.ExtractDataNonce(cdata, 32)
+		if err != nil {
+			return nil, FAILED, err
+		}
+		uname, err := hermes.Unpad(padded)
+		if err != nil {
+			return nil, FAILED, err
+		}
+		h.uname = string(uname)
+
+		// suppose client and server agree on the KDF parameters already
+		salt, storedKey, servKey, err := h.creds(h.uname)
+		if err != nil {
+			return nil, FAILED, err
+		}
+		h.storedKey, h.servKey = storedKey, servKey
+
+		snonce := make([]byte, 32)
+		_, err = io.ReadFull(h.random, snonce)
+		if err != nil {
+			return nil, FAILED, err
+		}
+		// nonce used for the rest of the authentication procedure (by both client and server)
+		err = h.cipher.UpdateNonce(seshat.MergeChunks(cnonce, snonce))
+		if err != nil {
+			return nil, FAILED, err
+		}
+
+		// an unknown user gets an empty salt, and gives up
+		challenge, err := h.cipher.Encrypt(seshat.MergeChunks(h.cipher.Nonce(), salt))
+		if err != nil {
+			return nil, FAILED, err
+		}
+
+		return [][]byte{challenge}, SERVER_SENT_CHALLENGE, nil
+
+	case SERVER_SENT_CHALLENGE:
+		authMessage, err := h.cipher.Decrypt(msg)
+		if err != nil {
+			return nil, FAILED, err
+		}
+		clientProof, nonce, err := seshat.ExtractDataNonce(authMessage, 64)
+		if err != nil {
+			return nil, FAILED, err
+		}
+		if subtle.ConstantTimeCompare(nonce, h.cipher.Nonce()) != 1 {
+			return nil, FAILED, errors.New("the client and server nonces don't match")
+		}
+
+		err = authClient(clientProof, nonce, h.storedKey)
+		if err != nil {
+			fail, serr := hermes.SealRecord(h.cipher, []byte("SERVER_FAIL"), h.padding)
+			if serr != nil {
+				// the client isn't told, but it was refused all the same
+				return nil, FAILED, err
+			}
+			return [][]byte{fail}, FAILED, err
+		}
+
+		serverSignature, err := seshat.GetServerSignature(seshat.MergeChunks(nonce, clientProof), h.servKey)
+		if err != nil {
+			return nil, FAILED, err
+		}
+		// the client is authenticated: it gets a ticket along with the signature
+		serverSignature, err = h.attachTicket(serverSignature, authMessage)
+		if err != nil {
+			return nil, FAILED, err
+		}
+
+		ok, err := hermes.SealRecord(h.cipher, []byte("SERVER_OK"), h.padding)
+		if err != nil {
+			return nil, FAILED, err
+		}
+		signature, err := hermes.SealRecord(h.cipher, serverSignature, h.padding)
+		if err != nil {
+			return nil, FAILED, err
+		}
+
+		return [][]byte{ok, signature}, SERVER_SENT_SIGNATURE, nil
+
+	case SERVER_SENT_SIGNATURE, SERVER_RESUMED:
+		resp, err := hermes.OpenRecord(h.cipher, msg)
+		if err != nil {
+			return nil, FAILED, err
+		}
+		if string(resp) != "CLIENT_OK" {
+			return nil, FAILED, errors.New("server authentication failed")
+		}
+
+		return nil, DONE, nil
+	}
+
+	return nil, FAILED, errors.New("unknown state " + h.state.String())
+}
+
+// Resumes the session of the ticket the client sent (along with its nonce, its ECDHE key and the binder proving it holds the key of the ticket).
+// Returns the messages to send, the next state and an error: a ticket that can't be used is answered with RESUME_FAIL, for the client to log in instead.
+func (h *ServerHandshake) resume(msg []byte) ([][]byte, State, error) {
+	refuse := [][]byte{[]byte(RESUME_FAIL)}
+	if h.tickets == nil {
+		return refuse, FAILED, errors.New("the server issues no tickets")
+	}
+
+	hello := msg[len(RESUME):]
+	if len(hello) <= 32+hermes.ECDHE_KEY_SIZE+32 {
+		return refuse, FAILED, errors.New("the ticket is missing")
+	}
+	cnonce, pubKey := hello[:32], hello[32:32+hermes.ECDHE_KEY_SIZE]
+	binder, ticket := hello[32+hermes.ECDHE_KEY_SIZE:64+hermes.ECDHE_KEY_SIZE], hello[64+hermes.ECDHE_KEY_SIZE:]
+
+	state, err := h.tickets.open(ticket)
+	if err != nil {
+		return refuse, FAILED, err
+	}
+	if !hmac.Equal(binder, resumeBinder(state.psk, cnonce, pubKey, ticket)) {
+		return refuse, FAILED, errors.New("the binder of the ticket doesn't match")
+	}
+	err = h.tickets.use(state)
+	if err != nil {
+		return refuse, FAILED, err
+	}
+	// the user could have been removed since the ticket was issued
+	salt, _, _, err := h.creds(state.uname)
+	if err != nil {
+		return nil, FAILED, err
+	}
+	if len(salt) == 0 {
+		return refuse, FAILED, errors.New("the user of the ticket is unknown")
+	}
+	h.uname = state.uname
+
+	privKey, serverPub, err := hermes.NewECDHEKeys(h.random)
+	if err != nil {
+		return nil, FAILED, err
+	}
+	sharedKey, err := hermes.ECDHESharedKey(privKey, pubKey)
+	if err != nil {
+		return refuse, FAILED, err
+	}
+	snonce := make([]byte, 32)
+	_, err = io.ReadFull(h.random, snonce)
+	if err != nil {
+		return nil, FAILED, err
+	}
+
+	nonce := seshat.MergeChunks(cnonce, snonce)
+	h.sessionKey = resumedKey(state.psk, sharedKey, nonce)
+	h.cipher, err = anubis.NewCipherWith(h.sessionKey, h.random)
+	if err != nil {
+		return nil, FAILED, err
+	}
+	err = h.cipher.UpdateNonce(nonce)
+	if err != nil {
+		return nil, FAILED, err
+	}
+
+	// the ticket is used up (if it was single-use): the client gets a new one
+	resp, err := h.attachTicket(resumeFinished(state.psk, msg, serverPub, snonce), nonce)
+	if err != nil {
+		return nil, FAILED, err
+	}
+
+	record, err := hermes.SealRecord(h.cipher, resp, h.padding)
+	if err != nil {
+		return nil, FAILED, err
+	}
+
+	return [][]byte{seshat.MergeChunks(serverPub, snonce, record)}, SERVER_RESUMED, nil
+}
+
+// Issues a ticket for the client to resume its session with later, whose key is bound to the session by binding.
+// Returns proof with the ticket appended (as it is if the server issues no tickets) and an error.
+func (h *ServerHandshake) attachTicket(proof, binding []byte) ([]byte, error) {
+	if h.tickets == nil {
+		return proof, nil
+	}
+
+	ticket, err := h.tickets.issue(h.uname, resumptionKey(h.sessionKey, binding))
+	if err != nil {
+		return nil, err
+	}
+
+	return appendTicket(proof, h.tickets.lifetime, ticket), nil
+}
+
+// Verifies the authenticity of the client.
+// Returns an error if the authentication failed for some reason (nil otherwise).
+func authClient(clientProof, nonce, storedKey []byte) error {
+	clientSignature := hmac.New(sha256.New, storedKey)
+	clientSignature.Write(nonce) // ! changed from the RFC !
+
+	clientKey, err := seshat.XOR(clientSignature.Sum(nil), clientProof)
+	if err != nil {
+		return err
+	}
+
+	expectedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey, expectedKey[:]) != 1 {
+		return errors.New("stored key and the client key don't match")
+	}
+
+	return nil
+}
@@ -6,7 +6,7 @@ import (
 	"crypto/sha256"
 	"testing"
 
-	"github.com/mowzhja/harpocrates/server/seshat"
+	"github.com/mowzhja/harpocrates/harpocrates/seshat"
 	"golang.org/x/crypto/argon2"
 )
 
@@ -0,0 +1,511 @@
+package cerberus
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// Rewrites the golden files with what the tests get, when the wire format changes on purpose.
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// The settings of the handshakes of the tests.
+var testConfig = &Config{KDF: VECTORS_KDF}
+
+// The users of the server (alice's password is alicespass, bob's bobspass).
+var testUsers, _ = MemoryUsers(testConfig.KDF, map[string]string{"alice": "alicespass", "bob": "bobspass"})
+
+// A message of the handshake, and who sent it.
+type sent struct {
+	byClient bool
+	msg      []byte
+}
+
+// Utility function, runs a client and a server handshake against each other in memory, until no message is left on the way.
+// Every message goes through tamper, which returns what gets delivered in its place (nil to deliver it as is).
+// Returns the transcript (what was sent, before tampering), the first error of the client and the first error of the server.
+func run(client, server Handshake, tamper func(i int, m sent) []sent) ([]sent, error, error) {
+	var transcript, queue []sent
+	var clientErr, serverErr error
+
+	out, err := client.Step(nil)
+	clientErr = err
+	for _, msg := range out {
+		queue = append(queue, sent{true, msg})
+	}
+
+	for len(queue) > 0 {
+		m := queue[0]
+		queue = queue[1:]
+		transcript = append(transcript, m)
+
+		deliver := []sent{m}
+		if tamper != nil {
+			if d := tamper(len(transcript)-1, m); d != nil {
+				deliver = d
+			}
+		}
+
+		for _, d := range deliver {
+			to, errp := server, &serverErr
+			if !d.byClient {
+				to, errp = client, &clientErr
+			}
+			out, err := to.Step(d.msg)
+			if err != nil && *errp == nil {
+				*errp = err
+			}
+			for _, msg := range out {
+				queue = append(queue, sent{!d.byClient, msg})
+			}
+		}
+	}
+
+	return transcript, clientErr, serverErr
+}
+
+// Tests a whole handshake, message by message, and that both sides end up with the same session.
+func Test_Handshake(t *testing.T) {
+	client := NewClientHandshake([]byte("alice"), []byte("alicespass"), testConfig)
+	server := NewServerHandshake(testUsers, nil)
+
+	transcript, clientErr, serverErr := run(client, server, nil)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+	if client.State() != DONE || server.State() != DONE || server.Username() != "alice" {
+		t.Fatalf("the handshake should be done: %s, %s (%s)", client.State(), server.State(), server.Username())
+	}
+
+	// key, key, name, challenge, proof, SERVER_OK, signature, CLIENT_OK
+	byClient := []bool{true, false, true, false, true, false, false, true}
+	if len(transcript) != len(byClient) {
+		t.Fatalf("expected %d messages, got %d", len(byClient), len(transcript))
+	}
+	for i, m := range transcript {
+		if m.byClient != byClient[i] {
+			t.Fatalf("message %d was sent by the wrong side", i)
+		}
+	}
+
+	record, err := hermes.SealRecord(client.Cipher(), []byte("hello"), hermes.DEFAULT_PADDING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := hermes.OpenRecord(server.Cipher(), record)
+	if err != nil || string(msg) != "hello" {
+		t.Fatal("the two sides don't share the session", err)
+	}
+}
+
+// Tests that a client with the wrong password, or that the server doesn't know, is turned away.
+func Test_Handshake_refused(t *testing.T) {
+	for _, user := range [][2]string{{"alice", "bobspass"}, {"mallory", "alicespass"}} {
+		client := NewClientHandshake([]byte(user[0]), []byte(user[1]), testConfig)
+		server := NewServerHandshake(testUsers, nil)
+
+		_, clientErr, _ := run(client, server, nil)
+		if !errors.Is(clientErr, ErrAuthFailed) {
+			t.Fatalf("%s: expected ErrAuthFailed, got %v", user[0], clientErr)
+		}
+		if client.State() != FAILED || server.State() == DONE {
+			t.Fatalf("%s: the handshake shouldn't succeed: %s, %s", user[0], client.State(), server.State())
+		}
+	}
+}
+
+// Tests that a client salting its password differently from how the user was registered is refused.
+func Test_Handshake_otherKDF(t *testing.T) {
+	client := NewClientHandshake([]byte("alice"), []byte("alicespass"), &Config{KDF: KDFParams{Time: 2, Memory: 64, Threads: 1}})
+	server := NewServerHandshake(testUsers, nil)
+
+	_, clientErr, _ := run(client, server, nil)
+	if !errors.Is(clientErr, ErrAuthFailed) {
+		t.Fatalf("expected ErrAuthFailed, got %v", clientErr)
+	}
+}
+
+// Tests a handshake against the users of the server, registered with the default KDF.
+func Test_Handshake_usersFile(t *testing.T) {
+	client := NewClientHandshake([]byte("bob"), []byte("bobspass"), nil)
+	server := NewServerHandshake(UsersFile("../../server/user_data.csv"), nil)
+
+	_, clientErr, serverErr := run(client, server, nil)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+	if server.Username() != "bob" {
+		t.Fatalf("expected bob to be logged in, got %q", server.Username())
+	}
+}
+
+// Tests that a message delivered twice, or swapped with the next one, makes the handshake fail instead of being accepted.
+func Test_Handshake_outOfOrder(t *testing.T) {
+	for i := 0; i < 8; i++ {
+		client := NewClientHandshake([]byte("alice"), []byte("alicespass"), testConfig)
+		server := NewServerHandshake(testUsers, nil)
+
+		var byClient bool
+		_, clientErr, serverErr := run(client, server, func(j int, m sent) []sent {
+			if j == i {
+				byClient = m.byClient
+				return []sent{m, m}
+			}
+			return nil
+		})
+		// the last messages come once the receiver is done already
+		receiverErr := clientErr
+		if byClient {
+			receiverErr = serverErr
+		}
+		if receiverErr == nil {
+			t.Fatalf("message %d was accepted twice", i)
+		}
+		if client.State() == DONE && server.State() == DONE && receiverErr != ErrHandshakeOver {
+			t.Fatalf("the handshake went through with message %d delivered twice", i)
+		}
+	}
+
+	// the signature of the server before its verdict
+	client := NewClientHandshake([]byte("alice"), []byte("alicespass"), testConfig)
+	server := NewServerHandshake(testUsers, nil)
+	var held *sent
+	_, clientErr, _ := run(client, server, func(j int, m sent) []sent {
+		switch j {
+		case 5:
+			held = &m
+			return []sent{}
+		case 6:
+			return []sent{m, *held}
+		}
+		return nil
+	})
+	if clientErr == nil || client.State() != FAILED {
+		t.Fatal("the client accepted the messages of the server out of order")
+	}
+}
+
+// Tests that a client speaking another version of the protocol is told which one the server speaks, and gives up.
+func Test_Handshake_version(t *testing.T) {
+	client := NewClientHandshake([]byte("alice"), []byte("alicespass"), testConfig)
+	out, err := client.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out[0][0] != PROTOCOL_VERSION {
+		t.Fatalf("the first message should start with version %d, got %x", PROTOCOL_VERSION, out[0])
+	}
+
+	server := NewServerHandshake(testUsers, nil)
+	out[0][0] = PROTOCOL_VERSION + 1
+	answer, err := server.Step(out[0])
+	if !errors.Is(err, ErrProtocolVersion) || server.State() != FAILED {
+		t.Fatalf("the server should refuse another version, got %v in state %s", err, server.State())
+	}
+	if len(answer) != 1 || string(answer[0]) != string(append([]byte(VERSION_FAIL), PROTOCOL_VERSION)) {
+		t.Fatalf("the server should answer with the version it speaks, got %q", answer)
+	}
+
+	_, err = client.Step(answer[0])
+	if !errors.Is(err, ErrProtocolVersion) || client.State() != FAILED {
+		t.Fatalf("the client should give up, got %v in state %s", err, client.State())
+	}
+}
+
+// Tests that the machines refuse to move where they can't.
+func Test_Handshake_illegal(t *testing.T) {
+	client := NewClientHandshake([]byte("alice"), []byte("alicespass"), testConfig)
+	if _, err := client.Step([]byte("hi")); err == nil || client.State() != FAILED {
+		t.Fatal("the client must speak first")
+	}
+	if _, err := client.Step(nil); err != ErrHandshakeOver {
+		t.Fatal("a failed handshake must stay failed, got", err)
+	}
+
+	server := NewServerHandshake(testUsers, nil)
+	if _, err := server.Step(nil); err == nil || server.State() != FAILED {
+		t.Fatal("the server can't speak first")
+	}
+
+	server = NewServerHandshake(testUsers, nil)
+	if _, err := server.Step(versioned([]byte("not a point"))); err == nil || server.State() != FAILED {
+		t.Fatal("an invalid ECDHE key must be refused")
+	}
+
+	for from, to := range transitions {
+		for _, next := range []State{CLIENT_START, CLIENT_SENT_PROOF, CLIENT_SENT_TICKET, SERVER_SENT_KEY, SERVER_SENT_SIGNATURE, SERVER_RESUMED, DONE} {
+			allowed := false
+			for _, t := range to {
+				allowed = allowed || next == t
+			}
+
+			state := from
+			err := advance(&state, next)
+			if (err == nil) != allowed {
+				t.Fatalf("moving from %s to %s: %v", from, next, err)
+			}
+		}
+		state := from
+		if advance(&state, FAILED) != nil {
+			t.Fatalf("%s can't fail", from)
+		}
+	}
+
+	if !bytes.Equal([]byte(DONE.String()), []byte("DONE")) {
+		t.Fatal("states should print their name")
+	}
+}
+
+// Utility function, runs a handshake of alice where every key, nonce and salt is drawn from seeded sources.
+// Returns the transcript, one message per line (> from the client, < from the server, then the message in hex).
+func goldenTranscript(t *testing.T) string {
+	kdf := testConfig.KDF
+	salt := []byte("a salt that never changes, 32 B.")
+	_, storedKey, servKey := deriveKeys(kdf, []byte("alicespass"), salt)
+	users := func(uname string) ([]byte, []byte, []byte, error) {
+		if uname != "alice" {
+			return nil, nil, nil, nil
+		}
+		return salt, storedKey, servKey, nil
+	}
+
+	client := NewClientHandshake([]byte("alice"), []byte("alicespass"), &Config{KDF: kdf, Rand: rand.New(rand.NewSource(1))})
+	server := NewServerHandshake(users, &Config{Rand: rand.New(rand.NewSource(2))})
+	transcript, clientErr, serverErr := run(client, server, nil)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+
+	var lines strings.Builder
+	for _, m := range transcript {
+		if m.byClient {
+			lines.WriteString("> ")
+		} else {
+			lines.WriteString("< ")
+		}
+		lines.WriteString(hex.EncodeToString(m.msg) + "\n")
+	}
+
+	return lines.String()
+}
+
+// Tests that the handshake is the same, byte for byte, as the one in testdata/handshake.golden (run with -update after changing the wire format on purpose).
+func Test_Handshake_golden(t *testing.T) {
+	transcript := goldenTranscript(t)
+	if goldenTranscript(t) != transcript {
+		t.Fatal("the same seeds should give the same transcript")
+	}
+
+	if *update {
+		err := os.WriteFile("testdata/handshake.golden", []byte(transcript), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	golden, err := os.ReadFile("testdata/handshake.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(golden) != transcript {
+		t.Fatalf("the handshake changed:\n%s\nexpected:\n%s", transcript, golden)
+	}
+}
+
+// Utility function, logs alice in against a server issuing tickets.
+// Returns the ticket they got.
+func loginForTicket(t *testing.T, cfg *Config) *Ticket {
+	t.Helper()
+
+	client := NewClientHandshake([]byte("alice"), []byte("alicespass"), testConfig)
+	_, clientErr, serverErr := run(client, NewServerHandshake(testUsers, cfg), nil)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+	if client.Ticket() == nil || client.Ticket().Username != "alice" {
+		t.Fatalf("expected a ticket for alice, got %+v", client.Ticket())
+	}
+
+	return client.Ticket()
+}
+
+// Tests that a client resumes its session with a ticket, getting a new one each time, and that a used ticket doesn't work twice.
+func Test_Handshake_resume(t *testing.T) {
+	cfg := &Config{Tickets: NewTickets(0, 0, nil)}
+	ticket := loginForTicket(t, cfg)
+
+	for i := 0; i < 3; i++ {
+		client := NewResumingHandshake(ticket, testConfig)
+		server := NewServerHandshake(testUsers, cfg)
+		transcript, clientErr, serverErr := run(client, server, nil)
+		if clientErr != nil || serverErr != nil {
+			t.Fatal(clientErr, serverErr)
+		}
+		if client.State() != DONE || server.State() != DONE || server.Username() != "alice" {
+			t.Fatalf("the handshake should be done: %s, %s (%s)", client.State(), server.State(), server.Username())
+		}
+		// ticket, then key and proof, then CLIENT_OK
+		if len(transcript) != 3 {
+			t.Fatalf("expected 3 messages, got %d", len(transcript))
+		}
+
+		record, err := hermes.SealRecord(server.Cipher(), []byte("hello"), hermes.DEFAULT_PADDING)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := hermes.OpenRecord(client.Cipher(), record)
+		if err != nil || string(msg) != "hello" {
+			t.Fatal("the two sides don't share the session", err)
+		}
+
+		// the ticket was single-use
+		replay := NewResumingHandshake(ticket, testConfig)
+		_, clientErr, _ = run(replay, NewServerHandshake(testUsers, cfg), nil)
+		if clientErr != ErrTicketRejected {
+			t.Fatal("expected a replayed ticket to be rejected, got", clientErr)
+		}
+
+		if client.Ticket() == nil || bytes.Equal(client.Ticket().blob, ticket.blob) {
+			t.Fatal("expected a new ticket")
+		}
+		ticket = client.Ticket()
+	}
+}
+
+// Tests that the tickets that can't be used are refused, and that the client notices a server that doesn't hold the key of its ticket.
+func Test_Handshake_resume_refused(t *testing.T) {
+	cfg := &Config{Tickets: NewTickets(0, 0, nil)}
+
+	for name, change := range map[string]func(ticket *Ticket){
+		"tampered": func(ticket *Ticket) { ticket.blob[len(ticket.blob)-1] ^= 1 },
+		"wrong key": func(ticket *Ticket) {
+			ticket.psk = append([]byte{}, ticket.psk...)
+			ticket.psk[0] ^= 1
+		},
+		"someone else's": func(ticket *Ticket) { ticket.Username = "bob" },
+	} {
+		ticket := loginForTicket(t, cfg)
+		change(ticket)
+		client := NewResumingHandshake(ticket, testConfig)
+		server := NewServerHandshake(testUsers, cfg)
+		_, clientErr, serverErr := run(client, server, nil)
+		if name == "someone else's" {
+			// the name is inside the ticket: the client is alice all the same
+			if clientErr != nil || server.Username() != "alice" {
+				t.Fatalf("%s: expected alice to resume their session, got %v (%q)", name, clientErr, server.Username())
+			}
+			continue
+		}
+		if clientErr != ErrTicketRejected || serverErr == nil || server.State() != FAILED {
+			t.Fatalf("%s: expected the ticket to be rejected, got %v and %v", name, clientErr, serverErr)
+		}
+	}
+
+	ticket := loginForTicket(t, cfg)
+	expired := *ticket
+	expired.Expires = time.Now()
+	if _, err := NewResumingHandshake(&expired, testConfig).Step(nil); err != ErrTicketExpired {
+		t.Fatal("expected an expired ticket to be refused by the client, got", err)
+	}
+
+	// the server forgot its keys (it restarted, say)
+	client := NewResumingHandshake(ticket, testConfig)
+	_, clientErr, _ := run(client, NewServerHandshake(testUsers, &Config{Tickets: NewTickets(0, 0, nil)}), nil)
+	if clientErr != ErrTicketRejected {
+		t.Fatal("expected a ticket from another server to be rejected, got", clientErr)
+	}
+	client = NewResumingHandshake(loginForTicket(t, cfg), testConfig)
+	_, clientErr, _ = run(client, NewServerHandshake(testUsers, nil), nil)
+	if clientErr != ErrTicketRejected {
+		t.Fatal("expected a server issuing no tickets to reject them, got", clientErr)
+	}
+
+	// the user was removed since
+	nobody := func(string) ([]byte, []byte, []byte, error) { return nil, nil, nil, nil }
+	client = NewResumingHandshake(loginForTicket(t, cfg), testConfig)
+	_, clientErr, _ = run(client, NewServerHandshake(nobody, cfg), nil)
+	if clientErr != ErrTicketRejected {
+		t.Fatal("expected the ticket of a removed user to be rejected, got", clientErr)
+	}
+
+	// a server that answers without the key of the ticket
+	client = NewResumingHandshake(loginForTicket(t, cfg), testConfig)
+	server := NewServerHandshake(testUsers, cfg)
+	_, clientErr, _ = run(client, server, func(i int, m sent) []sent {
+		if i == 1 {
+			m.msg = append([]byte{}, m.msg...)
+			m.msg[len(m.msg)-1] ^= 1
+			return []sent{m}
+		}
+		return nil
+	})
+	if clientErr == nil || client.State() != FAILED || server.State() == DONE {
+		t.Fatal("the client resumed with a tampered answer")
+	}
+}
+
+// Utility function, logs in (and resumes the session with the ticket it got) as every one of unames, padding the handshake following padding.
+// Returns the lengths of the messages of every login, resumption included.
+func messageLengths(t *testing.T, unames []string, padding hermes.PaddingPolicy) [][]int {
+	t.Helper()
+
+	passwds := make(map[string]string)
+	for _, uname := range unames {
+		passwds[uname] = "a password"
+	}
+	users, err := MemoryUsers(testConfig.KDF, passwds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCfg := &Config{KDF: testConfig.KDF, Padding: padding}
+	serverCfg := &Config{Tickets: NewTickets(0, 0, nil), Padding: padding}
+
+	var lengths [][]int
+	for _, uname := range unames {
+		client := NewClientHandshake([]byte(uname), []byte("a password"), clientCfg)
+		login, clientErr, serverErr := run(client, NewServerHandshake(users, serverCfg), nil)
+		if clientErr != nil || serverErr != nil {
+			t.Fatal(clientErr, serverErr)
+		}
+		resumption, clientErr, serverErr := run(NewResumingHandshake(client.Ticket(), clientCfg), NewServerHandshake(users, serverCfg), nil)
+		if clientErr != nil || serverErr != nil {
+			t.Fatal(clientErr, serverErr)
+		}
+
+		var l []int
+		for _, m := range append(login, resumption...) {
+			l = append(l, len(m.msg))
+		}
+		lengths = append(lengths, l)
+	}
+
+	return lengths
+}
+
+// Tests that how long the messages of a handshake are doesn't depend on how long the username is, once they're padded (and does otherwise).
+func Test_Handshake_padding(t *testing.T) {
+	unames := []string{"al", "alice", "alice_has_a_long_name", strings.Repeat("a", 60)}
+
+	for _, padding := range []hermes.PaddingPolicy{{}, {Scheme: hermes.PAD_BUCKETS, Size: 256}, {Scheme: hermes.PAD_FIXED, Size: 200}} {
+		lengths := messageLengths(t, unames, padding)
+		for i := 1; i < len(lengths); i++ {
+			if fmt.Sprint(lengths[i]) != fmt.Sprint(lengths[0]) {
+				t.Fatalf("%+v: the messages of %q are %v long, the ones of %q %v", padding, unames[i], lengths[i], unames[0], lengths[0])
+			}
+		}
+	}
+
+	lengths := messageLengths(t, unames[:2], hermes.PaddingPolicy{Scheme: hermes.PAD_NONE})
+	if fmt.Sprint(lengths[0]) == fmt.Sprint(lengths[1]) {
+		t.Fatal("without padding, the length of the username should show")
+	}
+}
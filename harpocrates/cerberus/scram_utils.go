@@ -0,0 +1,63 @@
+package cerberus
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/mowzhja/harpocrates/harpocrates/seshat"
+	"golang.org/x/crypto/argon2"
+)
+
+// The parameters of Argon2, the KDF that salts the passwords (client and server agree on them beforehand).
+type KDFParams struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` // in KiB
+	Threads uint8  `json:"threads"`
+}
+
+// The parameters the users of the server are registered with (see utils/gen_data.go).
+var DEFAULT_KDF = KDFParams{Time: 1, Memory: 2_000_000, Threads: 2}
+
+// Salts passwd with salt.
+func saltPassword(kdf KDFParams, passwd, salt []byte) []byte {
+	return argon2.Key(passwd, salt, kdf.Time, kdf.Memory, kdf.Threads, 32)
+}
+
+// Derives the SCRAM keys of passwd, salted with salt.
+// Returns the client key, the stored key and the server key.
+func deriveKeys(kdf KDFParams, passwd, salt []byte) ([]byte, []byte, []byte) {
+	saltedPasswd := saltPassword(kdf, passwd, salt)
+
+	clientKey := hmac.New(sha256.New, saltedPasswd)
+	clientKey.Write([]byte("Client Key"))
+	servKey := hmac.New(sha256.New, saltedPasswd)
+	servKey.Write([]byte("Server Key"))
+	storedKey := sha256.Sum256(clientKey.Sum(nil))
+
+	return clientKey.Sum(nil), storedKey[:], servKey.Sum(nil)
+}
+
+// Computes the parameters used for SCRAM given the password and the salt.
+// Returns the auth message, the server key and an error if anything goes wrong.
+func computeParams(kdf KDFParams, passwd, salt, nonce []byte) ([]byte, []byte, []byte, error) {
+	if len(passwd) == 0 || len(salt) == 0 {
+		return nil, nil, nil, errors.New("password, salt or both are empty")
+	}
+	if len(nonce) != 64 {
+		return nil, nil, nil, errors.New("the nonce must be 64 bytes long")
+	}
+
+	clientKey, storedKey, servKey := deriveKeys(kdf, passwd, salt)
+
+	clientSignature := hmac.New(sha256.New, storedKey)
+	clientSignature.Write(nonce)
+
+	clientProof, err := seshat.XOR(clientSignature.Sum(nil), clientKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	authMessage := seshat.MergeChunks(nonce, clientProof)
+
+	return authMessage, servKey, clientKey, nil
+}
@@ -7,122 +7,10 @@ import (
 	"math/rand"
 	"testing"
 
-	"github.com/mowzhja/harpocrates/client/seshat"
+	"github.com/mowzhja/harpocrates/harpocrates/seshat"
 	"golang.org/x/crypto/argon2"
 )
 
-// Tests errorless function of the data extraction.
-func Test_extractDataNonce(t *testing.T) {
-	for i := 0; i < 10; i++ {
-		uname := []byte("cerberus")
-		nonce := make([]byte, 32)
-		rand.Read(nonce)
-		m := append(nonce, uname...)
-
-		d, n, err := seshat.ExtractDataNonce(m, 32)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		if string(d) != string(uname) {
-			t.Fatalf("the data doesn't match: expected %s, got %s",
-				string(uname), string(d))
-		}
-
-		if string(n) != string(nonce) {
-			t.Fatalf("the nonces don't match: expected %s, got %s",
-				hex.EncodeToString(nonce), hex.EncodeToString(n))
-		}
-	}
-
-	for i := 0; i < 10; i++ {
-		uname := []byte("harpocratesishere")
-		nonce := make([]byte, 64)
-		rand.Read(nonce)
-		m := append(nonce, uname...)
-
-		d, n, err := seshat.ExtractDataNonce(m, 64)
-		if err != nil {
-			t.Fatal(err)
-		}
-		if string(d) != string(uname) {
-			t.Fatalf("(64) the data doesn't match: expected %s, got %s",
-				string(uname), string(d))
-		}
-
-		if string(n) != string(nonce) {
-			t.Fatalf("(64) the nonces don't match: expected %s, got %s",
-				hex.EncodeToString(nonce), hex.EncodeToString(n))
-		}
-	}
-}
-
-// Tests the data extraction when the nonce lengths are invalid.
-func Test_extractDataNonce_invalidNonces(t *testing.T) {
-	for i := 20; i < 55; i++ {
-		unmae := []byte("testingtest")
-		nonce := make([]byte, i)
-		rand.Read(nonce)
-		m := append(nonce, unmae...)
-
-		_, _, err := seshat.ExtractDataNonce(m, i)
-		if i == 32 {
-			if err != nil {
-				t.Fatal(err)
-			}
-		} else {
-			if err == nil {
-				t.Fatalf("all nonces with lengths != [32, 64] must raise an error (got %d)", i)
-			}
-		}
-	}
-}
-
-// Tests data extraction when the data is of an invalid length (too short).
-func Test_extractDataNonce_shortData(t *testing.T) {
-	for i := 20; i < 40; i++ {
-		m := make([]byte, i)
-		rand.Read(m)
-
-		_, _, err := seshat.ExtractDataNonce(m, 32)
-		if i < 32 {
-			if err == nil {
-				t.Fatalf("short data should raise an error (got datalen %d)", len(m))
-			}
-		} else {
-			if err != nil {
-				t.Fatalf("data of the correct length shouldn't return an error (got datalen %d)", len(m))
-			}
-		}
-	}
-}
-
-// Tests the normal function of the getServerSig() function.
-func Test_getServerSig(t *testing.T) {
-	for i := 0; i < 100; i++ {
-		authMessage := make([]byte, 128) // nonce + clientProof
-		rand.Read(authMessage)
-		serverKey := make([]byte, 32)
-		rand.Read(serverKey)
-
-		sig, err := getServerSignature(authMessage, serverKey)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		check := hmac.New(sha256.New, serverKey)
-		_, err = check.Write(authMessage)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		if !hmac.Equal(check.Sum(nil), sig) {
-			t.Fatalf("the two macs are different: %s == %s",
-				hex.EncodeToString(check.Sum(nil)), hex.EncodeToString(sig))
-		}
-	}
-}
-
 // Tests the generation of SCRAM parameters.
 func Test_computeParameters(t *testing.T) {
 	passwd := []byte("secretpass")
@@ -150,7 +38,7 @@ func Test_computeParameters(t *testing.T) {
 		}
 
 		expectedMsg := seshat.MergeChunks(nonce, clientProof)
-		gotMsg, gotKey, _, err := computeParams(passwd, salt, nonce)
+		gotMsg, gotKey, _, err := computeParams(DEFAULT_KDF, passwd, salt, nonce)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -172,7 +60,7 @@ func Test_computeParameters_emptyPasswdSalt(t *testing.T) {
 	rand.Read(nonce)
 	expectedError := "password, salt or both are empty"
 
-	authM, servK, _, err := computeParams([]byte(""), []byte("saltysalt"), nonce)
+	authM, servK, _, err := computeParams(DEFAULT_KDF, []byte(""), []byte("saltysalt"), nonce)
 	if err == nil {
 		t.Fatal("an error should've been raised")
 	}
@@ -184,7 +72,7 @@ func Test_computeParameters_emptyPasswdSalt(t *testing.T) {
 		t.Fatal("auth message and server key should be nil when an error occurs")
 	}
 
-	authM, servK, _, err = computeParams([]byte("passypass"), []byte(""), nonce)
+	authM, servK, _, err = computeParams(DEFAULT_KDF, []byte("passypass"), []byte(""), nonce)
 	if err == nil {
 		t.Fatal("an error should've been raised")
 	}
@@ -196,7 +84,7 @@ func Test_computeParameters_emptyPasswdSalt(t *testing.T) {
 		t.Fatal("auth message and server key should be nil when an error occurs")
 	}
 
-	authM, servK, _, err = computeParams([]byte(""), []byte(""), nonce)
+	authM, servK, _, err = computeParams(DEFAULT_KDF, []byte(""), []byte(""), nonce)
 	if err == nil {
 		t.Fatal("an error should've been raised")
 	}
@@ -219,7 +107,7 @@ func Test_computeParameters_invalidNonce(t *testing.T) {
 		nonce := make([]byte, i)
 		rand.Read(nonce)
 
-		_, _, _, err := computeParams(passwd, salt, nonce)
+		_, _, _, err := computeParams(DEFAULT_KDF, passwd, salt, nonce)
 		if i == 64 {
 			// not supposed to raise any error
 			if err != nil {
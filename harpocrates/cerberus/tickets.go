@@ -0,0 +1,295 @@
+package cerberus
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+	"github.com/mowzhja/harpocrates/harpocrates/seshat"
+)
+
+// How long a resumption ticket can be used by default.
+const TICKET_LIFETIME = 24 * time.Hour
+
+// How many times a ticket can be used by default (once: the server issues a new one every time it's used).
+const TICKET_MAX_USES = 1
+
+// How long the server encrypts the tickets with the same key.
+// A retired key still opens the tickets it issued, until they expire, and is thrown away then.
+const TICKET_KEY_ROTATION = time.Hour
+
+// What a client resuming a session starts its first message with (the key of a full handshake starts with 0x04).
+const RESUME = "RESUME"
+
+// What the server answers a ticket it refuses with (the client has to log in with its password then).
+const RESUME_FAIL = "RESUME_FAIL"
+
+// Returned when the server refuses to resume a session with our ticket.
+var ErrTicketRejected = errors.New("the server rejected the ticket")
+
+// Returned when resuming with a ticket that's expired already.
+var ErrTicketExpired = errors.New("the ticket is expired")
+
+// The sizes of the parts of a ticket: the id of the key that sealed it, then (sealed) its own id, its expiry and the resumption key.
+const (
+	TICKET_KEY_ID_SIZE = 8
+	TICKET_ID_SIZE     = 16
+	ticketHeaderSize   = TICKET_ID_SIZE + 8 + 32
+)
+
+// A Ticket lets a client resume its session with the server on a new connection, skipping the key derivation of a full login.
+// It's issued by the server after a successful handshake, and is bound to the user that logged in.
+type Ticket struct {
+	Username string
+	Expires  time.Time // by the clock of the client
+
+	blob []byte // what the server sealed (opaque to the client)
+	psk  []byte // the resumption key
+}
+
+// Issues the resumption tickets of a server and checks the ones the clients come back with.
+// The tickets are sealed with keys that rotate every TICKET_KEY_ROTATION, and are kept nowhere but by the clients:
+// the server only remembers how many times each one was used, until it expires.
+type Tickets struct {
+	lifetime time.Duration
+	maxUses  int
+	random   io.Reader
+	now      func() time.Time
+	padding  hermes.PaddingPolicy // so that a ticket doesn't tell how long the username inside is
+
+	mu   sync.Mutex
+	keys []ticketKey // the newest first
+	uses map[string]ticketUses
+}
+
+// A key tickets are sealed with.
+type ticketKey struct {
+	id      []byte
+	cipher  anubis.Cipher
+	created time.Time
+}
+
+// How many times a ticket was used, and when it stops mattering.
+type ticketUses struct {
+	n       int
+	expires time.Time
+}
+
+// What's inside a ticket.
+type ticketState struct {
+	id      []byte
+	expires time.Time
+	psk     []byte
+	uname   string
+}
+
+// Creates the tickets of a server, which last lifetime and can be used maxUses times (TICKET_LIFETIME and TICKET_MAX_USES if 0).
+// cfg can be nil, for the defaults.
+func NewTickets(lifetime time.Duration, maxUses int, cfg *Config) *Tickets {
+	if lifetime <= 0 {
+		lifetime = TICKET_LIFETIME
+	}
+	if maxUses <= 0 {
+		maxUses = TICKET_MAX_USES
+	}
+
+	return &Tickets{
+		lifetime: lifetime,
+		maxUses:  maxUses,
+		random:   cfg.random(),
+		now:      cfg.clock(),
+		padding:  cfg.padding(),
+		uses:     make(map[string]ticketUses),
+	}
+}
+
+// Seals a ticket for uname, who resumes with psk.
+// Returns the ticket and an error.
+func (t *Tickets) issue(uname string, psk []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if len(t.keys) == 0 || now.Sub(t.keys[0].created) >= TICKET_KEY_ROTATION {
+		err := t.rotate(now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	key := t.keys[0]
+
+	id := make([]byte, TICKET_ID_SIZE)
+	_, err := io.ReadFull(t.random, id)
+	if err != nil {
+		return nil, err
+	}
+	expires := make([]byte, 8)
+	binary.BigEndian.PutUint64(expires, uint64(now.Add(t.lifetime).Unix()))
+
+	padded, err := t.padding.Pad(seshat.MergeChunks(id, expires, psk, []byte(uname)))
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := key.cipher.Encrypt(padded)
+	if err != nil {
+		return nil, err
+	}
+
+	return seshat.MergeChunks(key.id, sealed), nil
+}
+
+// Opens a ticket a client came back with, checking that it's still valid (but not counting the use: see use()).
+// Returns what's inside and an error if the ticket isn't one of ours, or is expired.
+func (t *Tickets) open(ticket []byte) (ticketState, error) {
+	if len(ticket) < TICKET_KEY_ID_SIZE {
+		return ticketState{}, errors.New("the ticket is too short")
+	}
+
+	t.mu.Lock()
+	var key ticketKey
+	for _, k := range t.keys {
+		if hmac.Equal(k.id, ticket[:TICKET_KEY_ID_SIZE]) {
+			key = k
+		}
+	}
+	t.mu.Unlock()
+	if key.id == nil {
+		return ticketState{}, errors.New("the key of the ticket is unknown (or retired)")
+	}
+
+	padded, err := key.cipher.Decrypt(ticket[TICKET_KEY_ID_SIZE:])
+	if err != nil {
+		return ticketState{}, err
+	}
+	plaintext, err := hermes.Unpad(padded)
+	if err != nil {
+		return ticketState{}, err
+	}
+	if len(plaintext) < ticketHeaderSize {
+		return ticketState{}, errors.New("the ticket is malformed")
+	}
+
+	state := ticketState{
+		id:      plaintext[:TICKET_ID_SIZE],
+		expires: time.Unix(int64(binary.BigEndian.Uint64(plaintext[TICKET_ID_SIZE:])), 0),
+		psk:     plaintext[TICKET_ID_SIZE+8 : ticketHeaderSize],
+		uname:   string(plaintext[ticketHeaderSize:]),
+	}
+	if !t.now().Before(state.expires) {
+		return ticketState{}, ErrTicketExpired
+	}
+
+	return state, nil
+}
+
+// Counts a use of the ticket, once the client proved it holds the resumption key.
+// Returns an error if it was used up already (a single-use ticket coming back is a replay).
+func (t *Tickets) use(state ticketState) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	uses := t.uses[string(state.id)]
+	if uses.n >= t.maxUses {
+		return errors.New("the ticket was used up")
+	}
+	t.uses[string(state.id)] = ticketUses{n: uses.n + 1, expires: state.expires}
+
+	return nil
+}
+
+// Starts sealing the tickets with a new key, throws away the keys whose tickets have all expired and forgets the uses of the expired tickets.
+// Returns an error if there's no randomness for the new key.
+func (t *Tickets) rotate(now time.Time) error {
+	k := make([]byte, anubis.BYTE_SEC)
+	_, err := io.ReadFull(t.random, k)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, TICKET_KEY_ID_SIZE)
+	_, err = io.ReadFull(t.random, id)
+	if err != nil {
+		return err
+	}
+	cipher, err := anubis.NewCipherWith(k, t.random)
+	if err != nil {
+		return err
+	}
+
+	keys := []ticketKey{{id: id, cipher: cipher, created: now}}
+	for _, key := range t.keys {
+		// the last ticket it sealed expires lifetime after it was retired
+		if now.Before(key.created.Add(TICKET_KEY_ROTATION + t.lifetime)) {
+			keys = append(keys, key)
+		}
+	}
+	t.keys = keys
+
+	for id, uses := range t.uses {
+		if !now.Before(uses.expires) {
+			delete(t.uses, id)
+		}
+	}
+
+	return nil
+}
+
+// Returns the HMAC-SHA256 of parts, under key.
+func mac(key []byte, parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, part := range parts {
+		h.Write(part)
+	}
+
+	return h.Sum(nil)
+}
+
+// Derives the key a ticket resumes with, from the key of the session it's issued in and what's unique to that session.
+func resumptionKey(sessionKey, binding []byte) []byte {
+	return mac(sessionKey, []byte("resumption"), binding)
+}
+
+// Derives the key of a resumed session from the resumption key and the ECDHE of the new connection (which keeps it forward secret).
+func resumedKey(psk, sharedKey, nonce []byte) []byte {
+	return mac(psk, []byte("resumed session"), sharedKey, nonce)
+}
+
+// Returns the binder the client proves it holds the resumption key with, over the rest of its first message.
+func resumeBinder(psk, cnonce, pubKey, ticket []byte) []byte {
+	return mac(psk, []byte("client binder"), cnonce, pubKey, ticket)
+}
+
+// Returns the proof the server holds the resumption key too, over both its ECDHE key and nonce and the first message of the client.
+func resumeFinished(psk, hello, pubKey, snonce []byte) []byte {
+	return mac(psk, []byte("server finished"), hello, pubKey, snonce)
+}
+
+// Appends a ticket (and how many seconds it lasts) to proof, the way the server sends them: nothing is appended if there's no ticket.
+func appendTicket(proof []byte, lifetime time.Duration, ticket []byte) []byte {
+	if ticket == nil {
+		return proof
+	}
+	seconds := make([]byte, 4)
+	binary.BigEndian.PutUint32(seconds, uint32(lifetime/time.Second))
+
+	return seshat.MergeChunks(proof, seconds, ticket)
+}
+
+// Splits what the server sent into the 32 bytes of its proof and the ticket that comes after them (if any).
+// Returns the proof, the ticket (nil if there's none), how long it lasts and an error.
+func splitTicket(msg []byte) ([]byte, []byte, time.Duration, error) {
+	switch {
+	case len(msg) == sha256.Size:
+		return msg, nil, 0, nil
+	case len(msg) <= sha256.Size+4+TICKET_KEY_ID_SIZE:
+		return nil, nil, 0, errors.New("the ticket is malformed")
+	}
+	lifetime := time.Duration(binary.BigEndian.Uint32(msg[sha256.Size:])) * time.Second
+
+	return msg[:sha256.Size], msg[sha256.Size+4:], lifetime, nil
+}
@@ -0,0 +1,104 @@
+package cerberus
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// A clock that only moves when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// Utility function, issues a ticket for alice (failing the test if it can't).
+// Returns the ticket and the key it resumes with.
+func issueTicket(t *testing.T, tickets *Tickets) ([]byte, []byte) {
+	t.Helper()
+
+	psk := bytes.Repeat([]byte{7}, 32)
+	ticket, err := tickets.issue("alice", psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ticket, psk
+}
+
+// Tests that a ticket opens to what it was issued with, as many times as it can be used and until it expires.
+func Test_Tickets(t *testing.T) {
+	clock := &fakeClock{time.Unix(1_000_000, 0)}
+	tickets := NewTickets(time.Hour, 2, &Config{Now: clock.Now})
+
+	ticket, psk := issueTicket(t, tickets)
+	for i := 0; i < 2; i++ {
+		state, err := tickets.open(ticket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.uname != "alice" || !bytes.Equal(state.psk, psk) {
+			t.Fatalf("the ticket opened to %q and %x", state.uname, state.psk)
+		}
+		if err := tickets.use(state); err != nil {
+			t.Fatalf("use %d: %s", i+1, err)
+		}
+	}
+	state, err := tickets.open(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tickets.use(state) == nil {
+		t.Fatal("the ticket was used more times than it can be")
+	}
+
+	tampered := append([]byte{}, ticket...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := tickets.open(tampered); err == nil {
+		t.Fatal("a tampered ticket was opened")
+	}
+	if _, err := tickets.open(ticket[:4]); err == nil {
+		t.Fatal("a truncated ticket was opened")
+	}
+
+	ticket, _ = issueTicket(t, tickets)
+	clock.now = clock.now.Add(time.Hour)
+	if _, err := tickets.open(ticket); err != ErrTicketExpired {
+		t.Fatal("expected the ticket to be expired, got", err)
+	}
+}
+
+// Tests that the key tickets are sealed with rotates, that a retired key opens its tickets until they expire, and is thrown away then.
+func Test_Tickets_rotation(t *testing.T) {
+	clock := &fakeClock{time.Unix(1_000_000, 0)}
+	tickets := NewTickets(2*time.Hour, 0, &Config{Now: clock.Now})
+
+	first, _ := issueTicket(t, tickets)
+	state, err := tickets.open(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tickets.use(state)
+
+	clock.now = clock.now.Add(TICKET_KEY_ROTATION)
+	second, _ := issueTicket(t, tickets)
+	if bytes.Equal(first[:TICKET_KEY_ID_SIZE], second[:TICKET_KEY_ID_SIZE]) {
+		t.Fatal("the key didn't rotate")
+	}
+	if _, err := tickets.open(first); err != nil {
+		t.Fatal("the retired key doesn't open its tickets anymore:", err)
+	}
+
+	// every ticket of the first key is expired now
+	clock.now = clock.now.Add(2 * time.Hour)
+	issueTicket(t, tickets)
+	if len(tickets.keys) != 2 || len(tickets.uses) != 0 {
+		t.Fatalf("expected 2 keys and no uses left, got %d and %d", len(tickets.keys), len(tickets.uses))
+	}
+	if _, err := tickets.open(first); err == nil || err == ErrTicketExpired {
+		t.Fatal("expected the key of the ticket to be unknown, got", err)
+	}
+}
@@ -0,0 +1,89 @@
+package cerberus
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+)
+
+// Where the server looks its users up by default.
+const DB_FILE = "user_data.csv"
+
+// Returns the Credentials of the users in the given user database (as generated by utils/gen_data.go).
+func UsersFile(filename string) Credentials {
+	return func(uname string) ([]byte, []byte, []byte, error) {
+		return GetCredentials(filename, uname)
+	}
+}
+
+// Looks uname up in the given user database, whose fields are hex encoded.
+// Returns its salt, stored key and server key (all nil if there's no such user) and an error.
+func GetCredentials(filename, uname string) ([]byte, []byte, []byte, error) {
+	var salt, storedKey, servKey []byte
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if record[0] == uname {
+			// got a match
+			// no need to check errors (the file has been generated automatically, i know for a fact the hex encoding is correct)
+			salt, _ = hex.DecodeString(record[1])
+			// record[2] is the saltedPassword
+			storedKey, _ = hex.DecodeString(record[3])
+			servKey, _ = hex.DecodeString(record[4])
+		}
+	}
+
+	return salt, storedKey, servKey, nil
+}
+
+// Derives the SCRAM credentials of a new user from its password (with a fresh salt), the way utils/gen_data.go does.
+// Returns the salt, the stored key, the server key and an error.
+func NewCredentials(kdf KDFParams, passwd []byte) ([]byte, []byte, []byte, error) {
+	if len(passwd) == 0 {
+		return nil, nil, nil, errors.New("the password is empty")
+	}
+
+	salt := make([]byte, 32)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	_, storedKey, servKey := deriveKeys(kdf, passwd, salt)
+
+	return salt, storedKey, servKey, nil
+}
+
+// Keeps the credentials of the given users (name -> password) in memory, deriving them with kdf.
+// Returns their Credentials and an error.
+func MemoryUsers(kdf KDFParams, passwords map[string]string) (Credentials, error) {
+	users := make(map[string][3][]byte)
+	for uname, passwd := range passwords {
+		salt, storedKey, servKey, err := NewCredentials(kdf, []byte(passwd))
+		if err != nil {
+			return nil, err
+		}
+		users[uname] = [3][]byte{salt, storedKey, servKey}
+	}
+
+	return func(uname string) ([]byte, []byte, []byte, error) {
+		user := users[uname]
+		return user[0], user[1], user[2], nil
+	}, nil
+}
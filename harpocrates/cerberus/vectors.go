@@ -0,0 +1,364 @@
+package cerberus
+
+import (
+	"encoding/hex"
+	"errors"
+	"math/rand"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+	"github.com/mowzhja/harpocrates/harpocrates/seshat"
+)
+
+// The KDF of the vectors of whole handshakes (cheap, so that checking them is quick, and the one the tests log in with as often as they like).
+var VECTORS_KDF = KDFParams{Time: 1, Memory: 64, Threads: 1}
+
+// The test vectors of the protocol, for implementations in other languages (every byte string is hex encoded).
+type Vectors struct {
+	Notes         map[string]string `json:"notes"`
+	KeyDerivation []KDFVector       `json:"key_derivation"`
+	SCRAM         []SCRAMVector     `json:"scram"`
+	ECDHE         []ECDHEVector     `json:"ecdhe"`
+	Records       []RecordVector    `json:"records"`
+	Handshakes    []HandshakeVector `json:"handshakes"`
+}
+
+// The keys derived from a password.
+type KDFVector struct {
+	KDF            KDFParams `json:"kdf"`
+	Password       string    `json:"password"`
+	Salt           string    `json:"salt"`
+	SaltedPassword string    `json:"salted_password"`
+	ClientKey      string    `json:"client_key"`
+	StoredKey      string    `json:"stored_key"`
+	ServerKey      string    `json:"server_key"`
+}
+
+// The proof of a client and the signature of the server, for a given nonce.
+type SCRAMVector struct {
+	ClientKey       string `json:"client_key"`
+	StoredKey       string `json:"stored_key"`
+	ServerKey       string `json:"server_key"`
+	Nonce           string `json:"nonce"`
+	ClientSignature string `json:"client_signature"`
+	ClientProof     string `json:"client_proof"`
+	AuthMessage     string `json:"auth_message"`
+	ServerSignature string `json:"server_signature"`
+}
+
+// The key two sides share after swapping their ECDHE public keys.
+type ECDHEVector struct {
+	PrivateKey     string `json:"private_key"`
+	PublicKey      string `json:"public_key"`
+	PeerPrivateKey string `json:"peer_private_key"`
+	PeerPublicKey  string `json:"peer_public_key"`
+	SharedKey      string `json:"shared_key"`
+}
+
+// A message sealed in a record.
+type RecordVector struct {
+	Key          string `json:"key"`
+	SessionNonce string `json:"session_nonce"`
+	AEADNonce    string `json:"aead_nonce"`
+	Message      string `json:"message"`
+	Record       string `json:"record"`
+}
+
+// A whole handshake, and the secrets needed to follow it.
+type HandshakeVector struct {
+	Description      string          `json:"description"`
+	KDF              KDFParams       `json:"kdf"`
+	Username         string          `json:"username"`
+	Password         string          `json:"password"`
+	Salt             string          `json:"salt"` // the one the user is registered with (empty if it isn't)
+	ClientPrivateKey string          `json:"client_private_key"`
+	SharedKey        string          `json:"shared_key"`
+	Nonce            string          `json:"nonce"` // client and server nonce, once the challenge is sent
+	Messages         []MessageVector `json:"messages"`
+	ClientState      string          `json:"client_state"` // how the handshake ends for each side
+	ServerState      string          `json:"server_state"`
+}
+
+// A message of a handshake, with what it holds (once decrypted).
+type MessageVector struct {
+	FromClient bool   `json:"from_client"`
+	Message    string `json:"message"`
+	Plaintext  string `json:"plaintext,omitempty"`
+}
+
+// How everything in the vectors is computed (|| is concatenation).
+var vectorNotes = map[string]string{
+	"wire":           "every message is sent hex encoded (lowercase) on a line of its own (terminated by a newline)",
+	"version":        "the first message of the client starts with version = the version of the protocol (1 byte, 0x01); a server speaking another one answers \"VERSION_FAIL\" || the version it speaks, and the handshake ends",
+	"key_derivation": "salted_password = Argon2i(password, salt, time, memory (KiB), threads, 32 bytes); client_key = HMAC-SHA256(salted_password, \"Client Key\"); server_key = HMAC-SHA256(salted_password, \"Server Key\"); stored_key = SHA-256(client_key)",
+	"scram":          "client_signature = HMAC-SHA256(stored_key, nonce); client_proof = client_key XOR client_signature; auth_message = nonce || client_proof; server_signature = HMAC-SHA256(server_key, auth_message)",
+	"ecdhe":          "keys are points of NIST P-521, uncompressed (0x04 || x || y); shared_key = SHA-512/256(the shared point, uncompressed)",
+	"encryption":     "Encrypt(m) = aead_nonce || AES-256-GCM(key, aead_nonce, m), with a random 12 bytes aead_nonce and no additional data",
+	"records":        "record = Encrypt(session_nonce || message || 0x80 || zeros): the receiver drops the record unless session_nonce is the one of the session, and strips the zeros and the 0x80",
+	"handshake": "1. client: version || public key; 2. server: public key (both derive shared_key, the key of every message that follows); " +
+		"3. client: record(username), with the 32 random bytes client_nonce as session nonce; " +
+		"4. server: Encrypt(nonce || salt), where nonce = client_nonce || 32 random bytes is the session nonce from then on (the salt is empty for unknown users); " +
+		"5. client: Encrypt(auth_message); 6. server: record(\"SERVER_OK\") or record(\"SERVER_FAIL\"); 7. server: record(server_signature); 8. client: record(\"CLIENT_OK\") or record(\"CLIENT_FAIL\"). " +
+		"Anything unexpected ends the handshake.",
+	"tickets": "a server issuing tickets sends record(server_signature || lifetime || ticket) as message 7: lifetime is in seconds (4 bytes, big endian) and the ticket is opaque to the client, " +
+		"which resumes with psk = HMAC-SHA256(shared_key, \"resumption\" || auth_message)",
+	"resumption": "1. client: version || \"RESUME\" || client_nonce (32 random bytes) || public key || binder || ticket, where binder = HMAC-SHA256(psk, \"client binder\" || client_nonce || public key || ticket); " +
+		"2. server: public key || server_nonce (32 random bytes) || record(finished || lifetime || ticket), where finished = HMAC-SHA256(psk, \"server finished\" || message 1 (after the version) || public key || server_nonce), " +
+		"or \"RESUME_FAIL\" if it refuses the ticket; 3. client: record(\"CLIENT_OK\"). " +
+		"The key of the session is HMAC-SHA256(psk, \"resumed session\" || shared_key || nonce), with nonce = client_nonce || server_nonce as session nonce, " +
+		"and the next ticket resumes with HMAC-SHA256(key, \"resumption\" || nonce).",
+	"session": "after the handshake, client_secret || server_secret = HKDF-SHA256(key, salt = session nonce, info = \"harpocrates session traffic\", 64 bytes), the secret of what each end sends; " +
+		"the records of a direction are sealed with key = the first 32 bytes of HKDF-SHA256(secret, no salt, info = \"harpocrates record traffic\", 64 bytes), next_secret = the other 32, " +
+		"as AES-256-GCM(key, sequence number (12 bytes, big endian, from 0), content || type || zeros). Type 2 carries the messages; type 7 (a key update, empty) is the last record sealed with a key: " +
+		"the ones after it are sealed with the key of next_secret, from sequence number 0 again. A record of nothing but zeros is padding, and dropped.",
+	"padding": "how many zeros pad a record is up to its sender (the receiver strips them whatever their number): by default, the padded message (0x80 or the type included) " +
+		"is as long as the next power of two of at least 128 bytes, up to 16384, and a multiple of 16384 past it",
+}
+
+// Generates the test vectors of the protocol, the same every time (whatever should be random is drawn from math/rand, seeded: never use them as real keys).
+// Returns the vectors and an error.
+func GenerateVectors() (*Vectors, error) {
+	r := rand.New(rand.NewSource(1))
+	v := &Vectors{Notes: vectorNotes}
+
+	for _, kdf := range []KDFParams{VECTORS_KDF, DEFAULT_KDF} {
+		passwd, salt := []byte("alicespass"), draw(r, 32)
+		clientKey, storedKey, servKey := deriveKeys(kdf, passwd, salt)
+		v.KeyDerivation = append(v.KeyDerivation, KDFVector{
+			KDF:            kdf,
+			Password:       hex.EncodeToString(passwd),
+			Salt:           hex.EncodeToString(salt),
+			SaltedPassword: hex.EncodeToString(saltPassword(kdf, passwd, salt)),
+			ClientKey:      hex.EncodeToString(clientKey),
+			StoredKey:      hex.EncodeToString(storedKey),
+			ServerKey:      hex.EncodeToString(servKey),
+		})
+	}
+
+	for i := 0; i < 2; i++ {
+		s, err := scramVector(draw(r, 32), draw(r, 64))
+		if err != nil {
+			return nil, err
+		}
+		v.SCRAM = append(v.SCRAM, s)
+	}
+
+	for i := 0; i < 2; i++ {
+		e, err := ecdheVector(r)
+		if err != nil {
+			return nil, err
+		}
+		v.ECDHE = append(v.ECDHE, e)
+	}
+
+	for _, m := range []struct {
+		nlen int
+		msg  []byte
+	}{{32, []byte("alice")}, {64, []byte("SERVER_OK")}, {64, []byte{}}, {64, draw(r, 100)}} {
+		rec, err := recordVector(r, draw(r, anubis.BYTE_SEC), draw(r, m.nlen), m.msg)
+		if err != nil {
+			return nil, err
+		}
+		v.Records = append(v.Records, rec)
+	}
+
+	for _, h := range []struct{ description, uname, passwd string }{
+		{"alice logs in", "alice", "alicespass"},
+		{"alice logs in with the wrong password: the server refuses the proof", "alice", "bobspass"},
+		{"mallory isn't a user: the server sends an empty salt and the client gives up", "mallory", "mallorypass"},
+	} {
+		hv, err := handshakeVector(r, h.description, h.uname, h.passwd)
+		if err != nil {
+			return nil, err
+		}
+		v.Handshakes = append(v.Handshakes, hv)
+	}
+
+	return v, nil
+}
+
+// Draws n bytes from r.
+func draw(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+
+	return b
+}
+
+// Computes the proof of the client (whose password is alicespass, salted with salt) and the signature of the server for nonce.
+// Returns the vector and an error.
+func scramVector(salt, nonce []byte) (SCRAMVector, error) {
+	passwd := []byte("alicespass")
+	clientKey, storedKey, servKey := deriveKeys(VECTORS_KDF, passwd, salt)
+	authMessage, _, _, err := computeParams(VECTORS_KDF, passwd, salt, nonce)
+	if err != nil {
+		return SCRAMVector{}, err
+	}
+	clientProof, _, err := seshat.ExtractDataNonce(authMessage, 64)
+	if err != nil {
+		return SCRAMVector{}, err
+	}
+	clientSignature, err := seshat.XOR(clientProof, clientKey)
+	if err != nil {
+		return SCRAMVector{}, err
+	}
+	serverSignature, err := seshat.GetServerSignature(authMessage, servKey)
+	if err != nil {
+		return SCRAMVector{}, err
+	}
+	if authClient(clientProof, nonce, storedKey) != nil {
+		return SCRAMVector{}, errors.New("the proof of the vector doesn't verify")
+	}
+
+	return SCRAMVector{
+		ClientKey:       hex.EncodeToString(clientKey),
+		StoredKey:       hex.EncodeToString(storedKey),
+		ServerKey:       hex.EncodeToString(servKey),
+		Nonce:           hex.EncodeToString(nonce),
+		ClientSignature: hex.EncodeToString(clientSignature),
+		ClientProof:     hex.EncodeToString(clientProof),
+		AuthMessage:     hex.EncodeToString(authMessage),
+		ServerSignature: hex.EncodeToString(serverSignature),
+	}, nil
+}
+
+// Runs an ECDHE between two sides with keys drawn from r.
+// Returns the vector and an error.
+func ecdheVector(r *rand.Rand) (ECDHEVector, error) {
+	priv, pub, err := hermes.NewECDHEKeys(r)
+	if err != nil {
+		return ECDHEVector{}, err
+	}
+	peerPriv, peerPub, err := hermes.NewECDHEKeys(r)
+	if err != nil {
+		return ECDHEVector{}, err
+	}
+
+	sharedKey, err := hermes.ECDHESharedKey(priv, peerPub)
+	if err != nil {
+		return ECDHEVector{}, err
+	}
+	peerSharedKey, err := hermes.ECDHESharedKey(peerPriv, pub)
+	if err != nil {
+		return ECDHEVector{}, err
+	}
+	if string(sharedKey) != string(peerSharedKey) {
+		return ECDHEVector{}, errors.New("the two sides of the vector don't share a key")
+	}
+
+	return ECDHEVector{
+		PrivateKey:     hex.EncodeToString(priv),
+		PublicKey:      hex.EncodeToString(pub),
+		PeerPrivateKey: hex.EncodeToString(peerPriv),
+		PeerPublicKey:  hex.EncodeToString(peerPub),
+		SharedKey:      hex.EncodeToString(sharedKey),
+	}, nil
+}
+
+// Seals msg in a record, under key and the session nonce sessionNonce.
+// Returns the vector and an error.
+func recordVector(r *rand.Rand, key, sessionNonce, msg []byte) (RecordVector, error) {
+	cipher, err := anubis.NewCipherWith(key, r)
+	if err != nil {
+		return RecordVector{}, err
+	}
+	cipher.UpdateNonce(sessionNonce)
+	record, err := hermes.SealRecord(cipher, msg, hermes.DEFAULT_PADDING)
+	if err != nil {
+		return RecordVector{}, err
+	}
+
+	return RecordVector{
+		Key:          hex.EncodeToString(key),
+		SessionNonce: hex.EncodeToString(sessionNonce),
+		AEADNonce:    hex.EncodeToString(record[:12]),
+		Message:      hex.EncodeToString(msg),
+		Record:       hex.EncodeToString(record),
+	}, nil
+}
+
+// Runs a whole handshake of uname (logging in with passwd) against a server where alice is registered with alicespass.
+// Returns the vector and an error.
+func handshakeVector(r *rand.Rand, description, uname, passwd string) (HandshakeVector, error) {
+	salt := draw(r, 32)
+	_, storedKey, servKey := deriveKeys(VECTORS_KDF, []byte("alicespass"), salt)
+	users := func(u string) ([]byte, []byte, []byte, error) {
+		if u != "alice" {
+			return nil, nil, nil, nil
+		}
+		return salt, storedKey, servKey, nil
+	}
+
+	client := NewClientHandshake([]byte(uname), []byte(passwd), &Config{KDF: VECTORS_KDF, Rand: r})
+	server := NewServerHandshake(users, &Config{Rand: r})
+
+	type sent struct {
+		fromClient bool
+		msg        []byte
+	}
+	var transcript, queue []sent
+
+	out, err := client.Step(nil)
+	if err != nil {
+		return HandshakeVector{}, err
+	}
+	privKey := client.privKey
+	for _, m := range out {
+		queue = append(queue, sent{true, m})
+	}
+	for len(queue) > 0 {
+		m := queue[0]
+		queue = queue[1:]
+		transcript = append(transcript, m)
+
+		var to Handshake = server
+		if !m.fromClient {
+			to = client
+		}
+		// the refused handshakes end with an error on purpose
+		out, _ := to.Step(m.msg)
+		for _, o := range out {
+			queue = append(queue, sent{!m.fromClient, o})
+		}
+	}
+
+	if len(transcript) < 2 {
+		return HandshakeVector{}, errors.New("the handshake of the vector ended before the keys were swapped")
+	}
+	sharedKey, err := hermes.ECDHESharedKey(privKey, transcript[1].msg)
+	if err != nil {
+		return HandshakeVector{}, err
+	}
+	cipher, err := anubis.NewCipher(sharedKey)
+	if err != nil {
+		return HandshakeVector{}, err
+	}
+
+	hv := HandshakeVector{
+		Description:      description,
+		KDF:              VECTORS_KDF,
+		Username:         uname,
+		Password:         passwd,
+		ClientPrivateKey: hex.EncodeToString(privKey),
+		SharedKey:        hex.EncodeToString(sharedKey),
+		Nonce:            hex.EncodeToString(server.cipher.Nonce()),
+		ClientState:      client.State().String(),
+		ServerState:      server.State().String(),
+	}
+	if uname == "alice" {
+		hv.Salt = hex.EncodeToString(salt)
+	}
+	for i, m := range transcript {
+		mv := MessageVector{FromClient: m.fromClient, Message: hex.EncodeToString(m.msg)}
+		if i >= 2 {
+			plaintext, err := cipher.Decrypt(m.msg)
+			if err != nil {
+				return HandshakeVector{}, err
+			}
+			mv.Plaintext = hex.EncodeToString(plaintext)
+		}
+		hv.Messages = append(hv.Messages, mv)
+	}
+
+	return hv, nil
+}
@@ -0,0 +1,126 @@
+package cerberus
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// Where the vectors are published.
+const VECTORS_FILE = "../vectors.json"
+
+// Utility function, decodes the hex string s (failing the test if it isn't one).
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// Tests that the published vectors are the ones the code generates (run with -update after changing the protocol on purpose).
+func Test_GenerateVectors(t *testing.T) {
+	v, err := GenerateVectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated = append(generated, '\n')
+
+	if *update {
+		err := os.WriteFile(VECTORS_FILE, generated, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	published, err := os.ReadFile(VECTORS_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(published) != string(generated) {
+		t.Fatalf("%s is out of date (regenerate it with -update)", VECTORS_FILE)
+	}
+}
+
+// Tests the published vectors the way another implementation would, from what they say alone.
+func Test_Vectors(t *testing.T) {
+	published, err := os.ReadFile(VECTORS_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v Vectors
+	if err := json.Unmarshal(published, &v); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range v.SCRAM {
+		if err := authClient(unhex(t, s.ClientProof), unhex(t, s.Nonce), unhex(t, s.StoredKey)); err != nil {
+			t.Fatalf("the proof %s doesn't verify: %s", s.ClientProof, err)
+		}
+	}
+
+	for _, e := range v.ECDHE {
+		for _, side := range [][2]string{{e.PrivateKey, e.PeerPublicKey}, {e.PeerPrivateKey, e.PublicKey}} {
+			sharedKey, err := hermes.ECDHESharedKey(unhex(t, side[0]), unhex(t, side[1]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(sharedKey) != e.SharedKey {
+				t.Fatalf("expected the shared key %s, got %x", e.SharedKey, sharedKey)
+			}
+		}
+	}
+
+	for _, r := range v.Records {
+		cipher, err := anubis.NewCipher(unhex(t, r.Key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := unhex(t, r.Record)
+		plaintext, err := cipher.Decrypt(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nlen := len(r.SessionNonce) / 2
+		msg, err := hermes.Unpad(plaintext[nlen:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(record[:12]) != r.AEADNonce || hex.EncodeToString(plaintext[:nlen]) != r.SessionNonce || hex.EncodeToString(msg) != r.Message {
+			t.Fatalf("expected the record to hold %s and %s, got %x", r.SessionNonce, r.Message, plaintext)
+		}
+	}
+
+	ends := [][2]string{{"DONE", "DONE"}, {"FAILED", "FAILED"}, {"FAILED", "SERVER_SENT_CHALLENGE"}}
+	if len(v.Handshakes) != len(ends) {
+		t.Fatalf("expected %d handshakes, got %d", len(ends), len(v.Handshakes))
+	}
+	for i, h := range v.Handshakes {
+		if h.ClientState != ends[i][0] || h.ServerState != ends[i][1] {
+			t.Fatalf("%s: expected the handshake to end in %v, not %s and %s", h.Description, ends[i], h.ClientState, h.ServerState)
+		}
+
+		cipher, err := anubis.NewCipher(unhex(t, h.SharedKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range h.Messages[2:] {
+			plaintext, err := cipher.Decrypt(unhex(t, m.Message))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(plaintext) != m.Plaintext {
+				t.Fatalf("%s: expected %s to hold %s, got %x", h.Description, m.Message, m.Plaintext, plaintext)
+			}
+		}
+	}
+}
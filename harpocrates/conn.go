@@ -0,0 +1,127 @@
+package harpocrates
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/cerberus"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// A Conn is an authenticated and encrypted connection between a client and a server, implementing net.Conn.
+// What's written is sent in records, which are padded and encrypted with keys of their own in each direction, updated along the way (see hermes.RecordLayer).
+// A Read() that times out can be retried, but a Write() that times out leaves the connection unusable.
+// Both ends send keepalives when they have nothing to say, and a Read() fails with hermes.ErrIdleTimeout once the other end stopped sending them (see Config.Timeouts).
+type Conn struct {
+	conn    net.Conn
+	records *hermes.RecordLayer
+	uname   string
+	ticket  *cerberus.Ticket // to resume the session later (the client's side only)
+
+	rmu sync.Mutex
+	buf []byte // what was received but not read yet
+	wmu sync.Mutex
+}
+
+func newConn(conn net.Conn, records *hermes.RecordLayer, uname string, cfg *Config) *Conn {
+	records.SetKeyUpdatePolicy(cfg.keyUpdates())
+	records.SetPadding(cfg.Padding)
+	records.SetTimeouts(cfg.timeouts())
+
+	return &Conn{
+		conn:    conn,
+		records: records,
+		uname:   uname,
+	}
+}
+
+// Returns the name of the authenticated user: the one we logged in as (Dial) or the client's (Listen).
+func (c *Conn) Username() string {
+	return c.uname
+}
+
+// Returns the ticket the server issued, that resumes the session on a new connection (nil if it issued none, and on the side of the server).
+func (c *Conn) Ticket() *cerberus.Ticket {
+	return c.ticket
+}
+
+// Reads the data sent by the other end, waiting for the next record if there's none left.
+// Returns the number of bytes read and an error.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.buf) == 0 {
+		rtype, record, err := c.records.ReadRecord()
+		if err != nil {
+			return 0, err
+		}
+		if rtype != hermes.RECORD_DATA {
+			return 0, errors.New("unexpected record from the other end")
+		}
+		c.buf = record
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+
+	return n, nil
+}
+
+// Sends data to the other end, in records of at most MAX_RECORD_SIZE bytes.
+// Returns the number of bytes sent and an error.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	sent := 0
+	for sent < len(b) {
+		n := len(b) - sent
+		if n > MAX_RECORD_SIZE {
+			n = MAX_RECORD_SIZE
+		}
+		if err := c.records.WriteRecord(hermes.RECORD_DATA, b[sent:sent+n]); err != nil {
+			return sent, err
+		}
+		sent += n
+	}
+
+	return sent, nil
+}
+
+// Updates the keys we send with now, instead of waiting for Config.KeyUpdates to say so.
+// Returns an error if the update couldn't be sent.
+func (c *Conn) UpdateKeys() error {
+	return c.records.UpdateKeys()
+}
+
+// Closes the connection.
+func (c *Conn) Close() error {
+	return c.records.Close()
+}
+
+// Returns our address.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// Returns the address of the other end.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Sets the read and write deadlines.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.records.SetDeadline(t)
+}
+
+// Sets when Read() gives up waiting.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.records.SetReadDeadline(t)
+}
+
+// Sets when Write() gives up.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.records.SetWriteDeadline(t)
+}
@@ -0,0 +1,5 @@
+module github.com/mowzhja/harpocrates/harpocrates
+
+go 1.16
+
+require golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
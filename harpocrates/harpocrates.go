@@ -0,0 +1,191 @@
+// Harpocrates is the Greek god of silence and secrets, and the name of the whole project.
+// Package harpocrates lets other programs use its secure sessions the way they'd use crypto/tls:
+// Dial() connects to a server and authenticates, Listen() accepts authenticated clients, and both give connections implementing net.Conn.
+package harpocrates
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/harpocrates/cerberus"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// How long the handshake (ECDHE and SCRAM) can take by default: the key derivation of the client is slow on purpose.
+const HANDSHAKE_TIMEOUT = hermes.HANDSHAKE_TIMEOUT
+
+// The most handshakes a Listener runs at once.
+const MAX_PENDING_HANDSHAKES = 64
+
+// The most data sent in a single record.
+const MAX_RECORD_SIZE = 16 << 10
+
+// A Config holds the settings of Dial() and Listen().
+type Config struct {
+	// Who we log in as, with Dial().
+	Username string
+	Password []byte
+	// How Dial() salts the password: the way the user was registered (cerberus.DEFAULT_KDF if left empty).
+	KDF cerberus.KDFParams
+	// A ticket from an earlier connection (see Conn.Ticket()): Dial() resumes the session with it, skipping the key derivation.
+	Ticket *cerberus.Ticket
+
+	// Looks up the SCRAM credentials of a user, for Listen().
+	// There is no default: Listen() refuses to start without them (cerberus.UsersFile(cerberus.DB_FILE) reads the file of the server).
+	Credentials cerberus.Credentials
+	// Issues resumption tickets to the clients of Listen(), and lets them resume their sessions with them (none are issued if nil).
+	Tickets *cerberus.Tickets
+
+	// How long the handshake can take (HANDSHAKE_TIMEOUT if 0).
+	HandshakeTimeout time.Duration
+	// How often each end sends a keepalive, and how long it waits for the other end, once the handshake is over (hermes.DEFAULT_TIMEOUTS if left empty).
+	Timeouts hermes.Timeouts
+	// When each end updates the keys it sends with (hermes.DEFAULT_KEY_UPDATES if left empty).
+	KeyUpdates hermes.KeyUpdatePolicy
+	// How each end pads what it sends, the handshake included (hermes.DEFAULT_PADDING if left empty).
+	Padding hermes.PaddingPolicy
+
+	// Where the progress of the handshake is reported (nowhere if nil).
+	Log io.Writer
+
+	// Where the keys and nonces come from (crypto/rand if nil), and the clock the deadlines are set by (time.Now if nil).
+	// Only tests have a reason to change them: with both fixed, a handshake is the same byte for byte every time.
+	Rand io.Reader
+	Now  func() time.Time
+}
+
+// Connects to the server at addr and authenticates as cfg.Username, giving up when ctx is done.
+// With cfg.Ticket, the session is resumed instead (logging in with the password only if the server refuses the ticket).
+// Returns the connection (whose Ticket() resumes the session next time) and an error.
+func Dial(ctx context.Context, addr string, cfg *Config) (*Conn, error) {
+	if cfg == nil || (cfg.Username == "" && cfg.Ticket == nil) {
+		return nil, errors.New("no username to log in with")
+	}
+
+	if cfg.Ticket != nil {
+		c, err := dial(ctx, addr, cfg, func(conn net.Conn) (anubis.Cipher, *cerberus.Ticket, error) {
+			return cerberus.ResumeWithServer(conn, cfg.Ticket, cfg.auth())
+		})
+		refused := errors.Is(err, cerberus.ErrTicketRejected) || errors.Is(err, cerberus.ErrTicketExpired)
+		if !refused || cfg.Username == "" {
+			return c, err
+		}
+	}
+
+	return dial(ctx, addr, cfg, func(conn net.Conn) (anubis.Cipher, *cerberus.Ticket, error) {
+		return cerberus.LoginWithServer(conn, []byte(cfg.Username), cfg.Password, cfg.auth())
+	})
+}
+
+// Connects to the server at addr and authenticates with auth, giving up when ctx is done.
+// Returns the connection and an error.
+func dial(ctx context.Context, addr string, cfg *Config, auth func(conn net.Conn) (anubis.Cipher, *cerberus.Ticket, error)) (*Conn, error) {
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := hermes.NewConn(raw)
+
+	var session anubis.Cipher
+	var ticket *cerberus.Ticket
+	err = handshake(ctx, conn, cfg.handshakeDeadline(), func() error {
+		cipher, t, err := auth(conn)
+		if err != nil {
+			return err
+		}
+		session, ticket = cipher, t
+
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	uname := cfg.Username
+	if cfg.Ticket != nil {
+		uname = cfg.Ticket.Username
+	}
+	c := newConn(conn, hermes.NewSessionRecords(conn, session, hermes.CLIENT), uname, cfg)
+	c.ticket = ticket
+
+	return c, nil
+}
+
+// Runs run on conn, before deadline and before ctx is done.
+// Returns the error of run, or the one of ctx.
+func handshake(ctx context.Context, conn net.Conn, deadline time.Time, run func() error) error {
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	// the handshake is cut short if ctx is cancelled
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	err := run()
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	return conn.SetDeadline(time.Time{})
+}
+
+// Returns when a handshake starting now has to be over.
+func (cfg *Config) handshakeDeadline() time.Time {
+	timeout := cfg.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = HANDSHAKE_TIMEOUT
+	}
+
+	now := time.Now
+	if cfg.Now != nil {
+		now = cfg.Now
+	}
+
+	return now().Add(timeout)
+}
+
+// Returns when the keys of a connection are updated.
+func (cfg *Config) keyUpdates() hermes.KeyUpdatePolicy {
+	policy := cfg.KeyUpdates
+	if policy.Records == 0 && policy.Bytes == 0 && policy.Interval == 0 {
+		policy = hermes.DEFAULT_KEY_UPDATES
+		policy.Now = cfg.KeyUpdates.Now
+	}
+
+	return policy
+}
+
+// Returns the timeouts of a connection.
+func (cfg *Config) timeouts() hermes.Timeouts {
+	if cfg.Timeouts == (hermes.Timeouts{}) {
+		return hermes.DEFAULT_TIMEOUTS
+	}
+
+	return cfg.Timeouts
+}
+
+// Returns the settings of the handshake itself.
+func (cfg *Config) auth() *cerberus.Config {
+	return &cerberus.Config{KDF: cfg.KDF, Rand: cfg.Rand, Now: cfg.Now, Tickets: cfg.Tickets, Padding: cfg.Padding, Log: cfg.Log}
+}
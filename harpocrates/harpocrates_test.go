@@ -0,0 +1,232 @@
+package harpocrates
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/cerberus"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// Utility function, listens on an ephemeral port with alice (whose password is alicespass) and bob (bobspass) as users, issuing tickets.
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+
+	users, err := cerberus.MemoryUsers(cerberus.VECTORS_KDF, map[string]string{"alice": "alicespass", "bob": "bobspass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Listen("127.0.0.1:0", &Config{Credentials: users, Tickets: cerberus.NewTickets(0, 0, nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	return l
+}
+
+// Tests that data written on either side gets to the other whole, and that a read that times out can be retried.
+func Test_Conn(t *testing.T) {
+	l := listen(t)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	// the client updates its keys after every record
+	cfg := &Config{Username: "alice", Password: []byte("alicespass"), KDF: cerberus.VECTORS_KDF, KeyUpdates: hermes.KeyUpdatePolicy{Records: 1}}
+	client, err := Dial(ctx, l.Addr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	server := <-accepted
+	if server == nil {
+		t.FailNow()
+	}
+	defer server.Close()
+	if server.(*Conn).Username() != "alice" {
+		t.Fatalf("the server sees %q", server.(*Conn).Username())
+	}
+
+	// larger than a record, so that it's sent in several
+	msg := make([]byte, 3*MAX_RECORD_SIZE+100)
+	rand.Read(msg)
+	go func() {
+		if _, err := client.Write(msg); err != nil {
+			t.Error(err)
+		}
+	}()
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("the message was garbled on the way")
+	}
+
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	client.SetReadDeadline(time.Time{})
+
+	go func() {
+		server.(*Conn).UpdateKeys()
+		server.Write([]byte("still here"))
+	}()
+	got = make([]byte, len("still here"))
+	if _, err := io.ReadFull(client, got); err != nil || string(got) != "still here" {
+		t.Fatalf("got %q and %v after the timeout", got, err)
+	}
+}
+
+// Tests that Dial() fails with the wrong password, and that the listener doesn't hand the connection over.
+func Test_Dial_wrongPassword(t *testing.T) {
+	l := listen(t)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if c, err := Dial(ctx, l.Addr().String(), &Config{Username: "alice", Password: []byte("bobspass"), KDF: cerberus.VECTORS_KDF}); err == nil {
+		c.Close()
+		t.Fatal("logged in with the wrong password")
+	}
+
+	l.Close()
+	if c := <-accepted; c != nil {
+		t.Fatal("the listener accepted a client that didn't authenticate")
+	}
+}
+
+// Tests that a listener without credentials lets no one in: Listen() refuses to start, and NewListener() fails every handshake.
+func Test_Listen_noCredentials(t *testing.T) {
+	if l, err := Listen("127.0.0.1:0", &Config{}); !errors.Is(err, ErrNoCredentials) {
+		if l != nil {
+			l.Close()
+		}
+		t.Fatalf("expected ErrNoCredentials, got %v", err)
+	}
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(raw, nil)
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if c, err := Dial(ctx, l.Addr().String(), &Config{Username: "alice", Password: []byte("alicespass"), KDF: cerberus.VECTORS_KDF}); err == nil {
+		c.Close()
+		t.Fatal("logged in to a listener without credentials")
+	}
+}
+
+// Tests that the progress of the handshake goes to the Log of the Config, and nowhere without one.
+func Test_Dial_log(t *testing.T) {
+	l := listen(t)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	var log bytes.Buffer
+	c, err := Dial(ctx, l.Addr().String(), &Config{Username: "alice", Password: []byte("alicespass"), KDF: cerberus.VECTORS_KDF, Log: &log})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if !strings.Contains(log.String(), "[+]") {
+		t.Fatalf("expected the progress of the handshake, got %q", log.String())
+	}
+}
+
+// Tests that the handshake deadline is set by the clock of the Config.
+func Test_Dial_clock(t *testing.T) {
+	l := listen(t)
+
+	// a clock an hour late sets a deadline that's already gone
+	late := func() time.Time { return time.Now().Add(-time.Hour) }
+	c, err := Dial(context.Background(), l.Addr().String(), &Config{Username: "alice", Password: []byte("alicespass"), KDF: cerberus.VECTORS_KDF, Now: late})
+	if err == nil {
+		c.Close()
+		t.Fatal("the handshake should be past its deadline")
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+}
+
+// Tests that Dial() resumes the session with a ticket, and logs in with the password when the server refuses it.
+func Test_Dial_ticket(t *testing.T) {
+	l := listen(t)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	c, err := Dial(ctx, l.Addr().String(), &Config{Username: "alice", Password: []byte("alicespass"), KDF: cerberus.VECTORS_KDF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	first := c.Ticket()
+	if first == nil {
+		t.Fatal("the server issued no ticket")
+	}
+
+	c, err = Dial(ctx, l.Addr().String(), &Config{Ticket: first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if c.Username() != "alice" || c.Ticket() == nil {
+		t.Fatalf("expected alice to resume their session and get a new ticket, got %q and %v", c.Username(), c.Ticket())
+	}
+
+	// the first ticket is used up: without a password there's nothing to fall back on
+	if _, err := Dial(ctx, l.Addr().String(), &Config{Ticket: first}); !errors.Is(err, cerberus.ErrTicketRejected) {
+		t.Fatalf("expected the ticket to be rejected, got %v", err)
+	}
+	// with one, it's used (and checked)
+	_, err = Dial(ctx, l.Addr().String(), &Config{Ticket: first, Username: "alice", Password: []byte("bobspass"), KDF: cerberus.VECTORS_KDF})
+	if !errors.Is(err, cerberus.ErrAuthFailed) {
+		t.Fatalf("expected to fall back on the (wrong) password, got %v", err)
+	}
+}
@@ -0,0 +1,324 @@
+package hermes
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// The bounds of the records of the constant-rate mode, and of the interval between two of them.
+// The longest interval is well within the keepalive interval of DEFAULT_TIMEOUTS, for the other end not to take a silence between two records for a dead peer.
+const (
+	MIN_COVER_SIZE     = 64
+	MAX_COVER_SIZE     = 64 << 10
+	MIN_COVER_INTERVAL = 10 * time.Millisecond
+	MAX_COVER_INTERVAL = 10 * time.Second
+)
+
+// The smallest budget of the constant-rate mode, in bytes per second: records of MIN_COVER_SIZE bytes every MAX_COVER_INTERVAL.
+const MIN_COVER_BUDGET = 7
+
+// Length of the header of a record carried in chunks: its type (1 byte) and the length of its content (4 bytes).
+const CHUNKED_HEADER_SIZE = 5
+
+// What the constant-rate mode of a peer to peer connection (direct or relayed) costs: a record of Size bytes every Interval, whether there's something to send or not.
+// What's sent goes in those records, in chunks, and the ones with nothing to carry are padding only: someone watching the connection can't tell when
+// the peers talk, and how much they say.
+type CoverTraffic struct {
+	Interval time.Duration // between two records (0 for no constant-rate mode)
+	Size     int           // of every record (before encryption)
+	Budget   int           // the most bytes per second the mode can cost (no limit if 0)
+}
+
+// What a client that asks for the constant-rate mode offers by default: 10 records of 1 KiB per second, at most 16 KiB per second.
+var DEFAULT_COVER_TRAFFIC = CoverTraffic{Interval: 100 * time.Millisecond, Size: 1 << 10, Budget: 16 << 10}
+
+// Agrees with the peer on the constant-rate mode of the connection: each end offers the CoverTraffic it wants (a zero Interval if it doesn't want it),
+// and the mode is on as soon as one of them asks for it, at the shortest interval and largest size of the two, within the smallest budget
+// (with fewer records first, then smaller ones, for it to fit).
+// Like StartRatchet(), it must be called by both ends at the same point of the conversation.
+// Returns what was agreed on (the mode is on from then on if its Interval isn't 0) and an error.
+func (p *Peer) NegotiateCover(offer CoverTraffic) (CoverTraffic, error) {
+	if offer.Interval > 0 && (offer.Size < MIN_COVER_SIZE || offer.Size > MAX_COVER_SIZE) {
+		return CoverTraffic{}, errors.New("invalid size of the records")
+	}
+	if offer.Interval < 0 || offer.Budget < 0 {
+		return CoverTraffic{}, errors.New("invalid constant-rate mode")
+	}
+	if offer.Budget > 0 && offer.Budget < MIN_COVER_BUDGET {
+		return CoverTraffic{}, errors.New("the budget of the constant-rate mode is too small")
+	}
+
+	var peerOffer CoverTraffic
+	var err error
+	if p.dialer {
+		err = p.writeRecord(RECORD_COVER, encodeCover(offer))
+		if err == nil {
+			peerOffer, err = p.readCoverRecord()
+		}
+	} else {
+		peerOffer, err = p.readCoverRecord()
+		if err == nil {
+			err = p.writeRecord(RECORD_COVER, encodeCover(offer))
+		}
+	}
+	if err != nil {
+		return CoverTraffic{}, err
+	}
+
+	agreed := agreeCover(offer, peerOffer)
+	if agreed.Interval > 0 {
+		p.records.StartConstantRate(agreed.Interval, agreed.Size)
+	}
+
+	return agreed, nil
+}
+
+// Reads a record that must be a constant-rate offer.
+// Returns the offer and an error.
+func (p *Peer) readCoverRecord() (CoverTraffic, error) {
+	rtype, data, err := p.readRecord()
+	if err != nil {
+		return CoverTraffic{}, err
+	}
+	if rtype != RECORD_COVER || len(data) != 12 {
+		return CoverTraffic{}, errors.New("unexpected record from the peer")
+	}
+
+	offer := CoverTraffic{
+		Interval: time.Duration(binary.BigEndian.Uint32(data)) * time.Millisecond,
+		Size:     int(binary.BigEndian.Uint32(data[4:])),
+		Budget:   int(binary.BigEndian.Uint32(data[8:])),
+	}
+	if offer.Interval > 0 && (offer.Size < MIN_COVER_SIZE || offer.Size > MAX_COVER_SIZE) {
+		return CoverTraffic{}, errors.New("invalid size of the records")
+	}
+	if offer.Budget > 0 && offer.Budget < MIN_COVER_BUDGET {
+		return CoverTraffic{}, errors.New("the budget of the constant-rate mode is too small")
+	}
+
+	return offer, nil
+}
+
+// Encodes an offer the way RECORD_COVER carries it: the interval in milliseconds, the size and the budget (4 bytes each, big endian).
+func encodeCover(offer CoverTraffic) []byte {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data, uint32(offer.Interval/time.Millisecond))
+	binary.BigEndian.PutUint32(data[4:], uint32(offer.Size))
+	binary.BigEndian.PutUint32(data[8:], uint32(offer.Budget))
+
+	return data
+}
+
+// Combines the offers of the two ends (the same way on both, whichever is ours).
+// Returns what they agree on.
+func agreeCover(a, b CoverTraffic) CoverTraffic {
+	a.Interval, b.Interval = a.Interval/time.Millisecond*time.Millisecond, b.Interval/time.Millisecond*time.Millisecond
+	if a.Interval <= 0 && b.Interval <= 0 {
+		return CoverTraffic{}
+	}
+
+	agreed := CoverTraffic{Interval: a.Interval, Size: a.Size, Budget: a.Budget}
+	if a.Interval <= 0 || (b.Interval > 0 && b.Interval < a.Interval) {
+		agreed.Interval = b.Interval
+	}
+	if b.Size > agreed.Size {
+		agreed.Size = b.Size
+	}
+	if agreed.Budget <= 0 || (b.Budget > 0 && b.Budget < agreed.Budget) {
+		agreed.Budget = b.Budget
+	}
+
+	if agreed.Interval < MIN_COVER_INTERVAL {
+		agreed.Interval = MIN_COVER_INTERVAL
+	}
+	if agreed.Interval > MAX_COVER_INTERVAL {
+		agreed.Interval = MAX_COVER_INTERVAL
+	}
+	// fewer records, rather than smaller ones, to stay within the budget
+	if agreed.Budget > 0 && int64(agreed.Size)*int64(time.Second) > int64(agreed.Budget)*int64(agreed.Interval) {
+		agreed.Interval = time.Duration(int64(agreed.Size) * int64(time.Second) / int64(agreed.Budget))
+	}
+	// unless they'd be too far apart (the budget is never below MIN_COVER_BUDGET, so smaller records fit then)
+	if agreed.Interval > MAX_COVER_INTERVAL {
+		agreed.Interval = MAX_COVER_INTERVAL
+		agreed.Size = int(int64(agreed.Budget) * int64(MAX_COVER_INTERVAL) / int64(time.Second))
+	}
+
+	return agreed
+}
+
+// The constant-rate mode of a RecordLayer: what's waiting for a slot.
+type pacer struct {
+	interval time.Duration
+	size     int
+	queue    []*queued
+	update   bool  // the next slot goes to a key update
+	err      error // why the mode stopped (nil while it's running)
+	stop     chan struct{}
+}
+
+// A record waiting for its chunks to be sent.
+type queued struct {
+	data []byte // what's left of it
+	done chan error
+}
+
+// Returned to the records still waiting for a slot when the constant-rate mode is stopped.
+var ErrConstantRateStopped = errors.New("the constant-rate mode was stopped")
+
+// Starts sending a record of size bytes every interval, in which what WriteRecord() is given goes in chunks (padding only if there's nothing to send).
+// WriteRecord() waits for the record to be sent from then on, and UpdateKeys() for the next slot; the other end needs to do nothing to read them.
+// The records are the keepalives as well, so they're never further apart than the keepalive interval of the timeouts set so far.
+func (r *RecordLayer) StartConstantRate(interval time.Duration, size int) {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+
+	if r.pacer != nil && r.pacer.err == nil {
+		return
+	}
+	r.dmu.Lock()
+	if keepalive := r.timeouts.Keepalive; keepalive > 0 && interval > keepalive {
+		interval = keepalive
+	}
+	r.dmu.Unlock()
+	p := &pacer{
+		interval: interval,
+		size:     size,
+		stop:     make(chan struct{}),
+	}
+	r.pacer = p
+	r.padding = PaddingPolicy{Scheme: PAD_FIXED, Size: size}
+	go r.pace(p)
+}
+
+// Stops the constant-rate mode (the records still waiting for a slot aren't sent).
+func (r *RecordLayer) StopConstantRate() {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+
+	if r.pacer != nil {
+		r.pacer.fail(ErrConstantRateStopped)
+		r.pacer = nil
+	}
+}
+
+// Fills a slot every interval, until the mode is stopped or the connection fails.
+func (r *RecordLayer) pace(p *pacer) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		r.wmu.Lock()
+		if p.err != nil {
+			// stopped while we were waiting for the lock
+			r.wmu.Unlock()
+			return
+		}
+		err := r.slot(p)
+		if err != nil {
+			p.fail(err)
+		}
+		r.wmu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Sends the record of a slot: a key update if one is due, the next chunk of what's waiting otherwise, or padding if nothing is (r.wmu must be held).
+// Returns an error if it couldn't be sent.
+func (r *RecordLayer) slot(p *pacer) error {
+	if p.update || r.updateDue() {
+		p.update = false
+		return r.updateKeys()
+	}
+	if len(p.queue) == 0 {
+		return r.writePadding()
+	}
+
+	// the type of the chunk marks where it ends, the padding fills the rest
+	chunk := make([]byte, 0, p.size-1)
+	var sent []*queued
+	for len(p.queue) > 0 && len(chunk) < cap(chunk) {
+		q := p.queue[0]
+		n := cap(chunk) - len(chunk)
+		if n > len(q.data) {
+			n = len(q.data)
+		}
+		chunk = append(chunk, q.data[:n]...)
+		q.data = q.data[n:]
+		if len(q.data) == 0 {
+			p.queue = p.queue[1:]
+			sent = append(sent, q)
+		}
+	}
+
+	err := r.write(RECORD_CHUNK, chunk)
+	if err == nil {
+		r.records++
+		r.bytes += uint64(len(chunk))
+	}
+	for _, q := range sent {
+		q.done <- err
+	}
+
+	return err
+}
+
+// Queues a record for the next slots (r.wmu must be held, and is released).
+// Returns an error once the record was sent, or couldn't be.
+func (r *RecordLayer) enqueue(p *pacer, rtype byte, data []byte) error {
+	if p.err != nil {
+		r.wmu.Unlock()
+		return p.err
+	}
+
+	chunked := make([]byte, CHUNKED_HEADER_SIZE, CHUNKED_HEADER_SIZE+len(data))
+	chunked[0] = rtype
+	binary.BigEndian.PutUint32(chunked[1:], uint32(len(data)))
+	q := &queued{data: append(chunked, data...), done: make(chan error, 1)}
+	p.queue = append(p.queue, q)
+	r.wmu.Unlock()
+
+	return <-q.done
+}
+
+// Stops the mode because of err, failing the records that wait for a slot (the RecordLayer's wmu must be held).
+func (p *pacer) fail(err error) {
+	if p.err != nil {
+		return
+	}
+	p.err = err
+	close(p.stop)
+	for _, q := range p.queue {
+		q.done <- err
+	}
+	p.queue = nil
+}
+
+// Takes the next whole record out of the chunks received so far (r.rmu must be held).
+// Returns its type, its content, whether there was one and an error if the chunks are malformed.
+func (r *RecordLayer) unchunk() (byte, []byte, bool, error) {
+	if len(r.chunks) < CHUNKED_HEADER_SIZE {
+		return 0, nil, false, nil
+	}
+	rtype, n := r.chunks[0], binary.BigEndian.Uint32(r.chunks[1:])
+	if n > MAX_MESSAGE_SIZE || rtype == RECORD_CHUNK || rtype == RECORD_KEY_UPDATE {
+		return 0, nil, false, errors.New("malformed chunk")
+	}
+	if len(r.chunks) < CHUNKED_HEADER_SIZE+int(n) {
+		return 0, nil, false, nil
+	}
+
+	data := append([]byte{}, r.chunks[CHUNKED_HEADER_SIZE:CHUNKED_HEADER_SIZE+int(n)]...)
+	r.chunks = r.chunks[CHUNKED_HEADER_SIZE+int(n):]
+
+	return rtype, data, true, nil
+}
@@ -0,0 +1,200 @@
+package hermes
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+)
+
+// A connection that remembers how long everything written to it was.
+type tapConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	writes []int
+}
+
+func (c *tapConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.writes = append(c.writes, len(b))
+	c.mu.Unlock()
+
+	return c.Conn.Write(b)
+}
+
+// Returns how long every write was so far.
+func (c *tapConn) lengths() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]int{}, c.writes...)
+}
+
+// Tests how the offers of the two ends are combined, whichever end makes which.
+func Test_agreeCover(t *testing.T) {
+	tests := []struct {
+		a, b, agreed CoverTraffic
+	}{
+		{CoverTraffic{}, CoverTraffic{}, CoverTraffic{}},
+		{CoverTraffic{Interval: time.Second, Size: 512}, CoverTraffic{}, CoverTraffic{Interval: time.Second, Size: 512}},
+		{CoverTraffic{Interval: time.Second, Size: 512}, CoverTraffic{Interval: 100 * time.Millisecond, Size: 256}, CoverTraffic{Interval: 100 * time.Millisecond, Size: 512}},
+		// 10 KiB per second don't fit in a budget of 5 KiB per second
+		{CoverTraffic{Interval: 100 * time.Millisecond, Size: 1024, Budget: 5120}, CoverTraffic{Budget: 20000}, CoverTraffic{Interval: 200 * time.Millisecond, Size: 1024, Budget: 5120}},
+		{CoverTraffic{Interval: time.Millisecond, Size: 64}, CoverTraffic{}, CoverTraffic{Interval: MIN_COVER_INTERVAL, Size: 64}},
+		{CoverTraffic{Interval: time.Minute, Size: 64}, CoverTraffic{}, CoverTraffic{Interval: MAX_COVER_INTERVAL, Size: 64}},
+		// a record of 1 KiB every 10 seconds is still too much for 100 bytes per second: the records get smaller
+		{CoverTraffic{Interval: 100 * time.Millisecond, Size: 1024}, CoverTraffic{Budget: 100}, CoverTraffic{Interval: MAX_COVER_INTERVAL, Size: 1000, Budget: 100}},
+		{CoverTraffic{Interval: 100 * time.Millisecond, Size: 1024}, CoverTraffic{Budget: MIN_COVER_BUDGET}, CoverTraffic{Interval: MAX_COVER_INTERVAL, Size: 70, Budget: MIN_COVER_BUDGET}},
+	}
+	for _, test := range tests {
+		for _, offers := range [][2]CoverTraffic{{test.a, test.b}, {test.b, test.a}} {
+			if agreed := agreeCover(offers[0], offers[1]); agreed != test.agreed {
+				t.Fatalf("%+v and %+v: expected %+v, got %+v", offers[0], offers[1], test.agreed, agreed)
+			}
+		}
+	}
+}
+
+// Tests that in constant-rate mode every record is as long as the others, that they keep coming when there's nothing to say,
+// and that what's sent (longer than a record, key updates in between) gets through whole.
+func Test_RecordLayer_constantRate(t *testing.T) {
+	key := make([]byte, anubis.BYTE_SEC)
+	rand.Read(key)
+	cipher, _ := anubis.NewCipher(key)
+	local, remote := net.Pipe()
+	defer local.Close()
+	tap := &tapConn{Conn: local}
+	client, server := NewSessionRecords(tap, cipher, CLIENT), NewSessionRecords(remote, cipher, SERVER)
+
+	client.StartConstantRate(5*time.Millisecond, 128)
+	msgs := [][]byte{[]byte("hi"), bytes.Repeat([]byte("a long message "), 100), {}}
+	records := readRecords(server, len(msgs))
+	for i, msg := range msgs {
+		if i == 1 {
+			client.UpdateKeys()
+		}
+		if err := client.WriteRecord(RECORD_DATA, msg); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-records; got != string(msg) {
+			t.Fatalf("message %d: got %v", i, got)
+		}
+	}
+
+	// nothing to say: padding only
+	before := len(tap.lengths())
+	go io.Copy(io.Discard, remote)
+	time.Sleep(100 * time.Millisecond)
+	lengths := tap.lengths()
+	if len(lengths)-before < 5 {
+		t.Fatalf("only %d records in 100ms, expected about 20", len(lengths)-before)
+	}
+	for _, n := range lengths {
+		if n != lengths[0] {
+			t.Fatalf("records of %d and %d bytes were sent", lengths[0], n)
+		}
+	}
+	if sent, _ := client.Updates(); sent != 1 {
+		t.Fatalf("expected a key update, got %d", sent)
+	}
+
+	client.StopConstantRate()
+	n := len(tap.lengths())
+	time.Sleep(20 * time.Millisecond)
+	if len(tap.lengths()) != n {
+		t.Fatal("records are still sent after the mode was stopped")
+	}
+}
+
+// Tests that no keepalive is sent in between the records of the constant-rate mode, and that these are never further apart than the keepalives would be.
+func Test_RecordLayer_constantRate_keepalive(t *testing.T) {
+	key := make([]byte, anubis.BYTE_SEC)
+	rand.Read(key)
+	cipher, _ := anubis.NewCipher(key)
+
+	for _, keepaliveFirst := range []bool{false, true} {
+		local, remote := net.Pipe()
+		tap := &tapConn{Conn: local}
+		client := NewSessionRecords(tap, cipher, CLIENT)
+		go io.Copy(io.Discard, remote)
+
+		// a record every 50ms, unless the keepalives (every 10ms) were set first
+		if keepaliveFirst {
+			client.SetTimeouts(Timeouts{Keepalive: 10 * time.Millisecond})
+			client.StartConstantRate(50*time.Millisecond, 128)
+		} else {
+			client.StartConstantRate(50*time.Millisecond, 128)
+			client.SetTimeouts(Timeouts{Keepalive: 10 * time.Millisecond})
+		}
+		time.Sleep(200 * time.Millisecond)
+		n := len(tap.lengths())
+		client.Close()
+
+		if !keepaliveFirst && n > 5 {
+			t.Fatalf("%d records in 200ms, expected one every 50ms", n)
+		}
+		if keepaliveFirst && n < 8 {
+			t.Fatalf("%d records in 200ms, expected one every 10ms", n)
+		}
+	}
+}
+
+// Tests that the constant-rate mode is on as soon as one of two peers asks for it, and that they can still talk (and hang up) then.
+func Test_Peer_NegotiateCover(t *testing.T) {
+	key := make([]byte, anubis.BYTE_SEC)
+	rand.Read(key)
+	dialer, listener, derr, lerr := connectPeers(t, key, key)
+	if derr != nil || lerr != nil {
+		t.Fatal(derr, lerr)
+	}
+
+	if _, err := dialer.NegotiateCover(CoverTraffic{Interval: 10 * time.Millisecond, Size: 256, Budget: MIN_COVER_BUDGET - 1}); err == nil {
+		t.Fatal("a budget too small for any record was taken")
+	}
+
+	offer := CoverTraffic{Interval: 10 * time.Millisecond, Size: 256}
+	agreed := make(chan CoverTraffic, 1)
+	go func() {
+		a, err := listener.NegotiateCover(CoverTraffic{})
+		if err != nil {
+			t.Error(err)
+		}
+		agreed <- a
+	}()
+	a, err := dialer.NegotiateCover(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != offer || <-agreed != offer {
+		t.Fatalf("expected both to agree on %+v, got %+v", offer, a)
+	}
+
+	file := bytes.Repeat([]byte{7}, 2000)
+	go func() {
+		dialer.Send([]byte("hello"))
+		dialer.SendFile("seven.bin", file)
+	}()
+	if _, msg, err := listener.Receive(); err != nil || string(msg) != "hello" {
+		t.Fatalf("got %q and %v", msg, err)
+	}
+	if name, content, err := listener.Receive(); err != nil || name != "seven.bin" || !bytes.Equal(content, file) {
+		t.Fatalf("got %q (%d bytes) and %v", name, len(content), err)
+	}
+
+	go listener.Send([]byte("hello back"))
+	if _, msg, err := dialer.Receive(); err != nil || string(msg) != "hello back" {
+		t.Fatalf("got %q and %v", msg, err)
+	}
+
+	dialer.Close()
+	if _, _, err := listener.Receive(); err != io.EOF {
+		t.Fatal("expected the peer to hang up, got", err)
+	}
+	listener.Close()
+}
@@ -0,0 +1,120 @@
+package hermes
+
+import (
+	"crypto/sha256"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"golang.org/x/crypto/hkdf"
+)
+
+// A DatagramConn carries records between two peers over UDP (on the path opened by Punch()), one per datagram.
+// Datagrams can be lost, duplicated or reordered on the way: the ones that are duplicated, replayed or tampered with are dropped,
+// the others are handed over in the order they arrive.
+// It's a Path as well, so that it can carry the chat of a Peer next to the connection (see Peer.StartStreams()).
+type DatagramConn struct {
+	pc     net.PacketConn
+	peer   net.Addr
+	cipher *anubis.DatagramCipher
+	wmu    sync.Mutex // the send and receive sides of the cipher are independent, but each must be used by one goroutine at a time
+	rmu    sync.Mutex
+}
+
+// Creates the DatagramConn with the peer at addr on pc, protected by cipher.
+func NewDatagramConn(pc net.PacketConn, addr net.Addr, cipher *anubis.DatagramCipher) *DatagramConn {
+	return &DatagramConn{
+		pc:     pc,
+		peer:   addr,
+		cipher: cipher,
+	}
+}
+
+// Opens the DatagramConn with the peer at addr on pc, with keys derived from the handshake (so that they're bound to this connection).
+// Returns the DatagramConn and an error.
+func (p *Peer) Datagrams(pc net.PacketConn, addr net.Addr) (*DatagramConn, error) {
+	secrets := make([]byte, 2*anubis.BYTE_SEC)
+	_, err := io.ReadFull(hkdf.New(sha256.New, p.datagramSecret, nil, []byte("harpocrates datagrams")), secrets)
+	if err != nil {
+		return nil, err
+	}
+	dialerSecret, listenerSecret := secrets[:anubis.BYTE_SEC], secrets[anubis.BYTE_SEC:]
+
+	var dc *anubis.DatagramCipher
+	if p.dialer {
+		dc, err = anubis.NewDatagramCipher(dialerSecret, listenerSecret)
+	} else {
+		dc, err = anubis.NewDatagramCipher(listenerSecret, dialerSecret)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDatagramConn(pc, addr, dc), nil
+}
+
+// Sends a record to the peer, in a datagram of its own.
+// Returns an error if the record is too large (see anubis.MAX_DATAGRAM_PAYLOAD) or can't be sent.
+func (c *DatagramConn) Send(record []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	datagram, err := c.cipher.Seal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.pc.WriteTo(datagram, c.peer)
+	return err
+}
+
+// Moves to fresh keys for what's sent from now on.
+// Returns an error.
+func (c *DatagramConn) Rekey() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return c.cipher.Rekey()
+}
+
+// Waits for the next record from the peer, silently dropping datagrams that come from elsewhere or don't pass the checks of the cipher.
+// Returns the record and an error if the socket can't be read (a timeout, past the read deadline).
+func (c *DatagramConn) Receive() ([]byte, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	buf := make([]byte, anubis.MAX_DATAGRAM_SIZE+1)
+	for {
+		n, from, err := c.pc.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		if from.String() != c.peer.String() {
+			continue
+		}
+
+		record, err := c.cipher.Open(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		return record, nil
+	}
+}
+
+// Sets when Receive() gives up waiting.
+func (c *DatagramConn) SetReadDeadline(t time.Time) error {
+	return c.pc.SetReadDeadline(t)
+}
+
+// Returns the address of the peer.
+func (c *DatagramConn) RemoteAddr() net.Addr {
+	return c.peer
+}
+
+// Closes the socket underneath (only the reader, if it's shared through a PacketHub).
+func (c *DatagramConn) Close() error {
+	return c.pc.Close()
+}
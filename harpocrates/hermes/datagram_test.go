@@ -0,0 +1,257 @@
+package hermes
+
+import (
+	"crypto/rand"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+)
+
+// Utility function, one end of a simulated UDP link that loses, duplicates and reorders what goes through it.
+type lossyConn struct {
+	addr *net.UDPAddr
+	peer *lossyConn
+	in   chan memPacket
+	link *lossyLink
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+// Utility function, what the link does to the packets (the same rand for both directions, so that a run can be reproduced).
+type lossyLink struct {
+	mu                  sync.Mutex
+	rand                *mrand.Rand
+	loss, dup, reorder  float64
+	held                *memPacket // a packet held back, to be delivered after the next one
+	heldTo              *lossyConn
+	dropped, duplicated int
+	reordered           int
+	captured            [][]byte // everything that was sent, for replaying it
+}
+
+// Utility function, creates the two ends of a link with the given probabilities of losing, duplicating and reordering a packet.
+func newLossyLink(seed int64, loss, dup, reorder float64) (*lossyConn, *lossyConn, *lossyLink) {
+	l := &lossyLink{rand: mrand.New(mrand.NewSource(seed)), loss: loss, dup: dup, reorder: reorder}
+	a := &lossyConn{addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}, in: make(chan memPacket, 1024), link: l}
+	b := &lossyConn{addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2000}, in: make(chan memPacket, 1024), link: l}
+	a.peer, b.peer = b, a
+
+	return a, b, l
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	l := c.link
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p := memPacket{c.addr, append([]byte{}, b...)}
+	l.captured = append(l.captured, p.data)
+	switch r := l.rand.Float64(); {
+	case r < l.loss:
+		l.dropped++
+		return len(b), nil
+	case r < l.loss+l.reorder && l.held == nil:
+		l.held, l.heldTo = &p, c.peer
+		l.reordered++
+		return len(b), nil
+	case r < l.loss+l.reorder+l.dup:
+		l.duplicated++
+		c.peer.in <- p
+	}
+	c.peer.in <- p
+
+	if l.held != nil {
+		l.heldTo.in <- *l.held
+		l.held = nil
+	}
+
+	return len(b), nil
+}
+
+// Utility function, delivers the packet held back (if any).
+func (l *lossyLink) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.held != nil {
+		l.heldTo.in <- *l.held
+		l.held = nil
+	}
+}
+
+func (c *lossyConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p := <-c.in:
+		return copy(b, p.data), p.from, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *lossyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+	return nil
+}
+
+func (c *lossyConn) Close() error                       { return nil }
+func (c *lossyConn) LocalAddr() net.Addr                { return c.addr }
+func (c *lossyConn) SetDeadline(t time.Time) error      { return c.SetReadDeadline(t) }
+func (c *lossyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Utility function, opens the datagram connection between two peers on the two ends of a link.
+func datagramPair(t *testing.T, a, b *lossyConn) (*DatagramConn, *DatagramConn) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	dialer, listener, derr, lerr := connectPeers(t, key, key)
+	if derr != nil || lerr != nil {
+		t.Fatal(derr, lerr)
+	}
+	t.Cleanup(func() {
+		dialer.conn.Close()
+		listener.conn.Close()
+	})
+
+	dc, err := dialer.Datagrams(a, b.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc, err := listener.Datagrams(b, a.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dc, lc
+}
+
+// Utility function, receives records until none arrives for a while.
+func receiveAll(c *DatagramConn) [][]byte {
+	var records [][]byte
+	for {
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		record, err := c.Receive()
+		if err != nil {
+			return records
+		}
+		records = append(records, record)
+	}
+}
+
+// Tests records going through a link that loses, duplicates and reorders them, with a rekey halfway:
+// everything that isn't lost arrives exactly once, and replaying the captured datagrams gets nothing through twice.
+func Test_DatagramConn_lossy(t *testing.T) {
+	a, b, link := newLossyLink(34, 0.1, 0.1, 0.2)
+	dialer, listener := datagramPair(t, a, b)
+
+	const N = 300
+	for i := 0; i < N; i++ {
+		if i == N/2 {
+			if err := dialer.Rekey(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := dialer.Send([]byte(fmt.Sprintf("record %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link.flush()
+
+	records := receiveAll(listener)
+	if link.dropped == 0 || link.duplicated == 0 || link.reordered == 0 {
+		t.Fatalf("the link should have lost, duplicated and reordered some packets (%d, %d, %d)", link.dropped, link.duplicated, link.reordered)
+	}
+	if len(records) != N-link.dropped {
+		t.Fatalf("%d records should have arrived, got %d", N-link.dropped, len(records))
+	}
+
+	seen := make(map[string]bool)
+	inOrder := true
+	for i, r := range records {
+		if seen[string(r)] {
+			t.Fatalf("%s was delivered twice", r)
+		}
+		seen[string(r)] = true
+
+		var n int
+		if _, err := fmt.Sscanf(string(r), "record %d", &n); err != nil || n < 0 || n >= N {
+			t.Fatalf("unexpected record %q", r)
+		}
+		if i > 0 && string(r) < string(records[i-1]) {
+			inOrder = false
+		}
+	}
+	if inOrder {
+		t.Fatal("some records should have arrived out of order")
+	}
+
+	// someone on the path replays everything: the records that were lost are new to the receiver (if they're still within the window),
+	// the others never get through again
+	for _, d := range link.captured {
+		b.in <- memPacket{a.addr, d}
+	}
+	for _, r := range receiveAll(listener) {
+		if seen[string(r)] {
+			t.Fatalf("%s was replayed", r)
+		}
+		seen[string(r)] = true
+	}
+	for _, d := range link.captured {
+		b.in <- memPacket{a.addr, d}
+	}
+	if replayed := receiveAll(listener); len(replayed) != 0 {
+		t.Fatalf("%d replayed records got through", len(replayed))
+	}
+}
+
+// Tests that datagrams from another address, tampered with or too large are dropped, and that records too large aren't sent.
+func Test_DatagramConn_invalid(t *testing.T) {
+	a, b, _ := newLossyLink(1, 0, 0, 0)
+	dialer, listener := datagramPair(t, a, b)
+
+	if err := dialer.Send(make([]byte, anubis.MAX_DATAGRAM_PAYLOAD+1)); err == nil {
+		t.Fatal("a record too large for a datagram shouldn't be sent")
+	}
+	if err := dialer.Send(make([]byte, anubis.MAX_DATAGRAM_PAYLOAD)); err != nil {
+		t.Fatal(err)
+	}
+	full := <-b.in
+
+	mallory := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 66), Port: 6666}
+	b.in <- memPacket{mallory, full.data}
+
+	tampered := append([]byte{}, full.data...)
+	tampered[len(tampered)-1] ^= 1
+	b.in <- memPacket{a.addr, tampered}
+
+	tooLarge := append(append([]byte{}, full.data...), 0)
+	b.in <- memPacket{a.addr, tooLarge}
+
+	if records := receiveAll(listener); len(records) != 0 {
+		t.Fatalf("%d invalid datagrams got through", len(records))
+	}
+
+	b.in <- full
+	if records := receiveAll(listener); len(records) != 1 || len(records[0]) != anubis.MAX_DATAGRAM_PAYLOAD {
+		t.Fatal("the genuine datagram should get through")
+	}
+}
@@ -0,0 +1,61 @@
+package hermes
+
+import (
+	"crypto/elliptic"
+	"crypto/sha512"
+	"errors"
+	"io"
+)
+
+// The size of a public key of the ECDHE (a point of P-521, uncompressed).
+const ECDHE_KEY_SIZE = 133
+
+// Generates the key pair of one side of the ECDHE between client and server, drawing the private key from random.
+// Returns the private key, the public key (to send to the other side) and an error.
+func NewECDHEKeys(random io.Reader) ([]byte, []byte, error) {
+	return generateKeys(elliptic.P521(), random)
+}
+
+// Computes the key client and server share once they've swapped their public keys.
+// Returns the shared key (the key for symmetric crypto) and an error if the public key of the other side is invalid.
+func ECDHESharedKey(privKey, peerPub []byte) ([]byte, error) {
+	sharedSecret, err := calculateSharedSecret(elliptic.P521(), peerPub, privKey)
+	if err != nil {
+		return nil, err
+	}
+	sharedKey := sha512.Sum512_256(sharedSecret)
+
+	return sharedKey[:], nil
+}
+
+// Generates the private/public key pair for ECDH.
+func generateKeys(E elliptic.Curve, random io.Reader) ([]byte, []byte, error) {
+	privKey, x, y, err := elliptic.GenerateKey(E, random)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !E.IsOnCurve(x, y) {
+		return nil, nil, errors.New("the generated parameters are not on the curve")
+	}
+
+	pubKey := elliptic.Marshal(E, x, y)
+
+	return privKey, pubKey, nil
+}
+
+// Calculates the shared secret given our private key and the public key of the other party.
+// Returns the shared secret and an error if anything went wrong.
+func calculateSharedSecret(E elliptic.Curve, pubKey, privKey []byte) ([]byte, error) {
+	if E != elliptic.P521() {
+		return nil, errors.New("only the NIST P-521 curve is accepted")
+	}
+
+	cx, cy := elliptic.Unmarshal(E, pubKey)
+	// Unmarshal() returns (nil, nil) if there were errors: https://golang.google.cn/src/crypto/elliptic/elliptic.go?s=9365:9421#L330
+	if cx == nil || cy == nil {
+		return nil, errors.New("error unmarshaling the client's public key")
+	}
+
+	sx, sy := E.ScalarMult(cx, cy, privKey) // shared (x, y)
+	return elliptic.Marshal(E, sx, sy), nil
+}
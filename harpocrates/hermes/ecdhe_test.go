@@ -2,6 +2,7 @@ package hermes
 
 import (
 	"crypto/elliptic"
+	"crypto/rand"
 	"encoding/hex"
 	"testing"
 )
@@ -15,7 +16,7 @@ func Test_generateKeys_Uniqueness(t *testing.T) {
 
 	N := 100
 	for i := 0; i < N; i++ {
-		priv, pub, err := generateKeys(E)
+		priv, pub, err := generateKeys(E, rand.Reader)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -63,11 +64,11 @@ func Test_calculateSharedSecret_Exchanges(t *testing.T) {
 
 	N := 100
 	for i := 0; i < N; i++ {
-		sPriv, sPub, err := generateKeys(E) // server side
+		sPriv, sPub, err := generateKeys(E, rand.Reader) // server side
 		if err != nil {
 			t.Fatal(err)
 		}
-		cPriv, cPub, err := generateKeys(E) // client side
+		cPriv, cPub, err := generateKeys(E, rand.Reader) // client side
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -0,0 +1,105 @@
+package hermes
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"sync"
+)
+
+// Length of the tokens tying the UDP endpoint of a client to its session.
+const BIND_TOKEN_SIZE = 16
+
+// Endpoints keeps track of the UDP endpoints the clients are seen from (their reflexive addresses, behind whatever NAT they're in),
+// so that peers can try to reach each other directly over UDP.
+type Endpoints struct {
+	mu     sync.Mutex
+	tokens map[string]string // token -> client
+	addrs  map[string]string // client -> endpoint
+	bound  func(uname, addr string)
+}
+
+// Creates an empty Endpoints; bound is called whenever the endpoint of a client is learned or changes (it mustn't block).
+func NewEndpoints(bound func(uname, addr string)) *Endpoints {
+	return &Endpoints{
+		tokens: make(map[string]string),
+		addrs:  make(map[string]string),
+		bound:  bound,
+	}
+}
+
+// Creates the token uname has to send in its bind requests, replacing the previous one.
+// Returns the token and an error.
+func (e *Endpoints) Token(uname string) ([]byte, error) {
+	token := make([]byte, BIND_TOKEN_SIZE)
+	_, err := rand.Read(token)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for t, u := range e.tokens {
+		if u == uname {
+			delete(e.tokens, t)
+		}
+	}
+	e.tokens[string(token)] = uname
+
+	return token, nil
+}
+
+// Reads the bind requests sent to pc, recording the address each one comes from as the endpoint of the client whose token it carries.
+// Clients repeat their requests to keep their NAT mapping alive, only changes are reported.
+// Returns an error once pc can't be read anymore.
+func (e *Endpoints) Serve(pc net.PacketConn) error {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if n != len(BIND_MAGIC)+BIND_TOKEN_SIZE || !bytes.HasPrefix(buf[:n], []byte(BIND_MAGIC)) {
+			continue
+		}
+
+		e.bind(string(buf[len(BIND_MAGIC):n]), from.String())
+	}
+}
+
+// Returns the endpoint of uname ("" if it's unknown).
+func (e *Endpoints) Get(uname string) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.addrs[uname]
+}
+
+// Forgets the endpoint and the token of uname, once it leaves.
+func (e *Endpoints) Forget(uname string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.addrs, uname)
+	for t, u := range e.tokens {
+		if u == uname {
+			delete(e.tokens, t)
+		}
+	}
+}
+
+// Records addr as the endpoint of the client token belongs to (unknown tokens are ignored).
+func (e *Endpoints) bind(token, addr string) {
+	e.mu.Lock()
+	uname, ok := e.tokens[token]
+	changed := ok && e.addrs[uname] != addr
+	if changed {
+		e.addrs[uname] = addr
+	}
+	e.mu.Unlock()
+
+	if changed {
+		e.bound(uname, addr)
+	}
+}
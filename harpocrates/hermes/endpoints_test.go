@@ -0,0 +1,50 @@
+package hermes
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that only changes of the endpoint are reported, and that tokens are tied to their client.
+func Test_Endpoints_bind(t *testing.T) {
+	bound := make(chan [2]string, 10)
+	e := NewEndpoints(func(uname, addr string) {
+		bound <- [2]string{uname, addr}
+	})
+
+	token, err := e.Token("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.bind(string(token), "1.2.3.4:5")
+	e.bind(string(token), "1.2.3.4:5")
+	e.bind("made up", "6.6.6.6:6")
+	e.bind(string(token), "1.2.3.4:6")
+
+	for _, addr := range []string{"1.2.3.4:5", "1.2.3.4:6"} {
+		select {
+		case b := <-bound:
+			if b != [2]string{"alice", addr} {
+				t.Fatalf("expected alice at %s, got %v", addr, b)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the endpoint of alice should have been reported")
+		}
+	}
+	select {
+	case b := <-bound:
+		t.Fatal("nothing else changed, got", b)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a new token replaces the old one
+	newToken, _ := e.Token("alice")
+	e.bind(string(token), "7.7.7.7:7")
+	if e.Get("alice") != "1.2.3.4:6" {
+		t.Fatal("the old token shouldn't work anymore")
+	}
+	e.bind(string(newToken), "7.7.7.7:7")
+	if e.Get("alice") != "7.7.7.7:7" {
+		t.Fatal("the new token should work")
+	}
+}
@@ -0,0 +1,114 @@
+package hermes
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+)
+
+// The seeds in testdata/fuzz are what client and server sent each other during a real handshake (alice logging in).
+
+// Utility function, feeds stream to read over a pipe until it runs out, failing if read hangs.
+func readAll(t *testing.T, stream []byte, read func(conn net.Conn) error) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	go func() {
+		remote.Write(stream)
+		remote.Close()
+	}()
+
+	conn := NewConn(local)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		err := read(conn)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal("the read hung")
+		}
+		if err == io.EOF {
+			return
+		}
+	}
+}
+
+// Utility function, returns a cipher with a fixed key and nonce, so that the records it seals open across runs.
+func fuzzCipher(t testing.TB) anubis.Cipher {
+	cipher, err := anubis.NewCipher(bytes.Repeat([]byte{0x42}, anubis.BYTE_SEC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher.UpdateNonce(bytes.Repeat([]byte{0x24}, 64))
+
+	return cipher
+}
+
+// Tests that Read() copes with whatever comes down the wire.
+func Fuzz_Read(f *testing.F) {
+	f.Add([]byte("\n"))
+	f.Add([]byte("zz\n"))
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		readAll(t, stream, func(conn net.Conn) error {
+			msg, n, err := Read(conn)
+			if err == nil && (n != len(msg) || len(msg) > MAX_HANDSHAKE_MESSAGE_SIZE) {
+				t.Fatalf("read %d bytes, claiming %d", len(msg), n)
+			}
+			return err
+		})
+	})
+}
+
+// Tests that DecRead() and FullRead() cope with whatever comes down the wire.
+func Fuzz_DecRead(f *testing.F) {
+	cipher := fuzzCipher(f)
+	sealed, err := cipher.Encrypt([]byte("a message"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	record, err := SealRecord(cipher, []byte("SERVER_OK"), DEFAULT_PADDING)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add([]byte(hex.EncodeToString(sealed) + "\n"))
+	f.Add([]byte(hex.EncodeToString(record) + "\n"))
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		cipher := fuzzCipher(t)
+		readAll(t, stream, func(conn net.Conn) error {
+			_, _, err := DecRead(conn, cipher)
+			return err
+		})
+		readAll(t, stream, func(conn net.Conn) error {
+			msg, n, err := FullRead(conn, cipher)
+			if err == nil && n != len(msg) {
+				t.Fatalf("read %d bytes, claiming %d", len(msg), n)
+			}
+			return err
+		})
+	})
+}
+
+// Tests that ECDHESharedKey() refuses anything that isn't a point of the curve, without panicking.
+func Fuzz_ECDHESharedKey(f *testing.F) {
+	privKey, _, err := generateKeys(elliptic.P521(), rand.Reader)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{4})
+
+	f.Fuzz(func(t *testing.T, peerPub []byte) {
+		sharedKey, err := ECDHESharedKey(privKey, peerPub)
+		if err == nil && len(sharedKey) != anubis.BYTE_SEC {
+			t.Fatalf("the shared key is %d bytes long", len(sharedKey))
+		}
+	})
+}
@@ -0,0 +1,11 @@
+// Package hermes implements functionality related to the TCP connection between client and server (seeing as Hermes is the god of travelers and boundaries (among other things)).
+// Client and server speak the same protocol: where they differ, it's down to the Role each of them plays.
+package hermes
+
+// Which end of the connection with the server we are.
+type Role int
+
+const (
+	CLIENT Role = iota + 1 // opens the streams of a Mux with odd IDs
+	SERVER
+)
@@ -0,0 +1,210 @@
+package hermes
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// How many packets wait for each reader of a PacketHub: the ones that come while its queue is full are dropped, as UDP would.
+const MAX_HUB_QUEUE = 64
+
+// How long a packet read by a PacketHub can be.
+const MAX_HUB_PACKET = 2048
+
+// A PacketHub shares a socket among several readers (the punches and the DatagramConns of a few peers, say), since a socket can't be read by more than one:
+// every packet that arrives is handed to all of them, and each drops the ones that aren't for it.
+type PacketHub struct {
+	pc   net.PacketConn
+	mu   sync.Mutex
+	subs map[*hubConn]bool
+	err  error // why the socket can't be read anymore
+	done chan struct{}
+}
+
+// A packet read by a PacketHub, and where it came from.
+type hubPacket struct {
+	data []byte
+	from net.Addr
+}
+
+// Creates the PacketHub over pc, and starts reading it.
+func NewPacketHub(pc net.PacketConn) *PacketHub {
+	h := &PacketHub{
+		pc:   pc,
+		subs: make(map[*hubConn]bool),
+		done: make(chan struct{}),
+	}
+	go h.read()
+
+	return h
+}
+
+// Returns a new reader of the socket: it gets every packet that arrives from now on, and writes to the socket directly.
+// Closing it only stops its packets, the socket stays open until the PacketHub is closed.
+func (h *PacketHub) Conn() net.PacketConn {
+	c := &hubConn{
+		hub:     h,
+		packets: make(chan hubPacket, MAX_HUB_QUEUE),
+		closed:  make(chan struct{}),
+		wake:    make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	h.subs[c] = true
+	h.mu.Unlock()
+
+	return c
+}
+
+// Returns the address of the socket.
+func (h *PacketHub) LocalAddr() net.Addr {
+	return h.pc.LocalAddr()
+}
+
+// Sends b to addr from the socket.
+// Returns how much was sent and an error.
+func (h *PacketHub) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return h.pc.WriteTo(b, addr)
+}
+
+// Closes the socket, and with it all its readers.
+func (h *PacketHub) Close() error {
+	return h.pc.Close()
+}
+
+// Reads the socket until it fails, handing every packet to the readers.
+func (h *PacketHub) read() {
+	for {
+		buf := make([]byte, MAX_HUB_PACKET)
+		n, from, err := h.pc.ReadFrom(buf)
+		if err != nil {
+			h.mu.Lock()
+			h.err = err
+			h.mu.Unlock()
+			close(h.done)
+			return
+		}
+
+		p := hubPacket{data: buf[:n], from: from}
+		h.mu.Lock()
+		for c := range h.subs {
+			select {
+			case c.packets <- p:
+			default:
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// A reader of a PacketHub.
+type hubConn struct {
+	hub      *PacketHub
+	packets  chan hubPacket
+	closed   chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	deadline time.Time
+	wake     chan struct{} // closed when the deadline changes
+}
+
+// Waits for the next packet, until the read deadline.
+// Returns its length, where it came from and an error (os.ErrDeadlineExceeded past the deadline).
+func (c *hubConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		select {
+		case <-c.closed:
+			return 0, nil, net.ErrClosed
+		default:
+		}
+		c.mu.Lock()
+		deadline, wake := c.deadline, c.wake
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		n, from, err, ok := c.wait(b, timeout, wake)
+		if timer != nil {
+			timer.Stop()
+		}
+		if ok {
+			return n, from, err
+		}
+	}
+}
+
+// Waits for the next packet, until timeout or the deadline changes (wake).
+// Returns its length, where it came from, an error and false if the deadline changed.
+func (c *hubConn) wait(b []byte, timeout <-chan time.Time, wake chan struct{}) (int, net.Addr, error, bool) {
+	select {
+	case p := <-c.packets:
+		return copy(b, p.data), p.from, nil, true
+	case <-c.closed:
+		return 0, nil, net.ErrClosed, true
+	case <-c.hub.done:
+		c.hub.mu.Lock()
+		defer c.hub.mu.Unlock()
+		return 0, nil, c.hub.err, true
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded, true
+	case <-wake:
+		return 0, nil, nil, false
+	}
+}
+
+func (c *hubConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	return c.hub.pc.WriteTo(b, addr)
+}
+
+// Stops the packets of the reader (the socket stays open).
+func (c *hubConn) Close() error {
+	c.once.Do(func() {
+		c.hub.mu.Lock()
+		delete(c.hub.subs, c)
+		c.hub.mu.Unlock()
+		close(c.closed)
+	})
+
+	return nil
+}
+
+func (c *hubConn) LocalAddr() net.Addr {
+	return c.hub.pc.LocalAddr()
+}
+
+func (c *hubConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *hubConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+
+	return nil
+}
+
+// Writes don't wait for anything worth a deadline.
+func (c *hubConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,81 @@
+package hermes
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Tests a socket shared by two readers: both get every packet, the deadlines of one don't touch the other,
+// closing one leaves the socket open, and closing the hub ends the other.
+func Test_PacketHub(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewPacketHub(pc)
+	defer hub.Close()
+	sender, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	a, b := hub.Conn(), hub.Conn()
+	if _, err := sender.WriteTo([]byte("hello"), hub.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, MAX_HUB_PACKET)
+	for _, c := range []net.PacketConn{a, b} {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := c.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "hello" || from.String() != sender.LocalAddr().String() {
+			t.Fatalf("expected hello from %s, got %q from %s", sender.LocalAddr(), buf[:n], from)
+		}
+	}
+
+	// a deadline moved while waiting is kept
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		a.SetReadDeadline(time.Now())
+	}()
+	a.SetReadDeadline(time.Time{})
+	_, _, err = a.ReadFrom(buf)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+
+	// the other reader answers through the socket, which stays open once a is closed
+	a.Close()
+	if _, _, err := a.ReadFrom(buf); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed, got %v", err)
+	}
+	if _, err := b.WriteTo([]byte("hi"), sender.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	sender.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := sender.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "hi" {
+		t.Fatalf("expected hi, got %q (%v)", buf[:n], err)
+	}
+
+	b.SetReadDeadline(time.Time{})
+	done := make(chan error)
+	go func() {
+		_, _, err := b.ReadFrom(buf)
+		done <- err
+	}()
+	hub.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("the reader outlived the socket")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the reader outlived the socket")
+	}
+}
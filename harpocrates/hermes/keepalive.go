@@ -0,0 +1,199 @@
+package hermes
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// How long the handshake with the server (or with a peer) can take by default: the key derivation of the client is slow on purpose.
+const HANDSHAKE_TIMEOUT = time.Minute
+
+// How many keepalives in a row the other end of a session can miss before it's taken for dead.
+const MISSED_KEEPALIVES = 3
+
+// How long the records of a session can take, once the handshake is over.
+// Each end sends a keepalive (a record with nothing but padding, which the other end drops) whenever it went Keepalive without sending anything,
+// so an end that doesn't hear from the other for Idle stopped responding: its ReadRecord() fails with ErrIdleTimeout.
+type Timeouts struct {
+	Keepalive time.Duration // how long we stay silent before sending a keepalive (none are sent if 0)
+	Idle      time.Duration // how long the other end can stay silent (no limit if 0)
+	Write     time.Duration // how long a record can take to be sent (no limit if 0)
+}
+
+// The timeouts of the sessions with the server and with the peers by default: a keepalive every 30 seconds, and an end that misses MISSED_KEEPALIVES of them is dead.
+var DEFAULT_TIMEOUTS = Timeouts{Keepalive: 30 * time.Second, Idle: MISSED_KEEPALIVES * 30 * time.Second, Write: 30 * time.Second}
+
+// Returned by ReadRecord() once the other end was silent for longer than the idle timeout.
+var ErrIdleTimeout = errors.New("the other end stopped responding")
+
+// Changes the timeouts of the records (none unless changed), starting to send the keepalives right away.
+func (r *RecordLayer) SetTimeouts(t Timeouts) {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+
+	r.dmu.Lock()
+	r.timeouts = t
+	r.dmu.Unlock()
+
+	if r.keepalives != nil {
+		close(r.keepalives)
+		r.keepalives = nil
+	}
+	if t.Keepalive > 0 {
+		r.keepalives = make(chan struct{})
+		r.lastWrite = time.Now()
+		go r.keepalive(t.Keepalive, r.keepalives)
+	}
+}
+
+// Sets the read and write deadlines (the zero time to remove them), on top of the timeouts.
+func (r *RecordLayer) SetDeadline(t time.Time) error {
+	err := r.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	return r.SetWriteDeadline(t)
+}
+
+// Sets when ReadRecord() gives up waiting (it can be retried then), unless the idle timeout is up before.
+func (r *RecordLayer) SetReadDeadline(t time.Time) error {
+	r.dmu.Lock()
+	defer r.dmu.Unlock()
+
+	r.readDeadline = t
+	deadline := earliest(t, r.idleBy)
+	r.readArmed = !deadline.IsZero()
+
+	return r.conn.SetReadDeadline(deadline)
+}
+
+// Sets when WriteRecord() gives up (the records are unusable then), unless the write timeout is up before.
+func (r *RecordLayer) SetWriteDeadline(t time.Time) error {
+	r.dmu.Lock()
+	defer r.dmu.Unlock()
+
+	r.writeDeadline = t
+	deadline := earliest(t, r.writeBy)
+	r.writeArmed = !deadline.IsZero()
+
+	return r.conn.SetWriteDeadline(deadline)
+}
+
+// Stops sending (the constant-rate mode and the keepalives) and closes the connection.
+func (r *RecordLayer) Close() error {
+	// a write stuck on the connection holds r.wmu until the connection is closed
+	err := r.conn.Close()
+
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+
+	if r.pacer != nil {
+		r.pacer.fail(ErrConstantRateStopped)
+		r.pacer = nil
+	}
+	if r.keepalives != nil {
+		close(r.keepalives)
+		r.keepalives = nil
+	}
+
+	return err
+}
+
+// Sends a keepalive whenever nothing was sent for interval, until stop is closed or the connection fails.
+// In constant-rate mode, there's never the need: the slots are sent whether there's something to send or not.
+func (r *RecordLayer) keepalive(interval time.Duration, stop chan struct{}) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+
+		r.wmu.Lock()
+		select {
+		case <-stop:
+			// stopped while we were waiting for the lock
+			r.wmu.Unlock()
+			return
+		default:
+		}
+		var err error
+		wait := interval - time.Since(r.lastWrite)
+		if r.pacer != nil {
+			// a keepalive would stand out among the records sent at a constant rate, which do its job already
+			wait = interval
+		} else if wait <= 0 {
+			err = r.writePadding()
+			wait = interval
+		}
+		r.wmu.Unlock()
+		if err != nil {
+			return
+		}
+		timer.Reset(wait)
+	}
+}
+
+// Sets the read deadline of the connection before reading a record: the earliest of the one of the owner and the idle timeout (r.rmu must be held).
+func (r *RecordLayer) armRead() error {
+	r.dmu.Lock()
+	defer r.dmu.Unlock()
+
+	r.idleBy = time.Time{}
+	if r.timeouts.Idle > 0 {
+		r.idleBy = time.Now().Add(r.timeouts.Idle)
+	}
+	deadline := earliest(r.readDeadline, r.idleBy)
+	if deadline.IsZero() && !r.readArmed {
+		// leave alone a deadline set on the connection itself (say, by a handshake)
+		return nil
+	}
+	r.readArmed = !deadline.IsZero()
+
+	return r.conn.SetReadDeadline(deadline)
+}
+
+// Sets the write deadline of the connection before sending a record: the earliest of the one of the owner and the write timeout (r.wmu must be held).
+func (r *RecordLayer) armWrite() error {
+	r.dmu.Lock()
+	defer r.dmu.Unlock()
+
+	r.writeBy = time.Time{}
+	if r.timeouts.Write > 0 {
+		r.writeBy = time.Now().Add(r.timeouts.Write)
+	}
+	deadline := earliest(r.writeDeadline, r.writeBy)
+	if deadline.IsZero() && !r.writeArmed {
+		return nil
+	}
+	r.writeArmed = !deadline.IsZero()
+
+	return r.conn.SetWriteDeadline(deadline)
+}
+
+// Returns whether err means that the idle timeout was up (rather than the deadline of the owner).
+func (r *RecordLayer) idle(err error) bool {
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		return false
+	}
+
+	r.dmu.Lock()
+	defer r.dmu.Unlock()
+
+	return !r.idleBy.IsZero() && (r.readDeadline.IsZero() || r.idleBy.Before(r.readDeadline))
+}
+
+// Returns the earliest of two deadlines (the zero time being none).
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+
+	return a
+}
@@ -0,0 +1,108 @@
+package hermes
+
+import (
+	"context"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Tests that the keepalives keep a silent session alive, and that an end which stops sending them is taken for dead.
+func Test_RecordLayer_keepalive(t *testing.T) {
+	client, server := newRecordLayers(t, KeyUpdatePolicy{})
+	timeouts := Timeouts{Keepalive: 10 * time.Millisecond, Idle: 50 * time.Millisecond}
+	client.SetTimeouts(timeouts)
+	server.SetTimeouts(timeouts)
+
+	// the server reads whatever comes (the pipe doesn't buffer the keepalives of the client)
+	fromClient := readRecords(server, 1)
+	fromServer := readRecords(client, 1)
+
+	// much longer than the idle timeout, without a word
+	time.Sleep(200 * time.Millisecond)
+	if err := server.WriteRecord(RECORD_DATA, []byte("still there?")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-fromServer; got != "still there?" {
+		t.Fatal("got", got)
+	}
+
+	// the server stalls: no more keepalives
+	server.SetTimeouts(Timeouts{})
+	start := time.Now()
+	fromServer = readRecords(client, 1)
+	if got := <-fromServer; got != ErrIdleTimeout {
+		t.Fatal("expected the server to be taken for dead, got", got)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("the server was taken for dead after %s", waited)
+	}
+
+	client.Close()
+	if _, ok := (<-fromClient).(error); !ok {
+		t.Fatal("expected the server to see the connection closed")
+	}
+}
+
+// Tests that a deadline set by the owner of the records can be retried, unlike the idle timeout, and that writes time out as well.
+func Test_RecordLayer_deadlines(t *testing.T) {
+	client, server := newRecordLayers(t, KeyUpdatePolicy{})
+	client.SetTimeouts(Timeouts{Idle: time.Minute})
+
+	client.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, _, err := client.ReadRecord()
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() || err == ErrIdleTimeout {
+		t.Fatal("expected the deadline to be up, got", err)
+	}
+	client.SetReadDeadline(time.Time{})
+	records := readRecords(client, 1)
+	server.WriteRecord(RECORD_DATA, []byte("after the deadline"))
+	if got := <-records; got != "after the deadline" {
+		t.Fatal("got", got)
+	}
+
+	// nobody reads what the server writes
+	server.SetTimeouts(Timeouts{Write: 20 * time.Millisecond})
+	if err := server.WriteRecord(RECORD_DATA, []byte("lost")); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatal("expected the write to time out, got", err)
+	}
+}
+
+// Tests that a peer which stops responding in the middle of the handshake doesn't hold the other one past its deadline.
+func Test_OpenPeer_stalled(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	// the stalled peer answers the public key of the dialer, and is never heard from again
+	go func() {
+		_, pub, err := generateKeys(elliptic.P521(), rand.Reader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, _, err := Read(remote); err != nil {
+			return
+		}
+		Write(remote, pub)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := OpenPeer(ctx,
+		func(context.Context) (net.Conn, error) { return local, nil },
+		func(context.Context) (net.Conn, error) { return nil, errors.New("no relay") },
+		key, true, newIdentity(t))
+	if err == nil {
+		t.Fatal("the handshake with a stalled peer succeeded")
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Fatalf("gave up on the stalled peer after %s", waited)
+	}
+}
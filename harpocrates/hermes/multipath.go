@@ -0,0 +1,490 @@
+package hermes
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+)
+
+// Length of the header of a fragment: the ID of the message (8 bytes), the index of the fragment (2 bytes) and how many there are (2 bytes).
+const FRAGMENT_HEADER_SIZE = 8 + 2 + 2
+
+// The most data carried by a fragment: small enough for it to fit in a datagram.
+const FRAGMENT_SIZE = anubis.MAX_DATAGRAM_PAYLOAD - FRAGMENT_HEADER_SIZE
+
+// The most fragments a message can be split into (the count is 2 bytes on the wire).
+const MAX_FRAGMENTS = 1<<16 - 1
+
+// How long the fragments of a message are kept waiting for the rest of them.
+const REASSEMBLY_TIMEOUT = 30 * time.Second
+
+// The most data kept in incomplete messages (also the largest message that can be sent).
+const MAX_REASSEMBLY_MEMORY = 32 << 20
+
+// The most incomplete messages kept at once.
+const MAX_PENDING_MESSAGES = 256
+
+// The most erasure coded messages remembered once they were got back, to drop their remaining shares.
+const MAX_JOINED_MESSAGES = 4096
+
+// A Path is one of the connections a Multipath spreads fragments over: it carries them whole, one at a time.
+type Path interface {
+	Send(fragment []byte) error
+	Receive() ([]byte, error)
+}
+
+// Wraps a connection carrying a stream (a direct connection with the peer or a RelayConn) into a Path, each fragment being a message.
+func StreamPath(conn net.Conn) Path {
+	return &streamPath{conn: NewConn(conn)}
+}
+
+// A Path over a stream.
+type streamPath struct {
+	conn *Conn
+	wmu  sync.Mutex
+}
+
+func (p *streamPath) Send(fragment []byte) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+
+	_, err := Write(p.conn, fragment)
+	return err
+}
+
+func (p *streamPath) Receive() ([]byte, error) {
+	fragment, _, err := Read(p.conn)
+	return fragment, err
+}
+
+// A Multipath spreads the messages it sends over several paths to the peer (say the relay of the server and a direct connection,
+// or connections through two different networks): each message is split into fragments, and every path carries some of them,
+// so that anyone watching a single path only gets an incomplete ciphertext.
+// The messages must be encrypted already, fragmenting them doesn't hide anything by itself.
+// With an ErasureCoder, each message is coded into shares instead, spread over the paths so that it survives losing some of them.
+type Multipath struct {
+	paths  []Path
+	wmu    sync.Mutex
+	coder  *anubis.ErasureCoder // nil unless the shares are erasure coded
+	lost   []bool               // the paths that failed to send (only skipped with erasure coding)
+	shares *shareCollector
+
+	messages chan []byte
+	mu       sync.Mutex
+	alive    int   // paths that can still be read
+	err      error // why the last path was lost
+	done     chan struct{}
+}
+
+// Creates the Multipath over the given paths, and starts reading the fragments coming from each of them.
+// Returns the Multipath and an error if there are no paths.
+func NewMultipath(paths ...Path) (*Multipath, error) {
+	return NewErasureMultipath(nil, paths...)
+}
+
+// Creates the Multipath over the given paths, coding every message with coder (as agreed with the peer, see Peer.NegotiateErasure()).
+// Each path carries whole shares (fragmented if they're too large), in turn:
+// a message gets through as long as the paths lost carried no more than n-k of its shares.
+// Returns the Multipath and an error if there are no paths.
+func NewErasureMultipath(coder *anubis.ErasureCoder, paths ...Path) (*Multipath, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no paths")
+	}
+
+	mp := &Multipath{
+		paths:    paths,
+		coder:    coder,
+		lost:     make([]bool, len(paths)),
+		messages: make(chan []byte, MAX_PENDING_MESSAGES),
+		alive:    len(paths),
+		done:     make(chan struct{}),
+	}
+	if coder != nil {
+		mp.shares = newShareCollector(coder)
+	}
+	r := newReassembler()
+	for _, p := range paths {
+		go mp.readPath(p, r)
+	}
+
+	return mp, nil
+}
+
+// Splits msg into fragments and sends them over all the paths in turn, each path getting at least one (if msg is long enough).
+// With erasure coding, the shares of msg are sent over the paths in turn instead, skipping the ones that failed before.
+// Returns an error if msg is too large or a path failed (with erasure coding, if fewer than k shares were sent):
+// the message is lost then, since the peer can't reassemble it.
+func (mp *Multipath) Send(msg []byte) error {
+	if len(msg) > MAX_REASSEMBLY_MEMORY {
+		return errors.New("the message is too large")
+	}
+
+	mp.wmu.Lock()
+	defer mp.wmu.Unlock()
+
+	if mp.coder == nil {
+		return sendFragments(msg, mp.paths)
+	}
+
+	shares, err := mp.coder.Seal(msg)
+	if err != nil {
+		return err
+	}
+	sent := 0
+	next := 0
+	for _, share := range shares {
+		p := mp.nextPath(next)
+		if p == -1 {
+			break
+		}
+		next = p + 1
+		if err = sendFragments(share, mp.paths[p:p+1]); err != nil {
+			mp.lost[p] = true
+			continue
+		}
+		sent++
+	}
+	if sent < mp.coder.K() {
+		if err == nil {
+			err = errors.New("all the paths were lost")
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Returns the first path from i on (wrapping around) that didn't fail, -1 if they all did (mp.wmu must be held).
+func (mp *Multipath) nextPath(i int) int {
+	for j := 0; j < len(mp.paths); j++ {
+		p := (i + j) % len(mp.paths)
+		if !mp.lost[p] {
+			return p
+		}
+	}
+
+	return -1
+}
+
+// Splits msg into fragments and sends them over paths in turn, each path getting at least one (if msg is long enough).
+// Returns an error if msg is too large or a path failed.
+func sendFragments(msg []byte, paths []Path) error {
+	n := (len(msg) + FRAGMENT_SIZE - 1) / FRAGMENT_SIZE
+	if n < len(paths) {
+		n = len(paths)
+	}
+	if n > len(msg) {
+		n = len(msg)
+	}
+	if n == 0 {
+		n = 1
+	}
+	if n > MAX_FRAGMENTS {
+		return errors.New("the message is too large")
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	// the fragments are as even as possible
+	start := 0
+	for i := 0; i < n; i++ {
+		end := start + (len(msg)-start)/(n-i)
+		fragment := make([]byte, FRAGMENT_HEADER_SIZE, FRAGMENT_HEADER_SIZE+end-start)
+		copy(fragment, id)
+		binary.BigEndian.PutUint16(fragment[8:], uint16(i))
+		binary.BigEndian.PutUint16(fragment[10:], uint16(n))
+		fragment = append(fragment, msg[start:end]...)
+
+		if err := paths[i%len(paths)].Send(fragment); err != nil {
+			return err
+		}
+		start = end
+	}
+
+	return nil
+}
+
+// Waits for the next message whose fragments all arrived.
+// Returns the message and an error once all the paths are lost.
+func (mp *Multipath) Receive() ([]byte, error) {
+	select {
+	case msg := <-mp.messages:
+		return msg, nil
+	case <-mp.done:
+		// whatever was reassembled before the paths were lost comes first
+		select {
+		case msg := <-mp.messages:
+			return msg, nil
+		default:
+		}
+		mp.mu.Lock()
+		defer mp.mu.Unlock()
+		return nil, mp.err
+	}
+}
+
+// Reads the fragments coming from p until it fails, handing them to r.
+func (mp *Multipath) readPath(p Path, r *reassembler) {
+	for {
+		fragment, err := p.Receive()
+		if err != nil {
+			mp.mu.Lock()
+			mp.alive--
+			if mp.alive == 0 {
+				mp.err = err
+				close(mp.done)
+			}
+			mp.mu.Unlock()
+			return
+		}
+
+		msg := r.add(fragment)
+		if msg != nil && mp.shares != nil {
+			msg = mp.shares.add(msg)
+		}
+		if msg != nil {
+			mp.messages <- msg
+		}
+	}
+}
+
+// A reassembler puts messages back together from their fragments, whichever order and path they come in,
+// dropping the incomplete ones once they time out or when they take too much memory.
+type reassembler struct {
+	mu      sync.Mutex
+	pending map[string]*partial
+	memory  int // data held in pending messages
+	now     func() time.Time
+}
+
+// A message whose fragments are still arriving.
+type partial struct {
+	fragments [][]byte
+	missing   int
+	size      int
+	first     time.Time // when the first fragment arrived
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{
+		pending: make(map[string]*partial),
+		now:     time.Now,
+	}
+}
+
+// Adds a fragment, dropping it if it's malformed, doesn't match the others of its message or doesn't fit in memory.
+// Returns the message if it was its last missing fragment, nil otherwise.
+func (r *reassembler) add(fragment []byte) []byte {
+	if len(fragment) < FRAGMENT_HEADER_SIZE || len(fragment)-FRAGMENT_HEADER_SIZE > FRAGMENT_SIZE {
+		return nil
+	}
+	id := string(fragment[:8])
+	index := int(binary.BigEndian.Uint16(fragment[8:]))
+	total := int(binary.BigEndian.Uint16(fragment[10:]))
+	data := fragment[FRAGMENT_HEADER_SIZE:]
+	if total == 0 || index >= total {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire()
+
+	if total == 1 {
+		return append([]byte{}, data...)
+	}
+
+	p, ok := r.pending[id]
+	if !ok {
+		if len(r.pending) == MAX_PENDING_MESSAGES {
+			r.dropOldest()
+		}
+		p = &partial{fragments: make([][]byte, total), missing: total, first: r.now()}
+		r.pending[id] = p
+	}
+	if len(p.fragments) != total || p.fragments[index] != nil {
+		// inconsistent or duplicated
+		return nil
+	}
+
+	for r.memory+len(data) > MAX_REASSEMBLY_MEMORY && len(r.pending) > 1 {
+		r.dropOldest()
+		if _, ok := r.pending[id]; !ok {
+			// the message itself was the oldest one
+			return nil
+		}
+	}
+	if r.memory+len(data) > MAX_REASSEMBLY_MEMORY {
+		r.drop(id)
+		return nil
+	}
+
+	p.fragments[index] = append([]byte{}, data...)
+	p.missing--
+	p.size += len(data)
+	r.memory += len(data)
+	if p.missing > 0 {
+		return nil
+	}
+
+	msg := make([]byte, 0, p.size)
+	for _, f := range p.fragments {
+		msg = append(msg, f...)
+	}
+	r.drop(id)
+
+	return msg
+}
+
+// Drops the messages that have been waiting for their fragments for too long (r.mu must be held).
+func (r *reassembler) expire() {
+	now := r.now()
+	for id, p := range r.pending {
+		if now.Sub(p.first) > REASSEMBLY_TIMEOUT {
+			r.drop(id)
+		}
+	}
+}
+
+// Drops the message that has been waiting the longest (r.mu must be held).
+func (r *reassembler) dropOldest() {
+	var oldest string
+	var first time.Time
+	for id, p := range r.pending {
+		if first.IsZero() || p.first.Before(first) {
+			oldest, first = id, p.first
+		}
+	}
+	r.drop(oldest)
+}
+
+// Drops a pending message (r.mu must be held).
+func (r *reassembler) drop(id string) {
+	if p, ok := r.pending[id]; ok {
+		r.memory -= p.size
+		delete(r.pending, id)
+	}
+}
+
+// A shareCollector gathers the shares of erasure coded messages, getting each message back as soon as k of its shares arrived.
+// It has the same limits as the reassembler, and it remembers the messages it got back for a while to drop the shares that arrive late.
+type shareCollector struct {
+	coder   *anubis.ErasureCoder
+	mu      sync.Mutex
+	pending map[string]*shareSet
+	joined  map[string]time.Time // when each message was got back
+	memory  int
+	now     func() time.Time
+}
+
+// The shares of a message that arrived so far.
+type shareSet struct {
+	shares map[int][]byte
+	size   int
+	first  time.Time
+}
+
+func newShareCollector(coder *anubis.ErasureCoder) *shareCollector {
+	return &shareCollector{
+		coder:   coder,
+		pending: make(map[string]*shareSet),
+		joined:  make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+// Adds a share, dropping it if it was tampered with, is late, duplicated or doesn't fit in memory.
+// Returns the message if it was the k-th share of it, nil otherwise.
+func (c *shareCollector) add(share []byte) []byte {
+	id, index, data, err := c.coder.OpenShare(share)
+	if err != nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for id, p := range c.pending {
+		if now.Sub(p.first) > REASSEMBLY_TIMEOUT {
+			c.drop(id)
+		}
+	}
+	for id, t := range c.joined {
+		if now.Sub(t) > REASSEMBLY_TIMEOUT {
+			delete(c.joined, id)
+		}
+	}
+	if _, ok := c.joined[id]; ok {
+		return nil
+	}
+
+	p, ok := c.pending[id]
+	if !ok {
+		if len(c.pending) == MAX_PENDING_MESSAGES {
+			c.dropOldest()
+		}
+		p = &shareSet{shares: make(map[int][]byte), first: now}
+		c.pending[id] = p
+	}
+	if _, ok := p.shares[index]; ok {
+		return nil
+	}
+	for c.memory+len(data) > MAX_REASSEMBLY_MEMORY && len(c.pending) > 1 {
+		c.dropOldest()
+		if _, ok := c.pending[id]; !ok {
+			return nil
+		}
+	}
+	if c.memory+len(data) > MAX_REASSEMBLY_MEMORY {
+		c.drop(id)
+		return nil
+	}
+
+	p.shares[index] = data
+	p.size += len(data)
+	c.memory += len(data)
+	if len(p.shares) < c.coder.K() {
+		return nil
+	}
+
+	msg, err := c.coder.Join(p.shares)
+	c.drop(id)
+	if err != nil {
+		return nil
+	}
+	if len(c.joined) < MAX_JOINED_MESSAGES {
+		c.joined[id] = now
+	}
+
+	return msg
+}
+
+// Drops the message that has been waiting the longest (c.mu must be held).
+func (c *shareCollector) dropOldest() {
+	var oldest string
+	var first time.Time
+	for id, p := range c.pending {
+		if first.IsZero() || p.first.Before(first) {
+			oldest, first = id, p.first
+		}
+	}
+	c.drop(oldest)
+}
+
+// Drops a pending message (c.mu must be held).
+func (c *shareCollector) drop(id string) {
+	if p, ok := c.pending[id]; ok {
+		c.memory -= p.size
+		delete(c.pending, id)
+	}
+}
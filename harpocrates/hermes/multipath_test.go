@@ -0,0 +1,310 @@
+package hermes
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+)
+
+// Utility function, a Path that records everything it carries, as someone watching it would.
+type tappedPath struct {
+	Path
+	mu   sync.Mutex
+	seen []byte
+}
+
+func (p *tappedPath) Send(fragment []byte) error {
+	p.mu.Lock()
+	p.seen = append(p.seen, fragment...)
+	p.mu.Unlock()
+
+	return p.Path.Send(fragment)
+}
+
+// Utility function, returns a fragment of the message id.
+func fragmentOf(id uint64, index, total int, data []byte) []byte {
+	f := make([]byte, FRAGMENT_HEADER_SIZE)
+	binary.BigEndian.PutUint64(f, id)
+	binary.BigEndian.PutUint16(f[8:], uint16(index))
+	binary.BigEndian.PutUint16(f[10:], uint16(total))
+
+	return append(f, data...)
+}
+
+// Tests messages spread over a stream (say the relay) and a UDP path that reorders datagrams:
+// they're all reassembled, and neither path alone carries any of them whole.
+func Test_Multipath(t *testing.T) {
+	s1, s2 := net.Pipe()
+	defer s1.Close()
+	defer s2.Close()
+	a, b, link := newLossyLink(35, 0, 0, 0.3)
+	udpA, udpB := datagramPair(t, a, b)
+
+	relay := &tappedPath{Path: StreamPath(s1)}
+	direct := &tappedPath{Path: udpA}
+	sender, err := NewMultipath(relay, direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := NewMultipath(StreamPath(s2), udpB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs [][]byte
+	for _, size := range []int{16, 100, FRAGMENT_SIZE, 10*FRAGMENT_SIZE + 7} {
+		msg := make([]byte, size)
+		rand.Read(msg)
+		msgs = append(msgs, msg)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		for _, msg := range msgs {
+			if err := sender.Send(msg); err != nil {
+				errs <- err
+				return
+			}
+		}
+		link.flush()
+		errs <- nil
+	}()
+
+	// the messages may be completed in another order than they were sent in
+	received := make(map[string]bool)
+	for range msgs {
+		msg, err := receiver.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		received[string(msg)] = true
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range msgs {
+		if !received[string(msg)] {
+			t.Fatalf("a message of %d bytes wasn't reassembled", len(msg))
+		}
+		for _, p := range []*tappedPath{relay, direct} {
+			if bytes.Contains(p.seen, msg) {
+				t.Fatalf("a message of %d bytes went whole over a single path", len(msg))
+			}
+		}
+	}
+}
+
+// Tests that Receive() fails once all the paths are lost.
+func Test_Multipath_lost(t *testing.T) {
+	s1, s2 := net.Pipe()
+	receiver, err := NewMultipath(StreamPath(s2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, _ := NewMultipath(StreamPath(s1))
+
+	go func() {
+		sender.Send([]byte("last words"))
+		s1.Close()
+	}()
+	if msg, err := receiver.Receive(); err != nil || string(msg) != "last words" {
+		t.Fatal("the message sent before the path was lost should arrive", err)
+	}
+	if _, err := receiver.Receive(); err == nil {
+		t.Fatal("Receive() should fail once the paths are lost")
+	}
+}
+
+// Tests that malformed, inconsistent and duplicated fragments are dropped, and that incomplete messages time out.
+func Test_reassembler(t *testing.T) {
+	r := newReassembler()
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	for _, f := range [][]byte{
+		[]byte("short"),
+		fragmentOf(1, 0, 0, []byte("no fragments")),
+		fragmentOf(1, 2, 2, []byte("out of range")),
+		fragmentOf(1, 0, 1, make([]byte, FRAGMENT_SIZE+1)),
+	} {
+		if r.add(f) != nil || len(r.pending) != 0 {
+			t.Fatal("a malformed fragment should be dropped")
+		}
+	}
+
+	r.add(fragmentOf(2, 1, 2, []byte("world")))
+	if r.add(fragmentOf(2, 1, 2, []byte("again"))) != nil {
+		t.Fatal("a duplicated fragment should be dropped")
+	}
+	if r.add(fragmentOf(2, 0, 3, []byte("hello "))) != nil {
+		t.Fatal("a fragment with another count should be dropped")
+	}
+	if msg := r.add(fragmentOf(2, 0, 2, []byte("hello "))); string(msg) != "hello world" {
+		t.Fatalf("expected hello world, got %q", msg)
+	}
+	if len(r.pending) != 0 || r.memory != 0 {
+		t.Fatal("the reassembled message should be forgotten")
+	}
+
+	r.add(fragmentOf(3, 0, 2, []byte("too")))
+	now = now.Add(REASSEMBLY_TIMEOUT + time.Second)
+	if r.add(fragmentOf(3, 1, 2, []byte(" late"))) != nil {
+		t.Fatal("the first fragment should have timed out")
+	}
+}
+
+// Tests that the incomplete messages can't take more than MAX_REASSEMBLY_MEMORY, the oldest ones being dropped first.
+func Test_reassembler_memory(t *testing.T) {
+	r := newReassembler()
+	now := time.Now()
+	r.now = func() time.Time {
+		now = now.Add(time.Millisecond)
+		return now
+	}
+
+	// messages of two fragments, of which only the first arrives
+	data := make([]byte, FRAGMENT_SIZE)
+	count := MAX_REASSEMBLY_MEMORY/FRAGMENT_SIZE + 10
+	for i := 0; i < count; i++ {
+		r.add(fragmentOf(uint64(i), 0, 2, data))
+		if r.memory > MAX_REASSEMBLY_MEMORY {
+			t.Fatalf("%d bytes held, more than the limit", r.memory)
+		}
+		if len(r.pending) > MAX_PENDING_MESSAGES {
+			t.Fatalf("%d messages pending, more than the limit", len(r.pending))
+		}
+	}
+
+	// the newest ones are still there, the oldest ones are gone
+	if msg := r.add(fragmentOf(uint64(count-1), 1, 2, data)); len(msg) != 2*FRAGMENT_SIZE {
+		t.Fatal("the newest message should be complete")
+	}
+	if msg := r.add(fragmentOf(0, 1, 2, data)); msg != nil {
+		t.Fatal("the oldest message should have been dropped")
+	}
+}
+
+// Utility function, a Path that silently loses what it's given while it's down, or fails while it's broken.
+type flakyPath struct {
+	Path
+	mu     sync.Mutex
+	down   bool
+	broken bool
+}
+
+func (p *flakyPath) Send(fragment []byte) error {
+	p.mu.Lock()
+	down, broken := p.down, p.broken
+	p.mu.Unlock()
+
+	if broken {
+		return errors.New("broken path")
+	}
+	if down {
+		return nil
+	}
+
+	return p.Path.Send(fragment)
+}
+
+// Utility function, negotiates erasure coding between two peers offering different parameters.
+func negotiatePair(t *testing.T) (*anubis.ErasureCoder, *anubis.ErasureCoder) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	dialer, listener, derr, lerr := connectPeers(t, key, key)
+	if derr != nil || lerr != nil {
+		t.Fatal(derr, lerr)
+	}
+	defer dialer.Close()
+
+	errs := make(chan error, 1)
+	var lc *anubis.ErasureCoder
+	go func() {
+		var err error
+		lc, err = listener.NegotiateErasure(2, 3)
+		errs <- err
+	}()
+	dc, err := dialer.NegotiateErasure(3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	return dc, lc
+}
+
+// Tests erasure coded messages over four paths, dropping random subsets of the shares:
+// a message gets through as long as no more than n-k paths lost its shares, and paths that fail are skipped from then on.
+func Test_Multipath_erasure(t *testing.T) {
+	dc, lc := negotiatePair(t)
+	if dc.K() != 2 || dc.N() != 4 || lc.K() != 2 || lc.N() != 4 {
+		t.Fatalf("the peers should agree on k=2 and n=4, got %d/%d and %d/%d", dc.K(), dc.N(), lc.K(), lc.N())
+	}
+
+	var senders []Path
+	var receivers []Path
+	var flaky []*flakyPath
+	for i := 0; i < 4; i++ {
+		s1, s2 := net.Pipe()
+		defer s1.Close()
+		defer s2.Close()
+		f := &flakyPath{Path: StreamPath(s1)}
+		flaky = append(flaky, f)
+		senders = append(senders, f)
+		receivers = append(receivers, StreamPath(s2))
+	}
+	sender, _ := NewErasureMultipath(dc, senders...)
+	receiver, _ := NewErasureMultipath(lc, receivers...)
+
+	rng := mrand.New(mrand.NewSource(36))
+	for i := 0; i < 30; i++ {
+		// each path carries one share, any two of them may be lost
+		for _, j := range rng.Perm(4)[:rng.Intn(3)] {
+			flaky[j].down = true
+		}
+		msg := make([]byte, rng.Intn(3*FRAGMENT_SIZE)+16)
+		rand.Read(msg)
+		if err := sender.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+		got, err := receiver.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("message %d wasn't got back", i)
+		}
+		for _, f := range flaky {
+			f.down = false
+		}
+	}
+
+	// with three paths down the message is lost (its shares are dropped once they time out)
+	for _, f := range flaky[:3] {
+		f.down = true
+	}
+	sender.Send([]byte("lost in transit"))
+	for _, f := range flaky[:3] {
+		f.down = false
+	}
+
+	// a path that fails is skipped: its share goes over the next one
+	flaky[1].broken = true
+	if err := sender.Send([]byte("over three paths")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := receiver.Receive(); err != nil || string(got) != "over three paths" {
+		t.Fatalf("expected the message sent over three paths, got %q (%v)", got, err)
+	}
+}
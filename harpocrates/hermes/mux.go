@@ -0,0 +1,480 @@
+package hermes
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+)
+
+// Types of the frames of a Mux.
+const (
+	FRAME_OPEN   byte = iota + 1 // opens a stream
+	FRAME_DATA                   // data on a stream
+	FRAME_WINDOW                 // the receiver read some data, the sender can send that much more (4 bytes)
+	FRAME_CLOSE                  // the sender won't send anything more on the stream
+	FRAME_RESET                  // the stream is aborted, in both directions
+	FRAME_GOAWAY                 // the whole connection is closing (stream 0)
+)
+
+// Length of the header of a frame: its type and the ID of the stream (4 bytes).
+const FRAME_HEADER_SIZE = 1 + 4
+
+// The most data carried by a single frame, so that large writes on a stream don't hold up the others
+// (and so that a full frame, with its header and the type of its record, fits the largest bucket of PAD_BUCKETS).
+const MAX_FRAME_DATA = MAX_PADDING_BUCKET - FRAME_HEADER_SIZE - 1
+
+// How much data can be sent on a stream before the receiver reads it (the window of each stream).
+const STREAM_WINDOW = 256 << 10
+
+// The most streams open at once on a connection.
+const MAX_STREAMS = 1024
+
+// The most streams opened by the peer waiting to be accepted.
+const ACCEPT_BACKLOG = 64
+
+// Returned when using a stream that was reset, from either side.
+var ErrStreamReset = errors.New("the stream was reset")
+
+// Returned when using a stream whose connection was closed.
+var ErrMuxClosed = errors.New("the connection was closed")
+
+// A Mux carries several independent streams over an authenticated connection, each in its own frames
+// (encrypted like any other message), so that chat, files and control messages can share the connection.
+// Every stream has its own flow-control window: a stream whose data isn't read blocks its sender, but not the other streams.
+type Mux struct {
+	records *RecordLayer
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32 // the initiator opens odd streams, the other end even ones
+	err     error  // why the connection was closed (nil while it's open)
+	accept  chan *Stream
+	done    chan struct{}
+}
+
+// Starts multiplexing streams over conn, already authenticated with cipher (from then on, nothing else must read or write it).
+// initiator must be true at one end (the client) and false at the other.
+func NewMux(conn net.Conn, cipher anubis.Cipher, initiator bool) *Mux {
+	c := NewConn(conn)
+	role := SERVER
+	if initiator {
+		role = CLIENT
+	}
+
+	return newMux(NewSessionRecords(c, cipher, role), initiator)
+}
+
+// Starts multiplexing streams over records.
+func newMux(records *RecordLayer, initiator bool) *Mux {
+	m := &Mux{
+		records: records,
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+		accept:  make(chan *Stream, ACCEPT_BACKLOG),
+		done:    make(chan struct{}),
+	}
+	if initiator {
+		m.nextID = 1
+	}
+	go m.readFrames()
+
+	return m
+}
+
+// Opens a new stream.
+// Returns the stream and an error if the connection is closed or too many streams are open.
+func (m *Mux) Open() (*Stream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	if len(m.streams) >= MAX_STREAMS {
+		m.mu.Unlock()
+		return nil, errors.New("too many streams")
+	}
+	s := newStream(m, m.nextID)
+	m.streams[s.id] = s
+	m.nextID += 2
+	m.mu.Unlock()
+
+	if err := m.writeFrame(FRAME_OPEN, s.id, nil); err != nil {
+		m.remove(s.id)
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Waits for the peer to open a stream.
+// Returns the stream and an error once the connection is closed.
+func (m *Mux) Accept() (*Stream, error) {
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-m.done:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return nil, m.err
+	}
+}
+
+// Tells the peer the connection is closing, and closes it along with all its streams.
+func (m *Mux) Close() error {
+	m.writeFrame(FRAME_GOAWAY, 0, nil)
+	m.shutdown(ErrMuxClosed)
+
+	return m.records.Close()
+}
+
+// Reads the frames of the peer and hands them to their streams, until the connection fails.
+// It never waits on a stream: what a stream receives is bounded by its window.
+func (m *Mux) readFrames() {
+	for {
+		rtype, frame, err := m.records.ReadRecord()
+		if err != nil {
+			m.shutdown(err)
+			return
+		}
+		if rtype != RECORD_DATA || len(frame) < FRAME_HEADER_SIZE {
+			continue
+		}
+		typ, id, data := frame[0], binary.BigEndian.Uint32(frame[1:]), frame[FRAME_HEADER_SIZE:]
+
+		if typ == FRAME_GOAWAY {
+			m.shutdown(io.EOF)
+			m.records.Close()
+			return
+		}
+		if typ == FRAME_OPEN {
+			m.opened(id)
+			continue
+		}
+
+		m.mu.Lock()
+		s, ok := m.streams[id]
+		m.mu.Unlock()
+		if !ok {
+			// a stream that was reset or closed already
+			continue
+		}
+
+		switch typ {
+		case FRAME_DATA:
+			if !s.receive(data) {
+				// the peer ignored the window
+				s.abort()
+				go m.writeFrame(FRAME_RESET, id, nil)
+			}
+		case FRAME_WINDOW:
+			if len(data) == 4 {
+				s.grow(int(binary.BigEndian.Uint32(data)))
+			}
+		case FRAME_CLOSE:
+			s.remoteClose()
+		case FRAME_RESET:
+			s.abort()
+		}
+	}
+}
+
+// Registers a stream opened by the peer, refusing it if its ID is wrong or if there are too many.
+func (m *Mux) opened(id uint32) {
+	m.mu.Lock()
+	_, exists := m.streams[id]
+	// the peer opens the streams of the other parity
+	ok := !exists && id != 0 && id%2 != m.nextID%2 && len(m.streams) < MAX_STREAMS
+	var s *Stream
+	if ok {
+		s = newStream(m, id)
+		m.streams[id] = s
+	}
+	m.mu.Unlock()
+
+	if ok {
+		select {
+		case m.accept <- s:
+			return
+		default:
+			// nobody's accepting
+			m.remove(id)
+		}
+	}
+	if !exists {
+		go m.writeFrame(FRAME_RESET, id, nil)
+	}
+}
+
+// Sends a frame (encrypted, like any other message).
+func (m *Mux) writeFrame(typ byte, id uint32, data []byte) error {
+	frame := make([]byte, FRAME_HEADER_SIZE, FRAME_HEADER_SIZE+len(data))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], id)
+	frame = append(frame, data...)
+
+	return m.records.WriteRecord(RECORD_DATA, frame)
+}
+
+// Forgets a stream, once it's closed in both directions or reset.
+func (m *Mux) remove(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.streams, id)
+}
+
+// Closes the connection (if it isn't already) because of err, waking up everyone waiting on a stream.
+func (m *Mux) shutdown(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.err = err
+	streams := m.streams
+	m.streams = make(map[uint32]*Stream)
+	close(m.done)
+	m.mu.Unlock()
+
+	for _, s := range streams {
+		s.wake()
+	}
+}
+
+// Returns why the connection was closed.
+func (m *Mux) closedErr() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.err
+}
+
+// A Stream is one of the conversations carried by a Mux.
+// Read() and Write() can be called from different goroutines; a Write() is sent as a whole, even if it takes several frames.
+type Stream struct {
+	id  uint32
+	m   *Mux
+	wmu sync.Mutex
+
+	mu           sync.Mutex
+	buf          []byte
+	recvWindow   int // how much the peer can still send
+	consumed     int // how much was read since the last window update
+	sendWindow   int // how much we can still send
+	remoteClosed bool
+	localClosed  bool
+	reset        bool
+	readable     chan struct{}
+	writable     chan struct{}
+}
+
+func newStream(m *Mux, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		m:          m,
+		recvWindow: STREAM_WINDOW,
+		sendWindow: STREAM_WINDOW,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+// Returns the ID of the stream.
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Reads the data sent on the stream, waiting for it if there's none.
+// Returns the number of bytes read and an error (io.EOF once the peer closed the stream).
+func (s *Stream) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if len(s.buf) > 0 {
+			n := copy(b, s.buf)
+			s.buf = s.buf[n:]
+			s.consumed += n
+			var update int
+			if s.consumed >= STREAM_WINDOW/2 && !s.remoteClosed && !s.reset {
+				update = s.consumed
+				s.recvWindow += update
+				s.consumed = 0
+			}
+			s.mu.Unlock()
+
+			if update > 0 {
+				inc := make([]byte, 4)
+				binary.BigEndian.PutUint32(inc, uint32(update))
+				s.m.writeFrame(FRAME_WINDOW, s.id, inc)
+			}
+			return n, nil
+		}
+		if s.reset {
+			s.mu.Unlock()
+			return 0, ErrStreamReset
+		}
+		if s.remoteClosed {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.readable:
+		case <-s.m.done:
+			return 0, s.m.closedErr()
+		}
+	}
+}
+
+// Sends data on the stream, in frames of at most MAX_FRAME_DATA bytes, waiting whenever the window of the peer is full.
+// Returns the number of bytes sent and an error.
+func (s *Stream) Write(b []byte) (int, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	sent := 0
+	for sent < len(b) {
+		s.mu.Lock()
+		if s.reset {
+			s.mu.Unlock()
+			return sent, ErrStreamReset
+		}
+		if s.localClosed {
+			s.mu.Unlock()
+			return sent, errors.New("the stream is closed")
+		}
+		if s.sendWindow == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.writable:
+			case <-s.m.done:
+				return sent, s.m.closedErr()
+			}
+			continue
+		}
+		n := len(b) - sent
+		if n > s.sendWindow {
+			n = s.sendWindow
+		}
+		if n > MAX_FRAME_DATA {
+			n = MAX_FRAME_DATA
+		}
+		s.sendWindow -= n
+		s.mu.Unlock()
+
+		if err := s.m.writeFrame(FRAME_DATA, s.id, b[sent:sent+n]); err != nil {
+			return sent, err
+		}
+		sent += n
+	}
+
+	return sent, nil
+}
+
+// Closes the sending side of the stream: the peer reads io.EOF once it got everything, and the stream is gone once it closes its side too.
+func (s *Stream) Close() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.mu.Lock()
+	if s.localClosed || s.reset {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	gone := s.remoteClosed
+	s.mu.Unlock()
+
+	if gone {
+		s.m.remove(s.id)
+	}
+
+	return s.m.writeFrame(FRAME_CLOSE, s.id, nil)
+}
+
+// Aborts the stream in both directions, dropping whatever wasn't read.
+func (s *Stream) Reset() error {
+	s.mu.Lock()
+	if s.reset {
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+	s.abort()
+
+	return s.m.writeFrame(FRAME_RESET, s.id, nil)
+}
+
+// Buffers data received on the stream.
+// Returns false if the peer sent more than its window allowed.
+func (s *Stream) receive(data []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reset || s.remoteClosed {
+		return true
+	}
+	if len(data) > s.recvWindow {
+		return false
+	}
+	s.recvWindow -= len(data)
+	s.buf = append(s.buf, data...)
+	signal(s.readable)
+
+	return true
+}
+
+// Gives more room to send, as the peer read some data.
+func (s *Stream) grow(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sendWindow+n > STREAM_WINDOW {
+		// more than what was ever sent
+		n = STREAM_WINDOW - s.sendWindow
+	}
+	s.sendWindow += n
+	signal(s.writable)
+}
+
+// Records that the peer won't send anything more.
+func (s *Stream) remoteClose() {
+	s.mu.Lock()
+	s.remoteClosed = true
+	gone := s.localClosed
+	signal(s.readable)
+	s.mu.Unlock()
+
+	if gone {
+		s.m.remove(s.id)
+	}
+}
+
+// Marks the stream as reset and forgets it.
+func (s *Stream) abort() {
+	s.mu.Lock()
+	s.reset = true
+	s.buf = nil
+	s.mu.Unlock()
+
+	s.wake()
+	s.m.remove(s.id)
+}
+
+// Wakes up whoever is waiting to read or write.
+func (s *Stream) wake() {
+	signal(s.readable)
+	signal(s.writable)
+}
+
+// Signals c, unless it's signalled already.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,195 @@
+package hermes
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+)
+
+// Utility function, creates the two ends of a Mux over an authenticated connection.
+func newMuxPair(t *testing.T) (*Mux, *Mux) {
+	key := make([]byte, anubis.BYTE_SEC)
+	rand.Read(key)
+	nonce := make([]byte, 64)
+	rand.Read(nonce)
+	cipher, err := anubis.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher.UpdateNonce(nonce)
+
+	local, remote := net.Pipe()
+	client, server := NewMux(local, cipher, true), NewMux(remote, cipher, false)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client, server
+}
+
+// Tests many streams at once, each carrying more than its window in both directions.
+func Test_Mux_streams(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	// the server echoes every stream back
+	go func() {
+		for {
+			s, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				data, err := io.ReadAll(s)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				s.Write(data)
+				s.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			s, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			data := make([]byte, i*STREAM_WINDOW/10)
+			rand.Read(data)
+			go func() {
+				s.Write(data)
+				s.Close()
+			}()
+
+			echo, err := io.ReadAll(s)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(echo, data) {
+				t.Errorf("stream %d: wrong echo (%d bytes instead of %d)", s.ID(), len(echo), len(data))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if len(client.streams) != 0 {
+		t.Fatalf("%d streams closed on both sides are still around", len(client.streams))
+	}
+}
+
+// Tests that a stream whose data isn't read doesn't hold up the others.
+func Test_Mux_headOfLine(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	stuck, _ := client.Open()
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	// the server never reads it: the writer fills the window and waits
+	written := make(chan struct{})
+	go func() {
+		stuck.Write(make([]byte, 2*STREAM_WINDOW))
+		close(written)
+	}()
+
+	chat, _ := client.Open()
+	peer, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := chat.Write([]byte("still there?")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 12)
+		if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "still there?" {
+			t.Fatal("the other stream should go on", err)
+		}
+	}
+
+	select {
+	case <-written:
+		t.Fatal("the writer should be waiting for the window to open")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Tests resetting a stream from one side, and closing the whole connection.
+func Test_Mux_reset(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	s, _ := client.Open()
+	peer, _ := server.Accept()
+	s.Write([]byte("dropped"))
+	if err := peer.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Read(make([]byte, 10)); err != ErrStreamReset {
+		t.Fatalf("expected ErrStreamReset, got %v", err)
+	}
+
+	// the reset reaches the client
+	for i := 0; ; i++ {
+		if _, err := s.Write([]byte("anyone?")); err == ErrStreamReset {
+			break
+		}
+		if i == 100 {
+			t.Fatal("the client should see the reset")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := s.Read(make([]byte, 10)); err != ErrStreamReset {
+		t.Fatalf("expected ErrStreamReset, got %v", err)
+	}
+
+	other, _ := client.Open()
+	server.Accept()
+	client.Close()
+	if _, err := server.Accept(); err == nil {
+		t.Fatal("Accept() should fail once the connection is closed")
+	}
+	if _, err := other.Read(make([]byte, 10)); err == nil {
+		t.Fatal("the streams should fail once the connection is closed")
+	}
+	if _, err := client.Open(); err == nil {
+		t.Fatal("no stream can be opened once the connection is closed")
+	}
+}
+
+// Tests that the peer can't open streams with the IDs of our side.
+func Test_Mux_wrongID(t *testing.T) {
+	client, server := newMuxPair(t)
+
+	// the client opens odd streams only
+	if err := client.writeFrame(FRAME_OPEN, 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	s, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted.ID() != s.ID() || s.ID()%2 != 1 {
+		t.Fatalf("only stream %d should have been accepted, got %d", s.ID(), accepted.ID())
+	}
+}
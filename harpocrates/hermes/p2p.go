@@ -0,0 +1,594 @@
+package hermes
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/harpocrates/seshat"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Roles the two peers take in the peer to peer connection (as decided by the server): one listens, the other dials.
+const (
+	PEER_LISTENER = "LISTEN"
+	PEER_DIALER   = "DIAL"
+)
+
+// Types of the records exchanged between peers (a Session only uses RECORD_DATA and RECORD_KEY_UPDATE).
+const (
+	RECORD_FINISHED   byte = iota + 1 // proof that the sender derived the same keys, and its identity (ends the handshake)
+	RECORD_DATA                       // a chat message
+	RECORD_CLOSE                      // the sender is hanging up
+	RECORD_FILE                       // a file: the length of its name (2 bytes), its name and its content
+	RECORD_RATCHET                    // agreement on the Double Ratchet session protecting chat messages and files
+	RECORD_ERASURE                    // agreement on how messages are erasure coded over several paths: k and n (1 byte each)
+	RECORD_KEY_UPDATE                 // the sender seals what follows with its next key (see RecordLayer)
+	RECORD_COVER                      // agreement on the constant-rate mode: interval (ms), size and budget (4 bytes each)
+	RECORD_CHUNK                      // a part of the records sent in constant-rate mode: type (1 byte), length (4 bytes) and content of each
+)
+
+// The largest file that can be sent to a peer.
+const MAX_FILE_SIZE = 16 << 20
+
+// A Peer is an authenticated and encrypted connection to another client.
+type Peer struct {
+	conn           *Conn
+	records        *RecordLayer
+	dialer         bool
+	identity       ed25519.PublicKey // the long-term identity key of the peer
+	ownIdentity    ed25519.PublicKey
+	ratchetSecret  []byte    // where a new Double Ratchet session starts from
+	datagramSecret []byte    // where the keys of the datagrams exchanged over UDP come from
+	random         io.Reader // where the keys of the handshake and of the ratchet come from
+
+	rmu     sync.Mutex
+	ratchet *anubis.Ratchet // nil until StartRatchet() is called
+	save    func([]byte) error
+
+	mux      *Mux       // nil until StartStreams() is called: the records are used directly until then
+	chat     *Multipath // where the chat messages go, once the streams are started: the chat stream and the paths given to StartStreams()
+	paths    []Path     // the paths given to StartStreams(), closed along with the connection
+	incoming chan received
+}
+
+// Runs the handshake with the other client on conn: an ECDHE whose result is mixed with the pairing key brokered by the server.
+// Only someone who knows the pairing key can complete the handshake, so both ends are authenticated to each other.
+// Each end also signs the transcript with its identity key: the server knows the pairing key, but it can't forge the signature of a peer.
+// Returns the Peer and an error if the handshake failed.
+func PeerHandshake(conn net.Conn, pairingKey []byte, dialer bool, identity ed25519.PrivateKey) (*Peer, error) {
+	return PeerHandshakeWith(conn, pairingKey, dialer, identity, rand.Reader)
+}
+
+// Runs the handshake with the other client on conn, like PeerHandshake(), with the keys drawn from random (the ratchet keys of the Peer as well).
+// Only tests have a reason to use anything but crypto/rand: with the same random on both ends, the handshake is the same byte for byte every time.
+// Returns the Peer and an error if the handshake failed.
+func PeerHandshakeWith(conn net.Conn, pairingKey []byte, dialer bool, identity ed25519.PrivateKey, random io.Reader) (*Peer, error) {
+	if len(pairingKey) != anubis.BYTE_SEC {
+		return nil, errors.New("the pairing key must be 32 bytes long")
+	}
+	if len(identity) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid identity key")
+	}
+	c := NewConn(conn)
+
+	E := elliptic.P521()
+	privKey, pubKey, err := generateKeys(E, random)
+	if err != nil {
+		return nil, err
+	}
+
+	// the dialer speaks first, so that the handshake works on unbuffered connections as well
+	var peerPub []byte
+	if dialer {
+		_, err = Write(c, pubKey)
+		if err != nil {
+			return nil, err
+		}
+		peerPub, _, err = Read(c)
+	} else {
+		peerPub, _, err = Read(c)
+		if err != nil {
+			return nil, err
+		}
+		_, err = Write(c, pubKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sharedSecret, err := calculateSharedSecret(E, peerPub, privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var transcript []byte
+	if dialer {
+		transcript = seshat.MergeChunks(pubKey, peerPub)
+	} else {
+		transcript = seshat.MergeChunks(peerPub, pubKey)
+	}
+
+	dialerKey, listenerKey, finishedKey, ratchetSecret, datagramSecret, err := derivePeerKeys(sharedSecret, pairingKey, transcript)
+	if err != nil {
+		return nil, err
+	}
+
+	var rc *anubis.RecordCipher
+	if dialer {
+		rc, err = anubis.NewRecordCipher(dialerKey, listenerKey)
+	} else {
+		rc, err = anubis.NewRecordCipher(listenerKey, dialerKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Peer{
+		conn:           c,
+		records:        NewRecordLayer(c, rc, DEFAULT_KEY_UPDATES),
+		dialer:         dialer,
+		ownIdentity:    identity.Public().(ed25519.PublicKey),
+		ratchetSecret:  ratchetSecret,
+		datagramSecret: datagramSecret,
+		random:         random,
+	}
+	err = p.finish(dialer, finishedKey, transcript, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Exchanges the finished records, each proving that its sender derived the same keys from the same transcript.
+// A finished record is the MAC (32 bytes), the identity key of the sender (32 bytes) and its signature of the transcript.
+// Returns an error if the proof of the peer is wrong.
+func (p *Peer) finish(dialer bool, finishedKey, transcript []byte, identity ed25519.PrivateKey) error {
+	own := seshat.MergeChunks(
+		finishedMAC(finishedKey, dialer, transcript),
+		identity.Public().(ed25519.PublicKey),
+		ed25519.Sign(identity, identityMessage(dialer, transcript)),
+	)
+	expected := finishedMAC(finishedKey, !dialer, transcript)
+
+	if dialer {
+		err := p.writeRecord(RECORD_FINISHED, own)
+		if err != nil {
+			return err
+		}
+	}
+
+	rtype, proof, err := p.readRecord()
+	if err != nil {
+		return err
+	}
+	if rtype != RECORD_FINISHED || len(proof) != sha256.Size+ed25519.PublicKeySize+ed25519.SignatureSize {
+		return errors.New("the peer failed to authenticate")
+	}
+	mac := proof[:sha256.Size]
+	peerIdentity := ed25519.PublicKey(proof[sha256.Size : sha256.Size+ed25519.PublicKeySize])
+	sig := proof[sha256.Size+ed25519.PublicKeySize:]
+	if !hmac.Equal(mac, expected) || !ed25519.Verify(peerIdentity, identityMessage(!dialer, transcript), sig) {
+		return errors.New("the peer failed to authenticate")
+	}
+	p.identity = peerIdentity
+
+	if !dialer {
+		return p.writeRecord(RECORD_FINISHED, own)
+	}
+
+	return nil
+}
+
+// Returns the identity key the peer proved to own during the handshake.
+func (p *Peer) Identity() ed25519.PublicKey {
+	return p.identity
+}
+
+// Sets the deadline of the connection with the peer (the zero time to remove it).
+func (p *Peer) SetDeadline(t time.Time) error {
+	return p.records.SetDeadline(t)
+}
+
+// Changes the timeouts of the connection with the peer (none unless changed): the keepalives are sent from now on.
+func (p *Peer) SetTimeouts(t Timeouts) {
+	p.records.SetTimeouts(t)
+}
+
+// Agrees with the peer on the Double Ratchet session protecting messages and files from now on.
+// saved is the state of the last session with the peer (nil if there's none): it's resumed if the peer has the same session, otherwise a new one starts.
+// save is called with the new state every time it changes, before anything is sent or shown: if it fails, nothing is.
+// Returns whether a new session was started and an error.
+func (p *Peer) StartRatchet(saved []byte, save func([]byte) error) (bool, error) {
+	if p.ratchetSecret == nil {
+		return false, errors.New("the ratchet was already started")
+	}
+
+	// the identity keys are sorted, because the roles of the peers change with every connection
+	ad := seshat.MergeChunks(p.ownIdentity, p.identity)
+	if bytes.Compare(p.ownIdentity, p.identity) > 0 {
+		ad = seshat.MergeChunks(p.identity, p.ownIdentity)
+	}
+
+	var current *anubis.Ratchet
+	id := make([]byte, 32)
+	if saved != nil {
+		r, err := anubis.UnmarshalRatchet(saved)
+		if err == nil && bytes.Equal(r.AD(), ad) {
+			current = r
+			id = r.ID()
+		}
+	}
+
+	// each end offers the session it has, and a ratchet key in case a new one is needed
+	ratchetKey, err := anubis.NewRatchetKeyWith(p.random)
+	if err != nil {
+		return false, err
+	}
+	ratchetPub, err := anubis.RatchetPublicKey(ratchetKey)
+	if err != nil {
+		return false, err
+	}
+	offer := seshat.MergeChunks(id, ratchetPub)
+
+	var peerOffer []byte
+	if p.dialer {
+		err = p.writeRecord(RECORD_RATCHET, offer)
+		if err != nil {
+			return false, err
+		}
+		peerOffer, err = p.readRatchetRecord()
+	} else {
+		peerOffer, err = p.readRatchetRecord()
+		if err != nil {
+			return false, err
+		}
+		err = p.writeRecord(RECORD_RATCHET, offer)
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(peerOffer) != len(offer) {
+		return false, errors.New("malformed ratchet record")
+	}
+
+	p.rmu.Lock()
+	defer p.rmu.Unlock()
+	p.save = save
+
+	// the secret is needed only once
+	secret := p.ratchetSecret
+	p.ratchetSecret = nil
+	defer func() {
+		for i := range secret {
+			secret[i] = 0
+		}
+	}()
+
+	if current != nil && bytes.Equal(peerOffer[:32], id) {
+		p.ratchet = current
+		p.ratchet.SetRand(p.random)
+		return false, nil
+	}
+
+	// the dialer starts the new session, with a first (empty) message so that the listener can send as well
+	if p.dialer {
+		p.ratchet, err = anubis.NewRatchetInitiatorWith(secret, ad, peerOffer[32:], p.random)
+		if err != nil {
+			return false, err
+		}
+		first, err := p.ratchet.Encrypt(nil)
+		if err != nil {
+			return false, err
+		}
+		err = p.saveRatchet()
+		if err != nil {
+			return false, err
+		}
+		err = p.writeRecord(RECORD_RATCHET, first)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		p.ratchet, err = anubis.NewRatchetResponder(secret, ad, ratchetKey)
+		if err != nil {
+			return false, err
+		}
+		p.ratchet.SetRand(p.random)
+		first, err := p.readRatchetRecord()
+		if err != nil {
+			return false, err
+		}
+		_, err = p.ratchet.Decrypt(first)
+		if err != nil {
+			return false, err
+		}
+		err = p.saveRatchet()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// Agrees with the peer on how messages spread over several paths are erasure coded (see NewErasureMultipath()):
+// each end offers the k and n it wants, and the most redundant combination of the two is kept (the smallest k and the largest n).
+// Like StartRatchet(), it must be called by both ends at the same point of the conversation.
+// Returns the ErasureCoder, with a key bound to this connection, and an error.
+func (p *Peer) NegotiateErasure(k, n int) (*anubis.ErasureCoder, error) {
+	if k < 1 || k > n || n > anubis.MAX_SHARES {
+		return nil, errors.New("invalid number of shares")
+	}
+	offer := []byte{byte(k), byte(n)}
+
+	var peerOffer []byte
+	var err error
+	if p.dialer {
+		err = p.writeRecord(RECORD_ERASURE, offer)
+		if err == nil {
+			peerOffer, err = p.readErasureRecord()
+		}
+	} else {
+		peerOffer, err = p.readErasureRecord()
+		if err == nil {
+			err = p.writeRecord(RECORD_ERASURE, offer)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	peerK, peerN := int(peerOffer[0]), int(peerOffer[1])
+	if peerK < k {
+		k = peerK
+	}
+	if peerN > n {
+		n = peerN
+	}
+
+	key := make([]byte, anubis.BYTE_SEC)
+	_, err = io.ReadFull(hkdf.New(sha256.New, p.datagramSecret, nil, []byte("harpocrates shares")), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return anubis.NewErasureCoder(key, k, n)
+}
+
+// Reads a record that must be an erasure record.
+// Returns its content and an error.
+func (p *Peer) readErasureRecord() ([]byte, error) {
+	rtype, data, err := p.readRecord()
+	if err != nil {
+		return nil, err
+	}
+	if rtype != RECORD_ERASURE || len(data) != 2 {
+		return nil, errors.New("unexpected record from the peer")
+	}
+	if data[0] < 1 || data[0] > data[1] {
+		return nil, errors.New("invalid number of shares")
+	}
+
+	return data, nil
+}
+
+// Sends a message to the peer.
+func (p *Peer) Send(msg []byte) error {
+	ct, err := p.seal(msg)
+	if err != nil {
+		return err
+	}
+	if p.mux != nil {
+		return p.sendChat(ct)
+	}
+
+	return p.writeRecord(RECORD_DATA, ct)
+}
+
+// Sends a file to the peer.
+func (p *Peer) SendFile(name string, content []byte) error {
+	if len(name) == 0 || len(name) > math.MaxUint16 {
+		return errors.New("invalid file name")
+	}
+	if len(content) > MAX_FILE_SIZE {
+		return errors.New("the file is too large")
+	}
+
+	header := make([]byte, 2)
+	binary.BigEndian.PutUint16(header, uint16(len(name)))
+
+	ct, err := p.seal(seshat.MergeChunks(header, []byte(name), content))
+	if err != nil {
+		return err
+	}
+	if p.mux != nil {
+		return p.sendFileStream(ct)
+	}
+
+	return p.writeRecord(RECORD_FILE, ct)
+}
+
+// Waits for the next message (or file) from the peer.
+// Returns the name of the file (empty for chat messages), the content and an error (io.EOF if the peer hung up).
+func (p *Peer) Receive() (string, []byte, error) {
+	if p.mux != nil {
+		return p.receiveStreams()
+	}
+
+	rtype, data, err := p.readRecord()
+	if err != nil {
+		return "", nil, err
+	}
+	if rtype == RECORD_DATA || rtype == RECORD_FILE {
+		data, err = p.open(data)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	switch rtype {
+	case RECORD_DATA:
+		return "", data, nil
+	case RECORD_FILE:
+		return parseFile(data)
+	case RECORD_CLOSE:
+		return "", nil, io.EOF
+	default:
+		return "", nil, errors.New("unexpected record from the peer")
+	}
+}
+
+// Splits a file, as SendFile() sends it, into its name and its content.
+// Returns the name, the content and an error if the file is malformed.
+func parseFile(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, errors.New("malformed file record")
+	}
+	nlen := int(binary.BigEndian.Uint16(data))
+	if nlen == 0 || len(data) < 2+nlen {
+		return "", nil, errors.New("malformed file record")
+	}
+
+	return string(data[2 : 2+nlen]), data[2+nlen:], nil
+}
+
+// Tells the peer we're hanging up and closes the connection.
+func (p *Peer) Close() error {
+	// what's still waiting for a slot of the constant-rate mode (if it's on) isn't worth waiting for
+	p.records.StopConstantRate()
+	if p.mux != nil {
+		p.closePaths()
+		// the GOAWAY of the mux says it all
+		return p.mux.Close()
+	}
+	// the peer might be gone already, so there's no point in checking whether it got the message
+	p.writeRecord(RECORD_CLOSE, nil)
+
+	return p.records.Close()
+}
+
+// Encrypts the content of a message with the Double Ratchet (if it was started) and saves the new state.
+// Returns the ciphertext and an error.
+func (p *Peer) seal(plaintext []byte) ([]byte, error) {
+	p.rmu.Lock()
+	defer p.rmu.Unlock()
+
+	if p.ratchet == nil {
+		return plaintext, nil
+	}
+
+	ciphertext, err := p.ratchet.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return ciphertext, p.saveRatchet()
+}
+
+// Decrypts the content of a message with the Double Ratchet (if it was started) and saves the new state.
+// Returns the plaintext and an error.
+func (p *Peer) open(ciphertext []byte) ([]byte, error) {
+	p.rmu.Lock()
+	defer p.rmu.Unlock()
+
+	if p.ratchet == nil {
+		return ciphertext, nil
+	}
+
+	plaintext, err := p.ratchet.Decrypt(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	return plaintext, p.saveRatchet()
+}
+
+// Hands the state of the Double Ratchet to whoever keeps it (p.rmu must be held).
+func (p *Peer) saveRatchet() error {
+	if p.save == nil {
+		return nil
+	}
+
+	state, err := p.ratchet.Marshal()
+	if err != nil {
+		return err
+	}
+
+	return p.save(state)
+}
+
+// Reads a record that must be a ratchet record.
+// Returns its content and an error.
+func (p *Peer) readRatchetRecord() ([]byte, error) {
+	rtype, data, err := p.readRecord()
+	if err != nil {
+		return nil, err
+	}
+	if rtype != RECORD_RATCHET {
+		return nil, errors.New("unexpected record from the peer")
+	}
+
+	return data, nil
+}
+
+// Encrypts and sends a record of the given type.
+func (p *Peer) writeRecord(rtype byte, data []byte) error {
+	return p.records.WriteRecord(rtype, data)
+}
+
+// Reads and decrypts a record.
+// Returns its type, its content and an error.
+func (p *Peer) readRecord() (byte, []byte, error) {
+	return p.records.ReadRecord()
+}
+
+// Derives the keys of a peer to peer session from the ECDHE shared secret, the pairing key and the handshake transcript.
+// Returns the key for the records sent by the dialer, the one for the records sent by the listener, the key for the finished records,
+// the secret a new Double Ratchet session starts from, the one the keys of the datagrams come from and an error.
+func derivePeerKeys(sharedSecret, pairingKey, transcript []byte) ([]byte, []byte, []byte, []byte, []byte, error) {
+	info := seshat.MergeChunks([]byte("harpocrates p2p"), transcript)
+	kdf := hkdf.New(sha256.New, sharedSecret, pairingKey, info)
+
+	keys := make([]byte, 5*anubis.BYTE_SEC)
+	if _, err := io.ReadFull(kdf, keys); err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+
+	return keys[:32], keys[32:64], keys[64:96], keys[96:128], keys[128:], nil
+}
+
+// Computes the finished MAC of the dialer (or of the listener) over the transcript.
+func finishedMAC(finishedKey []byte, dialer bool, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, finishedKey)
+	if dialer {
+		mac.Write([]byte(PEER_DIALER))
+	} else {
+		mac.Write([]byte(PEER_LISTENER))
+	}
+	mac.Write(transcript)
+
+	return mac.Sum(nil)
+}
+
+// Returns what the dialer (or the listener) signs with its identity key.
+func identityMessage(dialer bool, transcript []byte) []byte {
+	role := PEER_LISTENER
+	if dialer {
+		role = PEER_DIALER
+	}
+
+	return seshat.MergeChunks([]byte("harpocrates identity "+role), transcript)
+}
@@ -0,0 +1,389 @@
+package hermes
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// Utility function, creates an identity key.
+func newIdentity(t *testing.T) ed25519.PrivateKey {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return priv
+}
+
+// Utility function, connects two peers on loopback and runs the handshake with the given pairing keys (and identity keys).
+// Returns the dialer, the listener and the errors they got.
+func connectPeers(t *testing.T, dialerKey, listenerKey []byte, ids ...ed25519.PrivateKey) (*Peer, *Peer, error, error) {
+	if len(ids) == 0 {
+		ids = []ed25519.PrivateKey{newIdentity(t), newIdentity(t)}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	type result struct {
+		peer *Peer
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- result{nil, err}
+			return
+		}
+		p, err := PeerHandshake(conn, listenerKey, false, ids[1])
+		if err != nil {
+			conn.Close()
+		}
+		done <- result{p, err}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, derr := PeerHandshake(conn, dialerKey, true, ids[0])
+	if derr != nil {
+		conn.Close()
+	}
+	l := <-done
+
+	return dialer, l.peer, derr, l.err
+}
+
+// Tests a whole conversation between two peers.
+func Test_PeerHandshake(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	alice, bob := newIdentity(t), newIdentity(t)
+	dialer, listener, derr, lerr := connectPeers(t, key, key, alice, bob)
+	if derr != nil {
+		t.Fatal(derr)
+	}
+	if lerr != nil {
+		t.Fatal(lerr)
+	}
+
+	// each end learns the identity of the other
+	if !bytes.Equal(dialer.Identity(), bob.Public().(ed25519.PublicKey)) {
+		t.Fatal("the dialer got the wrong identity key for the listener")
+	}
+	if !bytes.Equal(listener.Identity(), alice.Public().(ed25519.PublicKey)) {
+		t.Fatal("the listener got the wrong identity key for the dialer")
+	}
+
+	msgs := []string{"hi bob", "hi alice", "", "how are you?"}
+	for i, m := range msgs {
+		from, to := dialer, listener
+		if i%2 == 1 {
+			from, to = listener, dialer
+		}
+
+		err := from.Send([]byte(m))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, got, err := to.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != m {
+			t.Fatalf("wrong message received: expected %s, got %s", m, string(got))
+		}
+	}
+
+	// messages sent back to back are all delivered, in order
+	for _, m := range msgs {
+		dialer.Send([]byte(m))
+	}
+	for _, m := range msgs {
+		_, got, err := listener.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != m {
+			t.Fatalf("wrong message received: expected %s, got %s", m, string(got))
+		}
+	}
+
+	// and so are files
+	content := make([]byte, 100_000)
+	rand.Read(content)
+	err := listener.SendFile("notes.txt", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, got, err := dialer.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "notes.txt" || string(got) != string(content) {
+		t.Fatalf("wrong file received: %s (%d bytes)", name, len(got))
+	}
+
+	dialer.Close()
+	if _, _, err := listener.Receive(); err != io.EOF {
+		t.Fatalf("hanging up should be seen as io.EOF by the peer, got %v", err)
+	}
+	listener.Close()
+}
+
+// Tests that peers with different pairing keys fail to authenticate each other.
+func Test_PeerHandshake_wrongKey(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		k1 := make([]byte, 32)
+		rand.Read(k1)
+		k2 := make([]byte, 32)
+		rand.Read(k2)
+
+		_, _, _, lerr := connectPeers(t, k1, k2)
+		if lerr == nil {
+			t.Fatal("the listener accepted a dialer with the wrong pairing key")
+		}
+	}
+}
+
+// Tests that an invalid pairing key is refused.
+func Test_PeerHandshake_invalidKey(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	_, err := PeerHandshake(local, make([]byte, 16), true, newIdentity(t))
+	if err == nil {
+		t.Fatal("a 16 bytes pairing key should be refused")
+	}
+
+	_, err = PeerHandshake(local, make([]byte, 32), true, nil)
+	if err == nil {
+		t.Fatal("a missing identity key should be refused")
+	}
+}
+
+// Tests that the handshake fails, before sending anything, when its randomness does.
+func Test_PeerHandshakeWith_noRandomness(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	// nobody reads on remote: a write would hang
+	_, err := PeerHandshakeWith(local, make([]byte, 32), true, newIdentity(t), bytes.NewReader(nil))
+	if err == nil {
+		t.Fatal("the handshake should fail without randomness")
+	}
+}
+
+// Tests that a record altered in transit is rejected.
+func Test_Peer_tampering(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	local, remote := net.Pipe()
+	mitm, victim := net.Pipe()
+	defer local.Close()
+	defer victim.Close()
+
+	// forward everything from local to victim, flipping a bit of the third message (the first data record)
+	go func() {
+		c := NewConn(remote)
+		for i := 0; ; i++ {
+			msg, _, err := Read(c)
+			if err != nil {
+				mitm.Close()
+				return
+			}
+			if i == 2 {
+				msg[len(msg)-1] ^= 1
+			}
+			Write(mitm, msg)
+		}
+	}()
+	// and everything from victim back to local
+	go func() {
+		c := NewConn(mitm)
+		for {
+			msg, _, err := Read(c)
+			if err != nil {
+				remote.Close()
+				return
+			}
+			Write(remote, msg)
+		}
+	}()
+
+	done := make(chan *Peer)
+	go func() {
+		p, err := PeerHandshake(victim, key, false, newIdentity(t))
+		if err != nil {
+			t.Error(err)
+		}
+		done <- p
+	}()
+	dialer, err := PeerHandshake(local, key, true, newIdentity(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := <-done
+	if listener == nil {
+		t.FailNow()
+	}
+
+	go dialer.Send([]byte("transfer 100 coins to bob"))
+	if _, _, err := listener.Receive(); err == nil {
+		t.Fatal("a tampered record should be rejected")
+	}
+}
+
+// Tests that the Double Ratchet session is started on the first connection, resumed on the next ones and started again if one end lost it.
+func Test_Peer_StartRatchet(t *testing.T) {
+	alice, bob := newIdentity(t), newIdentity(t)
+	var aliceState, bobState []byte
+
+	// Utility function, connects alice and bob (each time with different roles), starts the ratchet and checks that they can talk.
+	// Returns whether the two ends started a new session.
+	connect := func(round int) (bool, bool) {
+		key := make([]byte, 32)
+		rand.Read(key)
+
+		ids := []ed25519.PrivateKey{alice, bob}
+		if round%2 == 1 {
+			ids = []ed25519.PrivateKey{bob, alice}
+		}
+		dialer, listener, derr, lerr := connectPeers(t, key, key, ids...)
+		if derr != nil || lerr != nil {
+			t.Fatal(derr, lerr)
+		}
+		defer dialer.Close()
+		defer listener.Close()
+
+		dialerState, listenerState := &aliceState, &bobState
+		if round%2 == 1 {
+			dialerState, listenerState = &bobState, &aliceState
+		}
+
+		type result struct {
+			started bool
+			err     error
+		}
+		done := make(chan result)
+		go func() {
+			started, err := listener.StartRatchet(*listenerState, func(state []byte) error {
+				*listenerState = state
+				return nil
+			})
+			done <- result{started, err}
+		}()
+		dstarted, err := dialer.StartRatchet(*dialerState, func(state []byte) error {
+			*dialerState = state
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := <-done
+		if l.err != nil {
+			t.Fatal(l.err)
+		}
+
+		// the listener can speak first, and both ends can send several messages in a row
+		for i, from := range []*Peer{listener, listener, dialer, dialer, listener} {
+			to := dialer
+			if from == dialer {
+				to = listener
+			}
+			msg := fmt.Sprintf("round %d, message %d", round, i)
+			go from.Send([]byte(msg))
+			_, got, err := to.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != msg {
+				t.Fatalf("wrong message: expected %s, got %s", msg, string(got))
+			}
+		}
+
+		return dstarted, l.started
+	}
+
+	if d, l := connect(0); !d || !l {
+		t.Fatal("the first connection should start a new session")
+	}
+	for round := 1; round < 4; round++ {
+		if d, l := connect(round); d || l {
+			t.Fatalf("connection %d should have resumed the session", round)
+		}
+	}
+
+	// bob reinstalled the client (but kept his identity)
+	bobState = nil
+	if d, l := connect(4); !d || !l {
+		t.Fatal("a new session should start when one end lost it")
+	}
+	if d, l := connect(5); d || l {
+		t.Fatal("the new session should be resumed")
+	}
+}
+
+// Tests that a message whose ratchet state can't be saved isn't sent.
+func Test_Peer_ratchetSave(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	dialer, listener, derr, lerr := connectPeers(t, key, key)
+	if derr != nil || lerr != nil {
+		t.Fatal(derr, lerr)
+	}
+	defer dialer.Close()
+	defer listener.Close()
+
+	fail := false
+	done := make(chan error)
+	go func() {
+		_, err := listener.StartRatchet(nil, nil)
+		done <- err
+	}()
+	_, err := dialer.StartRatchet(nil, func([]byte) error {
+		if fail {
+			return errors.New("disk full")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.StartRatchet(nil, nil); err == nil {
+		t.Fatal("the ratchet can be started only once")
+	}
+
+	fail = true
+	if err := dialer.Send([]byte("not saved")); err == nil {
+		t.Fatal("a message whose ratchet state can't be saved shouldn't be sent")
+	}
+
+	fail = false
+	go dialer.Send([]byte("saved"))
+	_, got, err := listener.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "saved" {
+		t.Fatal("wrong message")
+	}
+}
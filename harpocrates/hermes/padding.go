@@ -0,0 +1,129 @@
+package hermes
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"math/big"
+)
+
+// Schemes of a PaddingPolicy.
+const (
+	PAD_NONE    = iota + 1 // as long as what they carry
+	PAD_BUCKETS            // to the next power of two, of at least Size bytes (to a multiple of MAX_PADDING_BUCKET past it)
+	PAD_FIXED              // to Size bytes (to a multiple of Size for the longer ones)
+	PAD_RANDOM             // with up to Size bytes, as many as chance says
+)
+
+// The largest bucket of PAD_BUCKETS: a bigger record is padded to a multiple of it, rather than to twice its length.
+const MAX_PADDING_BUCKET = 16 << 10
+
+// What ends the message of a handshake record, before the padding (the way ISO/IEC 7816-4 pads).
+const PADDING_MARKER = 0x80
+
+// How records are padded, to hide the length of what they carry: how long a message is (a username, for one) shows through the encryption otherwise.
+// The padding is made of zeros, after a byte that marks where the message ends, so that it's undone without knowing the policy it was made with.
+type PaddingPolicy struct {
+	Scheme int       // PAD_NONE, PAD_BUCKETS, PAD_FIXED or PAD_RANDOM (DEFAULT_PADDING if 0)
+	Size   int       // the smallest bucket, the fixed size or the most random padding
+	Rand   io.Reader // where the random padding comes from (crypto/rand if nil)
+}
+
+// How records are padded by default: a username, or a short chat message, can't be told from another one.
+var DEFAULT_PADDING = PaddingPolicy{Scheme: PAD_BUCKETS, Size: 128}
+
+// Pads the message of a handshake record: msg, PADDING_MARKER and zeros.
+// Returns the padded message and an error if the random padding can't be drawn.
+func (p PaddingPolicy) Pad(msg []byte) ([]byte, error) {
+	return p.pad(msg, PADDING_MARKER)
+}
+
+// Undoes Pad().
+// Returns the message and an error if it wasn't padded.
+func Unpad(padded []byte) ([]byte, error) {
+	msg, marker, ok := unpad(padded)
+	if !ok || marker != PADDING_MARKER {
+		return nil, errors.New("the message isn't padded")
+	}
+
+	return msg, nil
+}
+
+// Appends marker (never 0) to msg, and as many zeros as the policy says.
+// Returns the padded message and an error.
+func (p PaddingPolicy) pad(msg []byte, marker byte) ([]byte, error) {
+	n := len(msg) + 1
+	length, err := p.length(n)
+	if err != nil {
+		return nil, err
+	}
+	padded := make([]byte, length)
+	copy(padded, msg)
+	padded[len(msg)] = marker
+
+	return padded, nil
+}
+
+// Strips the zeros at the end of padded, and the marker before them.
+// Returns what comes before the marker, the marker and false if there's nothing but zeros (padding only).
+func unpad(padded []byte) ([]byte, byte, bool) {
+	i := len(padded) - 1
+	for i >= 0 && padded[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		return nil, 0, false
+	}
+
+	return padded[:i], padded[i], true
+}
+
+// Returns how long a message of n bytes (its marker included) is once padded, and an error if the random padding can't be drawn.
+func (p PaddingPolicy) length(n int) (int, error) {
+	if n < 1 {
+		// a record of nothing but padding still has a zero where the marker goes
+		n = 1
+	}
+	if p.Scheme == 0 {
+		p = DEFAULT_PADDING
+	}
+	size := p.Size
+	if size <= 0 {
+		size = 1
+	}
+
+	switch p.Scheme {
+	case PAD_BUCKETS:
+		if n > MAX_PADDING_BUCKET {
+			return roundUp(n, MAX_PADDING_BUCKET), nil
+		}
+		bucket := size
+		for bucket < n {
+			bucket *= 2
+		}
+		return bucket, nil
+	case PAD_FIXED:
+		return roundUp(n, size), nil
+	case PAD_RANDOM:
+		if p.Size <= 0 {
+			return n, nil
+		}
+		random := p.Rand
+		if random == nil {
+			random = rand.Reader
+		}
+		extra, err := rand.Int(random, big.NewInt(int64(p.Size)+1))
+		if err != nil {
+			// without randomness the padding would be the same every time
+			return 0, err
+		}
+		return n + int(extra.Int64()), nil
+	}
+
+	return n, nil
+}
+
+// Rounds n up to a multiple of size.
+func roundUp(n, size int) int {
+	return (n + size - 1) / size * size
+}
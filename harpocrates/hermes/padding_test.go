@@ -0,0 +1,79 @@
+package hermes
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// Tests how long each policy pads a message to, and that the padding is undone whatever the message ends with.
+func Test_PaddingPolicy(t *testing.T) {
+	tests := []struct {
+		policy PaddingPolicy
+		n      int // the length of the message
+		padded int
+	}{
+		{PaddingPolicy{}, 0, 128},
+		{PaddingPolicy{}, 127, 128},
+		{PaddingPolicy{}, 128, 256},
+		{PaddingPolicy{Scheme: PAD_NONE}, 10, 11},
+		{PaddingPolicy{Scheme: PAD_BUCKETS, Size: 32}, 40, 64},
+		{PaddingPolicy{Scheme: PAD_BUCKETS, Size: 32}, 3 * MAX_PADDING_BUCKET, 4 * MAX_PADDING_BUCKET},
+		{PaddingPolicy{Scheme: PAD_FIXED, Size: 100}, 5, 100},
+		{PaddingPolicy{Scheme: PAD_FIXED, Size: 100}, 150, 200},
+		{PaddingPolicy{Scheme: PAD_RANDOM}, 10, 11},
+	}
+	for _, test := range tests {
+		msg := make([]byte, test.n)
+		if test.n > 0 {
+			msg[0] = 1 // the rest are zeros, like the padding
+		}
+
+		padded, err := test.policy.Pad(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(padded) != test.padded {
+			t.Fatalf("%+v: expected %d bytes to be padded to %d, got %d", test.policy, test.n, test.padded, len(padded))
+		}
+		got, err := Unpad(padded)
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("%+v: got %x and %v back", test.policy, got, err)
+		}
+	}
+
+	// random padding adds anything from none to Size bytes
+	policy := PaddingPolicy{Scheme: PAD_RANDOM, Size: 16, Rand: rand.New(rand.NewSource(1))}
+	seen := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		padded, err := policy.Pad([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := len(padded)
+		if n < 6 || n > 6+16 {
+			t.Fatalf("%d bytes of random padding, expected at most 16", n-6)
+		}
+		seen[n] = true
+	}
+	if len(seen) != 17 {
+		t.Fatalf("expected every length of padding, got %d of them", len(seen))
+	}
+
+	for _, bad := range [][]byte{nil, make([]byte, 10), []byte("no marker")} {
+		if _, err := Unpad(bad); err == nil {
+			t.Fatalf("%q was unpadded", bad)
+		}
+	}
+}
+
+// Tests that random padding without randomness fails, rather than padding the same way every time (or panicking).
+func Test_PaddingPolicy_noRandomness(t *testing.T) {
+	policy := PaddingPolicy{Scheme: PAD_RANDOM, Size: 16, Rand: bytes.NewReader(nil)}
+	if _, err := policy.Pad([]byte("hello")); err == nil {
+		t.Fatal("the padding should fail without randomness")
+	}
+	if _, err := SealRecord(fuzzCipher(t), []byte("hello"), policy); err == nil {
+		t.Fatal("the record shouldn't be sealed without randomness")
+	}
+}
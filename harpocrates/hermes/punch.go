@@ -0,0 +1,168 @@
+package hermes
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// What a bind request starts with: it's followed by the token the server handed out with BIND.
+const BIND_MAGIC = "harpocrates bind"
+
+// How often probes are sent while punching.
+const PUNCH_INTERVAL = 100 * time.Millisecond
+
+// How long the probes of the peer are still answered once our side of the path is confirmed, so that the peer can confirm its side as well.
+const PUNCH_LINGER = 500 * time.Millisecond
+
+// Types of the packets exchanged while punching.
+const (
+	PROBE     byte = iota + 1 // are you there? (carries a fresh nonce)
+	PROBE_ACK                 // yes (echoes the nonce of the probe)
+)
+
+// Length of a probe: type, role of the sender, nonce and MAC.
+const PROBE_SIZE = 1 + 1 + 8 + sha256.Size
+
+// Returns the bind request carrying token, which the client sends to the UDP port of the server so that the server learns the endpoint it's seen from.
+func BindRequest(token []byte) []byte {
+	return append([]byte(BIND_MAGIC), token...)
+}
+
+// Punches a hole through the NATs between us and a peer: both send probes to each other's endpoint (as seen by the server) at the same time,
+// so that each NAT sees outgoing packets before the incoming ones and lets them in.
+// pc must be the socket whose endpoint was given to the peer; the probes are authenticated with a key derived from the pairing key,
+// and they're answered wherever they come from (the NAT of the peer may have picked another port for us).
+// Returns the address the peer answered from (once a probe of ours was acknowledged) and an error if ctx is done first.
+func Punch(ctx context.Context, pc net.PacketConn, peer net.Addr, pairingKey []byte, dialer bool) (net.Addr, error) {
+	key, err := punchKey(pairingKey)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.SetReadDeadline(time.Time{})
+
+	role := byte(0)
+	if dialer {
+		role = 1
+	}
+
+	var confirmed net.Addr
+	var answered bool // whether we acknowledged a probe of the peer
+	var lingerUntil time.Time
+	targets := []net.Addr{peer}
+	sent := make(map[string]bool)
+	nextProbe := time.Now()
+	buf := make([]byte, 2048)
+
+	for {
+		now := time.Now()
+		if confirmed != nil && (answered && now.After(lingerUntil) || ctx.Err() != nil) {
+			return confirmed, nil
+		}
+		if ctx.Err() != nil {
+			return nil, errors.New("the peer couldn't be reached over UDP")
+		}
+
+		if confirmed == nil && !now.Before(nextProbe) {
+			nonce := make([]byte, 8)
+			if _, err := rand.Read(nonce); err != nil {
+				return nil, err
+			}
+			sent[string(nonce)] = true
+			probe := probePacket(key, PROBE, role, nonce)
+			for _, t := range targets {
+				pc.WriteTo(probe, t)
+			}
+			nextProbe = now.Add(PUNCH_INTERVAL)
+		}
+
+		deadline := nextProbe
+		if confirmed != nil {
+			deadline = lingerUntil
+		}
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		pc.SetReadDeadline(deadline)
+
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return nil, err
+		}
+
+		typ, peerRole, nonce, ok := parseProbe(key, buf[:n])
+		if !ok || peerRole == role {
+			// not for us, or our own probe reflected back
+			continue
+		}
+
+		switch typ {
+		case PROBE:
+			pc.WriteTo(probePacket(key, PROBE_ACK, role, nonce), from)
+			answered = true
+			if !hasAddr(targets, from) {
+				targets = append(targets, from)
+			}
+		case PROBE_ACK:
+			if confirmed == nil && sent[string(nonce)] {
+				confirmed = from
+				lingerUntil = time.Now().Add(PUNCH_LINGER)
+			}
+		}
+	}
+}
+
+// Derives the key authenticating the probes from the pairing key.
+// Returns the key and an error.
+func punchKey(pairingKey []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, pairingKey, nil, []byte("harpocrates punch")), key)
+
+	return key, err
+}
+
+// Returns a probe of the given type, sent by role, with the given nonce.
+func probePacket(key []byte, typ, role byte, nonce []byte) []byte {
+	p := append([]byte{typ, role}, nonce...)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(p)
+
+	return mac.Sum(p)
+}
+
+// Checks the MAC of a probe.
+// Returns its type, the role of the sender, its nonce and whether it's a valid probe.
+func parseProbe(key, p []byte) (byte, byte, []byte, bool) {
+	if len(p) != PROBE_SIZE || (p[0] != PROBE && p[0] != PROBE_ACK) {
+		return 0, 0, nil, false
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(p[:PROBE_SIZE-sha256.Size])
+	if !hmac.Equal(mac.Sum(nil), p[PROBE_SIZE-sha256.Size:]) {
+		return 0, 0, nil, false
+	}
+
+	return p[0], p[1], p[2 : PROBE_SIZE-sha256.Size], true
+}
+
+// Returns whether addrs contains addr.
+func hasAddr(addrs []net.Addr, addr net.Addr) bool {
+	for _, a := range addrs {
+		if a.String() == addr.String() {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,249 @@
+package hermes
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Utility function, a simulated network carrying UDP packets between hosts, some of which sit behind NATs.
+type memNet struct {
+	mu    sync.Mutex
+	hosts map[string]*memConn // by address
+	nats  map[string]*memNAT  // by public ip
+}
+
+// Utility function, a NAT with endpoint-independent mapping and address-dependent filtering (a "restricted cone"):
+// a host behind it keeps its public port whoever it talks to, but packets only get in from addresses it sent something to.
+type memNAT struct {
+	ip       net.IP
+	next     int
+	public   map[string]int          // internal address -> public port
+	internal map[int]string          // public port -> internal address
+	allowed  map[int]map[string]bool // public port -> remote ips allowed in
+}
+
+// Utility function, a socket on the simulated network.
+type memConn struct {
+	net      *memNet
+	addr     *net.UDPAddr
+	nat      *memNAT // nil if the host isn't behind a NAT
+	in       chan memPacket
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+type memPacket struct {
+	from net.Addr
+	data []byte
+}
+
+func newMemNet() *memNet {
+	return &memNet{hosts: make(map[string]*memConn), nats: make(map[string]*memNAT)}
+}
+
+// Utility function, creates a NAT with the given public ip.
+func (n *memNet) newNAT(ip string) *memNAT {
+	nat := &memNAT{
+		ip:       net.ParseIP(ip),
+		next:     40000,
+		public:   make(map[string]int),
+		internal: make(map[int]string),
+		allowed:  make(map[int]map[string]bool),
+	}
+	n.mu.Lock()
+	n.nats[nat.ip.String()] = nat
+	n.mu.Unlock()
+
+	return nat
+}
+
+// Utility function, opens a socket at addr, behind nat (nil if it's on the internet).
+func (n *memNet) listen(addr string, nat *memNAT) *memConn {
+	a, _ := net.ResolveUDPAddr("udp", addr)
+	c := &memConn{net: n, addr: a, nat: nat, in: make(chan memPacket, 64)}
+	n.mu.Lock()
+	n.hosts[a.String()] = c
+	n.mu.Unlock()
+
+	return c
+}
+
+// Utility function, carries a packet to dst, through the NAT dst is behind (if any).
+func (n *memNet) deliver(from *net.UDPAddr, dst *net.UDPAddr, data []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if nat, ok := n.nats[dst.IP.String()]; ok {
+		internal, ok := nat.internal[dst.Port]
+		if !ok || !nat.allowed[dst.Port][from.IP.String()] {
+			// unsolicited, dropped
+			return
+		}
+		dst, _ = net.ResolveUDPAddr("udp", internal)
+	}
+
+	if c, ok := n.hosts[dst.String()]; ok {
+		select {
+		case c.in <- memPacket{from, append([]byte{}, data...)}:
+		default:
+		}
+	}
+}
+
+func (c *memConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil {
+		return 0, err
+	}
+
+	from := c.addr
+	if c.nat != nil {
+		c.net.mu.Lock()
+		port, ok := c.nat.public[c.addr.String()]
+		if !ok {
+			port = c.nat.next
+			c.nat.next++
+			c.nat.public[c.addr.String()] = port
+			c.nat.internal[port] = c.addr.String()
+			c.nat.allowed[port] = make(map[string]bool)
+		}
+		c.nat.allowed[port][dst.IP.String()] = true
+		c.net.mu.Unlock()
+		from = &net.UDPAddr{IP: c.nat.ip, Port: port}
+	}
+
+	c.net.deliver(from, dst, b)
+	return len(b), nil
+}
+
+func (c *memConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p := <-c.in:
+		return copy(b, p.data), p.from, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+	return nil
+}
+
+func (c *memConn) Close() error                       { return nil }
+func (c *memConn) LocalAddr() net.Addr                { return c.addr }
+func (c *memConn) SetDeadline(t time.Time) error      { return c.SetReadDeadline(t) }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Utility function, the server side of the binding: returns the address the server sees a packet from c coming from.
+func reflexive(t *testing.T, n *memNet, c *memConn) net.Addr {
+	server := n.listen("198.51.100.1:9001", nil)
+	c.WriteTo(BindRequest(make([]byte, 16)), server.addr)
+
+	select {
+	case p := <-server.in:
+		return p.from
+	case <-time.After(time.Second):
+		t.Fatal("the bind request never reached the server")
+	}
+	return nil
+}
+
+// Tests two peers behind NATs punching through them, having learnt their endpoints from the server.
+func Test_Punch(t *testing.T) {
+	n := newMemNet()
+	alice := n.listen("192.168.1.10:5000", n.newNAT("203.0.113.1"))
+	bob := n.listen("10.0.0.20:6000", n.newNAT("203.0.113.2"))
+	aliceEndpoint, bobEndpoint := reflexive(t, n, alice), reflexive(t, n, bob)
+	if aliceEndpoint.String() != "203.0.113.1:40000" {
+		t.Fatalf("the server should see alice from her NAT, got %s", aliceEndpoint)
+	}
+
+	// without punching, the NATs let nothing in
+	alice.WriteTo([]byte("hi"), bob.addr)
+	bob.WriteTo([]byte("hi"), aliceEndpoint)
+	alice.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := alice.ReadFrom(make([]byte, 10)); err == nil {
+		t.Fatal("the NAT of alice should drop packets from bob")
+	}
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		addr, err := Punch(ctx, alice, bobEndpoint, key, true)
+		if err == nil && addr.String() != bobEndpoint.String() {
+			t.Errorf("alice should reach bob at %s, got %s", bobEndpoint, addr)
+		}
+		done <- err
+	}()
+	// bob starts a bit later, his NAT drops the first probes of alice
+	time.Sleep(3 * PUNCH_INTERVAL)
+	addr, err := Punch(ctx, bob, aliceEndpoint, key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != aliceEndpoint.String() {
+		t.Fatalf("bob should reach alice at %s, got %s", aliceEndpoint, addr)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// the hole stays open
+	alice.WriteTo([]byte("still there?"), bobEndpoint)
+	bob.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 100)
+	for {
+		// the last probes may still be on their way
+		nr, _, err := bob.ReadFrom(buf)
+		if err != nil {
+			t.Fatal("the path should stay open", err)
+		}
+		if string(buf[:nr]) == "still there?" {
+			break
+		}
+	}
+}
+
+// Tests that punching gives up when the peer doesn't take part, and that probes made with another key are ignored.
+func Test_Punch_unauthenticated(t *testing.T) {
+	n := newMemNet()
+	alice := n.listen("192.168.1.10:5000", n.newNAT("203.0.113.1"))
+	mallory := n.listen("198.51.100.66:6666", nil)
+	aliceEndpoint := reflexive(t, n, alice)
+
+	key, wrongKey := make([]byte, 32), make([]byte, 32)
+	rand.Read(key)
+	rand.Read(wrongKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	go Punch(ctx, mallory, aliceEndpoint, wrongKey, false)
+
+	if _, err := Punch(ctx, alice, mallory.addr, key, true); err == nil {
+		t.Fatal("mallory doesn't know the pairing key, the path shouldn't be confirmed")
+	}
+}
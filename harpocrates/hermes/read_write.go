@@ -0,0 +1,211 @@
+package hermes
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/harpocrates/seshat"
+)
+
+// The longest record the record layer of a session accepts (the biggest one we send is a file, along with its name, over a P2P session).
+const MAX_MESSAGE_SIZE = MAX_FILE_SIZE + 1<<20
+
+// The longest message Read() accepts until the other end authenticated: no handshake message comes anywhere near it,
+// and whoever connects shouldn't make us buffer a file's worth of data before we know who they are.
+const MAX_HANDSHAKE_MESSAGE_SIZE = 64 << 10
+
+var ErrMessageTooLong = errors.New("the message is longer than the connection accepts")
+
+// Wrapper around Read() to decrypt the message and check the nonce every time we read from remote.
+// Returns the message enclosed in the stream, the number of bytes read and an error.
+func FullRead(conn net.Conn, cipher anubis.Cipher) ([]byte, int, error) {
+	record, _, err := Read(conn)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	msg, err := OpenRecord(cipher, record)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return msg, len(msg), nil
+}
+
+// Wrapper around Write(), automatically creates the nonce+msg data to send to the server and does the sending.
+// Returns number of bytes send and an error.
+func FullWrite(conn net.Conn, msg []byte, cipher anubis.Cipher) (int, error) {
+	record, err := SealRecord(cipher, msg, DEFAULT_PADDING)
+	if err != nil {
+		return 0, err
+	}
+
+	return Write(conn, record)
+}
+
+// Encrypts msg along with the nonce of the session, the way FullWrite() sends it, padded following padding.
+// Returns the record and an error.
+func SealRecord(cipher anubis.Cipher, msg []byte, padding PaddingPolicy) ([]byte, error) {
+	padded, err := padding.Pad(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.Encrypt(seshat.MergeChunks(cipher.Nonce(), padded))
+}
+
+// Decrypts a record sent with FullWrite() (or sealed with SealRecord()), checking that it carries the nonce of the session, and strips its padding.
+// Returns the message and an error.
+func OpenRecord(cipher anubis.Cipher, record []byte) ([]byte, error) {
+	m, err := cipher.Decrypt(record)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, nonce, err := seshat.ExtractDataNonce(m, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare(cipher.Nonce(), nonce) != 1 {
+		return nil, errors.New("the nonces don't match")
+	}
+
+	return Unpad(msg)
+}
+
+func EncWrite(conn net.Conn, cipher anubis.Cipher, plaintext []byte) (int, error) {
+	aeadtext, err := cipher.Encrypt(plaintext)
+	if err != nil {
+		return 0, err
+	}
+
+	return Write(conn, aeadtext)
+}
+
+// Wrapper around conn.Read() to make sure we read decrypted data.
+func DecRead(conn net.Conn, cipher anubis.Cipher) ([]byte, int, error) {
+	m, nr, err := Read(conn)
+	if err != nil {
+		return nil, 0, err
+	}
+	plaintext, err := cipher.Decrypt(m)
+
+	return plaintext, nr, err
+}
+
+// Wrapper to write accross a TCP connection.
+// To mantain consistency with the net API, it returns the number of bytes written and an error.
+func Write(conn net.Conn, msg []byte) (int, error) {
+	writer := bufio.NewWriter(conn)
+	hexMsg := hex.EncodeToString(msg) + "\n"
+
+	n, err := writer.WriteString(hexMsg)
+	if err != nil {
+		return 0, err
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// Wrapper to read data accross a TCP connection.
+// To mantain the API consistent with the net API, on top of returning the message read from the connection it returns the number of bytes read and an error.
+func Read(conn net.Conn) ([]byte, int, error) {
+	c, ok := conn.(*Conn)
+	var reader *bufio.Reader
+	if ok {
+		reader = c.reader
+	} else {
+		reader = bufio.NewReader(conn)
+	}
+
+	partial := ""
+	limit := MAX_HANDSHAKE_MESSAGE_SIZE
+	if ok {
+		// a deadline can cut a message in half: the rest of it comes with the next read
+		partial, c.partial = c.partial, ""
+		limit = c.maxMessageSize()
+	}
+
+	hexMsg, err := readLine(reader, partial, limit)
+	if ok && err != nil && err != ErrMessageTooLong {
+		c.partial = hexMsg
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	msg, err := hex.DecodeString(strings.TrimSuffix(hexMsg, "\n"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return msg, len(msg), err
+}
+
+// Reads a line from reader, after what was read of it already (partial), giving up once it's too long to hold a message of limit bytes.
+// Returns the line (what was read of it, on error) and an error.
+func readLine(reader *bufio.Reader, partial string, limit int) (string, error) {
+	line := []byte(partial)
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > 2*limit+1 {
+			return "", ErrMessageTooLong
+		}
+		line = append(line, chunk...)
+
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// A Conn is a net.Conn that keeps its read buffer between calls to Read().
+// Without it, whatever the buffer read past the end of a message (e.g. a second message written right after the first) would be lost.
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	partial string // what was read of a message before a read failed (say, because of a deadline)
+	limit   int    // the longest message Read() accepts (MAX_HANDSHAKE_MESSAGE_SIZE if 0)
+}
+
+// Wraps conn in a Conn (unless it is one already).
+func NewConn(conn net.Conn) *Conn {
+	if c, ok := conn.(*Conn); ok {
+		return c
+	}
+
+	return &Conn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// Changes the longest message Read() accepts on c: MAX_HANDSHAKE_MESSAGE_SIZE until the other end authenticated, MAX_MESSAGE_SIZE once the record layer takes over.
+func (c *Conn) SetMaxMessageSize(n int) {
+	c.limit = n
+}
+
+// Returns the longest message Read() accepts on c.
+func (c *Conn) maxMessageSize() int {
+	if c.limit <= 0 {
+		return MAX_HANDSHAKE_MESSAGE_SIZE
+	}
+
+	return c.limit
+}
+
+// Reads from the buffer, so that mixing Read() and conn.Read() doesn't lose any data.
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,122 @@
+package hermes
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+// Tests that messages written back to back are all read when the connection is wrapped in a Conn.
+func Test_Read_backToBack(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	msgs := []string{"SERVER_OK", "a longer message, written right after the first one", "x"}
+	go func() {
+		// a single write, as if the messages had been coalesced in transit
+		var all []byte
+		for _, m := range msgs {
+			all = append(all, []byte(hex.EncodeToString([]byte(m))+"\n")...)
+		}
+		remote.Write(all)
+	}()
+
+	conn := NewConn(local)
+	for _, expected := range msgs {
+		msg, n, err := Read(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != expected || n != len(expected) {
+			t.Fatalf("wrong message read: expected %s, got %s", expected, string(msg))
+		}
+	}
+}
+
+// Tests that wrapping a Conn again returns the same Conn (and thus the same buffer).
+func Test_NewConn_idempotent(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	conn := NewConn(local)
+	if NewConn(conn) != conn {
+		t.Fatal("wrapping a Conn twice should return the original Conn")
+	}
+}
+
+// Tests that a message cut in half by a read deadline is read whole by the next Read().
+func Test_Read_deadline(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	line := []byte(hex.EncodeToString([]byte("a message that arrives in two parts")) + "\n")
+	go remote.Write(line[:10])
+
+	conn := NewConn(local)
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := Read(conn); err == nil {
+		t.Fatal("the read should time out")
+	}
+
+	go remote.Write(line[10:])
+	conn.SetReadDeadline(time.Time{})
+	msg, _, err := Read(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "a message that arrives in two parts" {
+		t.Fatalf("wrong message read: %q", msg)
+	}
+}
+
+// Tests that Read() gives up on a line too long to hold a message, rather than buffering it all.
+func Test_Read_tooLong(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	go func() {
+		chunk := make([]byte, 64<<10)
+		for i := range chunk {
+			chunk[i] = 'a'
+		}
+		// never a newline: the writes only stop once the reader is gone
+		for {
+			if _, err := remote.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	_, _, err := Read(NewConn(local))
+	if err != ErrMessageTooLong {
+		t.Fatalf("expected ErrMessageTooLong, got %v", err)
+	}
+}
+
+// Tests that a message past MAX_HANDSHAKE_MESSAGE_SIZE is refused, unless the connection was told the other end authenticated.
+func Test_Read_handshakeLimit(t *testing.T) {
+	msg := make([]byte, MAX_HANDSHAKE_MESSAGE_SIZE+1)
+	for _, limit := range []int{0, MAX_MESSAGE_SIZE} {
+		local, remote := net.Pipe()
+		go func() {
+			Write(remote, msg)
+			remote.Close()
+		}()
+
+		conn := NewConn(local)
+		conn.SetMaxMessageSize(limit)
+		read, _, err := Read(conn)
+		local.Close()
+		if limit == 0 && err != ErrMessageTooLong {
+			t.Fatalf("expected ErrMessageTooLong before the handshake is over, got %v", err)
+		}
+		if limit != 0 && (err != nil || len(read) != len(msg)) {
+			t.Fatalf("read %d bytes (%v), expected %d", len(read), err, len(msg))
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package hermes
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+)
+
+// When one side of a session updates the keys it sends with: after so many records, so many bytes (of payload) or so much time
+// with the same key, whichever comes first (0 for no limit on that count).
+type KeyUpdatePolicy struct {
+	Records  uint64
+	Bytes    uint64
+	Interval time.Duration
+	Now      func() time.Time // the clock the interval is measured by (time.Now if nil)
+}
+
+// When the keys of a session are updated by default: long before AES-GCM gets anywhere near its limits, and at least every hour.
+var DEFAULT_KEY_UPDATES = KeyUpdatePolicy{Records: 1 << 20, Bytes: 1 << 30, Interval: time.Hour}
+
+// A RecordLayer sends and receives the records of a session, each made of its type (one byte) and its content,
+// and each direction protected with its own keys (see anubis.RecordCipher).
+// Either side can update the keys it sends with (UpdateKeys()), and does on its own, following its KeyUpdatePolicy:
+// it sends a RECORD_KEY_UPDATE, the last record sealed with the old key, and the other side moves to the next key when it reads it.
+// The two directions are updated independently of each other, so both sides updating at once are just two updates.
+// A record is padded following the PaddingPolicy of its sender (its type marks where its content ends): one with no type is padding only, and dropped.
+// Every read and write has a deadline, following the Timeouts of the session and the deadlines of its owner.
+type RecordLayer struct {
+	conn   net.Conn
+	cipher *anubis.RecordCipher
+
+	wmu     sync.Mutex // the send and receive sides of the cipher are independent, but each must be used by one goroutine at a time
+	policy  KeyUpdatePolicy
+	padding PaddingPolicy
+	records uint64    // sent with the current key
+	bytes   uint64    // of payload, sent with the current key
+	since   time.Time // when the current key started being used
+	sent    int       // how many times we updated our keys
+	pacer   *pacer    // nil unless the constant-rate mode is on
+
+	lastWrite  time.Time     // when the last record was sent
+	keepalives chan struct{} // closed to stop the keepalives (nil if none are sent)
+
+	rmu      sync.Mutex
+	received int    // how many times the other side updated its keys
+	chunks   []byte // the part of a chunked record received so far
+
+	dmu           sync.Mutex // the deadlines are changed while reads and writes wait on them
+	timeouts      Timeouts
+	readDeadline  time.Time // the ones of the owner of the connection
+	writeDeadline time.Time
+	idleBy        time.Time // the ones of the timeouts, for the read and the write going on
+	writeBy       time.Time
+	readArmed     bool // whether there's a read deadline on the connection
+	writeArmed    bool
+}
+
+// Creates the record layer of a session on conn, whose records are protected by cipher and whose keys are updated following policy.
+// The other end authenticated by now, so its records can be as long as MAX_MESSAGE_SIZE.
+func NewRecordLayer(conn net.Conn, cipher *anubis.RecordCipher, policy KeyUpdatePolicy) *RecordLayer {
+	c := NewConn(conn)
+	c.SetMaxMessageSize(MAX_MESSAGE_SIZE)
+	r := &RecordLayer{
+		conn:   c,
+		cipher: cipher,
+		policy: policy,
+	}
+	r.since = r.now()
+
+	return r
+}
+
+// Creates the record layer of the session between a client and the server (on the side of role), once the handshake agreed on cipher.
+// The keys are updated following DEFAULT_KEY_UPDATES, and the records padded following DEFAULT_PADDING.
+func NewSessionRecords(conn net.Conn, cipher anubis.Cipher, role Role) *RecordLayer {
+	rc, err := cipher.RecordCipher(role == CLIENT)
+	if err != nil {
+		// HKDF never runs out of output for two keys
+		panic(err)
+	}
+
+	return NewRecordLayer(conn, rc, DEFAULT_KEY_UPDATES)
+}
+
+// Changes when the keys we send with are updated (the interval starts over, by the clock of the new policy).
+func (r *RecordLayer) SetKeyUpdatePolicy(policy KeyUpdatePolicy) {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+
+	r.policy = policy
+	r.since = r.now()
+}
+
+// Changes how the records we send are padded.
+func (r *RecordLayer) SetPadding(padding PaddingPolicy) {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+
+	r.padding = padding
+}
+
+// Returns how many times we updated the keys we send with, and how many times the other side did.
+func (r *RecordLayer) Updates() (int, int) {
+	r.wmu.Lock()
+	sent := r.sent
+	r.wmu.Unlock()
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+
+	return sent, r.received
+}
+
+// Encrypts and sends a record of the given type, updating our keys first if the policy says it's time.
+// Returns an error if the record couldn't be sent.
+func (r *RecordLayer) WriteRecord(rtype byte, data []byte) error {
+	r.wmu.Lock()
+	if r.pacer != nil {
+		// it waits for its slots
+		return r.enqueue(r.pacer, rtype, data)
+	}
+	defer r.wmu.Unlock()
+
+	if r.updateDue() {
+		err := r.updateKeys()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := r.write(rtype, data)
+	if err != nil {
+		return err
+	}
+	r.records++
+	r.bytes += uint64(len(data))
+
+	return nil
+}
+
+// Sends a record with nothing but padding (as long as the policy pads an empty record to), which the other end drops.
+// Returns an error if the record couldn't be sent.
+// In constant-rate mode, there's no need: the slots with nothing to send are padding already.
+func (r *RecordLayer) WritePadding() error {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+
+	if r.pacer != nil {
+		return r.pacer.err
+	}
+
+	return r.writePadding()
+}
+
+// Updates the keys we send with now (in constant-rate mode, in the next slot), telling the other side.
+// Returns an error if the update couldn't be sent.
+func (r *RecordLayer) UpdateKeys() error {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+
+	if r.pacer != nil {
+		r.pacer.update = true
+		return r.pacer.err
+	}
+
+	return r.updateKeys()
+}
+
+// Reads and decrypts the next record, following the updates of the keys of the other side on the way (and dropping the padding).
+// Returns its type, its content and an error.
+func (r *RecordLayer) ReadRecord() (byte, []byte, error) {
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+
+	for {
+		// a record received in chunks comes first
+		if rtype, content, ok, err := r.unchunk(); ok || err != nil {
+			return rtype, content, err
+		}
+
+		err := r.armRead()
+		if err != nil {
+			return 0, nil, err
+		}
+		ciphertext, _, err := Read(r.conn)
+		if r.idle(err) {
+			return 0, nil, ErrIdleTimeout
+		} else if err != nil {
+			return 0, nil, err
+		}
+
+		plaintext, err := r.cipher.Open(ciphertext)
+		if err != nil {
+			return 0, nil, err
+		}
+		content, rtype, ok := unpad(plaintext)
+		if !ok {
+			continue
+		}
+		if rtype == RECORD_CHUNK {
+			r.chunks = append(r.chunks, content...)
+			continue
+		}
+		if rtype != RECORD_KEY_UPDATE {
+			return rtype, content, nil
+		}
+
+		if len(content) != 0 {
+			return 0, nil, errors.New("malformed key update")
+		}
+		// what follows is sealed with the next key
+		err = r.cipher.UpdateRecv()
+		if err != nil {
+			return 0, nil, err
+		}
+		r.received++
+	}
+}
+
+// Sends a RECORD_KEY_UPDATE and moves to the next key (r.wmu must be held).
+func (r *RecordLayer) updateKeys() error {
+	err := r.write(RECORD_KEY_UPDATE, nil)
+	if err != nil {
+		return err
+	}
+
+	err = r.cipher.UpdateSend()
+	if err != nil {
+		return err
+	}
+	r.records, r.bytes, r.since = 0, 0, r.now()
+	r.sent++
+
+	return nil
+}
+
+// Sends a record with nothing but padding (r.wmu must be held).
+func (r *RecordLayer) writePadding() error {
+	n, err := r.padding.length(0)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := r.cipher.Seal(make([]byte, n))
+	if err != nil {
+		return err
+	}
+
+	return r.send(ciphertext)
+}
+
+// Returns whether the policy says it's time to update the keys we send with (r.wmu must be held).
+func (r *RecordLayer) updateDue() bool {
+	p := r.policy
+
+	return (p.Records > 0 && r.records >= p.Records) ||
+		(p.Bytes > 0 && r.bytes >= p.Bytes) ||
+		(p.Interval > 0 && r.now().Sub(r.since) >= p.Interval)
+}
+
+// Pads, encrypts and sends a record (r.wmu must be held).
+func (r *RecordLayer) write(rtype byte, data []byte) error {
+	padded, err := r.padding.pad(data, rtype)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := r.cipher.Seal(padded)
+	if err != nil {
+		return err
+	}
+
+	return r.send(ciphertext)
+}
+
+// Sends a sealed record, within the write deadline (r.wmu must be held).
+func (r *RecordLayer) send(ciphertext []byte) error {
+	err := r.armWrite()
+	if err != nil {
+		return err
+	}
+
+	_, err = Write(r.conn, ciphertext)
+	if err != nil {
+		return err
+	}
+	r.lastWrite = time.Now()
+
+	return nil
+}
+
+// Returns the time by the clock of the policy.
+func (r *RecordLayer) now() time.Time {
+	if r.policy.Now == nil {
+		return time.Now()
+	}
+
+	return r.policy.Now()
+}
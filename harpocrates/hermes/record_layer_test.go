@@ -0,0 +1,207 @@
+package hermes
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+)
+
+// Utility function, creates the two ends of a session's record layer over a pipe, both following policy.
+func newRecordLayers(t *testing.T, policy KeyUpdatePolicy) (*RecordLayer, *RecordLayer) {
+	key := make([]byte, anubis.BYTE_SEC)
+	rand.Read(key)
+	cipher, err := anubis.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	client, server := NewSessionRecords(local, cipher, CLIENT), NewSessionRecords(remote, cipher, SERVER)
+	client.SetKeyUpdatePolicy(policy)
+	server.SetKeyUpdatePolicy(policy)
+
+	return client, server
+}
+
+// Utility function, reads n records in the background.
+// Returns the channel their contents (or the error that stopped the reading) come out of.
+func readRecords(r *RecordLayer, n int) chan interface{} {
+	out := make(chan interface{}, n)
+	go func() {
+		for i := 0; i < n; i++ {
+			rtype, data, err := r.ReadRecord()
+			if err != nil {
+				out <- err
+				return
+			}
+			if rtype != RECORD_DATA {
+				out <- fmt.Errorf("unexpected record type %d", rtype)
+				return
+			}
+			out <- string(data)
+		}
+	}()
+
+	return out
+}
+
+// Tests that the records keep flowing both ways across many key updates, including the ones both ends send at the same time.
+func Test_RecordLayer_updates(t *testing.T) {
+	client, server := newRecordLayers(t, KeyUpdatePolicy{})
+
+	const rounds = 200
+	fromClient, fromServer := readRecords(server, rounds), readRecords(client, rounds)
+	errs := make(chan error, 2)
+	for _, end := range []*RecordLayer{client, server} {
+		end := end
+		go func() {
+			for i := 0; i < rounds; i++ {
+				// both ends update on every other record, so that most updates cross each other on the wire
+				if i%2 == 0 {
+					if err := end.UpdateKeys(); err != nil {
+						errs <- err
+						return
+					}
+				}
+				if err := end.WriteRecord(RECORD_DATA, []byte(fmt.Sprint(i))); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+
+	for i := 0; i < rounds; i++ {
+		for _, got := range []interface{}{<-fromClient, <-fromServer} {
+			if got != fmt.Sprint(i) {
+				t.Fatalf("record %d: got %v", i, got)
+			}
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, end := range []*RecordLayer{client, server} {
+		sent, received := end.Updates()
+		if sent != rounds/2 || received != rounds/2 {
+			t.Fatalf("expected %d updates each way, got %d and %d", rounds/2, sent, received)
+		}
+	}
+}
+
+// Tests that the keys are updated on their own once the policy says so: after so many records, so many bytes or so much time.
+func Test_RecordLayer_policy(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	clock := func() time.Time { return now }
+
+	tests := []struct {
+		name    string
+		policy  KeyUpdatePolicy
+		size    int
+		advance time.Duration
+		updates int
+	}{
+		{"records", KeyUpdatePolicy{Records: 10}, 1, 0, 9},
+		{"bytes", KeyUpdatePolicy{Bytes: 1000}, 100, 0, 9},
+		{"time", KeyUpdatePolicy{Interval: time.Minute, Now: clock}, 1, 30 * time.Second, 49},
+		{"none", KeyUpdatePolicy{}, 1000, time.Hour, 0},
+	}
+	for _, test := range tests {
+		client, server := newRecordLayers(t, test.policy)
+
+		records := readRecords(server, 100)
+		msg := make([]byte, test.size)
+		for i := 0; i < 100; i++ {
+			if err := client.WriteRecord(RECORD_DATA, msg); err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			if got := <-records; got != string(msg) {
+				t.Fatalf("%s: record %d: got %v", test.name, i, got)
+			}
+			now = now.Add(test.advance)
+		}
+
+		sent, _ := client.Updates()
+		_, received := server.Updates()
+		if sent != test.updates || received != test.updates {
+			t.Fatalf("%s: expected %d updates, got %d sent and %d received", test.name, test.updates, sent, received)
+		}
+	}
+}
+
+// Tests that a record sealed with a key the other end already updated past can't be read anymore.
+func Test_RecordLayer_oldKeys(t *testing.T) {
+	key := make([]byte, anubis.BYTE_SEC)
+	rand.Read(key)
+	cipher, _ := anubis.NewCipher(key)
+	sender, _ := cipher.RecordCipher(true)
+	stale, _ := cipher.RecordCipher(true) // what someone who kept the first key could seal
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	client, server := NewRecordLayer(local, sender, KeyUpdatePolicy{}), NewSessionRecords(remote, cipher, SERVER)
+
+	records := readRecords(server, 2)
+	client.UpdateKeys()
+	client.WriteRecord(RECORD_DATA, []byte("new key"))
+	if got := <-records; got != "new key" {
+		t.Fatal("got", got)
+	}
+
+	ct, _ := stale.Seal([]byte{'o', 'l', 'd', RECORD_DATA})
+	Write(local, ct)
+	if got := <-records; got == "old" {
+		t.Fatal("a record sealed with the old key was read after the update")
+	}
+}
+
+// Tests that records of different lengths look the same once padded, and that the records of nothing but padding are dropped.
+func Test_RecordLayer_padding(t *testing.T) {
+	client, server := newRecordLayers(t, KeyUpdatePolicy{})
+	client.SetPadding(PaddingPolicy{Scheme: PAD_FIXED, Size: 64})
+
+	// what the server gets off the wire, as is
+	lengths := make(chan int, 3)
+	go func() {
+		for i := 0; i < 3; i++ {
+			ciphertext, _, err := Read(server.conn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			lengths <- len(ciphertext)
+		}
+	}()
+	for _, msg := range []string{"", "hi", "a somewhat longer message, but not by much"} {
+		if err := client.WriteRecord(RECORD_DATA, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if n := <-lengths; n != 64+16 {
+			t.Fatalf("%q was sent in %d bytes, expected %d", msg, n, 64+16)
+		}
+	}
+
+	client, server = newRecordLayers(t, KeyUpdatePolicy{})
+	records := readRecords(server, 1)
+	for i := 0; i < 3; i++ {
+		if err := client.WritePadding(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.WriteRecord(RECORD_DATA, []byte("after the padding\x00\x00"))
+	if got := <-records; got != "after the padding\x00\x00" {
+		t.Fatal("got", got)
+	}
+}
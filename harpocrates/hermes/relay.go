@@ -0,0 +1,365 @@
+package hermes
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long the direct connection with a peer (handshake included) can take before falling back to the relay of the server.
+const DIRECT_TIMEOUT = 10 * time.Second
+
+// The most data sent in a single RELAY_DATA message.
+const RELAY_CHUNK_SIZE = 16 << 10
+
+// The most relayed data kept while waiting for it to be read.
+const MAX_RELAY_BUFFER = 4 << 20
+
+// A RelayConn is a connection with a peer that goes through the server, for when the two can't reach each other directly.
+// It carries the records of the peers inside RELAY_DATA messages of the sessions with the server, which only sees them encrypted.
+// The messages of the server must be handed to it with Opened(), Deliver() and HangUp().
+type RelayConn struct {
+	s    *Session
+	peer string
+
+	mu        sync.Mutex
+	buf       []byte
+	hungUp    bool      // the peer (or the server) closed the relay
+	closed    bool      // we closed the relay
+	rdeadline time.Time // when Read() gives up
+	wdeadline time.Time // when Write() gives up (checked before writing)
+
+	open   chan struct{} // closed once the server opened the relay
+	signal chan struct{} // wakes up Read()
+}
+
+// Creates the connection with peer through the server s is the session with (RELAY <peer> must be sent separately).
+func NewRelayConn(s *Session, peer string) *RelayConn {
+	return &RelayConn{
+		s:      s,
+		peer:   peer,
+		open:   make(chan struct{}),
+		signal: make(chan struct{}, 1),
+	}
+}
+
+// Records that the server opened the relay (RELAYED <peer>).
+func (c *RelayConn) Opened() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.opened()
+}
+
+// Waits for the server to open the relay.
+// Returns an error if ctx is done first, or if the relay is closed.
+func (c *RelayConn) WaitOpen(ctx context.Context) error {
+	select {
+	case <-c.open:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hungUp || c.closed {
+		return errors.New("the relay was closed")
+	}
+
+	return nil
+}
+
+// Hands over data relayed by the server (RELAY_DATA <peer> <data>).
+// Returns an error if too much of it is waiting to be read.
+func (c *RelayConn) Deliver(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || c.hungUp {
+		return nil
+	}
+	if len(c.buf)+len(data) > MAX_RELAY_BUFFER {
+		return errors.New("too much relayed data waiting")
+	}
+	c.buf = append(c.buf, data...)
+	c.wake()
+
+	return nil
+}
+
+// Records that the relay was closed by the peer or the server (RELAY_CLOSE <peer>): what was already relayed can still be read.
+func (c *RelayConn) HangUp() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hungUp = true
+	c.wake()
+	c.opened()
+}
+
+// Returns whether the relay was closed, from either side.
+func (c *RelayConn) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed || c.hungUp
+}
+
+// Reads the data relayed from the peer, waiting for it if there's none.
+// Returns the number of bytes read and an error (io.EOF once the peer hung up).
+func (c *RelayConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(c.buf) > 0 {
+			n := copy(b, c.buf)
+			c.buf = c.buf[n:]
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.hungUp {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := c.rdeadline
+		c.mu.Unlock()
+
+		if deadline.IsZero() {
+			<-c.signal
+			continue
+		}
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-c.signal:
+			timer.Stop()
+		case <-timer.C:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Sends data to the peer through the server, in chunks of RELAY_CHUNK_SIZE.
+// Returns the number of bytes sent and an error.
+func (c *RelayConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	closed, hungUp, deadline := c.closed, c.hungUp, c.wdeadline
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	if hungUp {
+		return 0, io.ErrClosedPipe
+	}
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	sent := 0
+	for sent < len(b) {
+		n := len(b) - sent
+		if n > RELAY_CHUNK_SIZE {
+			n = RELAY_CHUNK_SIZE
+		}
+		err := c.s.Send("RELAY_DATA", c.peer, hex.EncodeToString(b[sent:sent+n]))
+		if err != nil {
+			return sent, err
+		}
+		sent += n
+	}
+
+	return sent, nil
+}
+
+// Closes the relay, telling the server (unless it was closed from the other side already).
+func (c *RelayConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	hungUp := c.hungUp
+	c.wake()
+	c.opened()
+	c.mu.Unlock()
+
+	if hungUp {
+		return nil
+	}
+
+	return c.s.Send("RELAY_CLOSE", c.peer)
+}
+
+// Returns a placeholder address: the connection goes through the server.
+func (c *RelayConn) LocalAddr() net.Addr {
+	return relayAddr("")
+}
+
+// Returns the name of the peer as its address.
+func (c *RelayConn) RemoteAddr() net.Addr {
+	return relayAddr(c.peer)
+}
+
+// Sets the read and write deadlines.
+func (c *RelayConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// Sets when Read() gives up waiting.
+func (c *RelayConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rdeadline = t
+	c.wake()
+
+	return nil
+}
+
+// Sets when Write() stops sending (it's only checked before sending anything).
+func (c *RelayConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.wdeadline = t
+
+	return nil
+}
+
+// Wakes up WaitOpen(), whether the relay was opened or closed (c.mu must be held).
+func (c *RelayConn) opened() {
+	select {
+	case <-c.open:
+	default:
+		close(c.open)
+	}
+}
+
+// Wakes up a pending Read() (c.mu must be held).
+func (c *RelayConn) wake() {
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+// The address of a relayed peer: its name.
+type relayAddr string
+
+func (a relayAddr) Network() string {
+	return "relay"
+}
+
+func (a relayAddr) String() string {
+	return string(a)
+}
+
+// Opens the direct connection with a peer, as the server paired us: the listener waits on l, the dialer connects to addr.
+// Returns the connection and an error if ctx is done first.
+func DialPeer(ctx context.Context, l net.Listener, role, addr string) (net.Conn, error) {
+	if role == PEER_DIALER {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-stop:
+		}
+	}()
+
+	conn, err := l.Accept()
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return conn, err
+}
+
+// Connects with a peer and runs the handshake: over the connection opened by direct if it works within DIRECT_TIMEOUT, over the one opened by relay otherwise.
+// The deadline of ctx (if any) stays on the connection, see Peer.SetDeadline().
+// Returns the Peer, whether the connection is relayed and an error.
+func OpenPeer(ctx context.Context, direct, relay func(context.Context) (net.Conn, error), pairingKey []byte, dialer bool, identity ed25519.PrivateKey) (*Peer, bool, error) {
+	return OpenPeerWith(ctx, direct, relay, pairingKey, dialer, identity, rand.Reader)
+}
+
+// Connects with a peer like OpenPeer(), running the handshake with PeerHandshakeWith() and random.
+// Returns the Peer, whether the connection is relayed and an error.
+func OpenPeerWith(ctx context.Context, direct, relay func(context.Context) (net.Conn, error), pairingKey []byte, dialer bool, identity ed25519.PrivateKey, random io.Reader) (*Peer, bool, error) {
+	dctx, cancel := context.WithTimeout(ctx, DIRECT_TIMEOUT)
+	p, err := handshakeOver(dctx, direct, pairingKey, dialer, identity, random)
+	cancel()
+	if err == nil {
+		deadline, _ := ctx.Deadline()
+		p.SetDeadline(deadline)
+		return p, false, nil
+	}
+	if ctx.Err() != nil {
+		return nil, false, err
+	}
+
+	p, err = handshakeOver(ctx, relay, pairingKey, dialer, identity, random)
+	if err != nil {
+		return nil, true, err
+	}
+
+	return p, true, nil
+}
+
+// Opens a connection with open and runs the handshake over it, giving up when ctx is done.
+// Returns the Peer and an error.
+func handshakeOver(ctx context.Context, open func(context.Context) (net.Conn, error), pairingKey []byte, dialer bool, identity ed25519.PrivateKey, random io.Reader) (*Peer, error) {
+	conn, err := open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// the handshake is cut short if ctx is cancelled
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	p, err := PeerHandshakeWith(conn, pairingKey, dialer, identity, random)
+	close(stop)
+	<-stopped
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+
+	return p, nil
+}
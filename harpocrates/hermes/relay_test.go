@@ -0,0 +1,251 @@
+package hermes
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+)
+
+// Utility function, a server that relays connections (and does nothing else) for the clients connected with connectRelay().
+type fakeRelay struct {
+	mu       sync.Mutex
+	sessions map[string]*Session // the server end of the session of each client
+	asked    map[string]bool     // who asked for a relay
+}
+
+// Utility function, connects uname to the relay server.
+// Returns the session of the client and the RelayConn to peer, which is fed the messages of the server.
+func (r *fakeRelay) connect(t *testing.T, uname, peer string) (*Session, *RelayConn) {
+	key := make([]byte, anubis.BYTE_SEC)
+	rand.Read(key)
+	nonce := make([]byte, 64)
+	rand.Read(nonce)
+	ciphers := make([]anubis.Cipher, 2)
+	for i := range ciphers {
+		c, err := anubis.NewCipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.UpdateNonce(nonce)
+		ciphers[i] = c
+	}
+
+	local, remote := net.Pipe()
+	client := NewSession(NewConn(local), ciphers[0], CLIENT, uname)
+	server := NewSession(NewConn(remote), ciphers[1], SERVER, uname)
+	t.Cleanup(func() { client.Close() })
+
+	r.mu.Lock()
+	r.sessions[uname] = server
+	r.mu.Unlock()
+
+	// the server
+	go func() {
+		for {
+			fields, err := server.Receive()
+			if err != nil {
+				return
+			}
+
+			r.mu.Lock()
+			ps := r.sessions[fields[1]]
+			switch fields[0] {
+			case "RELAY":
+				if r.asked[fields[1]] {
+					ps.Send("RELAYED", uname)
+					server.Send("RELAYED", fields[1])
+				}
+				r.asked[uname] = true
+			case "RELAY_DATA":
+				ps.Send("RELAY_DATA", uname, fields[2])
+			case "RELAY_CLOSE":
+				ps.Send("RELAY_CLOSE", uname)
+			}
+			r.mu.Unlock()
+		}
+	}()
+
+	// the client
+	rc := NewRelayConn(client, peer)
+	go func() {
+		for {
+			fields, err := client.Receive()
+			if err != nil {
+				rc.HangUp()
+				return
+			}
+
+			switch fields[0] {
+			case "RELAYED":
+				rc.Opened()
+			case "RELAY_DATA":
+				data, _ := hex.DecodeString(fields[2])
+				rc.Deliver(data)
+			case "RELAY_CLOSE":
+				rc.HangUp()
+			}
+		}
+	}()
+
+	return client, rc
+}
+
+// Utility function, creates a relay server and connects alice and bob to it.
+// Returns the RelayConn of alice (to bob) and of bob (to alice).
+func newRelayPair(t *testing.T) (*RelayConn, *RelayConn) {
+	r := &fakeRelay{sessions: make(map[string]*Session), asked: make(map[string]bool)}
+	as, alice := r.connect(t, "alice", "bob")
+	bs, bob := r.connect(t, "bob", "alice")
+
+	as.Send("RELAY", "bob")
+	bs.Send("RELAY", "alice")
+	for _, rc := range []*RelayConn{alice, bob} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := rc.WaitOpen(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return alice, bob
+}
+
+// Tests that data larger than a chunk goes through the relay as it was sent, and that hanging up is seen as the end of it.
+func Test_RelayConn(t *testing.T) {
+	alice, bob := newRelayPair(t)
+
+	data := make([]byte, 3*RELAY_CHUNK_SIZE+7)
+	rand.Read(data)
+	go func() {
+		alice.Write(data)
+		alice.Close()
+	}()
+
+	got, err := io.ReadAll(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("the data changed on its way")
+	}
+
+	if _, err := bob.Write([]byte("too late")); err == nil {
+		t.Fatal("alice hung up")
+	}
+	if _, err := alice.Write([]byte("closed")); err == nil {
+		t.Fatal("alice closed the relay")
+	}
+}
+
+// Tests that reading from a relay gives up at the deadline.
+func Test_RelayConn_deadline(t *testing.T) {
+	_, bob := newRelayPair(t)
+
+	bob.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := bob.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("the read should have timed out, got", err)
+	}
+}
+
+// Tests that two peers that can't reach each other fall back to the relay, and talk as they would directly.
+func Test_OpenPeer_fallback(t *testing.T) {
+	alice, bob := newRelayPair(t)
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	// bob's address leads nowhere and alice can't be reached either
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := closed.Addr().String()
+	closed.Close()
+	nowhere, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nowhere.Close()
+
+	type result struct {
+		peer    *Peer
+		relayed bool
+		err     error
+	}
+	done := make(chan result)
+	go func() {
+		p, relayed, err := OpenPeer(context.Background(),
+			func(ctx context.Context) (net.Conn, error) { return DialPeer(ctx, nil, PEER_DIALER, addr) },
+			func(context.Context) (net.Conn, error) { return alice, nil },
+			key, true, newIdentity(t))
+		done <- result{p, relayed, err}
+	}()
+
+	listener, relayed, err := OpenPeer(context.Background(),
+		func(ctx context.Context) (net.Conn, error) { return DialPeer(ctx, nowhere, PEER_LISTENER, "") },
+		func(context.Context) (net.Conn, error) { return bob, nil },
+		key, false, newIdentity(t))
+	if err != nil || !relayed {
+		t.Fatal("bob should have fallen back to the relay", err)
+	}
+	d := <-done
+	if d.err != nil || !d.relayed {
+		t.Fatal("alice should have fallen back to the relay", d.err)
+	}
+	dialer := d.peer
+
+	if err := dialer.Send([]byte("hi, through the server")); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := listener.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "hi, through the server" {
+		t.Fatal("wrong message")
+	}
+}
+
+// Tests that the direct connection is used when it works.
+func Test_OpenPeer_direct(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noRelay := func(context.Context) (net.Conn, error) {
+		return nil, errors.New("the relay shouldn't be needed")
+	}
+
+	done := make(chan error)
+	go func() {
+		_, relayed, err := OpenPeer(context.Background(),
+			func(ctx context.Context) (net.Conn, error) { return DialPeer(ctx, nil, PEER_DIALER, l.Addr().String()) },
+			noRelay, key, true, newIdentity(t))
+		if err == nil && relayed {
+			err = errors.New("alice's connection shouldn't be relayed")
+		}
+		done <- err
+	}()
+
+	_, relayed, err := OpenPeer(context.Background(),
+		func(ctx context.Context) (net.Conn, error) { return DialPeer(ctx, l, PEER_LISTENER, "") },
+		noRelay, key, false, newIdentity(t))
+	if err != nil || relayed {
+		t.Fatal("bob's connection should be direct", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
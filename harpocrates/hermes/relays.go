@@ -0,0 +1,189 @@
+package hermes
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many bytes per second a relay forwards by default (in both directions together).
+const RELAY_BANDWIDTH = 256 << 10
+
+// How long a relay lasts by default without anything going through it.
+const RELAY_IDLE_TIMEOUT = 5 * time.Minute
+
+// The limits put on every relay.
+type RelayConfig struct {
+	Bandwidth   int           // bytes per second (0 for no limit)
+	IdleTimeout time.Duration // 0 for no limit
+}
+
+// Relays keeps track of the pairs of clients whose peer to peer connection goes through the server, because they can't reach each other directly.
+// The server only forwards what the clients send: the connection is end-to-end encrypted between them.
+type Relays struct {
+	mu      sync.Mutex
+	cfg     RelayConfig
+	pending map[string]time.Time // when each client asked for a relay with its peer
+	active  map[string]*relay
+	idle    func(a, b string) // called when a relay is closed for being idle
+}
+
+// A relay between two clients.
+type relay struct {
+	mu     sync.Mutex
+	tokens float64 // what can be forwarded without waiting (negative if the clients went over the limit)
+	last   time.Time
+	timer  *time.Timer // closes the relay when it's idle
+}
+
+// Creates an empty Relays, whose relays have the limits in cfg; idle is called (in its own goroutine) with the two ends of any relay closed for being idle.
+func NewRelays(cfg RelayConfig, idle func(a, b string)) *Relays {
+	return &Relays{
+		cfg:     cfg,
+		pending: make(map[string]time.Time),
+		active:  make(map[string]*relay),
+		idle:    idle,
+	}
+}
+
+// Registers the wish of uname to relay its connection with peer, which is granted once peer asks for the same.
+// A new request replaces the relay the two already had, if any.
+// Returns whether the relay is open.
+func (rs *Relays) Request(uname, peer string) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.closeLocked(uname, peer)
+
+	asked, ok := rs.pending[pairID(peer, uname)]
+	if !ok || time.Since(asked) > RENDEZVOUS_TIMEOUT {
+		rs.pending[pairID(uname, peer)] = time.Now()
+		return false
+	}
+	delete(rs.pending, pairID(peer, uname))
+
+	r := &relay{tokens: float64(rs.cfg.Bandwidth), last: time.Now()}
+	if rs.cfg.IdleTimeout > 0 {
+		r.timer = time.AfterFunc(rs.cfg.IdleTimeout, func() {
+			rs.mu.Lock()
+			current := rs.active[relayID(uname, peer)] == r
+			if current {
+				delete(rs.active, relayID(uname, peer))
+			}
+			rs.mu.Unlock()
+
+			if current {
+				rs.idle(uname, peer)
+			}
+		})
+	}
+	rs.active[relayID(uname, peer)] = r
+
+	return true
+}
+
+// Accounts for n bytes going from from to to.
+// Returns how long to wait before forwarding them, to stay within the bandwidth limit, and an error if the two have no relay.
+func (rs *Relays) Forward(from, to string, n int) (time.Duration, error) {
+	rs.mu.Lock()
+	r, ok := rs.active[relayID(from, to)]
+	rs.mu.Unlock()
+	if !ok {
+		return 0, errors.New("no relay")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.timer != nil {
+		r.timer.Reset(rs.cfg.IdleTimeout)
+	}
+	if rs.cfg.Bandwidth <= 0 {
+		return 0, nil
+	}
+
+	// a token bucket, holding at most one second worth of data
+	now := time.Now()
+	bw := float64(rs.cfg.Bandwidth)
+	r.tokens += now.Sub(r.last).Seconds() * bw
+	if r.tokens > bw {
+		r.tokens = bw
+	}
+	r.last = now
+	r.tokens -= float64(n)
+	if r.tokens >= 0 {
+		return 0, nil
+	}
+
+	return time.Duration(-r.tokens / bw * float64(time.Second)), nil
+}
+
+// Closes the relay between a and b.
+// Returns whether there was one.
+func (rs *Relays) Close(a, b string) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.closeLocked(a, b)
+}
+
+// Closes all the relays of uname (and forgets its requests), once it leaves.
+// Returns the clients it had a relay with.
+func (rs *Relays) CloseAll(uname string) []string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	var peers []string
+	for id := range rs.active {
+		if a, b := splitPairID(id); a == uname {
+			peers = append(peers, b)
+		} else if b == uname {
+			peers = append(peers, a)
+		}
+	}
+	for _, peer := range peers {
+		rs.closeLocked(uname, peer)
+	}
+	for id := range rs.pending {
+		if a, b := splitPairID(id); a == uname || b == uname {
+			delete(rs.pending, id)
+		}
+	}
+
+	return peers
+}
+
+// Closes the relay between a and b (rs.mu must be held).
+// Returns whether there was one.
+func (rs *Relays) closeLocked(a, b string) bool {
+	r, ok := rs.active[relayID(a, b)]
+	if !ok {
+		return false
+	}
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	delete(rs.active, relayID(a, b))
+
+	return true
+}
+
+// Identifies the relay between a and b, whichever of the two asks.
+func relayID(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+
+	return pairID(a, b)
+}
+
+// Returns the two clients of an id made by pairID.
+func splitPairID(id string) (string, string) {
+	parts := strings.SplitN(id, "\x00", 2)
+	if len(parts) != 2 {
+		return id, ""
+	}
+
+	return parts[0], parts[1]
+}
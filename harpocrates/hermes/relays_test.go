@@ -0,0 +1,93 @@
+package hermes
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that a relay opens only once both clients asked for it.
+func Test_Relays_request(t *testing.T) {
+	rs := NewRelays(RelayConfig{}, func(a, b string) {})
+
+	if _, err := rs.Forward("alice", "bob", 10); err == nil {
+		t.Fatal("there's no relay yet")
+	}
+	if rs.Request("alice", "bob") {
+		t.Fatal("bob didn't ask for the relay yet")
+	}
+	if rs.Request("carol", "bob") {
+		t.Fatal("bob didn't ask for carol")
+	}
+	if !rs.Request("bob", "alice") {
+		t.Fatal("both asked for the relay")
+	}
+
+	for _, dir := range [][2]string{{"alice", "bob"}, {"bob", "alice"}} {
+		if wait, err := rs.Forward(dir[0], dir[1], 10); err != nil || wait != 0 {
+			t.Fatal("the relay should work both ways", err)
+		}
+	}
+	if _, err := rs.Forward("carol", "bob", 10); err == nil {
+		t.Fatal("carol has no relay with bob")
+	}
+
+	if peers := rs.CloseAll("bob"); len(peers) != 1 || peers[0] != "alice" {
+		t.Fatalf("bob had a relay with alice only, got %v", peers)
+	}
+	if _, err := rs.Forward("alice", "bob", 10); err == nil {
+		t.Fatal("the relay should be closed")
+	}
+	if len(rs.pending) != 0 {
+		t.Fatal("the request of carol should be forgotten along with bob")
+	}
+}
+
+// Tests that a relay is slowed down to its bandwidth.
+func Test_Relays_bandwidth(t *testing.T) {
+	rs := NewRelays(RelayConfig{Bandwidth: 1000}, func(a, b string) {})
+	rs.Request("alice", "bob")
+	rs.Request("bob", "alice")
+
+	// one second worth of data goes through right away
+	if wait, _ := rs.Forward("alice", "bob", 1000); wait != 0 {
+		t.Fatalf("the first second shouldn't wait, got %v", wait)
+	}
+	// the rest waits, whichever way it goes
+	wait, _ := rs.Forward("bob", "alice", 500)
+	if wait < 400*time.Millisecond || wait > 500*time.Millisecond {
+		t.Fatalf("expected to wait about half a second, got %v", wait)
+	}
+	wait, _ = rs.Forward("alice", "bob", 500)
+	if wait < 900*time.Millisecond || wait > time.Second {
+		t.Fatalf("expected to wait about a second, got %v", wait)
+	}
+}
+
+// Tests that a relay nobody uses is closed, and that using it keeps it open.
+func Test_Relays_idle(t *testing.T) {
+	closed := make(chan [2]string, 1)
+	rs := NewRelays(RelayConfig{IdleTimeout: 100 * time.Millisecond}, func(a, b string) {
+		closed <- [2]string{a, b}
+	})
+	rs.Request("alice", "bob")
+	rs.Request("bob", "alice")
+
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := rs.Forward("alice", "bob", 1); err != nil {
+			t.Fatal("a relay in use should stay open")
+		}
+	}
+
+	select {
+	case ends := <-closed:
+		if ends != [2]string{"bob", "alice"} {
+			t.Fatalf("wrong ends: %v", ends)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the idle relay should have been closed")
+	}
+	if _, err := rs.Forward("alice", "bob", 1); err == nil {
+		t.Fatal("the relay should be closed")
+	}
+}
@@ -0,0 +1,104 @@
+package hermes
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+)
+
+// How long a client waits for its peer to ask for the connection as well.
+const RENDEZVOUS_TIMEOUT = 2 * time.Minute
+
+// Keeps track of the clients waiting for their peer, so that the two can be put in touch.
+type Rendezvous struct {
+	mu      sync.Mutex
+	pending map[string]*waiter
+}
+
+// A client waiting for its peer.
+type waiter struct {
+	addr  string
+	match chan pairing
+}
+
+// What the server hands out to each of the two peers once they are matched.
+type pairing struct {
+	role string
+	addr string
+	key  []byte
+}
+
+// Creates an empty Rendezvous.
+func NewRendezvous() *Rendezvous {
+	return &Rendezvous{
+		pending: make(map[string]*waiter),
+	}
+}
+
+// Registers the wish of uname (reachable at addr) to talk to peer and waits for peer to do the same (or for ctx to be done).
+// The first of the two to show up listens, the second one dials: invite is called if uname is the first one, so that peer can be told.
+// Both get the same, freshly generated, pairing key.
+// Returns the role, the address of the peer, the pairing key and an error if the peer didn't show up in time.
+func (rv *Rendezvous) Meet(ctx context.Context, uname, peer, addr string, invite func()) (string, string, []byte, error) {
+	if uname == peer {
+		return "", "", nil, errors.New("a client can't connect to itself")
+	}
+
+	rv.mu.Lock()
+	if w, ok := rv.pending[pairID(peer, uname)]; ok {
+		delete(rv.pending, pairID(peer, uname))
+		rv.mu.Unlock()
+
+		key := make([]byte, anubis.BYTE_SEC)
+		if _, err := rand.Read(key); err != nil {
+			close(w.match)
+			return "", "", nil, err
+		}
+
+		w.match <- pairing{role: PEER_LISTENER, addr: addr, key: key}
+		return PEER_DIALER, w.addr, key, nil
+	}
+
+	w := &waiter{addr: addr, match: make(chan pairing, 1)}
+	if old, ok := rv.pending[pairID(uname, peer)]; ok {
+		// a client asking again replaces its previous request
+		close(old.match)
+	}
+	rv.pending[pairID(uname, peer)] = w
+	rv.mu.Unlock()
+
+	invite()
+
+	select {
+	case p, ok := <-w.match:
+		if !ok {
+			return "", "", nil, errors.New("the request was dropped")
+		}
+		return p.role, p.addr, p.key, nil
+	case <-ctx.Done():
+	}
+
+	rv.mu.Lock()
+	if rv.pending[pairID(uname, peer)] == w {
+		delete(rv.pending, pairID(uname, peer))
+		rv.mu.Unlock()
+		return "", "", nil, errors.New("the peer didn't show up in time")
+	}
+	rv.mu.Unlock()
+
+	// the peer showed up just as we were giving up (or we've been replaced)
+	p, ok := <-w.match
+	if !ok {
+		return "", "", nil, errors.New("the request was dropped")
+	}
+	return p.role, p.addr, p.key, nil
+}
+
+// Identifies the wish of from to talk to to.
+func pairID(from, to string) string {
+	return from + "\x00" + to
+}
@@ -0,0 +1,142 @@
+package hermes
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Utility function, a context that expires after d.
+func within(t *testing.T, d time.Duration) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	t.Cleanup(cancel)
+
+	return ctx
+}
+
+// Tests that two clients asking for each other are matched, with opposite roles and the same key.
+func Test_Meet(t *testing.T) {
+	rv := NewRendezvous()
+
+	type result struct {
+		role, addr string
+		key        []byte
+		err        error
+	}
+	done := make(chan result)
+	invited := make(chan struct{})
+	go func() {
+		role, addr, key, err := rv.Meet(within(t, time.Second), "alice", "bob", "10.0.0.1:5000", func() { close(invited) })
+		done <- result{role, addr, key, err}
+	}()
+	<-invited // alice is the first one to show up, so bob gets invited
+
+	role, addr, key, err := rv.Meet(within(t, time.Second), "bob", "alice", "10.0.0.2:6000", func() {
+		t.Error("bob should not invite alice, she's already waiting")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := <-done
+	if alice.err != nil {
+		t.Fatal(alice.err)
+	}
+
+	if alice.role != PEER_LISTENER || role != PEER_DIALER {
+		t.Fatalf("the first client should listen and the second dial: got %s and %s", alice.role, role)
+	}
+	if addr != "10.0.0.1:5000" || alice.addr != "10.0.0.2:6000" {
+		t.Fatalf("each client should get the address of the other: got %s and %s", alice.addr, addr)
+	}
+	if len(key) != 32 || string(key) != string(alice.key) {
+		t.Fatal("both clients should get the same 32 bytes pairing key")
+	}
+	if len(rv.pending) != 0 {
+		t.Fatal("matched clients should not be pending anymore")
+	}
+}
+
+// Tests that every pairing gets its own key.
+func Test_Meet_freshKeys(t *testing.T) {
+	rv := NewRendezvous()
+	keys := make(map[string]struct{})
+
+	N := 10
+	for i := 0; i < N; i++ {
+		invited := make(chan struct{})
+		go rv.Meet(within(t, time.Second), "alice", "bob", "10.0.0.1:5000", func() { close(invited) })
+		<-invited
+
+		_, _, key, err := rv.Meet(within(t, time.Second), "bob", "alice", "10.0.0.2:6000", func() {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[string(key)] = struct{}{}
+	}
+
+	if len(keys) != N {
+		t.Fatal("generated a duplicate pairing key")
+	}
+}
+
+// Tests that a client whose peer never shows up gives up when the context expires.
+func Test_Meet_timeout(t *testing.T) {
+	rv := NewRendezvous()
+
+	start := time.Now()
+	_, _, _, err := rv.Meet(within(t, 100*time.Millisecond), "alice", "bob", "10.0.0.1:5000", func() {})
+	if err == nil {
+		t.Fatal("meeting a peer that never shows up should fail")
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatal("gave up before the timeout")
+	}
+	if len(rv.pending) != 0 {
+		t.Fatal("a client that gave up should not be pending anymore")
+	}
+}
+
+// Tests that clients only get matched with the peer they asked for.
+func Test_Meet_wrongPeer(t *testing.T) {
+	rv := NewRendezvous()
+
+	invited := make(chan struct{})
+	go rv.Meet(within(t, 200*time.Millisecond), "alice", "bob", "10.0.0.1:5000", func() { close(invited) })
+	<-invited
+
+	_, _, _, err := rv.Meet(within(t, 100*time.Millisecond), "carol", "alice", "10.0.0.3:7000", func() {})
+	if err == nil {
+		t.Fatal("carol should not be matched with alice, who asked for bob")
+	}
+
+	_, _, _, err = rv.Meet(within(t, 100*time.Millisecond), "alice", "alice", "10.0.0.1:5000", func() {})
+	if err == nil {
+		t.Fatal("a client should not be able to connect to itself")
+	}
+}
+
+// Tests that asking twice for the same peer drops the first request.
+func Test_Meet_replaced(t *testing.T) {
+	rv := NewRendezvous()
+
+	first := make(chan error)
+	invited := make(chan struct{})
+	go func() {
+		_, _, _, err := rv.Meet(within(t, time.Second), "alice", "bob", "10.0.0.1:5000", func() { close(invited) })
+		first <- err
+	}()
+	<-invited
+
+	go rv.Meet(within(t, time.Second), "alice", "bob", "10.0.0.1:5001", func() {})
+	if err := <-first; err == nil {
+		t.Fatal("the first request should have been dropped")
+	}
+
+	_, addr, _, err := rv.Meet(within(t, time.Second), "bob", "alice", "10.0.0.2:6000", func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "10.0.0.1:5001" {
+		t.Fatalf("bob should be matched with the second request of alice: got address %s", addr)
+	}
+}
@@ -0,0 +1,84 @@
+package hermes
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+)
+
+// A Session is the authenticated connection between the client and the server.
+// Once authentication is done, client and server exchange messages made of space separated fields, the first of which says what the message is about,
+// each in a record of the RecordLayer of the session (whose keys are updated along the way).
+type Session struct {
+	Uname   string // the name of the authenticated client
+	role    Role
+	conn    net.Conn
+	records *RecordLayer
+}
+
+// Creates the Session of the client uname, playing role, on a connection that has already been authenticated with the given cipher.
+func NewSession(conn net.Conn, cipher anubis.Cipher, role Role, uname string) *Session {
+	return &Session{
+		Uname:   uname,
+		role:    role,
+		conn:    conn,
+		records: NewSessionRecords(conn, cipher, role),
+	}
+}
+
+// Sends a message, made of the given fields, to the other end.
+func (s *Session) Send(fields ...string) error {
+	return s.records.WriteRecord(RECORD_DATA, []byte(strings.Join(fields, " ")))
+}
+
+// Waits for the next message of the other end.
+// Returns the fields of the message and an error.
+func (s *Session) Receive() ([]string, error) {
+	rtype, msg, err := s.records.ReadRecord()
+	if err != nil {
+		return nil, err
+	}
+	if rtype != RECORD_DATA {
+		return nil, errors.New("unexpected record from the other end")
+	}
+
+	return strings.Fields(string(msg)), nil
+}
+
+// Returns the address of the other end.
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Turns the session into a Mux carrying several streams (the client is the initiator): Send() and Receive() mustn't be used anymore.
+func (s *Session) Mux() *Mux {
+	return newMux(s.records, s.role == CLIENT)
+}
+
+// Changes when the keys the session sends with are updated (DEFAULT_KEY_UPDATES unless changed).
+func (s *Session) SetKeyUpdates(policy KeyUpdatePolicy) {
+	s.records.SetKeyUpdatePolicy(policy)
+}
+
+// Changes how the messages the session sends are padded (DEFAULT_PADDING unless changed).
+func (s *Session) SetPadding(padding PaddingPolicy) {
+	s.records.SetPadding(padding)
+}
+
+// Changes the timeouts of the session (none unless changed): the keepalives are sent from now on.
+func (s *Session) SetTimeouts(t Timeouts) {
+	s.records.SetTimeouts(t)
+}
+
+// Updates the keys the session sends with now.
+// Returns an error if the update couldn't be sent.
+func (s *Session) UpdateKeys() error {
+	return s.records.UpdateKeys()
+}
+
+// Closes the connection.
+func (s *Session) Close() error {
+	return s.records.Close()
+}
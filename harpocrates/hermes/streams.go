@@ -0,0 +1,217 @@
+package hermes
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+)
+
+// How many files sent by the peer are received at once: the streams of the others wait, their windows holding up the peer.
+const MAX_INCOMING_FILES = 4
+
+// Something the peer sent over the streams, the way Receive() returns it.
+type received struct {
+	name string
+	data []byte
+	err  error
+}
+
+// Moves the conversation with the peer onto streams (see Mux): the chat messages go over a stream of their own,
+// and every file over a stream of its own, so that a large file doesn't hold up the messages sent after it.
+// The chat messages are spread over the chat stream and paths (see Multipath), if there are any, coded with coder unless it's nil
+// (see NegotiateErasure()): both ends must agree on it, but not on the paths, the peer reads whatever arrives on either.
+// The paths that are also io.Closers (like a DatagramConn) are closed along with the connection.
+// Like StartRatchet(), it must be called by both ends at the same point of the conversation, as the last step of the setup:
+// from then on, the connection is only used through Send(), SendFile(), Receive() and Close().
+// Returns an error.
+func (p *Peer) StartStreams(coder *anubis.ErasureCoder, paths ...Path) error {
+	if p.mux != nil {
+		return errors.New("the streams were already started")
+	}
+	p.mux = newMux(p.records, p.dialer)
+	p.paths = paths
+	p.incoming = make(chan received, MAX_INCOMING_FILES)
+
+	// the dialer opens the chat stream, so that it's the first one the listener accepts
+	var chat *Stream
+	var err error
+	if p.dialer {
+		chat, err = p.mux.Open()
+	} else {
+		chat, err = p.mux.Accept()
+	}
+	if err != nil {
+		return err
+	}
+	p.chat, err = NewErasureMultipath(coder, append([]Path{streamMessages{chat}}, paths...)...)
+	if err != nil {
+		return err
+	}
+
+	go p.readChat()
+	go p.acceptFiles()
+
+	return nil
+}
+
+// Sends a chat message over the chat stream (and the other paths).
+func (p *Peer) sendChat(ct []byte) error {
+	return p.chat.Send(ct)
+}
+
+// Sends a file over a stream of its own, closed once the whole file is sent.
+func (p *Peer) sendFileStream(ct []byte) error {
+	s, err := p.mux.Open()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Write(ct)
+	if err != nil {
+		s.Reset()
+		return err
+	}
+
+	return s.Close()
+}
+
+// Waits for the next message (or file) that came over the streams.
+// Returns the name of the file (empty for chat messages), the content and an error (io.EOF if the peer hung up).
+func (p *Peer) receiveStreams() (string, []byte, error) {
+	select {
+	case r := <-p.incoming:
+		return r.name, r.data, r.err
+	case <-p.mux.done:
+		// whatever arrived before the connection was closed comes first
+		select {
+		case r := <-p.incoming:
+			return r.name, r.data, r.err
+		default:
+		}
+		return "", nil, p.mux.closedErr()
+	}
+}
+
+// Reads the chat messages of the peer, until all the paths of the chat fail.
+func (p *Peer) readChat() {
+	for {
+		ct, err := p.chat.Receive()
+		if err != nil {
+			p.deliver(received{err: err})
+			return
+		}
+
+		msg, err := p.open(ct)
+		p.deliver(received{data: msg, err: err})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Accepts the streams the peer sends files on, receiving at most MAX_INCOMING_FILES at once, until the connection is closed.
+func (p *Peer) acceptFiles() {
+	slots := make(chan struct{}, MAX_INCOMING_FILES)
+	for {
+		s, err := p.mux.Accept()
+		if err != nil {
+			return
+		}
+
+		select {
+		case slots <- struct{}{}:
+		case <-p.mux.done:
+			return
+		}
+		go func() {
+			defer func() { <-slots }()
+			p.receiveFile(s)
+		}()
+	}
+}
+
+// Reads a whole file from s, where the peer sent it, and hands it over.
+func (p *Peer) receiveFile(s *Stream) {
+	ct, err := io.ReadAll(io.LimitReader(s, MAX_MESSAGE_SIZE+1))
+	if err == nil && len(ct) > MAX_MESSAGE_SIZE {
+		err = errors.New("the file is too large")
+	}
+	if err != nil {
+		s.Reset()
+		p.deliver(received{err: err})
+		return
+	}
+	s.Close()
+
+	data, err := p.open(ct)
+	if err != nil {
+		p.deliver(received{err: err})
+		return
+	}
+	name, content, err := parseFile(data)
+	p.deliver(received{name: name, data: content, err: err})
+}
+
+// Closes the paths given to StartStreams() that can be closed.
+func (p *Peer) closePaths() {
+	for _, path := range p.paths {
+		if c, ok := path.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// Hands r to Receive(), unless the connection is closed first.
+func (p *Peer) deliver(r received) {
+	select {
+	case p.incoming <- r:
+	case <-p.mux.done:
+	}
+}
+
+// A Path over a stream, each fragment being a message (see writeMessage()).
+type streamMessages struct {
+	s *Stream
+}
+
+func (p streamMessages) Send(fragment []byte) error {
+	return writeMessage(p.s, fragment)
+}
+
+func (p streamMessages) Receive() ([]byte, error) {
+	return readMessage(p.s, FRAGMENT_HEADER_SIZE+FRAGMENT_SIZE)
+}
+
+// Sends msg on s after its length (4 bytes), in a single write so that it's never mixed with another message.
+func writeMessage(s *Stream, msg []byte) error {
+	framed := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(framed, uint32(len(msg)))
+	framed = append(framed, msg...)
+
+	_, err := s.Write(framed)
+	return err
+}
+
+// Reads a message sent on s with writeMessage(), refusing one longer than max.
+// Returns the message and an error.
+func readMessage(s *Stream, max int) ([]byte, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(s, header)
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header)
+	if uint64(n) > uint64(max) {
+		return nil, ErrMessageTooLong
+	}
+
+	msg := make([]byte, n)
+	_, err = io.ReadFull(s, msg)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return msg, err
+}
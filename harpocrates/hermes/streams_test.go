@@ -0,0 +1,251 @@
+package hermes
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Utility function, connects two peers and runs setup on both ends at once, after starting the Double Ratchet (the way the client sets up a connection).
+// Returns the dialer and the listener, closed along with the test.
+func setUpPeers(t *testing.T, setup func(p *Peer) error) (*Peer, *Peer) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	dialer, listener, derr, lerr := connectPeers(t, key, key)
+	if derr != nil || lerr != nil {
+		t.Fatal(derr, lerr)
+	}
+	t.Cleanup(func() {
+		dialer.Close()
+		listener.Close()
+	})
+
+	done := make(chan error)
+	for _, p := range []*Peer{dialer, listener} {
+		go func(p *Peer) {
+			_, err := p.StartRatchet(nil, nil)
+			if err == nil {
+				err = setup(p)
+			}
+			done <- err
+		}(p)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dialer, listener
+}
+
+// Tests a conversation over streams: chat messages and files both ways, a file in the middle of the chat, and the hang up.
+func Test_Peer_StartStreams(t *testing.T) {
+	dialer, listener := setUpPeers(t, func(p *Peer) error {
+		return p.StartStreams(nil)
+	})
+	if err := dialer.StartStreams(nil); err == nil {
+		t.Fatal("the streams were started twice")
+	}
+
+	file := make([]byte, 3<<20)
+	rand.Read(file)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- dialer.SendFile("big.bin", file)
+	}()
+	if err := dialer.Send([]byte("sending you a file")); err != nil {
+		t.Fatal(err)
+	}
+
+	var gotFile, gotChat bool
+	for !gotFile || !gotChat {
+		name, data, err := listener.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch name {
+		case "":
+			if string(data) != "sending you a file" {
+				t.Fatalf("wrong message: %q", data)
+			}
+			gotChat = true
+		case "big.bin":
+			if !bytes.Equal(data, file) {
+				t.Fatal("the file was corrupted on the way")
+			}
+			gotFile = true
+		default:
+			t.Fatalf("unexpected file %q", name)
+		}
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	// the listener talks back, on the streams it opens itself
+	if err := listener.SendFile("small.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := listener.Send([]byte("got it")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		name, data, err := dialer.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (name == "" && string(data) != "got it") || (name != "" && (name != "small.txt" || string(data) != "hello")) {
+			t.Fatalf("wrong message: %q %q", name, data)
+		}
+	}
+
+	dialer.Close()
+	if _, _, err := listener.Receive(); err != io.EOF {
+		t.Fatalf("expected io.EOF once the dialer hung up, got %v", err)
+	}
+}
+
+// A Path counting the fragments sent over it.
+type countingPath struct {
+	Path
+	sent int32
+}
+
+func (p *countingPath) Send(fragment []byte) error {
+	atomic.AddInt32(&p.sent, 1)
+	return p.Path.Send(fragment)
+}
+
+// Tests that the chat is spread over the chat stream and the paths given to StartStreams(), and that hanging up still ends it.
+func Test_Peer_StartStreams_paths(t *testing.T) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	paths := map[bool]*countingPath{true: {Path: StreamPath(a)}, false: {Path: StreamPath(b)}}
+	dialer, listener := setUpPeers(t, func(p *Peer) error {
+		return p.StartStreams(nil, paths[p.dialer])
+	})
+
+	msg := make([]byte, 3*FRAGMENT_SIZE)
+	rand.Read(msg)
+	for _, ends := range [][2]*Peer{{dialer, listener}, {listener, dialer}} {
+		if err := ends[0].Send(msg); err != nil {
+			t.Fatal(err)
+		}
+		name, data, err := ends[1].Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "" || !bytes.Equal(data, msg) {
+			t.Fatal("the message was corrupted on the way")
+		}
+	}
+	for dialing, p := range paths {
+		if atomic.LoadInt32(&p.sent) == 0 {
+			t.Fatalf("the extra path carried nothing (dialer: %v)", dialing)
+		}
+	}
+
+	// the extra path is still open, but the connection is over
+	dialer.Close()
+	if _, _, err := listener.Receive(); err != io.EOF {
+		t.Fatalf("expected io.EOF once the dialer hung up, got %v", err)
+	}
+}
+
+// Tests the chat coded into shares over the chat stream and a path that drops some of them: every message arrives once.
+func Test_Peer_StartStreams_erasure(t *testing.T) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	paths := map[bool]*flakyPath{true: {Path: StreamPath(a)}, false: {Path: StreamPath(b)}}
+	dialer, listener := setUpPeers(t, func(p *Peer) error {
+		coder, err := p.NegotiateErasure(1, 2)
+		if err != nil {
+			return err
+		}
+		return p.StartStreams(coder, paths[p.dialer])
+	})
+
+	for i := 0; i < 10; i++ {
+		paths[true].mu.Lock()
+		paths[true].down = i%2 == 0
+		paths[true].mu.Unlock()
+
+		msg := make([]byte, 2*FRAGMENT_SIZE)
+		rand.Read(msg)
+		if err := dialer.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+		_, data, err := listener.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, msg) {
+			t.Fatalf("expected message %d, got another one", i)
+		}
+	}
+}
+
+// Tests the chat coded into shares over the chat stream and a datagram path (on a link that loses, duplicates and reorders them):
+// every message arrives once, and the datagram path is closed along with the connection.
+func Test_Peer_StartStreams_datagrams(t *testing.T) {
+	a, b, link := newLossyLink(34, 0.3, 0.1, 0.1)
+	ends := map[bool]*lossyConn{true: a, false: b}
+	datagrams := make(map[bool]*DatagramConn)
+	var mu sync.Mutex
+	dialer, listener := setUpPeers(t, func(p *Peer) error {
+		coder, err := p.NegotiateErasure(1, 2)
+		if err != nil {
+			return err
+		}
+		end := ends[p.dialer]
+		dc, err := p.Datagrams(NewPacketHub(end).Conn(), end.peer.addr)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		datagrams[p.dialer] = dc
+		mu.Unlock()
+
+		return p.StartStreams(coder, dc)
+	})
+
+	for i := 0; i < 20; i++ {
+		msg := make([]byte, FRAGMENT_SIZE/2)
+		rand.Read(msg)
+		if err := dialer.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+		_, data, err := listener.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, msg) {
+			t.Fatalf("expected message %d, got another one", i)
+		}
+	}
+	link.mu.Lock()
+	if len(link.captured) == 0 || link.dropped == 0 {
+		t.Fatalf("the datagram path wasn't used (%d datagrams sent, %d lost)", len(link.captured), link.dropped)
+	}
+	link.mu.Unlock()
+
+	dialer.Close()
+	if _, err := datagrams[true].Receive(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected the datagram path to be closed, got %v", err)
+	}
+	if _, _, err := listener.Receive(); err != io.EOF {
+		t.Fatalf("expected io.EOF once the dialer hung up, got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package harpocrates
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/harpocrates/cerberus"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// Returned by Listen() without credentials to check the clients against.
+var ErrNoCredentials = errors.New("the listener has no credentials")
+
+// A Listener accepts the clients that authenticated, running the handshakes in the background so that a slow client doesn't hold up the others.
+type Listener struct {
+	l     net.Listener
+	cfg   Config
+	conns chan *Conn
+
+	mu   sync.Mutex
+	err  error // why the listener stopped
+	done chan struct{}
+	once sync.Once
+}
+
+// Listens for clients on addr (TCP), authenticating them against cfg.Credentials.
+// Returns the listener and an error.
+func Listen(addr string, cfg *Config) (net.Listener, error) {
+	if cfg == nil || cfg.Credentials == nil {
+		return nil, ErrNoCredentials
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewListener(l, cfg), nil
+}
+
+// Wraps l, so that it only returns clients that authenticated (as *Conn).
+// Without cfg.Credentials no client can authenticate: every handshake fails with ErrNoCredentials.
+func NewListener(l net.Listener, cfg *Config) *Listener {
+	hl := &Listener{
+		l:     l,
+		conns: make(chan *Conn),
+		done:  make(chan struct{}),
+	}
+	if cfg != nil {
+		hl.cfg = *cfg
+	}
+	go hl.serve()
+
+	return hl
+}
+
+// Waits for the next client that authenticated.
+// Returns its connection (a *Conn, whose Username() is the name of the client) and an error once the listener is closed.
+func (hl *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-hl.conns:
+		return c, nil
+	case <-hl.done:
+		hl.mu.Lock()
+		defer hl.mu.Unlock()
+		return nil, hl.err
+	}
+}
+
+// Stops listening (the connections already accepted stay open).
+func (hl *Listener) Close() error {
+	hl.stop(net.ErrClosed)
+	return hl.l.Close()
+}
+
+// Returns the address the listener listens on.
+func (hl *Listener) Addr() net.Addr {
+	return hl.l.Addr()
+}
+
+// Accepts the connections and runs their handshakes, at most MAX_PENDING_HANDSHAKES at once.
+func (hl *Listener) serve() {
+	pending := make(chan struct{}, MAX_PENDING_HANDSHAKES)
+	for {
+		raw, err := hl.l.Accept()
+		if err != nil {
+			hl.stop(err)
+			return
+		}
+
+		select {
+		case pending <- struct{}{}:
+		case <-hl.done:
+			raw.Close()
+			return
+		}
+		go func() {
+			defer func() { <-pending }()
+
+			c, err := hl.handshake(raw)
+			if err != nil {
+				raw.Close()
+				return
+			}
+			select {
+			case hl.conns <- c:
+			case <-hl.done:
+				c.Close()
+			}
+		}()
+	}
+}
+
+// Runs the handshake with a client (ECDHE and SCRAM).
+// Returns the connection and an error.
+func (hl *Listener) handshake(raw net.Conn) (*Conn, error) {
+	if hl.cfg.Credentials == nil {
+		return nil, ErrNoCredentials
+	}
+	conn := hermes.NewConn(raw)
+
+	var session anubis.Cipher
+	var uname string
+	err := handshake(context.Background(), conn, hl.cfg.handshakeDeadline(), func() error {
+		cipher, u, err := cerberus.DoMutualAuthWith(conn, hl.cfg.Credentials, hl.cfg.auth())
+		if err != nil {
+			return err
+		}
+		session, uname = cipher, u
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return newConn(conn, hermes.NewSessionRecords(conn, session, hermes.SERVER), uname, &hl.cfg), nil
+}
+
+// Stops the listener because of err (unless it's stopped already).
+func (hl *Listener) stop(err error) {
+	hl.once.Do(func() {
+		hl.mu.Lock()
+		hl.err = err
+		hl.mu.Unlock()
+		close(hl.done)
+	})
+}
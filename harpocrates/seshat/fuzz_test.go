@@ -0,0 +1,33 @@
+package seshat
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The seeds in testdata/fuzz are the (decrypted) messages of a real handshake (alice logging in).
+
+// Tests that ExtractDataNonce() splits any message in two, without losing (or making up) a single byte.
+func Fuzz_ExtractDataNonce(f *testing.F) {
+	f.Add([]byte{}, false)
+	f.Add(make([]byte, 63), true)
+
+	f.Fuzz(func(t *testing.T, cdata []byte, long bool) {
+		nlen := 32
+		if long {
+			nlen = 64
+		}
+
+		data, nonce, err := ExtractDataNonce(cdata, nlen)
+		if err != nil {
+			if len(cdata) >= nlen {
+				t.Fatalf("refused %d bytes: %s", len(cdata), err)
+			}
+			return
+		}
+
+		if len(nonce) != nlen || !bytes.Equal(MergeChunks(nonce, data), cdata) {
+			t.Fatalf("%x split into %x and %x", cdata, nonce, data)
+		}
+	})
+}
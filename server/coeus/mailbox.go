@@ -0,0 +1,105 @@
+// Coeus is one of the Titans of Greek mythology, whose name means "query", "questioning".
+// As such, package coeus is responsible for the interaction with the filesystem (it queries it for information).
+package coeus
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Where the messages waiting for offline users are kept, one file per user.
+const MAILBOX_DIR = "mailboxes"
+
+// The messages waiting for a user.
+type MailboxRecord struct {
+	Name      string // random, so that the recipient doesn't take the ids of a new mailbox (if this one is lost) for ones it got already
+	NextID    uint64 // the id the next message gets (ids are never reused, so that acknowledgements can't hit the wrong message)
+	Envelopes []Envelope
+	Senders   map[string]Sent // the last message of each sender, so that a message sent again isn't kept twice
+}
+
+// The last message a sender left, by the id it gave it in its outbox.
+type Sent struct {
+	Outbox string // the outbox of the sender (a new one starts its ids over)
+	ID     uint64
+}
+
+// A message waiting for its recipient. The server can't read Data, it's end-to-end encrypted.
+type Envelope struct {
+	ID       uint64
+	From     string
+	Received time.Time
+	Data     []byte
+}
+
+// Returns the messages waiting for uname in dir (an empty mailbox if there are none) and an error.
+func GetMailbox(dir, uname string) (MailboxRecord, error) {
+	record := MailboxRecord{NextID: 1}
+
+	content, err := os.ReadFile(mailboxFile(dir, uname))
+	if errors.Is(err, os.ErrNotExist) {
+		return record, nil
+	} else if err != nil {
+		return MailboxRecord{}, err
+	}
+
+	err = json.Unmarshal(content, &record)
+	if err != nil {
+		return MailboxRecord{}, err
+	}
+
+	return record, nil
+}
+
+// (Re)writes the mailbox of uname in dir, atomically, so that a crash can't lose the messages.
+func SaveMailbox(dir, uname string, record MailboxRecord) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	filename := mailboxFile(dir, uname)
+	tmp := filename + ".tmp"
+	err = os.WriteFile(tmp, content, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
+
+// Returns the users with a mailbox in dir and an error.
+func ListMailboxes(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var unames []string
+	for _, e := range entries {
+		uname, err := hex.DecodeString(e.Name())
+		if err != nil {
+			// a temporary file, or something that isn't ours
+			continue
+		}
+		unames = append(unames, string(uname))
+	}
+
+	return unames, nil
+}
+
+// Returns the file the mailbox of uname is kept in (the name is hex encoded, usernames come from the network).
+func mailboxFile(dir, uname string) string {
+	return filepath.Join(dir, hex.EncodeToString([]byte(uname)))
+}
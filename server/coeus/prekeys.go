@@ -0,0 +1,67 @@
+package coeus
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const PREKEYS_FILE = "prekeys.json"
+
+// The prekeys a user published, for others to start sessions with it while it's offline.
+type PrekeyRecord struct {
+	Identity       []byte
+	SignedPrekeyID uint32
+	SignedPrekey   []byte
+	Created        time.Time
+	Signature      []byte
+	OneTime        []OneTimePrekey // handed out in the order they were published
+}
+
+// A prekey that is handed out only once.
+type OneTimePrekey struct {
+	ID  uint32
+	Key []byte
+}
+
+// Returns the prekeys kept in filename, by username (none if the file doesn't exist yet), and an error.
+func GetPrekeys(filename string) (map[string]*PrekeyRecord, error) {
+	records := make(map[string]*PrekeyRecord)
+
+	content, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(content, &records)
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// (Re)writes the prekeys file, atomically, so that a crash can't leave it half written.
+func SavePrekeys(filename string, records map[string]*PrekeyRecord) error {
+	content, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	err = os.WriteFile(tmp, content, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
@@ -2,7 +2,7 @@ module github.com/mowzhja/harpocrates/server
 
 go 1.16
 
-require (
-	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
-	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
-)
+require github.com/mowzhja/harpocrates/harpocrates v0.1.0
+
+// builds against the copy of the protocol module in this tree (tagged harpocrates/v0.1.0), so that a change to both sides is tested as one
+replace github.com/mowzhja/harpocrates/harpocrates => ../harpocrates
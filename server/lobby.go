@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+	"github.com/mowzhja/harpocrates/server/coeus"
+)
+
+// The first word of the reason of a NOT_QUEUED: whether leaving the message can work if the client sends it again.
+const (
+	NOT_QUEUED_REFUSED = "REFUSED" // it can't: the message is malformed, or its recipient can't get messages
+	NOT_QUEUED_RETRY   = "RETRY"   // it can, once the mailbox of the recipient has room again (or the server can write to it)
+)
+
+// The Lobby keeps track of the clients that are online and serves their requests.
+type Lobby struct {
+	mu        sync.Mutex
+	sessions  map[string]*hermes.Session
+	mail      map[string]chan struct{} // signals that messages were left for an online client
+	rv        *hermes.Rendezvous
+	prekeys   *PrekeyStore
+	mailbox   *Mailbox
+	relays    *hermes.Relays
+	endpoints *hermes.Endpoints
+}
+
+// Creates an empty Lobby, handing out the prekeys kept in prekeys, delivering the messages kept in mailbox and relaying connections within the limits in relay.
+func NewLobby(prekeys *PrekeyStore, mailbox *Mailbox, relay hermes.RelayConfig) *Lobby {
+	l := &Lobby{
+		sessions: make(map[string]*hermes.Session),
+		mail:     make(map[string]chan struct{}),
+		rv:       hermes.NewRendezvous(),
+		prekeys:  prekeys,
+		mailbox:  mailbox,
+	}
+	l.relays = hermes.NewRelays(relay, func(a, b string) {
+		l.hangUp(a, b)
+		l.hangUp(b, a)
+	})
+	l.endpoints = hermes.NewEndpoints(func(uname, addr string) {
+		if s := l.session(uname); s != nil {
+			// a slow client mustn't hold up the bind requests of the others
+			go s.Send("ENDPOINT", addr)
+		}
+	})
+
+	return l
+}
+
+// Serves the requests of the client until it disconnects.
+// The client can ask WHO (answered with USERS <uname>...) and CONNECT <peer> <port> (answered with PEER <peer> <role> <addr> <pairing key> <UDP endpoint>, once the peer asked for us as well; the endpoint is - unless both are bound).
+// BIND is answered with BIND <token>: the client sends the token to the UDP port of the server (see ServeUDP()), and is told ENDPOINT <addr> with the address it's seen from.
+// Asking for a peer who isn't waiting for us yet sends it an INVITE <uname>.
+// The client publishes its prekeys with SIGNED_PREKEY <identity> <id> <prekey> <created> <signature> and ONETIME_PREKEYS <id>:<prekey>...,
+// and is sent PREKEYS_LOW <count> whenever it's running out of one-time prekeys.
+// BUNDLE <user> is answered with BUNDLE <user> <identity> <id> <prekey> <created> <signature> <one-time id> <one-time prekey> (0 and - if there's none left).
+// SEND <user> <outbox> <id> <message> leaves an end-to-end encrypted message for user (answered with QUEUED <user> <id>, or NOT_QUEUED <user> <id> <REFUSED|RETRY> <reason>),
+// which gets it as MSG <mailbox> <id> <from> <sent> <message> as soon as it's online, in the order they were left, until it answers ACK <id>.
+// The mailbox is named at random: the ids of its messages never go back, unless it's lost and a new one (with a new name) starts over.
+// The id of SEND is the one the message has in the outbox of the sender, and grows with every message: a message sent again is answered with QUEUED, but left only once.
+// A sender that lost its outbox names a new one, whose ids start over.
+// Peers that can't reach each other directly both ask RELAY <peer> (answered with RELAYED <peer>), then send each other their records with RELAY_DATA <peer> <data>
+// until one of them (or the server) sends RELAY_CLOSE <peer>.
+// Anything going wrong gets an ERROR <reason>.
+// Returns an error if the connection broke (nil if the client simply left).
+func (l *Lobby) Serve(s *hermes.Session) error {
+	// pending requests die with the session
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mail := l.join(s)
+	defer l.leave(s)
+
+	go l.deliver(ctx, s, mail)
+	mail <- struct{}{}
+
+	for {
+		fields, err := s.Receive()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "WHO":
+			err = s.Send(append([]string{"USERS"}, l.Online()...)...)
+		case "BIND":
+			err = l.bind(s)
+		case "CONNECT":
+			err = l.connect(ctx, s, fields[1:])
+		case "SIGNED_PREKEY":
+			err = l.signedPrekey(s, fields[1:])
+		case "ONETIME_PREKEYS":
+			err = l.oneTimePrekeys(s, fields[1:])
+		case "BUNDLE":
+			err = l.bundle(s, fields[1:])
+		case "SEND":
+			err = l.send(s, fields[1:])
+		case "ACK":
+			err = l.ack(s, fields[1:])
+		case "RELAY":
+			err = l.relay(s, fields[1:])
+		case "RELAY_DATA":
+			err = l.relayData(s, fields[1:])
+		case "RELAY_CLOSE":
+			if len(fields) == 2 && l.relays.Close(s.Uname, fields[1]) {
+				l.hangUp(fields[1], s.Uname)
+			}
+		default:
+			err = s.Send("ERROR", "unknown request", fields[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Returns the (sorted) names of the clients that are online.
+func (l *Lobby) Online() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	unames := make([]string, 0, len(l.sessions))
+	for uname := range l.sessions {
+		unames = append(unames, uname)
+	}
+	sort.Strings(unames)
+
+	return unames
+}
+
+// Registers a session, kicking out any older session of the same client.
+// Returns the channel signalling that messages were left for the client.
+func (l *Lobby) join(s *hermes.Session) chan struct{} {
+	mail := make(chan struct{}, 1)
+
+	l.mu.Lock()
+	old, ok := l.sessions[s.Uname]
+	l.sessions[s.Uname] = s
+	l.mail[s.Uname] = mail
+	l.mu.Unlock()
+
+	if ok {
+		old.Close()
+	}
+	fmt.Printf("[+] (%s) Joined the lobby...\n", s.Uname)
+
+	return mail
+}
+
+// Unregisters a session (unless it has already been replaced by a newer one).
+func (l *Lobby) leave(s *hermes.Session) {
+	l.mu.Lock()
+	current := l.sessions[s.Uname] == s
+	if current {
+		delete(l.sessions, s.Uname)
+		delete(l.mail, s.Uname)
+	}
+	l.mu.Unlock()
+
+	if current {
+		l.endpoints.Forget(s.Uname)
+		for _, peer := range l.relays.CloseAll(s.Uname) {
+			go l.hangUp(peer, s.Uname)
+		}
+	}
+
+	fmt.Printf("[+] (%s) Left the lobby...\n", s.Uname)
+}
+
+// Returns the session of an online client (nil if it's offline).
+func (l *Lobby) session(uname string) *hermes.Session {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.sessions[uname]
+}
+
+// Handles a CONNECT request: the peer gets invited and, as soon as it asks for us as well, both get the pairing.
+// The pairing happens in the background, so that the client can keep making requests in the meantime.
+// Returns an error only if the connection with the client broke.
+func (l *Lobby) connect(ctx context.Context, s *hermes.Session, args []string) error {
+	if len(args) != 2 {
+		return s.Send("ERROR", "usage: CONNECT <peer> <port>")
+	}
+	peer, port := args[0], args[1]
+
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return s.Send("ERROR", "invalid port", port)
+	}
+	if peer == s.Uname {
+		return s.Send("ERROR", "you can't connect to yourself")
+	}
+	ps := l.session(peer)
+	if ps == nil {
+		return s.Send("ERROR", peer, "is offline")
+	}
+
+	// the client knows its port, but only we know the address it is reachable at
+	host, _, err := net.SplitHostPort(s.RemoteAddr().String())
+	if err != nil {
+		return s.Send("ERROR", "unknown address")
+	}
+	addr := net.JoinHostPort(host, port)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, hermes.RENDEZVOUS_TIMEOUT)
+		defer cancel()
+
+		role, peerAddr, key, err := l.rv.Meet(ctx, s.Uname, peer, addr, func() {
+			ps.Send("INVITE", s.Uname)
+		})
+		if err != nil {
+			s.Send("ERROR", "couldn't connect with", peer+":", err.Error())
+			return
+		}
+
+		// the peers can also try to reach each other over UDP, through the endpoints we've seen them from (punching takes both)
+		endpoint := l.endpoints.Get(peer)
+		if endpoint == "" || l.endpoints.Get(s.Uname) == "" {
+			endpoint = "-"
+		}
+
+		s.Send("PEER", peer, role, peerAddr, hex.EncodeToString(key), endpoint)
+		fmt.Printf("[+] (%s) Connected with %s...\n", s.Uname, peer)
+	}()
+
+	return nil
+}
+
+// Handles a SIGNED_PREKEY request.
+// Returns an error only if the connection with the client broke.
+func (l *Lobby) signedPrekey(s *hermes.Session, args []string) error {
+	if len(args) != 5 {
+		return s.Send("ERROR", "usage: SIGNED_PREKEY <identity> <id> <prekey> <created> <signature>")
+	}
+
+	identity, err1 := hex.DecodeString(args[0])
+	id, err2 := strconv.ParseUint(args[1], 10, 32)
+	prekey, err3 := hex.DecodeString(args[2])
+	created, err4 := strconv.ParseInt(args[3], 10, 64)
+	sig, err5 := hex.DecodeString(args[4])
+	for _, err := range []error{err1, err2, err3, err4, err5} {
+		if err != nil {
+			return s.Send("ERROR", "malformed signed prekey")
+		}
+	}
+
+	remaining, err := l.prekeys.SetSignedPrekey(s.Uname, identity, uint32(id), prekey, time.Unix(created, 0), sig)
+	if err != nil {
+		return s.Send("ERROR", "signed prekey refused:", err.Error())
+	}
+
+	return l.checkPrekeys(s, remaining)
+}
+
+// Handles a ONETIME_PREKEYS request.
+// Returns an error only if the connection with the client broke.
+func (l *Lobby) oneTimePrekeys(s *hermes.Session, args []string) error {
+	var prekeys []coeus.OneTimePrekey
+	for _, arg := range args {
+		parts := strings.SplitN(arg, ":", 2)
+		if len(parts) != 2 {
+			return s.Send("ERROR", "malformed one-time prekey")
+		}
+		id, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return s.Send("ERROR", "malformed one-time prekey")
+		}
+		key, err := hex.DecodeString(parts[1])
+		if err != nil {
+			return s.Send("ERROR", "malformed one-time prekey")
+		}
+		prekeys = append(prekeys, coeus.OneTimePrekey{ID: uint32(id), Key: key})
+	}
+
+	remaining, err := l.prekeys.AddOneTimePrekeys(s.Uname, prekeys)
+	if err != nil {
+		return s.Send("ERROR", "one-time prekeys refused:", err.Error())
+	}
+
+	return l.checkPrekeys(s, remaining)
+}
+
+// Handles a BUNDLE request, asking the owner of the bundle for more one-time prekeys if it's running out (and it's online).
+// Returns an error only if the connection with the client broke.
+func (l *Lobby) bundle(s *hermes.Session, args []string) error {
+	if len(args) != 1 {
+		return s.Send("ERROR", "usage: BUNDLE <user>")
+	}
+	peer := args[0]
+
+	b, remaining, err := l.prekeys.Bundle(peer)
+	if err != nil {
+		return s.Send("ERROR", "no bundle for", peer+":", err.Error())
+	}
+
+	otpkID, otpk := "0", "-"
+	if len(b.OneTime) > 0 {
+		otpkID = strconv.FormatUint(uint64(b.OneTime[0].ID), 10)
+		otpk = hex.EncodeToString(b.OneTime[0].Key)
+	}
+
+	// the owner may be slow to read, which mustn't hold up the client
+	if ps := l.session(peer); ps != nil {
+		go l.checkPrekeys(ps, remaining)
+	}
+
+	return s.Send("BUNDLE", peer, hex.EncodeToString(b.Identity), strconv.FormatUint(uint64(b.SignedPrekeyID), 10),
+		hex.EncodeToString(b.SignedPrekey), strconv.FormatInt(b.Created.Unix(), 10), hex.EncodeToString(b.Signature), otpkID, otpk)
+}
+
+// Tells the client it's running out of one-time prekeys, if it is.
+func (l *Lobby) checkPrekeys(s *hermes.Session, remaining int) error {
+	if remaining >= LOW_ONETIME_PREKEYS {
+		return nil
+	}
+
+	return s.Send("PREKEYS_LOW", strconv.Itoa(remaining))
+}
+
+// Handles a SEND request, waking up the delivery to the recipient if it's online.
+// Returns an error only if the connection with the client broke.
+func (l *Lobby) send(s *hermes.Session, args []string) error {
+	if len(args) != 4 {
+		return s.Send("ERROR", "usage: SEND <user> <outbox> <id> <message>")
+	}
+	to, outbox, id := args[0], args[1], args[2]
+
+	if outbox == "" || len(outbox) > MAX_OUTBOX_NAME {
+		return s.Send("ERROR", "malformed outbox")
+	}
+	sent, err := strconv.ParseUint(id, 10, 64)
+	if err != nil || sent == 0 {
+		return s.Send("ERROR", "malformed id")
+	}
+	data, err := hex.DecodeString(args[3])
+	if err != nil {
+		return s.Send("NOT_QUEUED", to, id, NOT_QUEUED_REFUSED, "malformed message")
+	}
+	// only users who published prekeys can decrypt anything, which also keeps made up usernames from filling the disk
+	if _, ok := l.prekeys.Remaining(to); !ok || to == s.Uname {
+		return s.Send("NOT_QUEUED", to, id, NOT_QUEUED_REFUSED, "can't leave messages for", to)
+	}
+
+	_, err = l.mailbox.PutOnce(to, s.Uname, outbox, sent, data)
+	if err == ErrAlreadyQueued {
+		// the client didn't hear that it was the first time
+		return s.Send("QUEUED", to, id)
+	} else if err == ErrMailboxFull {
+		return s.Send("NOT_QUEUED", to, id, NOT_QUEUED_RETRY, "the mailbox of", to, "is full")
+	} else if err != nil {
+		return s.Send("NOT_QUEUED", to, id, NOT_QUEUED_RETRY, "couldn't leave the message for", to+":", err.Error())
+	}
+
+	l.mu.Lock()
+	mail, ok := l.mail[to]
+	l.mu.Unlock()
+	if ok {
+		select {
+		case mail <- struct{}{}:
+		default:
+			// the delivery is already awake
+		}
+	}
+
+	return s.Send("QUEUED", to, id)
+}
+
+// Handles an ACK request: the message is deleted (acknowledging a message twice does nothing).
+// Returns an error only if the connection with the client broke.
+func (l *Lobby) ack(s *hermes.Session, args []string) error {
+	if len(args) != 1 {
+		return s.Send("ERROR", "usage: ACK <id>")
+	}
+
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return s.Send("ERROR", "malformed id")
+	}
+
+	_, err = l.mailbox.Ack(s.Uname, id)
+	if err != nil {
+		fmt.Printf("[-] (%s) Couldn't delete message %d: %s\n", s.Uname, id, err)
+	}
+
+	return nil
+}
+
+// Delivers the messages left for the client, in order, whenever it's woken up (through mail), until the session ends.
+// Messages that aren't acknowledged are delivered again in the next session.
+func (l *Lobby) deliver(ctx context.Context, s *hermes.Session, mail chan struct{}) {
+	var last uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-mail:
+		}
+
+		name, err := l.mailbox.Name(s.Uname)
+		if err != nil {
+			fmt.Printf("[-] (%s) Couldn't read the mailbox: %s\n", s.Uname, err)
+			continue
+		}
+		pending, err := l.mailbox.Pending(s.Uname, last)
+		if err != nil {
+			fmt.Printf("[-] (%s) Couldn't read the mailbox: %s\n", s.Uname, err)
+			continue
+		}
+
+		for _, e := range pending {
+			err := s.Send("MSG", name, strconv.FormatUint(e.ID, 10), e.From, strconv.FormatInt(e.Received.Unix(), 10), hex.EncodeToString(e.Data))
+			if err != nil {
+				return
+			}
+			last = e.ID
+		}
+	}
+}
+
+// Handles a RELAY request: once the peer asks for it as well, both are told the relay is open.
+// Returns an error only if the connection with the client broke.
+func (l *Lobby) relay(s *hermes.Session, args []string) error {
+	if len(args) != 1 {
+		return s.Send("ERROR", "usage: RELAY <peer>")
+	}
+	peer := args[0]
+
+	if peer == s.Uname {
+		return s.Send("ERROR", "you can't connect to yourself")
+	}
+	ps := l.session(peer)
+	if ps == nil {
+		return s.Send("ERROR", peer, "is offline")
+	}
+
+	if !l.relays.Request(s.Uname, peer) {
+		return nil
+	}
+	fmt.Printf("[+] (%s) Relaying the connection with %s...\n", s.Uname, peer)
+
+	// the peer must know before anything is relayed to it
+	ps.Send("RELAYED", s.Uname)
+	return s.Send("RELAYED", peer)
+}
+
+// Handles a RELAY_DATA request, forwarding the data as it is (it's encrypted end-to-end) once the bandwidth limit allows it.
+// Returns an error only if the connection with the client broke.
+func (l *Lobby) relayData(s *hermes.Session, args []string) error {
+	if len(args) != 2 {
+		return s.Send("ERROR", "usage: RELAY_DATA <peer> <data>")
+	}
+	peer, data := args[0], args[1]
+
+	ps := l.session(peer)
+	wait, err := l.relays.Forward(s.Uname, peer, len(data)/2)
+	if err != nil || ps == nil {
+		return s.Send("RELAY_CLOSE", peer)
+	}
+	// the client waits along with its data, which keeps the order of the records
+	time.Sleep(wait)
+
+	err = ps.Send("RELAY_DATA", s.Uname, data)
+	if err != nil && l.relays.Close(s.Uname, peer) {
+		return s.Send("RELAY_CLOSE", peer)
+	}
+
+	return nil
+}
+
+// Tells uname that the relay with peer is closed.
+func (l *Lobby) hangUp(uname, peer string) {
+	if s := l.session(uname); s != nil {
+		s.Send("RELAY_CLOSE", peer)
+	}
+}
+
+// Serves the bind requests sent to the UDP side-channel of the server, until pc can't be read anymore.
+// Returns the reason it stopped.
+func (l *Lobby) ServeUDP(pc net.PacketConn) error {
+	return l.endpoints.Serve(pc)
+}
+
+// Handles a BIND request, handing out the token that ties the UDP endpoint of the client to its session.
+// Returns an error only if the connection with the client broke.
+func (l *Lobby) bind(s *hermes.Session) error {
+	token, err := l.endpoints.Token(s.Uname)
+	if err != nil {
+		return s.Send("ERROR", "couldn't bind:", err.Error())
+	}
+
+	return s.Send("BIND", hex.EncodeToString(token))
+}
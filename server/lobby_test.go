@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// A net.Conn with a made up remote address (the ones of net.Pipe() have no host and port).
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// Utility function, creates a Lobby whose prekeys and messages are kept only in memory.
+func newTestLobby(t *testing.T) *Lobby {
+	prekeys, err := NewPrekeyStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewLobby(prekeys, NewMailbox(""), hermes.RelayConfig{Bandwidth: hermes.RELAY_BANDWIDTH, IdleTimeout: hermes.RELAY_IDLE_TIMEOUT})
+}
+
+// Utility function, logs uname into the lobby (as if it had just authenticated).
+// Returns the client end of the session and a channel on which Serve() returns.
+func joinLobby(t *testing.T, l *Lobby, uname, ip string) (*hermes.Session, chan error) {
+	key := make([]byte, anubis.BYTE_SEC)
+	rand.Read(key)
+	nonce := make([]byte, 64)
+	rand.Read(nonce)
+
+	cipher, err := anubis.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher.UpdateNonce(nonce)
+
+	local, remote := net.Pipe()
+	addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+	server := hermes.NewSession(hermes.NewConn(addrConn{remote, addr}), cipher, hermes.SERVER, uname)
+	client := hermes.NewSession(hermes.NewConn(local), cipher, hermes.CLIENT, uname)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- l.Serve(server)
+	}()
+	t.Cleanup(func() { client.Close() })
+
+	// wait for the client to be registered
+	for i := 0; l.session(uname) == nil; i++ {
+		if i == 100 {
+			t.Fatal("the client never joined the lobby")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	return client, done
+}
+
+// Utility function, waits for the next message and checks its kind.
+func expect(t *testing.T, s *hermes.Session, kind string) []string {
+	fields, err := s.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) == 0 || fields[0] != kind {
+		t.Fatalf("expected a %s message, got %v", kind, fields)
+	}
+
+	return fields
+}
+
+// Tests that WHO lists the clients that are online.
+func Test_Lobby_who(t *testing.T) {
+	l := newTestLobby(t)
+	alice, _ := joinLobby(t, l, "alice", "10.0.0.1")
+	bob, bobDone := joinLobby(t, l, "bob", "10.0.0.2")
+
+	alice.Send("WHO")
+	users := expect(t, alice, "USERS")
+	if len(users) != 3 || users[1] != "alice" || users[2] != "bob" {
+		t.Fatalf("expected alice and bob to be online, got %v", users[1:])
+	}
+
+	bob.Close()
+	if err := <-bobDone; err != nil {
+		t.Fatal(err)
+	}
+
+	alice.Send("WHO")
+	users = expect(t, alice, "USERS")
+	if len(users) != 2 || users[1] != "alice" {
+		t.Fatalf("expected only alice to be online, got %v", users[1:])
+	}
+}
+
+// Tests the whole CONNECT exchange.
+func Test_Lobby_connect(t *testing.T) {
+	l := newTestLobby(t)
+	alice, _ := joinLobby(t, l, "alice", "10.0.0.1")
+	bob, _ := joinLobby(t, l, "bob", "10.0.0.2")
+
+	alice.Send("CONNECT", "bob", "5000")
+	invite := expect(t, bob, "INVITE")
+	if invite[1] != "alice" {
+		t.Fatalf("bob should be invited by alice, not %s", invite[1])
+	}
+
+	bob.Send("CONNECT", "alice", "6000")
+	ap := expect(t, alice, "PEER")
+	bp := expect(t, bob, "PEER")
+
+	if ap[1] != "bob" || ap[2] != hermes.PEER_LISTENER || ap[3] != "10.0.0.2:6000" {
+		t.Fatalf("wrong pairing for alice: %v", ap)
+	}
+	if bp[1] != "alice" || bp[2] != hermes.PEER_DIALER || bp[3] != "10.0.0.1:5000" {
+		t.Fatalf("wrong pairing for bob: %v", bp)
+	}
+	if ap[4] != bp[4] || len(ap[4]) != 64 {
+		t.Fatal("both peers should get the same 32 bytes (hex encoded) pairing key")
+	}
+}
+
+// Tests that invalid CONNECT requests are refused.
+func Test_Lobby_connectErrors(t *testing.T) {
+	l := newTestLobby(t)
+	alice, _ := joinLobby(t, l, "alice", "10.0.0.1")
+
+	for _, req := range [][]string{
+		{"CONNECT", "carol", "5000"},   // offline
+		{"CONNECT", "alice", "5000"},   // herself
+		{"CONNECT", "bob", "notaport"}, // bad port
+		{"CONNECT", "bob", "70000"},
+		{"CONNECT", "bob"},
+		{"DANCE"},
+	} {
+		alice.Send(req...)
+		expect(t, alice, "ERROR")
+	}
+}
+
+// Tests that a second login kicks out the first session.
+func Test_Lobby_relogin(t *testing.T) {
+	l := newTestLobby(t)
+	_, firstDone := joinLobby(t, l, "alice", "10.0.0.1")
+	second, _ := joinLobby(t, l, "alice", "10.0.0.3")
+
+	select {
+	case <-firstDone:
+	case <-time.After(time.Second):
+		t.Fatal("the first session should have been closed")
+	}
+
+	second.Send("WHO")
+	users := expect(t, second, "USERS")
+	if len(users) != 2 || users[1] != "alice" {
+		t.Fatalf("alice should still be online, got %v", users[1:])
+	}
+}
+
+// Utility function, starts the UDP side-channel of the lobby on loopback.
+// Returns its address.
+func serveUDP(t *testing.T, l *Lobby) net.Addr {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go l.ServeUDP(pc)
+
+	return pc.LocalAddr()
+}
+
+// Utility function, binds the UDP endpoint of a client through the lobby, as clients do.
+// Returns the UDP socket of the client.
+func bindEndpoint(t *testing.T, s *hermes.Session, server net.Addr) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	s.Send("BIND")
+	token, err := hex.DecodeString(expect(t, s, "BIND")[1])
+	if err != nil || len(token) != hermes.BIND_TOKEN_SIZE {
+		t.Fatal("malformed token", err)
+	}
+
+	// a request with a made up token is ignored
+	pc.WriteTo(append([]byte(hermes.BIND_MAGIC), make([]byte, hermes.BIND_TOKEN_SIZE)...), server)
+	pc.WriteTo(append([]byte(hermes.BIND_MAGIC), token...), server)
+	if e := expect(t, s, "ENDPOINT"); e[1] != pc.LocalAddr().String() {
+		t.Fatalf("expected endpoint %s, got %v", pc.LocalAddr(), e)
+	}
+
+	return pc
+}
+
+// Tests that clients learn the endpoint they're seen from, and that peers get each other's.
+func Test_Lobby_endpoints(t *testing.T) {
+	l := newTestLobby(t)
+	server := serveUDP(t, l)
+	alice, _ := joinLobby(t, l, "alice", "10.0.0.1")
+	bob, _ := joinLobby(t, l, "bob", "10.0.0.2")
+
+	apc := bindEndpoint(t, alice, server)
+	bpc := bindEndpoint(t, bob, server)
+
+	alice.Send("CONNECT", "bob", "5000")
+	expect(t, bob, "INVITE")
+	bob.Send("CONNECT", "alice", "6000")
+	if p := expect(t, alice, "PEER"); len(p) != 6 || p[5] != bpc.LocalAddr().String() {
+		t.Fatalf("alice should get the endpoint of bob: %v", p)
+	}
+	if p := expect(t, bob, "PEER"); len(p) != 6 || p[5] != apc.LocalAddr().String() {
+		t.Fatalf("bob should get the endpoint of alice: %v", p)
+	}
+
+	// carol has no endpoint, so neither gets one
+	carol, _ := joinLobby(t, l, "carol", "10.0.0.3")
+	alice.Send("CONNECT", "carol", "5001")
+	expect(t, carol, "INVITE")
+	carol.Send("CONNECT", "alice", "7000")
+	for _, s := range []*hermes.Session{alice, carol} {
+		if p := expect(t, s, "PEER"); len(p) != 6 || p[5] != "-" {
+			t.Fatalf("no endpoint should be handed out without both: %v", p)
+		}
+	}
+
+	// the endpoint is forgotten along with the client
+	bob.Close()
+	for i := 0; l.endpoints.Get("bob") != ""; i++ {
+		if i == 100 {
+			t.Fatal("the endpoint of bob should be forgotten")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Tests relaying the connection of two peers that can't reach each other directly.
+func Test_Lobby_relay(t *testing.T) {
+	l := newTestLobby(t)
+	alice, _ := joinLobby(t, l, "alice", "10.0.0.1")
+	bob, _ := joinLobby(t, l, "bob", "10.0.0.2")
+
+	// the addresses they get are unreachable, so both fall back to the relay
+	alice.Send("CONNECT", "bob", "5000")
+	expect(t, bob, "INVITE")
+	bob.Send("CONNECT", "alice", "6000")
+	expect(t, alice, "PEER")
+	expect(t, bob, "PEER")
+
+	alice.Send("RELAY_DATA", "bob", "00")
+	expect(t, alice, "RELAY_CLOSE")
+
+	alice.Send("RELAY", "bob")
+	bob.Send("RELAY", "alice")
+	if r := expect(t, alice, "RELAYED"); r[1] != "bob" {
+		t.Fatalf("wrong relay: %v", r)
+	}
+	if r := expect(t, bob, "RELAYED"); r[1] != "alice" {
+		t.Fatalf("wrong relay: %v", r)
+	}
+
+	for _, c := range []struct {
+		from, to         *hermes.Session
+		fromName, toName string
+		data             string
+	}{
+		{alice, bob, "alice", "bob", "0102"},
+		{bob, alice, "bob", "alice", "abcdef"},
+		{alice, bob, "alice", "bob", "ff"},
+	} {
+		c.from.Send("RELAY_DATA", c.toName, c.data)
+		if d := expect(t, c.to, "RELAY_DATA"); d[1] != c.fromName || d[2] != c.data {
+			t.Fatalf("wrong data: %v", d)
+		}
+	}
+
+	bob.Send("RELAY_CLOSE", "alice")
+	if c := expect(t, alice, "RELAY_CLOSE"); c[1] != "bob" {
+		t.Fatalf("wrong relay closed: %v", c)
+	}
+	alice.Send("RELAY_DATA", "bob", "00")
+	expect(t, alice, "RELAY_CLOSE")
+
+	// a relay is closed when one of its ends leaves
+	alice.Send("RELAY", "bob")
+	bob.Send("RELAY", "alice")
+	expect(t, alice, "RELAYED")
+	expect(t, bob, "RELAYED")
+	bob.Close()
+	if c := expect(t, alice, "RELAY_CLOSE"); c[1] != "bob" {
+		t.Fatalf("wrong relay closed: %v", c)
+	}
+}
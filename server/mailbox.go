@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mowzhja/harpocrates/server/coeus"
+)
+
+// The most messages that can wait for a single user.
+const MAX_QUEUED_MESSAGES = 500
+
+// The most bytes of messages that can wait for a single user.
+const MAX_QUEUED_BYTES = 8 << 20
+
+// The largest message that can be left for a user.
+const MAX_ENVELOPE_SIZE = 256 << 10
+
+// The longest name the outbox of a sender can have.
+const MAX_OUTBOX_NAME = 64
+
+// How long a message waits for its recipient before being thrown away.
+const MESSAGE_TTL = 14 * 24 * time.Hour
+
+// Returned when there's no room left for a user's messages.
+var ErrMailboxFull = errors.New("mailbox full")
+
+// Returned when a sender leaves a message it had already left (say, because the connection dropped before it heard it was).
+var ErrAlreadyQueued = errors.New("message already left")
+
+// The Mailbox keeps the (end-to-end encrypted) messages left for users while they're offline, until they acknowledge them.
+type Mailbox struct {
+	mu    sync.Mutex
+	dir   string // where the messages are kept ("" to keep them only in memory)
+	boxes map[string]*coeus.MailboxRecord
+}
+
+// Creates a Mailbox, keeping the messages in dir ("" to keep them only in memory).
+func NewMailbox(dir string) *Mailbox {
+	return &Mailbox{
+		dir:   dir,
+		boxes: make(map[string]*coeus.MailboxRecord),
+	}
+}
+
+// Leaves a message from from to to.
+// Returns the id of the message and an error (ErrMailboxFull if to has too many messages waiting).
+func (m *Mailbox) Put(to, from string, data []byte) (uint64, error) {
+	return m.PutOnce(to, from, "", 0, data)
+}
+
+// Leaves a message from from to to, like Put(), unless from already left it: sent is the id the message has in the outbox of the sender,
+// where ids grow with every message (0 to skip the check). A sender that lost its outbox starts a new one, whose ids start over.
+// Returns the id of the message and an error (ErrAlreadyQueued if it was left already, ErrMailboxFull if to has too many messages waiting).
+func (m *Mailbox) PutOnce(to, from, outbox string, sent uint64, data []byte) (uint64, error) {
+	if len(data) == 0 || len(data) > MAX_ENVELOPE_SIZE {
+		return 0, errors.New("invalid message size")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	box, err := m.box(to)
+	if err != nil {
+		return 0, err
+	}
+	// the message may well have been delivered (and acknowledged) since
+	last := box.Senders[from]
+	if sent != 0 && outbox == last.Outbox && sent <= last.ID {
+		return 0, ErrAlreadyQueued
+	}
+	expired := m.expire(box)
+
+	size := len(data)
+	for _, e := range box.Envelopes {
+		size += len(e.Data)
+	}
+	if len(box.Envelopes) >= MAX_QUEUED_MESSAGES || size > MAX_QUEUED_BYTES {
+		if expired {
+			m.save(to, box)
+		}
+		return 0, ErrMailboxFull
+	}
+
+	id := box.NextID
+	box.NextID++
+	box.Envelopes = append(box.Envelopes, coeus.Envelope{ID: id, From: from, Received: time.Now(), Data: data})
+	if sent != 0 {
+		if box.Senders == nil {
+			box.Senders = make(map[string]coeus.Sent)
+		}
+		box.Senders[from] = coeus.Sent{Outbox: outbox, ID: sent}
+	}
+
+	err = m.save(to, box)
+	if err != nil {
+		box.Envelopes = box.Envelopes[:len(box.Envelopes)-1]
+		if sent != 0 {
+			box.Senders[from] = last
+		}
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Returns the messages waiting for uname with an id greater than after, in the order they were left, and an error.
+func (m *Mailbox) Pending(uname string, after uint64) ([]coeus.Envelope, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	box, err := m.box(uname)
+	if err != nil {
+		return nil, err
+	}
+	if m.expire(box) {
+		err = m.save(uname, box)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var pending []coeus.Envelope
+	for _, e := range box.Envelopes {
+		if e.ID > after {
+			pending = append(pending, e)
+		}
+	}
+
+	return pending, nil
+}
+
+// Returns the name of the mailbox of uname, which changes only if the mailbox is lost (the ids of its messages start over then), and an error.
+func (m *Mailbox) Name(uname string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	box, err := m.box(uname)
+	if err != nil {
+		return "", err
+	}
+
+	return box.Name, nil
+}
+
+// Deletes the message with the given id, now that uname got it (acknowledging a message twice does nothing).
+// Returns whether the message was there and an error.
+func (m *Mailbox) Ack(uname string, id uint64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	box, err := m.box(uname)
+	if err != nil {
+		return false, err
+	}
+
+	for i, e := range box.Envelopes {
+		if e.ID == id {
+			box.Envelopes = append(box.Envelopes[:i], box.Envelopes[i+1:]...)
+			return true, m.save(uname, box)
+		}
+	}
+
+	return false, nil
+}
+
+// Throws away the expired messages of every user, including the ones who never came back.
+// Returns an error.
+func (m *Mailbox) Expire() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	unames := make(map[string]bool)
+	for uname := range m.boxes {
+		unames[uname] = true
+	}
+	if m.dir != "" {
+		stored, err := coeus.ListMailboxes(m.dir)
+		if err != nil {
+			return err
+		}
+		for _, uname := range stored {
+			unames[uname] = true
+		}
+	}
+
+	for uname := range unames {
+		box, err := m.box(uname)
+		if err != nil {
+			return err
+		}
+		if m.expire(box) {
+			err = m.save(uname, box)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the mailbox of uname, loading it if needed (m.mu must be held).
+func (m *Mailbox) box(uname string) (*coeus.MailboxRecord, error) {
+	if box, ok := m.boxes[uname]; ok {
+		return box, nil
+	}
+
+	box := coeus.MailboxRecord{NextID: 1}
+	if m.dir != "" {
+		var err error
+		box, err = coeus.GetMailbox(m.dir, uname)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if box.Name == "" {
+		name := make([]byte, 16)
+		_, err := rand.Read(name)
+		if err != nil {
+			return nil, err
+		}
+		box.Name = hex.EncodeToString(name)
+
+		// the messages already there must keep the name they're delivered with (an empty mailbox gets it saved with its first message)
+		if len(box.Envelopes) > 0 {
+			err = m.save(uname, &box)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	m.boxes[uname] = &box
+
+	return &box, nil
+}
+
+// Throws away the expired messages of a mailbox (m.mu must be held).
+// Returns whether any message was thrown away.
+func (m *Mailbox) expire(box *coeus.MailboxRecord) bool {
+	var kept []coeus.Envelope
+	for _, e := range box.Envelopes {
+		if time.Since(e.Received) < MESSAGE_TTL {
+			kept = append(kept, e)
+		}
+	}
+
+	expired := len(kept) != len(box.Envelopes)
+	box.Envelopes = kept
+
+	return expired
+}
+
+// Writes the mailbox of uname to disk (m.mu must be held).
+func (m *Mailbox) save(uname string, box *coeus.MailboxRecord) error {
+	if m.dir == "" {
+		return nil
+	}
+
+	return coeus.SaveMailbox(m.dir, uname, *box)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that the messages are handed out in order and survive a restart, until they're acknowledged.
+func Test_Mailbox_persistence(t *testing.T) {
+	dir := t.TempDir()
+	m := NewMailbox(dir)
+
+	for i := 1; i <= 3; i++ {
+		id, err := m.Put("bob", "alice", []byte(fmt.Sprint("message ", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != uint64(i) {
+			t.Fatalf("expected id %d, got %d", i, id)
+		}
+	}
+	if ok, err := m.Ack("bob", 1); !ok || err != nil {
+		t.Fatal("message 1 should have been deleted", err)
+	}
+
+	// restart
+	m = NewMailbox(dir)
+	pending, err := m.Pending("bob", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].ID != 2 || string(pending[1].Data) != "message 3" || pending[1].From != "alice" {
+		t.Fatalf("wrong messages after the restart: %+v", pending)
+	}
+	if pending, _ := m.Pending("bob", 2); len(pending) != 1 || pending[0].ID != 3 {
+		t.Fatal("only message 3 comes after message 2")
+	}
+
+	// ids aren't reused
+	id, _ := m.Put("bob", "alice", []byte("message 4"))
+	if id != 4 {
+		t.Fatalf("expected id 4, got %d", id)
+	}
+	if pending, _ := m.Pending("carol", 0); len(pending) != 0 {
+		t.Fatal("nothing was left for carol")
+	}
+}
+
+// Tests that a message left again by its sender is kept only once, even after it was acknowledged.
+func Test_Mailbox_PutOnce(t *testing.T) {
+	m := NewMailbox(t.TempDir())
+
+	for _, sent := range []uint64{1, 2} {
+		if _, err := m.PutOnce("bob", "alice", "a1", sent, []byte(fmt.Sprint("message ", sent))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.PutOnce("bob", "alice", "a1", 2, []byte("message 2")); err != ErrAlreadyQueued {
+		t.Fatal("expected the message to be left already, got", err)
+	}
+	// the ids of carol are their own
+	if _, err := m.PutOnce("bob", "carol", "a1", 1, []byte("from carol")); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Ack("bob", 1)
+	m.Ack("bob", 2)
+	// the mailbox remembers across restarts
+	m = NewMailbox(m.dir)
+	if _, err := m.PutOnce("bob", "alice", "a1", 1, []byte("message 1")); err != ErrAlreadyQueued {
+		t.Fatal("expected the acknowledged message to be left already, got", err)
+	}
+	if _, err := m.PutOnce("bob", "alice", "a1", 3, []byte("message 3")); err != nil {
+		t.Fatal(err)
+	}
+	pending, _ := m.Pending("bob", 0)
+	if len(pending) != 2 || string(pending[0].Data) != "from carol" || string(pending[1].Data) != "message 3" {
+		t.Fatalf("wrong messages: %+v", pending)
+	}
+}
+
+// Tests that a mailbox keeps its name across restarts, and that one which was lost (or only ever in memory) gets a new one.
+func Test_Mailbox_Name(t *testing.T) {
+	dir := t.TempDir()
+	m := NewMailbox(dir)
+	if _, err := m.Put("bob", "alice", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	name, err := m.Name("bob")
+	if err != nil || name == "" {
+		t.Fatal("expected the mailbox to have a name, got", name, err)
+	}
+
+	if again, _ := NewMailbox(dir).Name("bob"); again != name {
+		t.Fatalf("the mailbox was named %s, then %s", name, again)
+	}
+	if other, _ := NewMailbox(t.TempDir()).Name("bob"); other == name {
+		t.Fatal("a new mailbox has the name of the lost one")
+	}
+	if other, _ := NewMailbox("").Name("bob"); other == name {
+		t.Fatal("a mailbox kept in memory has the name of the lost one")
+	}
+}
+
+// Tests that a sender which lost its outbox isn't taken to send its old messages again: the ids of a new outbox start over.
+func Test_Mailbox_PutOnce_newOutbox(t *testing.T) {
+	m := NewMailbox(t.TempDir())
+
+	for _, sent := range []uint64{1, 2, 3} {
+		if _, err := m.PutOnce("bob", "alice", "a1", sent, []byte(fmt.Sprint("message ", sent))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Ack("bob", 1)
+	m.Ack("bob", 2)
+	m.Ack("bob", 3)
+
+	m = NewMailbox(m.dir)
+	if _, err := m.PutOnce("bob", "alice", "b2", 1, []byte("first of the new outbox")); err != nil {
+		t.Fatal("expected the message of the new outbox to be left, got", err)
+	}
+	if _, err := m.PutOnce("bob", "alice", "b2", 1, []byte("first of the new outbox")); err != ErrAlreadyQueued {
+		t.Fatal("expected the message to be left already, got", err)
+	}
+	pending, _ := m.Pending("bob", 0)
+	if len(pending) != 1 || string(pending[0].Data) != "first of the new outbox" {
+		t.Fatalf("wrong messages: %+v", pending)
+	}
+}
+
+// Tests that a mailbox doesn't take more than its share, in number of messages and in bytes.
+func Test_Mailbox_quota(t *testing.T) {
+	m := NewMailbox("")
+
+	for i := 0; i < MAX_QUEUED_MESSAGES; i++ {
+		if _, err := m.Put("bob", "alice", []byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.Put("bob", "alice", []byte("one too many")); err != ErrMailboxFull {
+		t.Fatal("the mailbox should be full", err)
+	}
+	// room is made by acknowledging
+	m.Ack("bob", 1)
+	if _, err := m.Put("bob", "alice", []byte("now it fits")); err != nil {
+		t.Fatal(err)
+	}
+
+	big := make([]byte, MAX_ENVELOPE_SIZE)
+	for i := 0; i < MAX_QUEUED_BYTES/MAX_ENVELOPE_SIZE; i++ {
+		if _, err := m.Put("carol", "alice", big); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.Put("carol", "alice", []byte("x")); err != ErrMailboxFull {
+		t.Fatal("the mailbox should be full", err)
+	}
+
+	if _, err := m.Put("dave", "alice", make([]byte, MAX_ENVELOPE_SIZE+1)); err == nil || err == ErrMailboxFull {
+		t.Fatal("a message that's too large should be refused")
+	}
+	if _, err := m.Put("dave", "alice", nil); err == nil {
+		t.Fatal("an empty message should be refused")
+	}
+}
+
+// Tests that old messages are thrown away, both when the recipient comes back and by the periodic sweep.
+func Test_Mailbox_expiry(t *testing.T) {
+	dir := t.TempDir()
+	m := NewMailbox(dir)
+
+	for _, uname := range []string{"bob", "carol"} {
+		m.Put(uname, "alice", []byte("old"))
+		m.Put(uname, "alice", []byte("new"))
+		m.boxes[uname].Envelopes[0].Received = time.Now().Add(-MESSAGE_TTL - time.Minute)
+		m.save(uname, m.boxes[uname])
+	}
+
+	pending, err := m.Pending("bob", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || string(pending[0].Data) != "new" {
+		t.Fatalf("the old message should be gone: %+v", pending)
+	}
+
+	// carol never comes back, and the server restarts in the meanwhile
+	m = NewMailbox(dir)
+	if err := m.Expire(); err != nil {
+		t.Fatal(err)
+	}
+	m = NewMailbox(dir)
+	if pending, _ := m.Pending("carol", 0); len(pending) != 1 || string(pending[0].Data) != "new" {
+		t.Fatalf("the old message should be gone: %+v", pending)
+	}
+}
+
+// Tests that acknowledging a message twice (or one that never existed) does nothing.
+func Test_Mailbox_duplicateAck(t *testing.T) {
+	m := NewMailbox("")
+	m.Put("bob", "alice", []byte("first"))
+	m.Put("bob", "alice", []byte("second"))
+
+	if ok, _ := m.Ack("bob", 1); !ok {
+		t.Fatal("message 1 should have been deleted")
+	}
+	for _, id := range []uint64{1, 1, 7} {
+		if ok, err := m.Ack("bob", id); ok || err != nil {
+			t.Fatalf("message %d isn't there anymore: %v %v", id, ok, err)
+		}
+	}
+	if ok, _ := m.Ack("carol", 2); ok {
+		t.Fatal("message 2 was for bob")
+	}
+
+	pending, _ := m.Pending("bob", 0)
+	if len(pending) != 1 || string(pending[0].Data) != "second" {
+		t.Fatalf("message 2 should still be there: %+v", pending)
+	}
+}
+
+// Tests leaving messages through the lobby: they're delivered in order when the recipient joins, right away while it's online, and again until acknowledged.
+func Test_Lobby_mailbox(t *testing.T) {
+	l := newTestLobby(t)
+	alice, _ := joinLobby(t, l, "alice", "10.0.0.1")
+
+	// bob can't get messages before publishing prekeys
+	alice.Send("SEND", "bob", "a1", "1", "00")
+	if refused := expect(t, alice, "NOT_QUEUED"); len(refused) < 4 || refused[3] != NOT_QUEUED_REFUSED {
+		t.Fatalf("sending it again can't work: %v", refused)
+	}
+	publish(t, l.prekeys, "bob", time.Now())
+
+	for i := 0; i < 3; i++ {
+		alice.Send("SEND", "bob", "a1", fmt.Sprint(i+2), hex.EncodeToString([]byte{byte(i)}))
+		if queued := expect(t, alice, "QUEUED"); len(queued) != 3 || queued[2] != fmt.Sprint(i+2) {
+			t.Fatalf("wrong acknowledgement: %v", queued)
+		}
+	}
+	// sent again, say after reconnecting without hearing back
+	alice.Send("SEND", "bob", "a1", "4", hex.EncodeToString([]byte{2}))
+	expect(t, alice, "QUEUED")
+	alice.Send("SEND", "bob", "a1", "5", "nothex")
+	if refused := expect(t, alice, "NOT_QUEUED"); len(refused) < 4 || refused[3] != NOT_QUEUED_REFUSED {
+		t.Fatalf("sending it again can't work: %v", refused)
+	}
+	alice.Send("SEND", "bob", "a1", "0", "00")
+	expect(t, alice, "ERROR")
+	alice.Send("SEND", "bob", strings.Repeat("a", MAX_OUTBOX_NAME+1), "7", "00")
+	expect(t, alice, "ERROR")
+
+	bob, _ := joinLobby(t, l, "bob", "10.0.0.2")
+	var mailbox string
+	for i := 0; i < 3; i++ {
+		msg := expect(t, bob, "MSG")
+		if len(msg) != 6 || msg[2] != fmt.Sprint(i+1) || msg[3] != "alice" || msg[5] != hex.EncodeToString([]byte{byte(i)}) {
+			t.Fatalf("wrong message: %v", msg)
+		}
+		mailbox = msg[1]
+	}
+	bob.Send("ACK", "1")
+	bob.Send("ACK", "1")
+	bob.Send("ACK", "3")
+
+	// bob is online, so it gets this right away
+	alice.Send("SEND", "bob", "a1", "6", "ff")
+	expect(t, alice, "QUEUED")
+	if msg := expect(t, bob, "MSG"); msg[2] != "4" || msg[5] != "ff" {
+		t.Fatalf("wrong message: %v", msg)
+	}
+
+	// what wasn't acknowledged comes again with the next session
+	bob.Close()
+	for i := 0; l.session("bob") != nil; i++ {
+		if i == 100 {
+			t.Fatal("bob never left the lobby")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	bob, _ = joinLobby(t, l, "bob", "10.0.0.2")
+	for _, id := range []string{"2", "4"} {
+		if msg := expect(t, bob, "MSG"); msg[1] != mailbox || msg[2] != id {
+			t.Fatalf("expected message %s of mailbox %s, got %v", id, mailbox, msg)
+		}
+	}
+}
+
+// Tests that the messages of a client that lost its outbox (and starts its ids over) are still delivered.
+func Test_Lobby_mailbox_newOutbox(t *testing.T) {
+	l := newTestLobby(t)
+	alice, _ := joinLobby(t, l, "alice", "10.0.0.1")
+	publish(t, l.prekeys, "bob", time.Now())
+	bob, _ := joinLobby(t, l, "bob", "10.0.0.2")
+
+	for _, outbox := range []string{"a1", "b2"} {
+		for _, id := range []string{"1", "2"} {
+			alice.Send("SEND", "bob", outbox, id, hex.EncodeToString([]byte(outbox+id)))
+			if queued := expect(t, alice, "QUEUED"); queued[2] != id {
+				t.Fatalf("wrong acknowledgement: %v", queued)
+			}
+			msg := expect(t, bob, "MSG")
+			if msg[5] != hex.EncodeToString([]byte(outbox+id)) {
+				t.Fatalf("expected message %s of outbox %s, got %v", id, outbox, msg)
+			}
+			bob.Send("ACK", msg[2])
+		}
+	}
+}
@@ -4,16 +4,30 @@ import (
 	"flag"
 	"fmt"
 	"net"
+	"os"
 	"strings"
+	"time"
 
-	"github.com/mowzhja/harpocrates/server/cerberus"
-	"github.com/mowzhja/harpocrates/server/hermes"
-	"github.com/mowzhja/harpocrates/server/seshat"
+	"github.com/mowzhja/harpocrates/harpocrates/cerberus"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+	"github.com/mowzhja/harpocrates/harpocrates/seshat"
+	"github.com/mowzhja/harpocrates/server/coeus"
 )
 
 func main() {
 	ip := flag.String("ip", "127.0.0.1", "ip address of the server")
 	port := flag.String("port", "9001", "server port")
+	prekeysFile := flag.String("prekeys", coeus.PREKEYS_FILE, "where the prekeys published by the users are kept")
+	mailboxDir := flag.String("mailboxes", coeus.MAILBOX_DIR, "where the messages left for offline users are kept")
+	relayBandwidth := flag.Int("relay-bandwidth", hermes.RELAY_BANDWIDTH, "bytes per second each relayed connection can use (0 for no limit)")
+	relayIdle := flag.Duration("relay-idle", hermes.RELAY_IDLE_TIMEOUT, "how long a relayed connection lasts without traffic (0 for no limit)")
+	ticketLifetime := flag.Duration("ticket-lifetime", cerberus.TICKET_LIFETIME, "how long the clients can resume their sessions without logging in again")
+	ticketUses := flag.Int("ticket-uses", cerberus.TICKET_MAX_USES, "how many times each resumption ticket can be used")
+	handshakeTimeout := flag.Duration("handshake-timeout", hermes.HANDSHAKE_TIMEOUT, "how long a client can take to log in (0 for no limit)")
+	keepalive := flag.Duration("keepalive", hermes.DEFAULT_TIMEOUTS.Keepalive, "how long the server stays silent before sending a client a keepalive (0 for none)")
+	idleTimeout := flag.Duration("idle-timeout", hermes.DEFAULT_TIMEOUTS.Idle, "how long a client can stay silent before it's taken for dead (0 for no limit)")
+	writeTimeout := flag.Duration("write-timeout", hermes.DEFAULT_TIMEOUTS.Write, "how long a message to a client can take to be sent (0 for no limit)")
+	flag.Parse()
 
 	var address strings.Builder
 	address.WriteString(*ip)
@@ -25,29 +39,61 @@ func main() {
 
 	fmt.Println("[+] Started listener at", address.String())
 
+	prekeys, err := NewPrekeyStore(*prekeysFile)
+	seshat.HandleErr(err)
+
+	mailbox := NewMailbox(*mailboxDir)
+	go func() {
+		for range time.Tick(time.Hour) {
+			err := mailbox.Expire()
+			if err != nil {
+				fmt.Println("[-] Couldn't throw away the expired messages:", err)
+			}
+		}
+	}()
+
+	users := cerberus.UsersFile(cerberus.DB_FILE)
+	// the keys of the tickets live in memory only: once the server restarts, the clients log in again
+	tickets := cerberus.NewTickets(*ticketLifetime, *ticketUses, nil)
+	timeouts := hermes.Timeouts{Keepalive: *keepalive, Idle: *idleTimeout, Write: *writeTimeout}
+	lobby := NewLobby(prekeys, mailbox, hermes.RelayConfig{Bandwidth: *relayBandwidth, IdleTimeout: *relayIdle})
+	// next to the listener, the clients learn the UDP endpoints they're seen from
+	pc, err := net.ListenPacket("udp", address.String())
+	seshat.HandleErr(err)
+	go func() {
+		err := lobby.ServeUDP(pc)
+		fmt.Println("[-] The UDP side-channel stopped:", err)
+	}()
+
 	for {
 		conn, err := listener.Accept()
 		seshat.HandleErr(err)
 
-		go handleClient(conn)
+		go handleClient(hermes.NewConn(conn), lobby, users, tickets, *handshakeTimeout, timeouts)
 	}
 }
 
-func handleClient(conn net.Conn) {
-	sharedKey, err := hermes.DoECDHE(conn)
-	if err != nil {
-		conn.Close()
-		return
-	}
+// Authenticates the client on conn against users (or resumes its session with one of tickets) within handshakeTimeout, then lets it into the lobby.
+// The session follows timeouts: a client that stops sending keepalives is dropped.
+func handleClient(conn net.Conn, lobby *Lobby, users cerberus.Credentials, tickets *cerberus.Tickets, handshakeTimeout time.Duration, timeouts hermes.Timeouts) {
+	defer conn.Close()
 
-	_, err = cerberus.DoMutualAuth(conn, sharedKey)
+	// a client that stalls in the middle of the handshake mustn't keep its goroutine and its socket forever
+	if handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	}
+	cipher, uname, err := cerberus.DoMutualAuthWith(conn, users, &cerberus.Config{Tickets: tickets, Log: os.Stdout})
 	if err != nil {
-		conn.Close()
 		return
 	}
+	conn.SetDeadline(time.Time{})
 
-	conn.Close()
+	s := hermes.NewSession(conn, cipher, hermes.SERVER, uname)
+	s.SetTimeouts(timeouts)
+	defer s.Close()
 
-	// err = hermes.ConnectPeers(conn, cipher)
-	// seshat.HandleErr(err)
+	err = lobby.Serve(s)
+	if err != nil {
+		fmt.Printf("[-] (%s) Connection lost: %s\n", uname, err)
+	}
 }
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/harpocrates/cerberus"
+	"github.com/mowzhja/harpocrates/harpocrates/hermes"
+)
+
+// What the harness does with every record on its way between a client and the server (the i-th one in its direction).
+// Returns the records to deliver in its place: none to drop it, different ones to tamper with it (it can also take its time, to delay it).
+type hook func(toServer bool, i int, record []byte) [][]byte
+
+// A server running in process, with its users in memory, that the clients reach through a proxy which lets a hook get in the way of the records.
+type harness struct {
+	t       *testing.T
+	addr    string
+	hook    hook
+	timeout time.Duration // how long a login can take
+}
+
+// Utility function, starts a harness on an ephemeral port of the loopback, with alice (whose password is alicespass) and bob (bobspass) as users.
+// hook can be nil, to leave the records alone.
+func newHarness(t *testing.T, h hook) *harness {
+	t.Helper()
+
+	return newTimedHarness(t, h, hermes.HANDSHAKE_TIMEOUT, hermes.DEFAULT_TIMEOUTS)
+}
+
+// Utility function, starts a harness like newHarness(), whose server gives up on a handshake after handshakeTimeout and follows timeouts once the clients are in.
+func newTimedHarness(t *testing.T, h hook, handshakeTimeout time.Duration, timeouts hermes.Timeouts) *harness {
+	t.Helper()
+
+	users, err := cerberus.MemoryUsers(cerberus.VECTORS_KDF, map[string]string{"alice": "alicespass", "bob": "bobspass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	tickets := cerberus.NewTickets(0, 0, nil)
+	hs := &harness{t: t, addr: listener.Addr().String(), hook: h, timeout: 5 * time.Second}
+	lobby := newTestLobby(t)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			local, remote := net.Pipe()
+			go handleClient(hermes.NewConn(addrConn{remote, conn.RemoteAddr()}), lobby, users, tickets, handshakeTimeout, timeouts)
+			go hs.forward(conn, local, true)
+			go hs.forward(local, conn, false)
+		}
+	}()
+
+	return hs
+}
+
+// Utility function, passes the records read from src on to dst, through the hook, until either of them is closed.
+func (hs *harness) forward(src, dst net.Conn, toServer bool) {
+	defer src.Close()
+	defer dst.Close()
+
+	conn := hermes.NewConn(src)
+	for i := 0; ; i++ {
+		record, _, err := hermes.Read(conn)
+		if err != nil {
+			return
+		}
+
+		deliver := [][]byte{record}
+		if hs.hook != nil {
+			deliver = hs.hook(toServer, i, record)
+		}
+		for _, r := range deliver {
+			if _, err := hermes.Write(dst, r); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Utility function, logs in as uname through the harness, the way the client does.
+// Returns the session with the server and an error.
+func (hs *harness) login(uname, passwd string) (*hermes.Session, error) {
+	s, _, err := hs.connect(uname, func(conn net.Conn) (anubis.Cipher, *cerberus.Ticket, error) {
+		return cerberus.LoginWithServer(conn, []byte(uname), []byte(passwd), &cerberus.Config{KDF: cerberus.VECTORS_KDF})
+	})
+
+	return s, err
+}
+
+// Utility function, connects to the harness and authenticates as uname with auth.
+// Returns the session with the server, the ticket it issued and an error.
+func (hs *harness) connect(uname string, auth func(conn net.Conn) (anubis.Cipher, *cerberus.Ticket, error)) (*hermes.Session, *cerberus.Ticket, error) {
+	conn, err := net.DialTimeout("tcp", hs.addr, hs.timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn = hermes.NewConn(conn)
+	hs.t.Cleanup(func() { conn.Close() })
+
+	conn.SetDeadline(time.Now().Add(hs.timeout))
+	cipher, ticket, err := auth(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return hermes.NewSession(conn, cipher, hermes.CLIENT, uname), ticket, nil
+}
+
+// Tests that real clients log in and get to use the lobby.
+func Test_handleClient(t *testing.T) {
+	hs := newHarness(t, nil)
+
+	alice, err := hs.login("alice", "alicespass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := hs.login("bob", "bobspass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob.Send("WHO")
+	users := expect(t, bob, "USERS")
+	if len(users) != 3 || users[1] != "alice" || users[2] != "bob" {
+		t.Fatalf("expected alice and bob to be online, got %v", users[1:])
+	}
+
+	alice.Close()
+	for i := 0; ; i++ {
+		bob.Send("WHO")
+		if users = expect(t, bob, "USERS"); len(users) == 2 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("alice should have left, got %v", users[1:])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Tests that a client resumes its session with the ticket of its last login, and only once.
+func Test_handleClient_resumed(t *testing.T) {
+	hs := newHarness(t, nil)
+
+	alice, ticket, err := hs.connect("alice", func(conn net.Conn) (anubis.Cipher, *cerberus.Ticket, error) {
+		return cerberus.LoginWithServer(conn, []byte("alice"), []byte("alicespass"), &cerberus.Config{KDF: cerberus.VECTORS_KDF})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.Close()
+
+	resume := func(conn net.Conn) (anubis.Cipher, *cerberus.Ticket, error) {
+		return cerberus.ResumeWithServer(conn, ticket, nil)
+	}
+	alice, next, err := hs.connect("alice", resume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == nil {
+		t.Fatal("expected a new ticket")
+	}
+	alice.Send("WHO")
+	if users := expect(t, alice, "USERS"); len(users) != 2 || users[1] != "alice" {
+		t.Fatalf("expected alice to be online, got %v", users[1:])
+	}
+
+	if _, _, err := hs.connect("alice", resume); !errors.Is(err, cerberus.ErrTicketRejected) {
+		t.Fatalf("expected the used ticket to be rejected, got %v", err)
+	}
+}
+
+// Tests that the wrong password, or a user that doesn't exist, are refused.
+func Test_handleClient_refused(t *testing.T) {
+	hs := newHarness(t, nil)
+
+	for _, user := range [][2]string{{"alice", "bobspass"}, {"mallory", "alicespass"}} {
+		if _, err := hs.login(user[0], user[1]); !errors.Is(err, cerberus.ErrAuthFailed) {
+			t.Fatalf("%s: expected ErrAuthFailed, got %v", user[0], err)
+		}
+	}
+}
+
+// Tests that tampering with any record of the handshake (key, name, proof and CLIENT_OK one way, key, challenge, SERVER_OK and signature the other) keeps the client out.
+func Test_handleClient_tampered(t *testing.T) {
+	for _, toServer := range []bool{true, false} {
+		for n := 0; n < 4; n++ {
+			toServer, n := toServer, n
+			hs := newHarness(t, func(ts bool, i int, record []byte) [][]byte {
+				if ts != toServer || i != n {
+					return [][]byte{record}
+				}
+				tampered := append([]byte{}, record...)
+				tampered[len(tampered)-1] ^= 1
+				return [][]byte{tampered}
+			})
+
+			s, err := hs.login("alice", "alicespass")
+			if err != nil {
+				continue
+			}
+			// the client can't know whether its CLIENT_OK got there untouched: the server has to hang up on it
+			if !toServer || n != 3 {
+				t.Fatalf("record %d (to the server: %v): the tampered handshake should fail", n, toServer)
+			}
+			s.Send("WHO")
+			if fields, err := s.Receive(); err == nil {
+				t.Fatalf("the server let the client in: %v", fields)
+			}
+		}
+	}
+}
+
+// Tests that a record that never gets there makes the login fail, rather than hang.
+func Test_handleClient_dropped(t *testing.T) {
+	for _, toServer := range []bool{true, false} {
+		toServer := toServer
+		hs := newHarness(t, func(ts bool, i int, record []byte) [][]byte {
+			if ts == toServer && i == 1 {
+				return nil
+			}
+			return [][]byte{record}
+		})
+		hs.timeout = 500 * time.Millisecond
+
+		if _, err := hs.login("alice", "alicespass"); err == nil {
+			t.Fatalf("the login should fail when a record is dropped (to the server: %v)", toServer)
+		}
+	}
+}
+
+// Tests that slow records in both directions only slow the login down.
+func Test_handleClient_delayed(t *testing.T) {
+	hs := newHarness(t, func(toServer bool, i int, record []byte) [][]byte {
+		time.Sleep(20 * time.Millisecond)
+		return [][]byte{record}
+	})
+
+	s, err := hs.login("alice", "alicespass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Send("WHO")
+	expect(t, s, "USERS")
+}
+
+// Tests that the server hangs up on a client that stops responding in the middle of the handshake, or once it's in,
+// and that a client sending keepalives stays in however long it's silent.
+func Test_handleClient_stalled(t *testing.T) {
+	// the second record of the client never gets there
+	hs := newTimedHarness(t, func(toServer bool, i int, record []byte) [][]byte {
+		if toServer && i == 1 {
+			return nil
+		}
+		return [][]byte{record}
+	}, 200*time.Millisecond, hermes.Timeouts{})
+
+	start := time.Now()
+	if _, err := hs.login("alice", "alicespass"); err == nil {
+		t.Fatal("the login should fail when the client stalls")
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Fatalf("the server hung up on the stalled client after %s", waited)
+	}
+
+	hs = newTimedHarness(t, nil, time.Second, hermes.Timeouts{Keepalive: 20 * time.Millisecond, Idle: 100 * time.Millisecond})
+	alice, err := hs.login("alice", "alicespass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.SetTimeouts(hermes.Timeouts{Keepalive: 20 * time.Millisecond})
+	// bob never sends a keepalive
+	bob, err := hs.login("bob", "bobspass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start = time.Now()
+	for {
+		if _, err := bob.Receive(); err != nil {
+			break
+		}
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Fatalf("the server dropped the silent client after %s", waited)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	alice.Send("WHO")
+	if users := expect(t, alice, "USERS"); len(users) != 2 || users[1] != "alice" {
+		t.Fatalf("expected only alice to be online, got %v", users[1:])
+	}
+}
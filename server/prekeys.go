@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/server/coeus"
+)
+
+// The most one-time prekeys kept for a user.
+const MAX_ONETIME_PREKEYS = 200
+
+// Below this many one-time prekeys, the owner is asked for more.
+const LOW_ONETIME_PREKEYS = 20
+
+// Length of the (X25519) prekeys.
+const PREKEY_SIZE = 32
+
+// The PrekeyStore keeps the prekeys the users published, and hands them out to whoever wants to start a session with them.
+type PrekeyStore struct {
+	mu       sync.Mutex
+	filename string // where the prekeys are kept ("" to keep them only in memory)
+	users    map[string]*coeus.PrekeyRecord
+}
+
+// Creates a PrekeyStore, loading the prekeys kept in filename ("" to keep them only in memory).
+// Returns the PrekeyStore and an error.
+func NewPrekeyStore(filename string) (*PrekeyStore, error) {
+	users := make(map[string]*coeus.PrekeyRecord)
+	if filename != "" {
+		var err error
+		users, err = coeus.GetPrekeys(filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &PrekeyStore{
+		filename: filename,
+		users:    users,
+	}, nil
+}
+
+// Publishes the signed prekey of uname, after checking its signature and that it isn't stale.
+// A new identity key (the user reinstalled the client) throws away the one-time prekeys signed by the old one.
+// Returns the number of one-time prekeys left and an error.
+func (ps *PrekeyStore) SetSignedPrekey(uname string, identity []byte, id uint32, prekey []byte, created time.Time, sig []byte) (int, error) {
+	if len(prekey) != PREKEY_SIZE {
+		return 0, errors.New("invalid prekey")
+	}
+	if !anubis.VerifyPrekey(ed25519.PublicKey(identity), id, prekey, created, sig) {
+		return 0, errors.New("invalid signature of the signed prekey")
+	}
+	if anubis.StalePrekey(created) {
+		return 0, errors.New("the signed prekey is stale")
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	r, ok := ps.users[uname]
+	if !ok || !bytes.Equal(r.Identity, identity) {
+		r = &coeus.PrekeyRecord{Identity: identity}
+		ps.users[uname] = r
+	}
+	r.SignedPrekeyID = id
+	r.SignedPrekey = prekey
+	r.Created = created
+	r.Signature = sig
+
+	return len(r.OneTime), ps.save()
+}
+
+// Adds one-time prekeys to the ones of uname (which must have published a signed prekey first), up to MAX_ONETIME_PREKEYS.
+// Returns the number of one-time prekeys and an error.
+func (ps *PrekeyStore) AddOneTimePrekeys(uname string, prekeys []coeus.OneTimePrekey) (int, error) {
+	for _, p := range prekeys {
+		if p.ID == 0 || len(p.Key) != PREKEY_SIZE {
+			return 0, errors.New("invalid one-time prekey")
+		}
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	r, ok := ps.users[uname]
+	if !ok {
+		return 0, errors.New("publish a signed prekey first")
+	}
+
+	known := make(map[uint32]bool)
+	for _, p := range r.OneTime {
+		known[p.ID] = true
+	}
+	for _, p := range prekeys {
+		if len(r.OneTime) == MAX_ONETIME_PREKEYS {
+			break
+		}
+		if known[p.ID] {
+			continue
+		}
+		known[p.ID] = true
+		r.OneTime = append(r.OneTime, p)
+	}
+
+	return len(r.OneTime), ps.save()
+}
+
+// Hands out the bundle of uname: its signed prekey and one of its one-time prekeys (if it has any left), which is then deleted.
+// Returns the bundle, the number of one-time prekeys left and an error.
+func (ps *PrekeyStore) Bundle(uname string) (coeus.PrekeyRecord, int, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	r, ok := ps.users[uname]
+	if !ok {
+		return coeus.PrekeyRecord{}, 0, errors.New("no prekeys published")
+	}
+	if anubis.StalePrekey(r.Created) {
+		return coeus.PrekeyRecord{}, 0, errors.New("no fresh prekeys published")
+	}
+
+	bundle := *r
+	bundle.OneTime = nil
+	if len(r.OneTime) > 0 {
+		bundle.OneTime = []coeus.OneTimePrekey{r.OneTime[0]}
+		r.OneTime = r.OneTime[1:]
+	}
+
+	return bundle, len(r.OneTime), ps.save()
+}
+
+// Returns the number of one-time prekeys uname has left (and whether it published a signed prekey at all).
+func (ps *PrekeyStore) Remaining(uname string) (int, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	r, ok := ps.users[uname]
+	if !ok {
+		return 0, false
+	}
+
+	return len(r.OneTime), true
+}
+
+// Writes the prekeys to disk (ps.mu must be held).
+func (ps *PrekeyStore) save() error {
+	if ps.filename == "" {
+		return nil
+	}
+
+	return coeus.SavePrekeys(ps.filename, ps.users)
+}
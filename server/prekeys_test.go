@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mowzhja/harpocrates/harpocrates/anubis"
+	"github.com/mowzhja/harpocrates/server/coeus"
+)
+
+// Utility function, signs a prekey the way clients do.
+func signPrekey(identity ed25519.PrivateKey, id uint32, prekey []byte, created time.Time) []byte {
+	idBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(idBytes, id)
+	createdBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(createdBytes, uint64(created.Unix()))
+
+	msg := append([]byte("harpocrates prekey"), idBytes...)
+	msg = append(msg, prekey...)
+
+	return ed25519.Sign(identity, append(msg, createdBytes...))
+}
+
+// Utility function, creates n one-time prekeys, with ids starting from first.
+func oneTimePrekeys(first uint32, n int) []coeus.OneTimePrekey {
+	var prekeys []coeus.OneTimePrekey
+	for i := 0; i < n; i++ {
+		key := make([]byte, PREKEY_SIZE)
+		rand.Read(key)
+		prekeys = append(prekeys, coeus.OneTimePrekey{ID: first + uint32(i), Key: key})
+	}
+
+	return prekeys
+}
+
+// Utility function, publishes a signed prekey (created at the given time) for uname.
+// Returns the identity key used and the error of the store.
+func publish(t *testing.T, ps *PrekeyStore, uname string, created time.Time) (ed25519.PrivateKey, error) {
+	_, identity, _ := ed25519.GenerateKey(nil)
+	prekey := make([]byte, PREKEY_SIZE)
+	rand.Read(prekey)
+
+	_, err := ps.SetSignedPrekey(uname, identity.Public().(ed25519.PublicKey), 1, prekey, created, signPrekey(identity, 1, prekey, created))
+
+	return identity, err
+}
+
+// Tests that every bundle consumes a one-time prekey, in the order they were published, and that they survive a restart.
+func Test_PrekeyStore_bundle(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "prekeys.json")
+	ps, err := NewPrekeyStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ps.Bundle("bob"); err == nil {
+		t.Fatal("bob didn't publish any prekeys yet")
+	}
+	if _, err := ps.AddOneTimePrekeys("bob", oneTimePrekeys(1, 3)); err == nil {
+		t.Fatal("one-time prekeys can't be published before the signed prekey")
+	}
+
+	if _, err := publish(t, ps, "bob", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	n, err := ps.AddOneTimePrekeys("bob", oneTimePrekeys(1, 3))
+	if err != nil || n != 3 {
+		t.Fatal("expected 3 one-time prekeys", n, err)
+	}
+	// the same prekeys published twice count once
+	n, _ = ps.AddOneTimePrekeys("bob", oneTimePrekeys(3, 2))
+	if n != 4 {
+		t.Fatalf("expected 4 one-time prekeys, got %d", n)
+	}
+
+	b, remaining, err := ps.Bundle("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.OneTime) != 1 || b.OneTime[0].ID != 1 || remaining != 3 {
+		t.Fatalf("the first bundle should have one-time prekey 1, and 3 should be left: %v %d", b.OneTime, remaining)
+	}
+
+	// restart
+	ps, err = NewPrekeyStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint32{2, 3, 4, 0, 0} {
+		b, _, err := ps.Bundle("bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == 0 {
+			if len(b.OneTime) != 0 {
+				t.Fatal("bob ran out of one-time prekeys")
+			}
+			continue
+		}
+		if len(b.OneTime) != 1 || b.OneTime[0].ID != id {
+			t.Fatalf("expected one-time prekey %d, got %v", id, b.OneTime)
+		}
+	}
+}
+
+// Tests that the number of one-time prekeys is capped.
+func Test_PrekeyStore_cap(t *testing.T) {
+	ps, _ := NewPrekeyStore("")
+	publish(t, ps, "bob", time.Now())
+
+	n, err := ps.AddOneTimePrekeys("bob", oneTimePrekeys(1, MAX_ONETIME_PREKEYS+10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != MAX_ONETIME_PREKEYS {
+		t.Fatalf("expected %d one-time prekeys, got %d", MAX_ONETIME_PREKEYS, n)
+	}
+}
+
+// Tests that forged and stale signed prekeys are refused.
+func Test_PrekeyStore_badSignedPrekey(t *testing.T) {
+	ps, _ := NewPrekeyStore("")
+
+	if _, err := publish(t, ps, "bob", time.Now().Add(-anubis.MAX_SIGNED_PREKEY_AGE-time.Hour)); err == nil {
+		t.Fatal("a stale signed prekey should be refused")
+	}
+	if _, err := publish(t, ps, "bob", time.Now().Add(time.Hour)); err == nil {
+		t.Fatal("a signed prekey from the future should be refused")
+	}
+
+	_, identity, _ := ed25519.GenerateKey(nil)
+	prekey := make([]byte, PREKEY_SIZE)
+	sig := signPrekey(identity, 1, prekey, time.Now())
+	if _, err := ps.SetSignedPrekey("bob", identity.Public().(ed25519.PublicKey), 2, prekey, time.Now(), sig); err == nil {
+		t.Fatal("a signed prekey with a wrong signature should be refused")
+	}
+	if _, err := ps.SetSignedPrekey("bob", identity.Public().(ed25519.PublicKey), 1, prekey[1:], time.Now(), sig); err == nil {
+		t.Fatal("a short prekey should be refused")
+	}
+
+	// a signed prekey that went stale on the server isn't handed out
+	publish(t, ps, "bob", time.Now())
+	ps.users["bob"].Created = time.Now().Add(-anubis.MAX_SIGNED_PREKEY_AGE - time.Hour)
+	if _, _, err := ps.Bundle("bob"); err == nil {
+		t.Fatal("a stale signed prekey shouldn't be handed out")
+	}
+}
+
+// Tests that a new identity key throws away the one-time prekeys of the old one.
+func Test_PrekeyStore_newIdentity(t *testing.T) {
+	ps, _ := NewPrekeyStore("")
+	publish(t, ps, "bob", time.Now())
+	ps.AddOneTimePrekeys("bob", oneTimePrekeys(1, 5))
+
+	n, _ := ps.Remaining("bob")
+	if n != 5 {
+		t.Fatalf("expected 5 one-time prekeys, got %d", n)
+	}
+
+	publish(t, ps, "bob", time.Now())
+	if n, _ := ps.Remaining("bob"); n != 0 {
+		t.Fatal("the one-time prekeys of the old identity should be gone")
+	}
+}
+
+// Tests publishing prekeys and fetching bundles through the lobby, and the alerts about running out of one-time prekeys.
+func Test_Lobby_prekeys(t *testing.T) {
+	l := newTestLobby(t)
+	alice, _ := joinLobby(t, l, "alice", "10.0.0.1")
+	bob, _ := joinLobby(t, l, "bob", "10.0.0.2")
+
+	alice.Send("BUNDLE", "bob")
+	expect(t, alice, "ERROR")
+
+	_, identity, _ := ed25519.GenerateKey(nil)
+	prekey := make([]byte, PREKEY_SIZE)
+	rand.Read(prekey)
+	created := time.Now()
+	bob.Send("SIGNED_PREKEY", hex.EncodeToString(identity.Public().(ed25519.PublicKey)), "9", hex.EncodeToString(prekey),
+		strconv.FormatInt(created.Unix(), 10), hex.EncodeToString(signPrekey(identity, 9, prekey, created)))
+	if low := expect(t, bob, "PREKEYS_LOW"); low[1] != "0" {
+		t.Fatalf("bob has no one-time prekeys yet, got %v", low)
+	}
+
+	args := []string{"ONETIME_PREKEYS"}
+	for _, p := range oneTimePrekeys(1, LOW_ONETIME_PREKEYS) {
+		args = append(args, strconv.Itoa(int(p.ID))+":"+hex.EncodeToString(p.Key))
+	}
+	bob.Send(args...)
+
+	alice.Send("BUNDLE", "bob")
+	b := expect(t, alice, "BUNDLE")
+	if len(b) != 9 || b[1] != "bob" || b[3] != "9" || b[4] != hex.EncodeToString(prekey) || b[7] != "1" {
+		t.Fatalf("wrong bundle: %v", b)
+	}
+
+	// bob just went below the threshold
+	if low := expect(t, bob, "PREKEYS_LOW"); low[1] != strconv.Itoa(LOW_ONETIME_PREKEYS-1) {
+		t.Fatalf("wrong count of one-time prekeys: %v", low)
+	}
+
+	bob.Send("SIGNED_PREKEY", "zz")
+	expect(t, bob, "ERROR")
+	bob.Send("ONETIME_PREKEYS", "1:nothex")
+	expect(t, bob, "ERROR")
+}